@@ -0,0 +1,108 @@
+// Command bavarix-record sits between the operator and a diagnostic cable
+// and records every byte read from the line and every frame recovered from
+// it to a capture file (see package capture for the format). Frames to
+// send are read from stdin as hex, one per line; lines starting with '#'
+// are stored as notes. Replies are printed as they arrive.
+//
+// The serial line must already be configured for the protocol, for example
+// with `stty -F /dev/ttyUSB0 9600 raw` for DS2; -baud only annotates the
+// capture.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alexcatdad/bavarix/pkg/transport"
+	"github.com/alexcatdad/bavarix/pkg/transport/capture"
+)
+
+func main() {
+	device := flag.String("device", "/dev/ttyUSB0", "serial device of the diagnostic cable")
+	protocol := flag.String("protocol", "kwp2000", "frame protocol on the line: ds2 or kwp2000")
+	baud := flag.Int("baud", 10400, "baud rate the line is configured for")
+	out := flag.String("o", "", "capture file to write (default: capture-<time>.jsonl)")
+	timeout := flag.Duration("timeout", 500*time.Millisecond, "how long to wait for further replies")
+	flag.Parse()
+
+	if *protocol != "ds2" && *protocol != "kwp2000" {
+		fmt.Fprintf(os.Stderr, "Error: unknown protocol %q\n", *protocol)
+		os.Exit(2)
+	}
+	if *out == "" {
+		*out = fmt.Sprintf("capture-%s.jsonl", time.Now().Format("20060102-150405"))
+	}
+
+	if err := run(*device, *protocol, *baud, *out, *timeout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(device, protocol string, baud int, out string, timeout time.Duration) error {
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := capture.NewWriter(f, capture.Header{
+		Protocol:  strings.ToUpper(protocol),
+		Baud:      baud,
+		Interface: device,
+	})
+	if err != nil {
+		return err
+	}
+
+	rec := capture.NewRecorder(&streamTransport{path: device, protocol: protocol, timeout: timeout}, w)
+	if err := rec.Connect(); err != nil {
+		return err
+	}
+	defer rec.Disconnect()
+
+	fmt.Fprintf(os.Stderr, "Recording %s (%s, %d baud) to %s\n", device, protocol, baud, out)
+
+	in := bufio.NewScanner(os.Stdin)
+	for in.Scan() {
+		line := strings.TrimSpace(in.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#"):
+			rec.Note(strings.TrimSpace(line[1:]))
+			continue
+		}
+
+		frame, err := hex.DecodeString(strings.ReplaceAll(line, " ", ""))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %q: %v\n", line, err)
+			continue
+		}
+		if err := rec.SendFrame(frame); err != nil {
+			return err
+		}
+		fmt.Printf("-> % X\n", frame)
+
+		for {
+			reply, err := rec.ReceiveFrame()
+			if errors.Is(err, transport.ErrTimeout) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("<- % X\n", reply)
+		}
+	}
+	if err := in.Err(); err != nil {
+		return err
+	}
+	return rec.Err()
+}
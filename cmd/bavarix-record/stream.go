@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alexcatdad/bavarix/pkg/protocol/ds2"
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+var errNoVoltage = errors.New("stream: adapter cannot read battery voltage")
+
+type received struct {
+	frame []byte
+	at    time.Time
+	err   error
+}
+
+// streamTransport talks to a serial device that has already been set up
+// (baud rate, raw mode) by the operating system, and recovers frames from
+// the byte stream with the protocol's decoder.
+type streamTransport struct {
+	path     string
+	protocol string
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	frames chan received
+	tap    func(data []byte, at time.Time)
+}
+
+func (s *streamTransport) Connect() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	frames := make(chan received, 64)
+
+	s.mu.Lock()
+	s.f, s.frames = f, frames
+	s.mu.Unlock()
+
+	go s.read(f, frames)
+	return nil
+}
+
+func (s *streamTransport) read(r io.Reader, frames chan<- received) {
+	defer close(frames)
+
+	s.mu.Lock()
+	if s.tap != nil {
+		r = &tapReader{r: r, tap: s.tap}
+	}
+	s.mu.Unlock()
+
+	var next func() (received, error)
+	if s.protocol == "ds2" {
+		d := ds2.NewDecoder(r)
+		next = func() (received, error) {
+			f, err := d.Next()
+			return received{frame: f.Raw, at: f.Time}, err
+		}
+	} else {
+		d := kwp2000.NewDecoder(r)
+		next = func() (received, error) {
+			f, err := d.Next()
+			return received{frame: f.Raw, at: f.Time}, err
+		}
+	}
+	for {
+		f, err := next()
+		if err != nil {
+			frames <- received{err: err}
+			return
+		}
+		frames <- f
+	}
+}
+
+// TapRaw registers a callback for every read from the device. It must be
+// called before Connect.
+func (s *streamTransport) TapRaw(tap func(data []byte, at time.Time)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tap = tap
+}
+
+// tapReader passes each read to tap before the decoder sees it.
+type tapReader struct {
+	r   io.Reader
+	tap func(data []byte, at time.Time)
+}
+
+func (t *tapReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.tap(p[:n], time.Now())
+	}
+	return n, err
+}
+
+func (s *streamTransport) Disconnect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func (s *streamTransport) SendFrame(frame []byte) error {
+	s.mu.Lock()
+	f := s.f
+	s.mu.Unlock()
+	if f == nil {
+		return transport.ErrNotConnected
+	}
+	_, err := f.Write(frame)
+	return err
+}
+
+func (s *streamTransport) ReceiveFrame() ([]byte, error) {
+	frame, _, err := s.ReceiveTimedFrame()
+	return frame, err
+}
+
+// ReceiveTimedFrame returns the next frame with the time its last byte was
+// read from the device.
+func (s *streamTransport) ReceiveTimedFrame() ([]byte, time.Time, error) {
+	s.mu.Lock()
+	frames, timeout := s.frames, s.timeout
+	s.mu.Unlock()
+	if frames == nil {
+		return nil, time.Time{}, transport.ErrNotConnected
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r, ok := <-frames:
+		if !ok {
+			return nil, time.Time{}, transport.ErrNotConnected
+		}
+		return r.frame, r.at, r.err
+	case <-timer.C:
+		return nil, time.Time{}, transport.ErrTimeout
+	}
+}
+
+func (s *streamTransport) SupportsWrite() bool {
+	return true
+}
+
+func (s *streamTransport) ReadVoltage() (float64, error) {
+	return 0, errNoVoltage
+}
+
+func (s *streamTransport) SetResponseTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeout = d
+}
@@ -0,0 +1,91 @@
+// Command bavarix-report writes the coverage report: for every chassis and
+// SP-Daten module, which coding fields are parsed, translated, verified by
+// the community overlay and have a known safe setting, with the gaps
+// listed per chassis.
+//
+//	bavarix-report -spdaten data/daten -prg data/ecu -translations translations.csv \
+//	    -overlays overlays -format html -o coverage.html
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/alexcatdad/bavarix/pkg/coverage"
+	"github.com/alexcatdad/bavarix/pkg/overlay"
+	"github.com/alexcatdad/bavarix/pkg/parser/translations"
+)
+
+func main() {
+	spdaten := flag.String("spdaten", "", "SP-Daten directory with one subdirectory per chassis (required)")
+	prgDir := flag.String("prg", "", "directory of EDIABAS PRG files")
+	dict := flag.String("translations", "", "translation CSV")
+	overlays := flag.String("overlays", "", "community overlay directory")
+	format := flag.String("format", "md", "output format: md, html or csv")
+	out := flag.String("o", "", "file to write (default: stdout)")
+	flag.Parse()
+
+	if *spdaten == "" {
+		fmt.Fprintln(os.Stderr, "Error: -spdaten is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	write, ok := map[string]func(io.Writer, *coverage.Report) error{
+		"md":   coverage.WriteMarkdown,
+		"html": coverage.WriteHTML,
+		"csv":  coverage.WriteCSV,
+	}[*format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q\n", *format)
+		os.Exit(2)
+	}
+
+	if err := run(coverage.Sources{SPDatenDir: *spdaten, PRGDir: *prgDir}, *dict, *overlays, *out, write); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(src coverage.Sources, dict, overlays, out string, write func(io.Writer, *coverage.Report) error) error {
+	if dict != "" {
+		d, err := translations.Load(dict)
+		if err != nil {
+			return err
+		}
+		src.Translations = d
+	}
+	if overlays != "" {
+		o, err := overlay.Load(overlays)
+		if err != nil {
+			return err
+		}
+		for _, w := range o.Warnings {
+			fmt.Fprintln(os.Stderr, "Warning:", w)
+		}
+		src.Overlays = o
+	}
+
+	r, err := coverage.Build(src)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := write(w, r); err != nil {
+		return err
+	}
+	if w != os.Stdout {
+		return w.Close()
+	}
+	return nil
+}
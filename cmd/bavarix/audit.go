@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/alexcatdad/bavarix/pkg/audit"
+	"github.com/alexcatdad/bavarix/pkg/safety/vault"
+)
+
+const defaultVault = "bavarix.db"
+
+// passphraseEnv holds the passphrase of an encrypted vault, needed to find
+// a car's records by VIN since the log stores only the vault's VIN index.
+const passphraseEnv = "BAVARIX_PASSPHRASE"
+
+func auditCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New("audit: expected verify or export")
+	}
+	switch args[0] {
+	case "verify":
+		return auditVerify(args[1:], os.Stdout)
+	case "export":
+		return auditExport(args[1:], os.Stdout)
+	}
+	return fmt.Errorf("audit: unknown subcommand %q", args[0])
+}
+
+// logFlags registers the flags that locate the audit log and its vault.
+func logFlags(fs *flag.FlagSet) (logPath func() string, vaultPath *string) {
+	vaultPath = fs.String("vault", defaultVault, "vault whose audit log to read")
+	log := fs.String("log", "", "audit log to read (default: next to the vault)")
+	return func() string {
+		if *log != "" {
+			return *log
+		}
+		return audit.PathFor(*vaultPath)
+	}, vaultPath
+}
+
+func auditVerify(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	path, _ := logFlags(fs)
+	expect := fs.String("expect", "", "hash of a head noted earlier, to detect records removed from the end")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	records, head, err := audit.VerifyFile(path())
+	if err != nil {
+		return err
+	}
+	if *expect != "" {
+		found := *expect == audit.GenesisHash
+		for _, r := range records {
+			found = found || r.Hash == *expect
+		}
+		if !found {
+			return fmt.Errorf("%w: expected head %s is not in the log; records were removed", audit.ErrBrokenChain, *expect)
+		}
+	}
+	fmt.Fprintf(out, "OK: %d records, chain intact\nhead: seq %d %s\n", len(records), head.Seq, head.Hash)
+	return nil
+}
+
+func auditExport(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("audit export", flag.ContinueOnError)
+	path, vaultPath := logFlags(fs)
+	format := fs.String("format", "csv", "output format: csv or json")
+	vin := fs.String("vin", "", "only export records for this VIN (set "+passphraseEnv+" for an encrypted vault)")
+	out := fs.String("o", "", "file to write (default: stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	write := map[string]func(io.Writer, []audit.Record) error{
+		"csv":  audit.WriteCSV,
+		"json": audit.WriteJSON,
+	}[*format]
+	if write == nil {
+		return fmt.Errorf("audit export: unknown format %q", *format)
+	}
+
+	// Paperwork must not be produced from a log that fails verification.
+	records, _, err := audit.VerifyFile(path())
+	if err != nil {
+		return err
+	}
+	if *vin != "" {
+		index, err := vinIndex(*vaultPath, *vin)
+		if err != nil {
+			return err
+		}
+		records = audit.FilterVIN(records, *vin, index)
+	}
+
+	w := stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return write(w, records)
+}
+
+// vinIndex returns the VIN index an encrypted vault stores in the audit log
+// for vin, or "" when the vault is not encrypted or no passphrase is set.
+// It opens the vault read-only, so it never migrates, creates or encrypts
+// one.
+func vinIndex(vaultPath, vin string) (string, error) {
+	pass := os.Getenv(passphraseEnv)
+	if pass == "" {
+		return "", nil
+	}
+	if _, err := os.Stat(vaultPath); err != nil {
+		return "", err
+	}
+	v, err := vault.OpenReadOnly(vaultPath, pass)
+	if err != nil {
+		return "", err
+	}
+	defer v.Close()
+	if !v.Encrypted() {
+		return "", nil
+	}
+	return v.VINIndex(vin), nil
+}
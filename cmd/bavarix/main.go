@@ -1,7 +1,39 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `bavarix — BMW diagnostics tool
+
+Usage:
+  bavarix audit verify [-vault path | -log path] [-expect hash]
+  bavarix audit export [-vault path | -log path] [-format csv|json] [-vin VIN] [-o file]
+
+Environment:
+  BAVARIX_PASSPHRASE  passphrase of an encrypted vault, for audit export -vin
+`
 
 func main() {
-	fmt.Println("bavarix — BMW diagnostics tool")
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "audit":
+		err = auditCmd(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,54 @@
+// Command build-db builds the knowledge database (see package kb) from the
+// data directory. Sources default to the usual places under -data and are
+// skipped with a note when missing; the flags override each one.
+//
+//	build-db -data data -overlays overlays -o bavarix-kb.db
+//
+// The same inputs always produce the same file, byte for byte.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/alexcatdad/bavarix/pkg/kb"
+)
+
+func main() {
+	data := flag.String("data", "data", "data directory; provenance paths are relative to it")
+	prgDir := flag.String("prg", "", "EDIABAS PRG directory (default: <data>/ediabas/ecu)")
+	spdaten := flag.String("spdaten", "", "SP-Daten directory (default: <data>/ncsexper/daten)")
+	dict := flag.String("translations", "", "translation CSV (default: <data>/translations/Translations.csv)")
+	overlays := flag.String("overlays", "", "community overlay directory")
+	out := flag.String("o", "bavarix-kb.db", "database to write")
+	flag.Parse()
+
+	src := kb.Sources{
+		Root:         *data,
+		PRGDir:       orDefault(*prgDir, *data, "ediabas", "ecu"),
+		SPDatenDir:   orDefault(*spdaten, *data, "ncsexper", "daten"),
+		Translations: orDefault(*dict, *data, "translations", "Translations.csv"),
+		Overlays:     *overlays,
+	}
+	if err := kb.Build(*out, src); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", *out)
+}
+
+// orDefault returns flag if set, otherwise the default path under data if
+// it exists, otherwise "" so the source is skipped.
+func orDefault(flag, data string, elem ...string) string {
+	if flag != "" {
+		return flag
+	}
+	path := filepath.Join(append([]string{data}, elem...)...)
+	if _, err := os.Stat(path); err != nil {
+		fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", path, err)
+		return ""
+	}
+	return path
+}
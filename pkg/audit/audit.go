@@ -0,0 +1,285 @@
+// Package audit keeps a tamper-evident, append-only record of every write
+// to a car. Records are stored as JSON Lines next to the vault, one record
+// per line, and each record carries the SHA-256 of the one before it:
+//
+//	{"seq":1,"time":"...","actor":"alex@shop-pc","vin":"WBA...","module":"GM5",
+//	 "operation":"coding","voltage":12.8,"backup_id":7,"before_sha256":"...",
+//	 "after_sha256":"...","outcome":"success","prev_hash":"000...","hash":"..."}
+//
+// Editing or deleting a record breaks the chain at that point, which Verify
+// reports. Removing records from the end leaves a valid but shorter chain;
+// to catch that, compare the head Verify returns with one noted earlier.
+//
+// The safety pipeline appends each record inside a vault transaction that
+// also writes a "run" record to the vault's own audit table, naming the
+// backup ID and this log's seq. For an encrypted vault the vin field holds
+// the vault's keyed VIN index rather than the VIN.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBrokenChain = errors.New("audit: chain is broken")
+	ErrClosed      = errors.New("audit: log is closed")
+)
+
+// GenesisHash is the PrevHash of the first record.
+var GenesisHash = strings.Repeat("0", 64)
+
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+	// OutcomeBlocked is a write refused before anything was sent to the
+	// module, e.g. by the voltage check or the user.
+	OutcomeBlocked Outcome = "blocked"
+)
+
+// Record is one operation. Seq, PrevHash and Hash are filled in by Append.
+type Record struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	VIN       string    `json:"vin,omitempty"`
+	Chassis   string    `json:"chassis,omitempty"`
+	Module    string    `json:"module"`
+	Operation string    `json:"operation"`
+	Voltage   float64   `json:"voltage,omitempty"`
+	BackupID  int64     `json:"backup_id,omitempty"`
+	// BeforeSHA256 and AfterSHA256 are digests of the module's data before
+	// and after the operation.
+	BeforeSHA256 string  `json:"before_sha256,omitempty"`
+	AfterSHA256  string  `json:"after_sha256,omitempty"`
+	Outcome      Outcome `json:"outcome"`
+	Detail       string  `json:"detail,omitempty"`
+	PrevHash     string  `json:"prev_hash"`
+	Hash         string  `json:"hash"`
+}
+
+// computeHash hashes the record's JSON encoding with Hash left empty.
+func (r Record) computeHash() string {
+	r.Hash = ""
+	data, _ := json.Marshal(r)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// HashData is the digest to put in BeforeSHA256 and AfterSHA256.
+func HashData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// PathFor returns the log path that belongs to a vault: the vault's path
+// with its extension replaced by ".audit.jsonl".
+func PathFor(vaultPath string) string {
+	return strings.TrimSuffix(vaultPath, filepath.Ext(vaultPath)) + ".audit.jsonl"
+}
+
+// DefaultActor names the person at the keyboard as user@host.
+func DefaultActor() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
+
+// Log appends records to a log file. It is safe for concurrent use, and
+// appends from other processes are serialised with a file lock.
+type Log struct {
+	mu  sync.Mutex
+	f   *os.File
+	now func() time.Time
+}
+
+// Open opens or creates the log at path.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("audit: opening log: %w", err)
+	}
+	return &Log{f: f, now: time.Now}, nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// Append chains r to the last record in the file and writes it. Time
+// defaults to now and Actor to DefaultActor. The stored record is returned.
+func (l *Log) Append(r Record) (Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return Record{}, ErrClosed
+	}
+	if err := lockFile(l.f); err != nil {
+		return Record{}, fmt.Errorf("audit: locking log: %w", err)
+	}
+	defer unlockFile(l.f)
+
+	last, err := lastRecord(l.f)
+	if err != nil {
+		return Record{}, err
+	}
+	r.Seq, r.PrevHash = 1, GenesisHash
+	if last != nil {
+		r.Seq, r.PrevHash = last.Seq+1, last.Hash
+	}
+	if r.Time.IsZero() {
+		r.Time = l.now()
+	}
+	r.Time = r.Time.UTC()
+	if r.Actor == "" {
+		r.Actor = DefaultActor()
+	}
+	r.Hash = r.computeHash()
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return Record{}, fmt.Errorf("audit: encoding record: %w", err)
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return Record{}, fmt.Errorf("audit: writing record: %w", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		return Record{}, fmt.Errorf("audit: writing record: %w", err)
+	}
+	return r, nil
+}
+
+// tailWindow bounds how far back lastRecord looks; records are far smaller.
+const tailWindow = 64 << 10
+
+// lastRecord returns the final record in f, or nil if f is empty.
+func lastRecord(f *os.File) (*Record, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("audit: reading log: %w", err)
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil, nil
+	}
+	start := max(0, size-tailWindow)
+	buf := make([]byte, size-start)
+	if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("audit: reading log: %w", err)
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	var r Record
+	if err := json.Unmarshal(buf, &r); err != nil {
+		return nil, fmt.Errorf("%w: last record is unreadable: %w", ErrBrokenChain, err)
+	}
+	return &r, nil
+}
+
+// ChainError locates the first problem Verify found.
+type ChainError struct {
+	Line   int
+	Seq    uint64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("%v at line %d (seq %d): %s", ErrBrokenChain, e.Line, e.Seq, e.Reason)
+}
+
+func (e *ChainError) Unwrap() error {
+	return ErrBrokenChain
+}
+
+// Head identifies the last record of a verified chain.
+type Head struct {
+	Seq  uint64
+	Hash string
+}
+
+// ReadAll reads every record from r without checking the chain.
+func ReadAll(r io.Reader) ([]Record, error) {
+	var records []Record
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), tailWindow)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return records, &ChainError{Line: line, Reason: "unreadable record: " + err.Error()}
+		}
+		records = append(records, rec)
+	}
+	if err := sc.Err(); err != nil {
+		return records, fmt.Errorf("audit: reading log: %w", err)
+	}
+	return records, nil
+}
+
+// Verify checks every record of the log in r: sequence numbers count up
+// from 1, each PrevHash is the previous record's Hash and each Hash matches
+// the record's contents. It returns the records and the head of the chain;
+// on failure the error is a *ChainError.
+func Verify(r io.Reader) ([]Record, Head, error) {
+	records, err := ReadAll(r)
+	if err != nil {
+		return records, Head{}, err
+	}
+	head := Head{Hash: GenesisHash}
+	for i, rec := range records {
+		fail := func(reason string) ([]Record, Head, error) {
+			return records, head, &ChainError{Line: i + 1, Seq: rec.Seq, Reason: reason}
+		}
+		switch {
+		case rec.Seq != head.Seq+1:
+			return fail(fmt.Sprintf("expected seq %d; records are missing or reordered", head.Seq+1))
+		case rec.PrevHash != head.Hash:
+			return fail("previous hash does not match; a record before this one was changed or removed")
+		case rec.computeHash() != rec.Hash:
+			return fail("hash does not match contents; this record was edited")
+		}
+		head = Head{Seq: rec.Seq, Hash: rec.Hash}
+	}
+	return records, head, nil
+}
+
+// VerifyFile runs Verify on the log at path.
+func VerifyFile(path string) ([]Record, Head, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, Head{}, fmt.Errorf("audit: opening log: %w", err)
+	}
+	defer f.Close()
+	return Verify(f)
+}
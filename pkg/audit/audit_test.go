@@ -0,0 +1,222 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempLog(t *testing.T) (*Log, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "vault.audit.jsonl")
+	l, err := Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	return l, path
+}
+
+func record(module string, outcome Outcome) Record {
+	return Record{
+		Actor:        "tech@shop",
+		VIN:          "WBAAV31070FZ12345",
+		Chassis:      "E46",
+		Module:       module,
+		Operation:    "coding",
+		Voltage:      12.84,
+		BackupID:     7,
+		BeforeSHA256: HashData([]byte{0x11}),
+		AfterSHA256:  HashData([]byte{0x22}),
+		Outcome:      outcome,
+	}
+}
+
+// writeLines replaces the log with the given lines.
+func writeLines(t *testing.T, path string, lines []string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600))
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestAppendChains(t *testing.T) {
+	l, path := tempLog(t)
+	first, err := l.Append(record("GM5", OutcomeSuccess))
+	require.NoError(t, err)
+	second, err := l.Append(record("LCM", OutcomeFailure))
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 1, first.Seq)
+	assert.Equal(t, GenesisHash, first.PrevHash)
+	assert.EqualValues(t, 2, second.Seq)
+	assert.Equal(t, first.Hash, second.PrevHash)
+	assert.False(t, first.Time.IsZero())
+
+	records, head, err := VerifyFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []Record{first, second}, records)
+	assert.Equal(t, Head{Seq: 2, Hash: second.Hash}, head)
+}
+
+func TestAppendContinuesAfterReopen(t *testing.T) {
+	l, path := tempLog(t)
+	first, err := l.Append(record("GM5", OutcomeSuccess))
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	l, err = Open(path)
+	require.NoError(t, err)
+	defer l.Close()
+	second, err := l.Append(record("GM5", OutcomeSuccess))
+	require.NoError(t, err)
+	assert.Equal(t, first.Hash, second.PrevHash)
+
+	_, err = l.Append(Record{})
+	require.NoError(t, err)
+	_, _, err = VerifyFile(path)
+	assert.NoError(t, err)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	l, path := tempLog(t)
+	for range 4 {
+		_, err := l.Append(record("GM5", OutcomeSuccess))
+		require.NoError(t, err)
+	}
+	original := readLines(t, path)
+
+	edit := func(line string) string {
+		var r Record
+		require.NoError(t, json.Unmarshal([]byte(line), &r))
+		r.Outcome = OutcomeSuccess
+		r.Voltage = 13.5
+		out, err := json.Marshal(r)
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	for name, tc := range map[string]struct {
+		lines  []string
+		seq    uint64
+		reason string
+	}{
+		"edited": {
+			lines:  []string{original[0], edit(original[1]), original[2], original[3]},
+			seq:    2,
+			reason: "edited",
+		},
+		"deleted": {
+			lines:  []string{original[0], original[2], original[3]},
+			seq:    3,
+			reason: "missing",
+		},
+		"reordered": {
+			lines:  []string{original[0], original[2], original[1], original[3]},
+			seq:    3,
+			reason: "missing or reordered",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			writeLines(t, path, tc.lines)
+			_, _, err := VerifyFile(path)
+			var ce *ChainError
+			require.ErrorAs(t, err, &ce)
+			assert.ErrorIs(t, err, ErrBrokenChain)
+			assert.Equal(t, tc.seq, ce.Seq)
+			assert.Contains(t, ce.Reason, tc.reason)
+		})
+	}
+}
+
+func TestVerifyDetectsRehashedEdit(t *testing.T) {
+	// Recomputing the edited record's own hash still breaks the next link.
+	l, path := tempLog(t)
+	for range 3 {
+		_, err := l.Append(record("GM5", OutcomeSuccess))
+		require.NoError(t, err)
+	}
+	lines := readLines(t, path)
+	var r Record
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &r))
+	r.VIN = "WBAEV33473KL67890"
+	r.Hash = r.computeHash()
+	edited, err := json.Marshal(r)
+	require.NoError(t, err)
+	lines[1] = string(edited)
+	writeLines(t, path, lines)
+
+	_, _, err = VerifyFile(path)
+	var ce *ChainError
+	require.ErrorAs(t, err, &ce)
+	assert.EqualValues(t, 3, ce.Seq)
+}
+
+func TestConcurrentAppends(t *testing.T) {
+	_, path := tempLog(t)
+	const writers, each = 4, 20
+
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Separate handles, as separate processes would have.
+			l, err := Open(path)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer l.Close()
+			for range each {
+				_, err := l.Append(record("GM5", OutcomeSuccess))
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	records, head, err := VerifyFile(path)
+	require.NoError(t, err)
+	assert.Len(t, records, writers*each)
+	assert.EqualValues(t, writers*each, head.Seq)
+}
+
+func TestExport(t *testing.T) {
+	l, _ := tempLog(t)
+	l.now = func() time.Time { return time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC) }
+	a, err := l.Append(record("GM5", OutcomeSuccess))
+	require.NoError(t, err)
+	other := record("LCM", OutcomeBlocked)
+	other.VIN = "WBAEV33473KL67890"
+	other.Detail = "battery at 11.6V, 1 below minimum"
+	_, err = l.Append(other)
+	require.NoError(t, err)
+
+	var csvOut bytes.Buffer
+	require.NoError(t, WriteCSV(&csvOut, FilterVIN([]Record{a}, "wbaav31070fz12345")))
+	lines := strings.Split(strings.TrimSpace(csvOut.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, strings.Join(csvHeader, ","), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "1,2024-03-01T09:30:00Z,tech@shop,WBAAV31070FZ12345,E46,GM5,coding,12.84,7,"))
+
+	var jsonOut bytes.Buffer
+	require.NoError(t, WriteJSON(&jsonOut, []Record{a}))
+	var decoded []Record
+	require.NoError(t, json.Unmarshal(jsonOut.Bytes(), &decoded))
+	assert.Equal(t, []Record{a}, decoded)
+}
+
+func TestPathFor(t *testing.T) {
+	assert.Equal(t, filepath.Join("data", "bavarix.audit.jsonl"), PathFor(filepath.Join("data", "bavarix.db")))
+}
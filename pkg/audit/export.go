@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var csvHeader = []string{
+	"seq", "time", "actor", "vin", "chassis", "module", "operation", "voltage",
+	"backup_id", "before_sha256", "after_sha256", "outcome", "detail", "hash",
+}
+
+// WriteCSV writes records as CSV with a header row.
+func WriteCSV(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return fmt.Errorf("audit: writing CSV: %w", err)
+	}
+	for _, r := range records {
+		voltage, backup := "", ""
+		if r.Voltage != 0 {
+			voltage = strconv.FormatFloat(r.Voltage, 'f', 2, 64)
+		}
+		if r.BackupID != 0 {
+			backup = strconv.FormatInt(r.BackupID, 10)
+		}
+		if err := cw.Write([]string{
+			strconv.FormatUint(r.Seq, 10), r.Time.UTC().Format(time.RFC3339), r.Actor, r.VIN,
+			r.Chassis, r.Module, r.Operation, voltage, backup, r.BeforeSHA256, r.AfterSHA256,
+			string(r.Outcome), r.Detail, r.Hash,
+		}); err != nil {
+			return fmt.Errorf("audit: writing CSV: %w", err)
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("audit: writing CSV: %w", err)
+	}
+	return nil
+}
+
+// WriteJSON writes records as an indented JSON array.
+func WriteJSON(w io.Writer, records []Record) error {
+	if records == nil {
+		records = []Record{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(records); err != nil {
+		return fmt.Errorf("audit: writing JSON: %w", err)
+	}
+	return nil
+}
+
+// FilterVIN returns the records for one car. Pass the vault's VIN index as
+// well to match records written for an encrypted vault.
+func FilterVIN(records []Record, vins ...string) []Record {
+	var out []Record
+	for _, r := range records {
+		for _, vin := range vins {
+			if vin != "" && strings.EqualFold(r.VIN, vin) {
+				out = append(out, r)
+				break
+			}
+		}
+	}
+	return out
+}
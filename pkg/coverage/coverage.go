@@ -0,0 +1,318 @@
+// Package coverage measures how well bavarix understands each module: for
+// every SP-Daten coding field it checks whether the format is parsed, the
+// label has an English translation, the community overlay verifies it and
+// a safe setting is known. The report cross-references PRG jobs, SP-Daten
+// files, translations and overlays per chassis and lists the gaps, so
+// reverse-engineering effort can go where it is missing.
+package coverage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/alexcatdad/bavarix/pkg/overlay"
+	"github.com/alexcatdad/bavarix/pkg/parser/prg"
+	"github.com/alexcatdad/bavarix/pkg/parser/spdaten"
+	"github.com/alexcatdad/bavarix/pkg/parser/translations"
+)
+
+// Sources are the inputs to a report. PRGDir holds EDIABAS *.prg files;
+// SPDatenDir holds one directory per chassis with the SP-Daten files in
+// it, e.g. E46/GM5.C05. Overlays may be nil and Translations empty.
+type Sources struct {
+	PRGDir       string
+	SPDatenDir   string
+	Translations translations.Dictionary
+	Overlays     *overlay.Overlays
+}
+
+// Param is the coverage of one coding field.
+type Param struct {
+	Label     string
+	Block     int
+	Byte, Bit int
+	Mask      byte
+	// Name is the overlay's name, empty for unverified fields.
+	Name       string
+	Translated bool
+	Verified   bool
+	Safety     overlay.Safety
+	// SafeRange is set when the overlay rates changing the field safe or
+	// caution, so there is a setting known not to cause harm.
+	SafeRange bool
+}
+
+// Confidence counts the checks the field passes, out of MaxConfidence:
+// format understood (always, for a listed field), translated, verified and
+// safe range known.
+func (p Param) Confidence() int {
+	n := 1
+	for _, ok := range []bool{p.Translated, p.Verified, p.SafeRange} {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+const MaxConfidence = 4
+
+// Module is the coverage of one SP-Daten file.
+type Module struct {
+	Chassis string
+	// Name is the module, e.g. "LSZ"; File the SP-Daten file, "LSZ.C28".
+	Name string
+	File string
+	Path string
+	// PRG is the matching PRG file and Jobs how many jobs it has; PRG is
+	// empty when none matched.
+	PRG  string
+	Jobs int
+	// FormatUnderstood is false when the SP-Daten file failed to parse;
+	// ParseError says why.
+	FormatUnderstood bool
+	ParseError       string
+	Params           []Param
+	// Orphans are overlay parameters that match no field of the file.
+	Orphans         []string
+	OverlayWarnings []string
+}
+
+// Counts returns how many fields pass each check.
+func (m Module) Counts() (translated, verified, safeRange int) {
+	for _, p := range m.Params {
+		if p.Translated {
+			translated++
+		}
+		if p.Verified {
+			verified++
+		}
+		if p.SafeRange {
+			safeRange++
+		}
+	}
+	return translated, verified, safeRange
+}
+
+// Confidence is the mean confidence of the module's fields as a fraction
+// of MaxConfidence; 0 if the file did not parse or has no fields.
+func (m Module) Confidence() float64 {
+	if len(m.Params) == 0 {
+		return 0
+	}
+	total := 0
+	for _, p := range m.Params {
+		total += p.Confidence()
+	}
+	return float64(total) / float64(len(m.Params)*MaxConfidence)
+}
+
+type GapKind string
+
+const (
+	GapNoPRG         GapKind = "no PRG"
+	GapFormat        GapKind = "SP-Daten not parsed"
+	GapOverlay       GapKind = "overlay rejected"
+	GapOrphan        GapKind = "overlay matches no field"
+	GapUntranslated  GapKind = "untranslated"
+	GapUnverified    GapKind = "unverified"
+	GapNoSafeSetting GapKind = "no safe setting"
+)
+
+// Gap is one kind of missing knowledge in one module. Items name the
+// fields or files concerned.
+type Gap struct {
+	Module string
+	Kind   GapKind
+	Items  []string
+}
+
+// Chassis groups the modules of one chassis with their gaps.
+type Chassis struct {
+	Name    string
+	Modules []Module
+	Gaps    []Gap
+}
+
+// Report is the coverage of every chassis. UnmatchedPRGs are PRG files no
+// SP-Daten file matched and PRGErrors those that failed to parse.
+type Report struct {
+	Chassis       []Chassis
+	UnmatchedPRGs []string
+	PRGErrors     []string
+}
+
+var spdatenFile = regexp.MustCompile(`(?i)^[A-Z0-9_]+\.C[0-9A-Z]{2}$`)
+
+// Build reads the sources and returns the report, chassis and modules in
+// name order. Files that fail to parse become gaps; only unreadable
+// directories are errors.
+func Build(src Sources) (*Report, error) {
+	r := &Report{}
+
+	var prgs prg.BatchResults
+	if src.PRGDir != "" {
+		var err error
+		if prgs, err = prg.BatchExtract(src.PRGDir); err != nil {
+			return nil, fmt.Errorf("coverage: %w", err)
+		}
+	}
+	matched := make([]bool, len(prgs))
+
+	dirs, err := os.ReadDir(src.SPDatenDir)
+	if err != nil {
+		return nil, fmt.Errorf("coverage: reading %s: %w", src.SPDatenDir, err)
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(src.SPDatenDir, dir.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("coverage: reading %s: %w", dir.Name(), err)
+		}
+		c := Chassis{Name: strings.ToUpper(dir.Name())}
+		for _, f := range files {
+			if f.IsDir() || !spdatenFile.MatchString(f.Name()) {
+				continue
+			}
+			m := src.module(c.Name, filepath.Join(src.SPDatenDir, dir.Name(), f.Name()))
+			if i := matchPRG(prgs, m.Name, c.Name); i >= 0 {
+				m.PRG, m.Jobs, matched[i] = prgs[i].Filename, len(prgs[i].Jobs), true
+			}
+			c.Modules = append(c.Modules, m)
+			c.Gaps = append(c.Gaps, gaps(m)...)
+		}
+		if len(c.Modules) > 0 {
+			r.Chassis = append(r.Chassis, c)
+		}
+	}
+
+	for i, p := range prgs {
+		switch {
+		case p.Error != "":
+			r.PRGErrors = append(r.PRGErrors, p.Filename+": "+p.Error)
+		case !matched[i]:
+			r.UnmatchedPRGs = append(r.UnmatchedPRGs, p.Filename)
+		}
+	}
+	return r, nil
+}
+
+func (src Sources) module(chassis, path string) Module {
+	file := filepath.Base(path)
+	m := Module{Chassis: chassis, Name: overlay.ModuleName(file), File: file, Path: path}
+	if src.Overlays != nil {
+		for _, w := range src.Overlays.WarningsFor(chassis, m.Name) {
+			m.OverlayWarnings = append(m.OverlayWarnings, w.String())
+		}
+	}
+
+	sp, err := spdaten.Parse(path)
+	if err != nil {
+		m.ParseError = err.Error()
+		return m
+	}
+	sp.Name = file
+	m.FormatUnderstood = true
+
+	type bit struct{ byte, bit int }
+	used := make(map[bit]bool)
+	for _, f := range src.Overlays.Merge(chassis, sp) {
+		p := Param{Label: f.Label, Block: f.Block, Byte: f.ByteAddr, Bit: f.BitIndex, Mask: f.Mask, Safety: f.Safety}
+		_, p.Translated = src.Translations.Translate(f.Label)
+		if f.Verified() {
+			p.Name, p.Verified = f.Name, true
+			p.SafeRange = f.Safety == overlay.SafetySafe || f.Safety == overlay.SafetyCaution
+			used[bit{f.Parameter.Byte, f.Parameter.Bit}] = true
+		}
+		m.Params = append(m.Params, p)
+	}
+	if src.Overlays != nil {
+		for _, p := range src.Overlays.Parameters(chassis, m.Name) {
+			if !used[bit{p.Byte, p.Bit}] && p.AppliesTo(file) {
+				m.Orphans = append(m.Orphans, fmt.Sprintf("%s (byte %d bit %d)", p.Name, p.Byte, p.Bit))
+			}
+		}
+	}
+	return m
+}
+
+// matchPRG finds the PRG for module: "LSZ.prg", "C_LSZ.prg", or a name
+// with a chassis or variant suffix such as "C_KMB46.prg". A suffix naming
+// the chassis wins over other suffixes.
+func matchPRG(prgs prg.BatchResults, module, chassis string) int {
+	best, bestScore := -1, 0
+	for i, p := range prgs {
+		if p.Error != "" {
+			continue
+		}
+		name := strings.ToUpper(strings.TrimSuffix(p.Filename, filepath.Ext(p.Filename)))
+		name = strings.TrimPrefix(name, "C_")
+		rest, ok := strings.CutPrefix(name, module)
+		if !ok {
+			continue
+		}
+		score := 0
+		switch {
+		case rest == "":
+			score = 3
+		case strings.HasSuffix(chassis, rest):
+			score = 2
+		case strings.Trim(rest, "0123456789") == "":
+			score = 1
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+func gaps(m Module) []Gap {
+	var out []Gap
+	add := func(kind GapKind, items ...string) {
+		if len(items) > 0 {
+			out = append(out, Gap{Module: m.File, Kind: kind, Items: items})
+		}
+	}
+	if m.PRG == "" {
+		add(GapNoPRG, m.Name)
+	}
+	if !m.FormatUnderstood {
+		add(GapFormat, m.ParseError)
+	}
+	add(GapOverlay, m.OverlayWarnings...)
+	add(GapOrphan, m.Orphans...)
+
+	var untranslated, unverified, unsafe []string
+	for _, p := range m.Params {
+		if !p.Translated {
+			untranslated = append(untranslated, p.Label)
+		}
+		if !p.Verified {
+			unverified = append(unverified, p.Label)
+		} else if !p.SafeRange {
+			unsafe = append(unsafe, fmt.Sprintf("%s (%s)", p.Name, p.Safety))
+		}
+	}
+	add(GapUntranslated, dedupe(untranslated)...)
+	add(GapUnverified, dedupe(unverified)...)
+	add(GapNoSafeSetting, dedupe(unsafe)...)
+	return out
+}
+
+func dedupe(items []string) []string {
+	seen := make(map[string]bool)
+	return slices.DeleteFunc(items, func(s string) bool {
+		if seen[s] {
+			return true
+		}
+		seen[s] = true
+		return false
+	})
+}
@@ -0,0 +1,200 @@
+package coverage
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/overlay"
+	"github.com/alexcatdad/bavarix/pkg/parser/prg"
+	"github.com/alexcatdad/bavarix/pkg/parser/translations"
+)
+
+func testdataPath(name string) string {
+	_, filename, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(filename), "..", "..", "testdata", name)
+}
+
+// writeSPDaten writes a minimal SP-Daten image with the given labels.
+func writeSPDaten(t *testing.T, path string, labels ...string) {
+	t.Helper()
+	data := []byte("DATEINAME\x00LSZ\x00\x00\x00\x00\xFF\xFF\x01")
+	for _, l := range labels {
+		data = append(data, l...)
+		data = append(data, 0x00, 0x01)
+	}
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+}
+
+func sources(t *testing.T) Sources {
+	t.Helper()
+	dir := t.TempDir()
+	writeSPDaten(t, filepath.Join(dir, "E46", "LSZ.C28"), "TFL_STANDLICHT", "NEBEL_BLINKER")
+	writeSPDaten(t, filepath.Join(dir, "E46", "KMB.C06"), "TANKINHALT", "GONG_LAUT")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "E46", "GM5.C05"), []byte("not SP-Daten"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "E46", "README.txt"), []byte("ignored"), 0o644))
+
+	// Copy the repo's overlays and add one whose bit the synthetic files
+	// cover: the parser places every field at byte 0 bit 0.
+	overlays := t.TempDir()
+	for _, name := range []string{"E46/LSZ.json", "E46/GM5.json"} {
+		data, err := os.ReadFile(testdataPath(filepath.Join("overlays", name)))
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(filepath.Join(overlays, "E46"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(overlays, name), data, 0o644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(overlays, "E46", "KMB.json"), []byte(`[
+		{"module": "KMB", "byte": 0, "bit": 0, "name": "Gong volume", "description": "Loud gong",
+		 "safety": "warning", "reversible": true, "chassis": ["E46"]}
+	]`), 0o644))
+	o, err := overlay.Load(overlays)
+	require.NoError(t, err)
+
+	return Sources{
+		PRGDir:     testdataPath("prg"),
+		SPDatenDir: dir,
+		Overlays:   o,
+		Translations: translations.Dictionary{Entries: map[string]string{
+			"tfl_standlicht": "Daytime running lights",
+			"gong_laut":      "Loud gong",
+		}},
+	}
+}
+
+func gapItems(c Chassis, module string, kind GapKind) []string {
+	for _, g := range c.Gaps {
+		if g.Module == module && g.Kind == kind {
+			return g.Items
+		}
+	}
+	return nil
+}
+
+func TestBuild(t *testing.T) {
+	r, err := Build(sources(t))
+	require.NoError(t, err)
+	require.Len(t, r.Chassis, 1)
+	c := r.Chassis[0]
+	assert.Equal(t, "E46", c.Name)
+	require.Len(t, c.Modules, 3)
+
+	gm5, kmb, lsz := c.Modules[0], c.Modules[1], c.Modules[2]
+
+	assert.Equal(t, "GM5", gm5.Name)
+	assert.False(t, gm5.FormatUnderstood)
+	assert.NotEmpty(t, gm5.ParseError)
+	assert.Equal(t, "C_GM5.prg", gm5.PRG)
+	assert.NotZero(t, gm5.Jobs)
+	assert.Len(t, gm5.OverlayWarnings, 1)
+	assert.Zero(t, gm5.Confidence())
+	assert.NotNil(t, gapItems(c, "GM5.C05", GapFormat))
+	assert.NotNil(t, gapItems(c, "GM5.C05", GapOverlay))
+
+	assert.Equal(t, "C_KMB46.prg", kmb.PRG)
+	require.Len(t, kmb.Params, 2)
+	assert.True(t, kmb.Params[0].Verified)
+	assert.False(t, kmb.Params[0].SafeRange, "rated warning")
+	assert.False(t, kmb.Params[0].Translated)
+	assert.True(t, kmb.Params[1].Translated)
+	assert.Equal(t, 3, kmb.Params[1].Confidence())
+	translated, verified, safe := kmb.Counts()
+	assert.Equal(t, []int{1, 2, 0}, []int{translated, verified, safe})
+	assert.InDelta(t, 5.0/8, kmb.Confidence(), 1e-9)
+	assert.Equal(t, []string{"Gong volume (warning)"}, gapItems(c, "KMB.C06", GapNoSafeSetting))
+
+	assert.Equal(t, "LSZ.prg", lsz.PRG)
+	require.Len(t, lsz.Params, 2)
+	assert.Equal(t, 2, lsz.Params[0].Confidence())
+	assert.Equal(t, []string{"NEBEL_BLINKER"}, gapItems(c, "LSZ.C28", GapUntranslated))
+	assert.Equal(t, []string{"TFL_STANDLICHT", "NEBEL_BLINKER"}, gapItems(c, "LSZ.C28", GapUnverified))
+	// Byte 2 bit 0 applies to every LSZ; byte 7 bit 3 lists C28 too.
+	assert.Len(t, gapItems(c, "LSZ.C28", GapOrphan), 2)
+
+	assert.Empty(t, r.UnmatchedPRGs)
+	assert.Empty(t, r.PRGErrors)
+}
+
+func TestBuildWithoutOptionalSources(t *testing.T) {
+	src := sources(t)
+	src.PRGDir, src.Overlays, src.Translations = "", nil, translations.Dictionary{}
+	r, err := Build(src)
+	require.NoError(t, err)
+	for _, m := range r.Chassis[0].Modules {
+		assert.Empty(t, m.PRG)
+		assert.NotNil(t, gapItems(r.Chassis[0], m.File, GapNoPRG))
+		for _, p := range m.Params {
+			assert.Equal(t, 1, p.Confidence())
+		}
+	}
+
+	_, err = Build(Sources{SPDatenDir: filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
+
+func TestMatchPRG(t *testing.T) {
+	prgs := prg.BatchResults{
+		{Filename: "C_KMB46.prg", Jobs: make([]prg.Job, 1)},
+		{Filename: "C_KMB39.prg", Jobs: make([]prg.Job, 1)},
+		{Filename: "LSZ2.PRG", Jobs: make([]prg.Job, 1)},
+		{Filename: "LSZ.prg", Error: "prg: invalid magic"},
+		{Filename: "KMBX.prg", Jobs: make([]prg.Job, 1)},
+	}
+	assert.Equal(t, 1, matchPRG(prgs, "KMB", "E39"))
+	assert.Equal(t, 0, matchPRG(prgs, "KMB", "E46"))
+	assert.Equal(t, 2, matchPRG(prgs, "LSZ", "E46"))
+	assert.Equal(t, -1, matchPRG(prgs, "GM5", "E46"))
+}
+
+func TestWriteCSV(t *testing.T) {
+	r, err := Build(sources(t))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteCSV(&buf, r))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 6)
+	assert.Equal(t, csvHeader, rows[0])
+	assert.Equal(t, []string{"E46", "GM5", "GM5.C05", "C_GM5.prg"}, rows[1][:4])
+	assert.Equal(t, "no", rows[1][5])
+	assert.Empty(t, rows[1][6])
+	assert.Equal(t, []string{"GONG_LAUT", "0", "0", "Gong volume", "yes", "yes", "warning", "no", "3/4"}, rows[3][6:])
+}
+
+func TestWriteMarkdown(t *testing.T) {
+	r, err := Build(sources(t))
+	require.NoError(t, err)
+	r.UnmatchedPRGs = []string{"ZKE5.prg"}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteMarkdown(&buf, r))
+	out := buf.String()
+	assert.Contains(t, out, "| KMB | KMB.C06 | C_KMB46.prg (")
+	assert.Contains(t, out, "| yes | 2 | 1/2 | 2/2 | 0/2 | 62% |")
+	assert.Contains(t, out, "| GM5 | GM5.C05 | C_GM5.prg (")
+	assert.Contains(t, out, "- **LSZ.C28** untranslated (1): NEBEL_BLINKER\n")
+	assert.Contains(t, out, "### E46 LSZ.C28\n")
+	assert.Contains(t, out, "| TFL_STANDLICHT | 0 | 0 |  | yes | no | unverified | no | 2/4 |")
+	assert.Contains(t, out, "- PRG ZKE5.prg matches no SP-Daten file\n")
+}
+
+func TestWriteHTML(t *testing.T) {
+	r, err := Build(sources(t))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteHTML(&buf, r))
+	out := buf.String()
+	assert.Contains(t, out, "<h2>E46</h2>")
+	assert.Contains(t, out, "<td>KMB</td><td>KMB.C06</td>")
+	assert.Contains(t, out, "<li><strong>LSZ.C28</strong> untranslated (1): NEBEL_BLINKER</li>")
+	assert.Contains(t, out, "<h3>E46 KMB.C06</h3>")
+	assert.NotContains(t, out, "<h2>Other</h2>")
+}
@@ -0,0 +1,201 @@
+package coverage
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var csvHeader = []string{
+	"chassis", "module", "spdaten", "prg", "jobs", "format", "label", "byte", "bit",
+	"name", "translated", "verified", "safety", "safe_range", "confidence",
+}
+
+// WriteCSV writes the per-field coverage matrix, one row per field. A
+// module without fields gets one row with the field columns empty.
+func WriteCSV(w io.Writer, r *Report) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return fmt.Errorf("coverage: writing CSV: %w", err)
+	}
+	for _, c := range r.Chassis {
+		for _, m := range c.Modules {
+			head := []string{c.Name, m.Name, m.File, m.PRG, strconv.Itoa(m.Jobs), yesNo(m.FormatUnderstood)}
+			if len(m.Params) == 0 {
+				if err := cw.Write(append(head, make([]string, len(csvHeader)-len(head))...)); err != nil {
+					return fmt.Errorf("coverage: writing CSV: %w", err)
+				}
+				continue
+			}
+			for _, p := range m.Params {
+				row := append(slices.Clone(head), p.Label, strconv.Itoa(p.Byte), strconv.Itoa(p.Bit), p.Name,
+					yesNo(p.Translated), yesNo(p.Verified), p.Safety.String(), yesNo(p.SafeRange),
+					fmt.Sprintf("%d/%d", p.Confidence(), MaxConfidence))
+				if err := cw.Write(row); err != nil {
+					return fmt.Errorf("coverage: writing CSV: %w", err)
+				}
+			}
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("coverage: writing CSV: %w", err)
+	}
+	return nil
+}
+
+func yesNo(ok bool) string {
+	if ok {
+		return "yes"
+	}
+	return "no"
+}
+
+// WriteMarkdown writes a module matrix and gap list per chassis, followed
+// by a field table per module.
+func WriteMarkdown(w io.Writer, r *Report) error {
+	var b strings.Builder
+	b.WriteString("# Coverage report\n")
+	for _, c := range r.Chassis {
+		fmt.Fprintf(&b, "\n## %s\n\n", c.Name)
+		b.WriteString("| Module | SP-Daten | PRG (jobs) | Format | Fields | Translated | Verified | Safe range | Confidence |\n")
+		b.WriteString("|---|---|---|---|---|---|---|---|---|\n")
+		for _, m := range c.Modules {
+			t, v, s := m.Counts()
+			n := len(m.Params)
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %d | %s | %s | %s | %.0f%% |\n",
+				m.Name, m.File, prgCell(m), yesNo(m.FormatUnderstood), n,
+				ratio(t, n), ratio(v, n), ratio(s, n), m.Confidence()*100)
+		}
+
+		if len(c.Gaps) > 0 {
+			fmt.Fprintf(&b, "\n### %s gaps\n\n", c.Name)
+			for _, g := range c.Gaps {
+				fmt.Fprintf(&b, "- **%s** %s (%d): %s\n", g.Module, g.Kind, len(g.Items), strings.Join(g.Items, ", "))
+			}
+		}
+
+		for _, m := range c.Modules {
+			if len(m.Params) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "\n### %s %s\n\n", c.Name, m.File)
+			b.WriteString("| Label | Byte | Bit | Name | Translated | Verified | Safety | Safe range | Confidence |\n")
+			b.WriteString("|---|---|---|---|---|---|---|---|---|\n")
+			for _, p := range m.Params {
+				fmt.Fprintf(&b, "| %s | %d | %d | %s | %s | %s | %s | %s | %d/%d |\n",
+					mdEscape(p.Label), p.Byte, p.Bit, mdEscape(p.Name), yesNo(p.Translated), yesNo(p.Verified),
+					p.Safety, yesNo(p.SafeRange), p.Confidence(), MaxConfidence)
+			}
+		}
+	}
+	if len(r.UnmatchedPRGs)+len(r.PRGErrors) > 0 {
+		b.WriteString("\n## Other\n\n")
+		for _, p := range r.UnmatchedPRGs {
+			fmt.Fprintf(&b, "- PRG %s matches no SP-Daten file\n", p)
+		}
+		for _, p := range r.PRGErrors {
+			fmt.Fprintf(&b, "- PRG %s\n", p)
+		}
+	}
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("coverage: writing Markdown: %w", err)
+	}
+	return nil
+}
+
+func prgCell(m Module) string {
+	if m.PRG == "" {
+		return "—"
+	}
+	return fmt.Sprintf("%s (%d)", m.PRG, m.Jobs)
+}
+
+func ratio(n, total int) string {
+	return fmt.Sprintf("%d/%d", n, total)
+}
+
+func mdEscape(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+var htmlTemplate = template.Must(template.New("coverage").Funcs(template.FuncMap{
+	"prg":   prgCell,
+	"yesno": yesNo,
+	"counts": func(m Module) []string {
+		t, v, s := m.Counts()
+		n := len(m.Params)
+		return []string{ratio(t, n), ratio(v, n), ratio(s, n)}
+	},
+	"percent": func(f float64) string { return fmt.Sprintf("%.0f%%", f*100) },
+	"join":    strings.Join,
+	"max":     func() int { return MaxConfidence },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Coverage report</title>
+<style>
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.no { background: #fde2e2; }
+.yes { background: #e2f5e2; }
+</style>
+</head>
+<body>
+<h1>Coverage report</h1>
+{{- range .Chassis}}
+<h2>{{.Name}}</h2>
+<table>
+<tr><th>Module</th><th>SP-Daten</th><th>PRG (jobs)</th><th>Format</th><th>Fields</th><th>Translated</th><th>Verified</th><th>Safe range</th><th>Confidence</th></tr>
+{{- range .Modules}}
+<tr><td>{{.Name}}</td><td>{{.File}}</td><td>{{prg .}}</td><td class="{{yesno .FormatUnderstood}}">{{yesno .FormatUnderstood}}</td><td>{{len .Params}}</td>
+{{- range counts .}}<td>{{.}}</td>{{end}}<td>{{percent .Confidence}}</td></tr>
+{{- end}}
+</table>
+{{- if .Gaps}}
+<h3>{{.Name}} gaps</h3>
+<ul>
+{{- range .Gaps}}
+<li><strong>{{.Module}}</strong> {{.Kind}} ({{len .Items}}): {{join .Items ", "}}</li>
+{{- end}}
+</ul>
+{{- end}}
+{{- $chassis := .Name}}
+{{- range .Modules}}{{if .Params}}
+<h3>{{$chassis}} {{.File}}</h3>
+<table>
+<tr><th>Label</th><th>Byte</th><th>Bit</th><th>Name</th><th>Translated</th><th>Verified</th><th>Safety</th><th>Safe range</th><th>Confidence</th></tr>
+{{- range .Params}}
+<tr><td>{{.Label}}</td><td>{{.Byte}}</td><td>{{.Bit}}</td><td>{{.Name}}</td><td class="{{yesno .Translated}}">{{yesno .Translated}}</td><td class="{{yesno .Verified}}">{{yesno .Verified}}</td><td>{{.Safety}}</td><td class="{{yesno .SafeRange}}">{{yesno .SafeRange}}</td><td>{{.Confidence}}/{{max}}</td></tr>
+{{- end}}
+</table>
+{{- end}}{{end}}
+{{- end}}
+{{- if or .UnmatchedPRGs .PRGErrors}}
+<h2>Other</h2>
+<ul>
+{{- range .UnmatchedPRGs}}
+<li>PRG {{.}} matches no SP-Daten file</li>
+{{- end}}
+{{- range .PRGErrors}}
+<li>PRG {{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+</body>
+</html>
+`))
+
+// WriteHTML writes the report as a standalone HTML page with the same
+// sections as WriteMarkdown.
+func WriteHTML(w io.Writer, r *Report) error {
+	if err := htmlTemplate.Execute(w, r); err != nil {
+		return fmt.Errorf("coverage: writing HTML: %w", err)
+	}
+	return nil
+}
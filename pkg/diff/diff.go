@@ -0,0 +1,214 @@
+// Package diff describes a coding change in plain English for the confirm
+// stage. Compare lines two coding images up against the module's SP-Daten
+// fields, the community overlay and the translation dictionary; the
+// renderers in this package show the result on a terminal, as JSON or as
+// HTML.
+package diff
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/alexcatdad/bavarix/pkg/overlay"
+	"github.com/alexcatdad/bavarix/pkg/parser/spdaten"
+	"github.com/alexcatdad/bavarix/pkg/parser/translations"
+)
+
+var ErrLengthMismatch = errors.New("diff: coding images differ in length")
+
+// Status says how much is known about a change.
+type Status int
+
+const (
+	// Verified changes are described by the community overlay.
+	Verified Status = iota
+	// Unverified changes hit an SP-Daten field no overlay describes.
+	Unverified
+	// Unknown changes hit bits no SP-Daten field covers.
+	Unknown
+)
+
+var statusNames = [...]string{"verified", "unverified", "unknown"}
+
+func (s Status) String() string {
+	if int(s) < len(statusNames) {
+		return statusNames[s]
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+func (s Status) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Value is one setting of a field.
+type Value struct {
+	Raw byte `json:"raw"`
+	// Name is the SP-Daten value name, e.g. "aktiv".
+	Name string `json:"name"`
+	// Translation is the English for Name, empty if the dictionary has
+	// none.
+	Translation string `json:"translation,omitempty"`
+}
+
+// String returns the English name if there is one.
+func (v Value) String() string {
+	if v.Translation != "" {
+		return v.Translation
+	}
+	return v.Name
+}
+
+// ByteChange is one byte of the image before and after.
+type ByteChange struct {
+	Offset int  `json:"offset"`
+	Old    byte `json:"old"`
+	New    byte `json:"new"`
+}
+
+// Change is one field whose value differs.
+type Change struct {
+	Status Status `json:"status"`
+	// Name is the overlay's name for the parameter, the SP-Daten label for
+	// unverified fields, or "byte N" for unknown ones.
+	Name string `json:"name"`
+	// Label is the raw SP-Daten label, empty for unknown changes.
+	Label string `json:"label,omitempty"`
+	// Translation is the English for Label, empty if the dictionary has
+	// none.
+	Translation string         `json:"translation,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Safety      overlay.Safety `json:"safety"`
+	Block       int            `json:"block"`
+	Mask        byte           `json:"mask"`
+	Old         Value          `json:"old"`
+	New         Value          `json:"new"`
+	Bytes       []ByteChange   `json:"bytes"`
+}
+
+// Verified reports whether the community overlay describes the change.
+func (c Change) Verified() bool {
+	return c.Status == Verified
+}
+
+// Diff is every change between two coding images of one module.
+type Diff struct {
+	Chassis string   `json:"chassis"`
+	Module  string   `json:"module"`
+	Changes []Change `json:"changes"`
+}
+
+// Count returns how many changes have status s.
+func (d Diff) Count(s Status) int {
+	n := 0
+	for _, c := range d.Changes {
+		if c.Status == s {
+			n++
+		}
+	}
+	return n
+}
+
+// Source is what Compare knows about the module. Overlays may be nil and
+// Translations empty; changes then fall back to raw labels.
+type Source struct {
+	Chassis      string
+	Module       spdaten.Module
+	Overlays     *overlay.Overlays
+	Translations translations.Dictionary
+}
+
+// Compare returns the changes from old to new, ordered by byte and bit.
+// Each changed bit belongs to the first field whose mask covers it; bits no
+// field covers are reported per byte as Unknown.
+func Compare(src Source, old, new []byte) (Diff, error) {
+	if len(old) != len(new) {
+		return Diff{}, fmt.Errorf("%w: %d and %d bytes", ErrLengthMismatch, len(old), len(new))
+	}
+	d := Diff{Chassis: src.Chassis, Module: src.Module.Name}
+	claimed := make([]byte, len(old))
+
+	for _, f := range src.Overlays.Merge(src.Chassis, src.Module) {
+		if f.ByteAddr < 0 || f.ByteAddr >= len(old) {
+			continue
+		}
+		mask := fieldMask(f.Field)
+		i := f.ByteAddr
+		changed := (old[i] ^ new[i]) & mask &^ claimed[i]
+		claimed[i] |= mask
+		if changed == 0 {
+			continue
+		}
+
+		c := Change{
+			Status:      Unverified,
+			Name:        f.Name,
+			Label:       f.Label,
+			Description: f.Description,
+			Safety:      f.Safety,
+			Block:       f.Block,
+			Mask:        mask,
+			Old:         value(src.Translations, old[i], mask),
+			New:         value(src.Translations, new[i], mask),
+			Bytes:       []ByteChange{{Offset: i, Old: old[i], New: new[i]}},
+		}
+		if f.Verified() {
+			c.Status = Verified
+		}
+		c.Translation, _ = src.Translations.Translate(f.Label)
+		d.Changes = append(d.Changes, c)
+	}
+
+	for i := range old {
+		mask := (old[i] ^ new[i]) &^ claimed[i]
+		if mask == 0 {
+			continue
+		}
+		d.Changes = append(d.Changes, Change{
+			Status: Unknown,
+			Name:   fmt.Sprintf("byte %d", i),
+			Safety: overlay.SafetyUnverified,
+			Mask:   mask,
+			Old:    Value{Raw: old[i] & mask, Name: fmt.Sprintf("0x%02X", old[i]&mask)},
+			New:    Value{Raw: new[i] & mask, Name: fmt.Sprintf("0x%02X", new[i]&mask)},
+			Bytes:  []ByteChange{{Offset: i, Old: old[i], New: new[i]}},
+		})
+	}
+
+	sort.SliceStable(d.Changes, func(a, b int) bool {
+		ca, cb := d.Changes[a], d.Changes[b]
+		if ca.Bytes[0].Offset != cb.Bytes[0].Offset {
+			return ca.Bytes[0].Offset < cb.Bytes[0].Offset
+		}
+		return bits.TrailingZeros8(ca.Mask) < bits.TrailingZeros8(cb.Mask)
+	})
+	return d, nil
+}
+
+// fieldMask returns f's mask; older SP-Daten records leave it zero and
+// give only the bit.
+func fieldMask(f spdaten.Field) byte {
+	if f.Mask != 0 {
+		return f.Mask
+	}
+	return 1 << (f.BitIndex & 7)
+}
+
+// value names the setting of the masked bits of b. Single bits use the
+// SP-Daten names "aktiv" and "nicht_aktiv", wider fields "wert_NN".
+func value(dict translations.Dictionary, b, mask byte) Value {
+	raw := (b & mask) >> bits.TrailingZeros8(mask)
+	v := Value{Raw: raw}
+	switch {
+	case bits.OnesCount8(mask) > 1:
+		v.Name = fmt.Sprintf("wert_%02d", raw)
+	case raw != 0:
+		v.Name = "aktiv"
+	default:
+		v.Name = "nicht_aktiv"
+	}
+	v.Translation, _ = dict.Translate(v.Name)
+	return v
+}
@@ -0,0 +1,202 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/overlay"
+	"github.com/alexcatdad/bavarix/pkg/parser/spdaten"
+	"github.com/alexcatdad/bavarix/pkg/parser/translations"
+)
+
+func testdataPath(name string) string {
+	_, filename, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(filename), "..", "..", "testdata", name)
+}
+
+func source(t *testing.T) Source {
+	t.Helper()
+	o, err := overlay.Load(testdataPath("overlays"))
+	require.NoError(t, err)
+	return Source{
+		Chassis: "E46",
+		Module: spdaten.Module{
+			Name: "LSZ.C28",
+			CodingBlocks: []spdaten.CodingBlock{{
+				BlockNr: 1,
+				Fields: []spdaten.Field{
+					{ByteAddr: 7, BitIndex: 3, Mask: 0x08, Label: "TFL_STANDLICHT"},
+					{ByteAddr: 2, BitIndex: 0, Mask: 0x01, Label: "KALTUEBERWACHUNG"},
+					{ByteAddr: 9, BitIndex: 1, Mask: 0x02, Label: "NEBEL_BLINKER"},
+					{ByteAddr: 4, BitIndex: 4, Mask: 0x30, Label: "BLINK_ANZAHL"},
+				},
+			}},
+		},
+		Overlays: o,
+		Translations: translations.Dictionary{Entries: map[string]string{
+			"tfl_standlicht": "Daytime running lights via parking lights",
+			"nebel_blinker":  "Fog lights flash with indicators",
+			"aktiv":          "active",
+			"nicht_aktiv":    "not active",
+			"wert_03":        "5 flashes",
+		}},
+	}
+}
+
+func images() (old, new []byte) {
+	old = make([]byte, 12)
+	new = make([]byte, 12)
+	new[7] = 0x08 // DRL on
+	old[9] = 0x02 // fog flash off
+	old[4] = 0x10 // flash count 1 -> 3
+	new[4] = 0x30
+	new[11] = 0x81 // no field
+	return old, new
+}
+
+func TestCompare(t *testing.T) {
+	old, new := images()
+	d, err := Compare(source(t), old, new)
+	require.NoError(t, err)
+	assert.Equal(t, "LSZ.C28", d.Module)
+	require.Len(t, d.Changes, 4)
+
+	flash := d.Changes[0]
+	assert.Equal(t, Unverified, flash.Status)
+	assert.Equal(t, "BLINK_ANZAHL", flash.Name)
+	assert.Equal(t, byte(0x30), flash.Mask)
+	assert.Equal(t, Value{Raw: 1, Name: "wert_01"}, flash.Old)
+	assert.Equal(t, Value{Raw: 3, Name: "wert_03", Translation: "5 flashes"}, flash.New)
+
+	drl := d.Changes[1]
+	assert.Equal(t, Verified, drl.Status)
+	assert.Equal(t, "Angel eyes as DRL", drl.Name)
+	assert.Equal(t, "TFL_STANDLICHT", drl.Label)
+	assert.Equal(t, "Daytime running lights via parking lights", drl.Translation)
+	assert.Equal(t, overlay.SafetySafe, drl.Safety)
+	assert.Equal(t, 1, drl.Block)
+	assert.Equal(t, "not active", drl.Old.String())
+	assert.Equal(t, "active", drl.New.String())
+	assert.Equal(t, []ByteChange{{Offset: 7, Old: 0x00, New: 0x08}}, drl.Bytes)
+
+	fog := d.Changes[2]
+	assert.Equal(t, Unverified, fog.Status)
+	assert.Equal(t, overlay.SafetyUnverified, fog.Safety)
+	assert.Equal(t, "Fog lights flash with indicators", fog.Translation)
+
+	unknown := d.Changes[3]
+	assert.Equal(t, Unknown, unknown.Status)
+	assert.Equal(t, "byte 11", unknown.Name)
+	assert.Equal(t, byte(0x81), unknown.Mask)
+	assert.Empty(t, unknown.Label)
+
+	assert.Equal(t, 1, d.Count(Verified))
+	assert.Equal(t, 2, d.Count(Unverified))
+	assert.Equal(t, 1, d.Count(Unknown))
+}
+
+func TestCompareUnchangedAndMismatch(t *testing.T) {
+	old, _ := images()
+	d, err := Compare(source(t), old, old)
+	require.NoError(t, err)
+	assert.Empty(t, d.Changes)
+
+	_, err = Compare(source(t), old, old[:4])
+	assert.ErrorIs(t, err, ErrLengthMismatch)
+}
+
+func TestCompareWithoutOverlays(t *testing.T) {
+	src := source(t)
+	src.Overlays = nil
+	src.Translations = translations.Dictionary{}
+	old, new := images()
+	d, err := Compare(src, old, new)
+	require.NoError(t, err)
+	assert.Zero(t, d.Count(Verified))
+	assert.Equal(t, "TFL_STANDLICHT", d.Changes[1].Name)
+	assert.Equal(t, "aktiv", d.Changes[1].New.String())
+}
+
+func TestCompareBitClaimedOnce(t *testing.T) {
+	// Older SP-Daten records carry no mask and may share a bit.
+	src := source(t)
+	src.Module.CodingBlocks[0].Fields = []spdaten.Field{
+		{ByteAddr: 0, BitIndex: 0, Label: "FIRST"},
+		{ByteAddr: 0, BitIndex: 0, Label: "SECOND"},
+	}
+	d, err := Compare(src, []byte{0x00}, []byte{0x01})
+	require.NoError(t, err)
+	require.Len(t, d.Changes, 1)
+	assert.Equal(t, "FIRST", d.Changes[0].Label)
+	assert.Equal(t, byte(0x01), d.Changes[0].Mask)
+}
+
+func TestWriteText(t *testing.T) {
+	old, new := images()
+	d, err := Compare(source(t), old, new)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteText(&buf, d))
+	out := buf.String()
+	assert.Contains(t, out, "E46 LSZ.C28: 4 change(s), 3 not verified by the community overlay")
+	assert.Contains(t, out, "\nAngel eyes as DRL [safe]\n"+
+		"    TFL_STANDLICHT: Daytime running lights via parking lights\n"+
+		"    Enables angel eye rings as daytime running lights\n"+
+		"    not active -> active\n"+
+		"    byte 7: 0x00 -> 0x08 (mask 0x08)\n")
+	assert.Contains(t, out, "[UNVERIFIED] NEBEL_BLINKER [unverified]")
+	assert.Contains(t, out, "[UNKNOWN] byte 11 [unverified]")
+	assert.Contains(t, out, "wert_01 -> 5 flashes")
+}
+
+func TestWriteJSON(t *testing.T) {
+	old, new := images()
+	d, err := Compare(source(t), old, new)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteJSON(&buf, d))
+	var got struct {
+		Changes []struct {
+			Status string `json:"status"`
+			Safety string `json:"safety"`
+			Name   string `json:"name"`
+			New    struct {
+				Translation string `json:"translation"`
+			} `json:"new"`
+		} `json:"changes"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	require.Len(t, got.Changes, 4)
+	assert.Equal(t, "verified", got.Changes[1].Status)
+	assert.Equal(t, "safe", got.Changes[1].Safety)
+	assert.Equal(t, "active", got.Changes[1].New.Translation)
+	assert.Equal(t, "unknown", got.Changes[3].Status)
+
+	buf.Reset()
+	require.NoError(t, WriteJSON(&buf, Diff{}))
+	assert.Contains(t, buf.String(), `"changes": []`)
+}
+
+func TestWriteHTML(t *testing.T) {
+	old, new := images()
+	d, err := Compare(source(t), old, new)
+	require.NoError(t, err)
+	d.Changes[1].Description = "<script>alert(1)</script>"
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteHTML(&buf, d))
+	out := buf.String()
+	assert.Contains(t, out, `<tr class="verified">`)
+	assert.Contains(t, out, `<tr class="unknown">`)
+	assert.Contains(t, out, `<span class="marker">unverified</span> <strong>NEBEL_BLINKER</strong>`)
+	assert.Contains(t, out, `byte 7: 0x00 &rarr; 0x08`)
+	assert.NotContains(t, out, "<script>")
+}
@@ -0,0 +1,116 @@
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+// marker flags changes the overlay does not vouch for.
+func (c Change) marker() string {
+	switch c.Status {
+	case Unverified:
+		return "[UNVERIFIED] "
+	case Unknown:
+		return "[UNKNOWN] "
+	}
+	return ""
+}
+
+// WriteText writes d for a terminal, one block per change:
+//
+//	Angel eyes as DRL [safe]
+//	    TFL_STANDLICHT: Daytime running lights
+//	    not active -> active
+//	    byte 7: 0x00 -> 0x08 (mask 0x08)
+func WriteText(w io.Writer, d Diff) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s: %d change(s)", d.Chassis, d.Module, len(d.Changes))
+	if n := d.Count(Unverified) + d.Count(Unknown); n > 0 {
+		fmt.Fprintf(&b, ", %d not verified by the community overlay", n)
+	}
+	b.WriteString("\n")
+
+	for _, c := range d.Changes {
+		fmt.Fprintf(&b, "\n%s%s [%s]\n", c.marker(), c.Name, c.Safety)
+		if c.Label != "" && c.Label != c.Name || c.Translation != "" {
+			label := c.Label
+			if c.Translation != "" {
+				label += ": " + c.Translation
+			}
+			fmt.Fprintf(&b, "    %s\n", label)
+		}
+		if c.Description != "" {
+			fmt.Fprintf(&b, "    %s\n", c.Description)
+		}
+		fmt.Fprintf(&b, "    %s -> %s\n", c.Old, c.New)
+		for _, bc := range c.Bytes {
+			fmt.Fprintf(&b, "    byte %d: 0x%02X -> 0x%02X (mask 0x%02X)\n", bc.Offset, bc.Old, bc.New, c.Mask)
+		}
+	}
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("diff: writing text: %w", err)
+	}
+	return nil
+}
+
+// WriteJSON writes d as indented JSON.
+func WriteJSON(w io.Writer, d Diff) error {
+	if d.Changes == nil {
+		d.Changes = []Change{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		return fmt.Errorf("diff: writing JSON: %w", err)
+	}
+	return nil
+}
+
+var htmlTemplate = template.Must(template.New("diff").Funcs(template.FuncMap{
+	"hex": func(b byte) string { return fmt.Sprintf("0x%02X", b) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Chassis}} {{.Module}} coding changes</title>
+<style>
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.unverified { background: #fff4d6; }
+.unknown { background: #fde2e2; }
+.marker { font-weight: bold; }
+.safety-caution, .safety-warning { color: #a15c00; }
+.safety-dangerous { color: #b00020; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>{{.Chassis}} {{.Module}}: {{len .Changes}} change(s)</h1>
+<table>
+<tr><th>Parameter</th><th>Old</th><th>New</th><th>Safety</th><th>Bytes</th></tr>
+{{- range .Changes}}
+<tr class="{{.Status}}">
+<td>{{if not .Verified}}<span class="marker">{{.Status}}</span> {{end}}<strong>{{.Name}}</strong>
+{{- if .Label}}<br><code>{{.Label}}</code>{{end}}
+{{- if .Translation}}<br>{{.Translation}}{{end}}
+{{- if .Description}}<br><em>{{.Description}}</em>{{end}}</td>
+<td>{{.Old}}</td>
+<td>{{.New}}</td>
+<td class="safety-{{.Safety}}">{{.Safety}}</td>
+<td>{{range .Bytes}}byte {{.Offset}}: {{hex .Old}} &rarr; {{hex .New}}<br>{{end}}mask {{hex .Mask}}</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// WriteHTML writes d as a standalone HTML page.
+func WriteHTML(w io.Writer, d Diff) error {
+	if err := htmlTemplate.Execute(w, d); err != nil {
+		return fmt.Errorf("diff: writing HTML: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+package kb
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/alexcatdad/bavarix/pkg/coverage"
+	"github.com/alexcatdad/bavarix/pkg/overlay"
+	"github.com/alexcatdad/bavarix/pkg/parser/prg"
+	"github.com/alexcatdad/bavarix/pkg/parser/translations"
+)
+
+// Sources are the inputs to Build; empty ones are skipped. Provenance
+// paths are stored relative to Root, so the same tree builds the same
+// database wherever it is checked out.
+type Sources struct {
+	Root string
+	// PRGDir holds EDIABAS *.prg files.
+	PRGDir string
+	// SPDatenDir holds one directory per chassis of SP-Daten files.
+	SPDatenDir string
+	// Translations is the translation CSV.
+	Translations string
+	// Overlays is the community overlay tree.
+	Overlays string
+}
+
+// Build writes a fresh knowledge database to path, replacing any file
+// there. The same sources always produce the same bytes: records are
+// inserted in name order, nothing time-dependent is stored, and the file
+// is written by VACUUM INTO from an in-memory build.
+func Build(path string, src Sources) error {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return fmt.Errorf("kb: %w", err)
+	}
+	defer db.Close()
+	// Every connection to :memory: is a separate database.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("kb: creating schema: %w", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("kb: %w", err)
+	}
+	defer tx.Rollback()
+
+	b := &builder{tx: tx, src: src, modules: make(map[string]int64), chassis: make(map[string]bool)}
+	for _, step := range []func() error{b.translations, b.prgs, b.overlays, b.codingFiles} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(searchIndex); err != nil {
+		return fmt.Errorf("kb: building search index: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("kb: %w", err)
+	}
+	if _, err := db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, SchemaVersion)); err != nil {
+		return fmt.Errorf("kb: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("kb: %w", err)
+	}
+	if _, err := db.Exec(`VACUUM INTO ?`, tmp); err != nil {
+		return fmt.Errorf("kb: writing %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("kb: %w", err)
+	}
+	return nil
+}
+
+type overlayRow struct {
+	id    int64
+	param overlay.Parameter
+}
+
+type builder struct {
+	tx      *sql.Tx
+	src     Sources
+	dict    translations.Dictionary
+	modules map[string]int64
+	chassis map[string]bool
+	// prgIDs maps PRG file names to prg_files ids.
+	prgIDs map[string]int64
+	// overlayRows maps chassis and module to their overlay rows.
+	overlayRows map[[2]string][]overlayRow
+	loaded      *overlay.Overlays
+}
+
+// source records a file's provenance and returns its id.
+func (b *builder) source(kind, path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("kb: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	rel := path
+	if b.src.Root != "" {
+		if r, err := filepath.Rel(b.src.Root, path); err == nil {
+			rel = r
+		}
+	}
+	res, err := b.tx.Exec(`INSERT INTO sources (kind, path, sha256) VALUES (?, ?, ?)`,
+		kind, filepath.ToSlash(rel), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return 0, fmt.Errorf("kb: recording source %s: %w", rel, err)
+	}
+	return res.LastInsertId()
+}
+
+func (b *builder) module(name string) (int64, error) {
+	if id, ok := b.modules[name]; ok {
+		return id, nil
+	}
+	res, err := b.tx.Exec(`INSERT INTO modules (name) VALUES (?)`, name)
+	if err != nil {
+		return 0, fmt.Errorf("kb: adding module %s: %w", name, err)
+	}
+	id, err := res.LastInsertId()
+	b.modules[name] = id
+	return id, err
+}
+
+func (b *builder) addChassis(name string) error {
+	if b.chassis[name] {
+		return nil
+	}
+	b.chassis[name] = true
+	if _, err := b.tx.Exec(`INSERT INTO chassis (name) VALUES (?)`, name); err != nil {
+		return fmt.Errorf("kb: adding chassis %s: %w", name, err)
+	}
+	return nil
+}
+
+func (b *builder) translate(key string) string {
+	s, _ := b.dict.Translate(key)
+	return s
+}
+
+func (b *builder) translations() error {
+	if b.src.Translations == "" {
+		return nil
+	}
+	dict, err := translations.Load(b.src.Translations)
+	if err != nil {
+		return err
+	}
+	b.dict = dict
+	sid, err := b.source("translations", b.src.Translations)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(dict.Entries))
+	for k := range dict.Entries {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if _, err := b.tx.Exec(`INSERT INTO translations (key, english, source_id, confidence) VALUES (?, ?, ?, 2)`,
+			k, dict.Entries[k], sid); err != nil {
+			return fmt.Errorf("kb: adding translation %s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func (b *builder) prgs() error {
+	b.prgIDs = make(map[string]int64)
+	if b.src.PRGDir == "" {
+		return nil
+	}
+	results, err := prg.BatchExtract(b.src.PRGDir)
+	if err != nil {
+		return fmt.Errorf("kb: %w", err)
+	}
+	for _, r := range results {
+		sid, err := b.source("prg", filepath.Join(b.src.PRGDir, r.Filename))
+		if err != nil {
+			return err
+		}
+		confidence := 1
+		if r.Error != "" {
+			confidence = 0
+		}
+		res, err := b.tx.Exec(`INSERT INTO prg_files (name, error, source_id, confidence) VALUES (?, ?, ?, ?)`,
+			r.Filename, r.Error, sid, confidence)
+		if err != nil {
+			return fmt.Errorf("kb: adding %s: %w", r.Filename, err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("kb: %w", err)
+		}
+		b.prgIDs[r.Filename] = id
+
+		for _, j := range r.Jobs {
+			tr := b.translate(j.Name)
+			confidence := 1
+			if tr != "" {
+				confidence++
+			}
+			if _, err := b.tx.Exec(`INSERT INTO jobs (prg_id, name, address, translation, source_id, confidence)
+				VALUES (?, ?, ?, ?, ?, ?)`, id, j.Name, j.Address, tr, sid, confidence); err != nil {
+				return fmt.Errorf("kb: adding job %s of %s: %w", j.Name, r.Filename, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *builder) overlays() error {
+	b.overlayRows = make(map[[2]string][]overlayRow)
+	if b.src.Overlays == "" {
+		return nil
+	}
+	o, err := overlay.Load(b.src.Overlays)
+	if err != nil {
+		return err
+	}
+	b.loaded = o
+
+	dirs, err := os.ReadDir(b.src.Overlays)
+	if err != nil {
+		return fmt.Errorf("kb: %w", err)
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(b.src.Overlays, dir.Name()))
+		if err != nil {
+			return fmt.Errorf("kb: %w", err)
+		}
+		chassis := strings.ToUpper(dir.Name())
+		for _, f := range files {
+			module := strings.ToUpper(strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())))
+			params := o.Parameters(chassis, module)
+			// Files the loader rejected have no parameters and are left out.
+			if f.IsDir() || !strings.EqualFold(filepath.Ext(f.Name()), ".json") || len(params) == 0 {
+				continue
+			}
+			if err := b.overlayFile(chassis, module, filepath.Join(b.src.Overlays, dir.Name(), f.Name()), params); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *builder) overlayFile(chassis, module, path string, params []overlay.Parameter) error {
+	sid, err := b.source("overlay", path)
+	if err != nil {
+		return err
+	}
+	mid, err := b.module(module)
+	if err != nil {
+		return err
+	}
+	if err := b.addChassis(chassis); err != nil {
+		return err
+	}
+	k := [2]string{chassis, module}
+	for _, p := range params {
+		hardware, _ := json.Marshal(nonNil(p.Hardware))
+		requires, _ := json.Marshal(nonNil(p.Requires))
+		conflicts, _ := json.Marshal(nonNil(p.Conflicts))
+		reversible := p.Reversible != nil && *p.Reversible
+		// An overlay parameter is understood, named in English and verified.
+		confidence := 3
+		if p.Safety == overlay.SafetySafe || p.Safety == overlay.SafetyCaution {
+			confidence++
+		}
+		res, err := b.tx.Exec(`INSERT INTO overlay_parameters (chassis, module_id, key, byte, bit, name, description,
+			safety, reversible, hardware, requires, conflicts, source_id, confidence)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			chassis, mid, p.ID, p.Byte, p.Bit, p.Name, p.Description, p.Safety.String(), reversible,
+			string(hardware), string(requires), string(conflicts), sid, confidence)
+		if err != nil {
+			return fmt.Errorf("kb: adding overlay %s %s %q: %w", chassis, module, p.Name, err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("kb: %w", err)
+		}
+		b.overlayRows[k] = append(b.overlayRows[k], overlayRow{id: id, param: p})
+	}
+	return nil
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// codingFiles adds the SP-Daten files with the coverage report's view of
+// them, which also matches each file to its PRG.
+func (b *builder) codingFiles() error {
+	if b.src.SPDatenDir == "" {
+		return nil
+	}
+	report, err := coverage.Build(coverage.Sources{
+		PRGDir:       b.src.PRGDir,
+		SPDatenDir:   b.src.SPDatenDir,
+		Translations: b.dict,
+		Overlays:     b.loaded,
+	})
+	if err != nil {
+		return fmt.Errorf("kb: %w", err)
+	}
+	for _, c := range report.Chassis {
+		if err := b.addChassis(c.Name); err != nil {
+			return err
+		}
+		for _, m := range c.Modules {
+			if err := b.codingFile(m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *builder) codingFile(m coverage.Module) error {
+	sid, err := b.source("spdaten", m.Path)
+	if err != nil {
+		return err
+	}
+	mid, err := b.module(m.Name)
+	if err != nil {
+		return err
+	}
+	var prgID sql.NullInt64
+	if id, ok := b.prgIDs[m.PRG]; ok {
+		prgID = sql.NullInt64{Int64: id, Valid: true}
+	}
+	confidence := 0
+	if m.FormatUnderstood {
+		confidence = 1
+	}
+	res, err := b.tx.Exec(`INSERT INTO coding_files (chassis, module_id, name, prg_id, parsed, error, source_id, confidence)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, m.Chassis, mid, m.File, prgID, m.FormatUnderstood, m.ParseError, sid, confidence)
+	if err != nil {
+		return fmt.Errorf("kb: adding %s %s: %w", m.Chassis, m.File, err)
+	}
+	fid, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("kb: %w", err)
+	}
+
+	rows := b.overlayRows[[2]string{m.Chassis, m.Name}]
+	for _, p := range m.Params {
+		var overlayID sql.NullInt64
+		if p.Verified {
+			for _, r := range rows {
+				if r.param.Byte == p.Byte && r.param.Bit == p.Bit && r.param.AppliesTo(m.File) {
+					overlayID = sql.NullInt64{Int64: r.id, Valid: true}
+					break
+				}
+			}
+		}
+		if _, err := b.tx.Exec(`INSERT INTO parameters (coding_file_id, block, byte, bit, mask, label, translation,
+			overlay_id, safety, source_id, confidence) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			fid, p.Block, p.Byte, p.Bit, p.Mask, p.Label, b.translate(p.Label), overlayID, p.Safety.String(),
+			sid, p.Confidence()); err != nil {
+			return fmt.Errorf("kb: adding parameter %s of %s: %w", p.Label, m.File, err)
+		}
+	}
+	return nil
+}
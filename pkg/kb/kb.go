@@ -0,0 +1,255 @@
+// Package kb is the knowledge database: PRG jobs, SP-Daten coding
+// parameters, translations and the community overlay merged into one
+// SQLite file. Build creates it from the raw sources; Open queries it.
+// Every record keeps its provenance, the source file and its digest, and
+// a confidence score (see the schema). Records are cross-linked module to
+// coding files to chassis, and coding file to the PRG that serves it, and
+// names, translations and descriptions are searchable with FTS5.
+package kb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+var (
+	ErrNotFound      = errors.New("kb: not found")
+	ErrSchemaVersion = errors.New("kb: database was built with a different schema; rebuild it")
+)
+
+// Source is where a record came from. Path is relative to the build root.
+type Source struct {
+	Kind   string
+	Path   string
+	SHA256 string
+}
+
+// Provenance is carried by every record.
+type Provenance struct {
+	Source     Source
+	Confidence int
+}
+
+type DB struct {
+	db *sql.DB
+}
+
+// Open opens a knowledge database read-only.
+func Open(path string) (*DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("kb: opening database: %w", err)
+	}
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("kb: opening database: %w", err)
+	}
+	if version != SchemaVersion {
+		db.Close()
+		return nil, fmt.Errorf("%w: database is at version %d, this build knows %d", ErrSchemaVersion, version, SchemaVersion)
+	}
+	return &DB{db: db}, nil
+}
+
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// Hit is one search result. Kind is "module", "job", "parameter",
+// "overlay" or "translation"; Ref is the record's id in its own table.
+type Hit struct {
+	Kind        string
+	Ref         int64
+	Name        string
+	Translation string
+	Description string
+}
+
+// Search runs an FTS5 query over names, translations and descriptions,
+// best match first. Labels are split at underscores, so "standlicht"
+// finds TFL_STANDLICHT. A limit of 0 means 50.
+func (d *DB) Search(query string, limit int) ([]Hit, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	rows, err := d.db.Query(`SELECT kind, ref, name, translation, description FROM search
+		WHERE search MATCH ? ORDER BY rank, kind, ref LIMIT ?`, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("kb: searching %q: %w", query, err)
+	}
+	defer rows.Close()
+	var hits []Hit
+	for rows.Next() {
+		var h Hit
+		if err := rows.Scan(&h.Kind, &h.Ref, &h.Name, &h.Translation, &h.Description); err != nil {
+			return nil, fmt.Errorf("kb: searching %q: %w", query, err)
+		}
+		hits = append(hits, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("kb: searching %q: %w", query, err)
+	}
+	return hits, nil
+}
+
+// Chassis returns every chassis, in name order.
+func (d *DB) Chassis() ([]string, error) {
+	rows, err := d.db.Query(`SELECT name FROM chassis ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("kb: listing chassis: %w", err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("kb: listing chassis: %w", err)
+		}
+		out = append(out, name)
+	}
+	return out, rows.Err()
+}
+
+// CodingFile is an SP-Daten file with its links. PRG is empty when no PRG
+// file matched the module.
+type CodingFile struct {
+	ID      int64
+	Chassis string
+	Module  string
+	Name    string
+	PRG     string
+	Parsed  bool
+	Error   string
+	Provenance
+}
+
+const codingFileQuery = `SELECT f.id, f.chassis, m.name, f.name, COALESCE(p.name, ''), f.parsed, f.error,
+	s.kind, s.path, s.sha256, f.confidence
+	FROM coding_files f JOIN modules m ON m.id = f.module_id JOIN sources s ON s.id = f.source_id
+	LEFT JOIN prg_files p ON p.id = f.prg_id `
+
+// CodingFiles returns the SP-Daten files of one chassis, in name order.
+func (d *DB) CodingFiles(chassis string) ([]CodingFile, error) {
+	return d.codingFiles("listing coding files", codingFileQuery+`WHERE f.chassis = ? ORDER BY f.name`, chassis)
+}
+
+// ModuleFiles returns a module's SP-Daten files across all chassis.
+func (d *DB) ModuleFiles(module string) ([]CodingFile, error) {
+	files, err := d.codingFiles("listing module files", codingFileQuery+`WHERE m.name = ? ORDER BY f.chassis, f.name`, module)
+	if err == nil && len(files) == 0 {
+		err = fmt.Errorf("%w: module %s", ErrNotFound, module)
+	}
+	return files, err
+}
+
+// PRGFiles returns the SP-Daten files a PRG file serves.
+func (d *DB) PRGFiles(prgName string) ([]CodingFile, error) {
+	return d.codingFiles("listing PRG files", codingFileQuery+`WHERE p.name = ? ORDER BY f.chassis, f.name`, prgName)
+}
+
+func (d *DB) codingFiles(what, query string, args ...any) ([]CodingFile, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("kb: %s: %w", what, err)
+	}
+	defer rows.Close()
+	var out []CodingFile
+	for rows.Next() {
+		var f CodingFile
+		if err := rows.Scan(&f.ID, &f.Chassis, &f.Module, &f.Name, &f.PRG, &f.Parsed, &f.Error,
+			&f.Source.Kind, &f.Source.Path, &f.Source.SHA256, &f.Confidence); err != nil {
+			return nil, fmt.Errorf("kb: %s: %w", what, err)
+		}
+		out = append(out, f)
+	}
+	return out, rows.Err()
+}
+
+// Parameter is one SP-Daten coding field. Name and Description come from
+// the community overlay and are empty for unverified fields.
+type Parameter struct {
+	ID           int64
+	CodingFileID int64
+	Block        int
+	Byte, Bit    int
+	Mask         byte
+	Label        string
+	Translation  string
+	Name         string
+	Description  string
+	Safety       string
+	Provenance
+}
+
+// Parameters returns the fields of a coding file in file order.
+func (d *DB) Parameters(codingFileID int64) ([]Parameter, error) {
+	rows, err := d.db.Query(`SELECT p.id, p.coding_file_id, p.block, p.byte, p.bit, p.mask, p.label, p.translation,
+		COALESCE(o.name, ''), COALESCE(o.description, ''), p.safety, s.kind, s.path, s.sha256, p.confidence
+		FROM parameters p JOIN sources s ON s.id = p.source_id
+		LEFT JOIN overlay_parameters o ON o.id = p.overlay_id
+		WHERE p.coding_file_id = ? ORDER BY p.id`, codingFileID)
+	if err != nil {
+		return nil, fmt.Errorf("kb: listing parameters: %w", err)
+	}
+	defer rows.Close()
+	var out []Parameter
+	for rows.Next() {
+		var p Parameter
+		if err := rows.Scan(&p.ID, &p.CodingFileID, &p.Block, &p.Byte, &p.Bit, &p.Mask, &p.Label, &p.Translation,
+			&p.Name, &p.Description, &p.Safety, &p.Source.Kind, &p.Source.Path, &p.Source.SHA256,
+			&p.Confidence); err != nil {
+			return nil, fmt.Errorf("kb: listing parameters: %w", err)
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// Job is a diagnostic job of a PRG file.
+type Job struct {
+	ID          int64
+	PRG         string
+	Name        string
+	Address     uint32
+	Translation string
+	Provenance
+}
+
+// Jobs returns the jobs of a PRG file in table order.
+func (d *DB) Jobs(prgName string) ([]Job, error) {
+	rows, err := d.db.Query(`SELECT j.id, p.name, j.name, j.address, j.translation, s.kind, s.path, s.sha256, j.confidence
+		FROM jobs j JOIN prg_files p ON p.id = j.prg_id JOIN sources s ON s.id = j.source_id
+		WHERE p.name = ? ORDER BY j.id`, prgName)
+	if err != nil {
+		return nil, fmt.Errorf("kb: listing jobs: %w", err)
+	}
+	defer rows.Close()
+	var out []Job
+	for rows.Next() {
+		var j Job
+		if err := rows.Scan(&j.ID, &j.PRG, &j.Name, &j.Address, &j.Translation,
+			&j.Source.Kind, &j.Source.Path, &j.Source.SHA256, &j.Confidence); err != nil {
+			return nil, fmt.Errorf("kb: listing jobs: %w", err)
+		}
+		out = append(out, j)
+	}
+	return out, rows.Err()
+}
+
+// Translate looks up the English for an SP-Daten or job name,
+// case-insensitively.
+func (d *DB) Translate(key string) (string, error) {
+	var english string
+	err := d.db.QueryRow(`SELECT english FROM translations WHERE key = lower(?)`, key).Scan(&english)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: translation of %s", ErrNotFound, key)
+	}
+	if err != nil {
+		return "", fmt.Errorf("kb: translating %s: %w", key, err)
+	}
+	return english, nil
+}
@@ -0,0 +1,231 @@
+package kb
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testdataPath(name string) string {
+	_, filename, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(filename), "..", "..", "testdata", name)
+}
+
+func copyFile(t *testing.T, from, to string) {
+	t.Helper()
+	data, err := os.ReadFile(from)
+	require.NoError(t, err)
+	writeFile(t, to, data)
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+}
+
+// spdaten returns a minimal SP-Daten image; the parser places every label
+// at byte 0 bit 0.
+func spdaten(labels ...string) []byte {
+	data := []byte("DATEINAME\x00LSZ\x00\x00\x00\x00\xFF\xFF\x01")
+	for _, l := range labels {
+		data = append(data, l...)
+		data = append(data, 0x00, 0x01)
+	}
+	return data
+}
+
+// tree lays out a data directory and returns its sources.
+func tree(t *testing.T) Sources {
+	t.Helper()
+	root := t.TempDir()
+	for _, name := range []string{"LSZ.prg", "C_KMB46.prg", "C_GM5.prg"} {
+		copyFile(t, testdataPath(filepath.Join("prg", name)), filepath.Join(root, "ecu", name))
+	}
+	copyFile(t, testdataPath("translations/sample.csv"), filepath.Join(root, "translations.csv"))
+	writeFile(t, filepath.Join(root, "daten", "E46", "KMB.C06"), spdaten("TANKINHALT", "GONG_LAUT"))
+	writeFile(t, filepath.Join(root, "daten", "E46", "LSZ.C28"), spdaten("TFL_STANDLICHT"))
+	writeFile(t, filepath.Join(root, "daten", "E39", "GM5.C05"), []byte("not SP-Daten"))
+	writeFile(t, filepath.Join(root, "overlays", "E46", "KMB.json"), []byte(`[
+		{"module": "KMB", "byte": 0, "bit": 0, "id": "gong", "name": "Gong volume",
+		 "description": "Makes the warning gong louder", "safety": "safe", "reversible": true,
+		 "chassis": ["E46"], "hardware": ["KMB.C06"]}
+	]`))
+	writeFile(t, filepath.Join(root, "overlays", "E46", "GM5.json"), []byte(`[`))
+	return Sources{
+		Root:         root,
+		PRGDir:       filepath.Join(root, "ecu"),
+		SPDatenDir:   filepath.Join(root, "daten"),
+		Translations: filepath.Join(root, "translations.csv"),
+		Overlays:     filepath.Join(root, "overlays"),
+	}
+}
+
+func build(t *testing.T) *DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kb.db")
+	require.NoError(t, Build(path, tree(t)))
+	d, err := Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestBuildIsReproducible(t *testing.T) {
+	a := filepath.Join(t.TempDir(), "a.db")
+	b := filepath.Join(t.TempDir(), "b.db")
+	require.NoError(t, Build(a, tree(t)))
+	require.NoError(t, Build(b, tree(t)))
+
+	first, err := os.ReadFile(a)
+	require.NoError(t, err)
+	second, err := os.ReadFile(b)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(first, second), "two builds of the same tree differ")
+
+	// Rebuilding over an existing file replaces it.
+	require.NoError(t, Build(a, tree(t)))
+	again, err := os.ReadFile(a)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(first, again))
+	_, err = os.Stat(a + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCrossLinks(t *testing.T) {
+	d := build(t)
+
+	chassis, err := d.Chassis()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"E39", "E46"}, chassis)
+
+	files, err := d.CodingFiles("E46")
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	kmb := files[0]
+	assert.Equal(t, "KMB.C06", kmb.Name)
+	assert.Equal(t, "KMB", kmb.Module)
+	assert.Equal(t, "C_KMB46.prg", kmb.PRG)
+	assert.True(t, kmb.Parsed)
+	assert.Equal(t, Source{Kind: "spdaten", Path: "daten/E46/KMB.C06", SHA256: kmb.Source.SHA256}, kmb.Source)
+	assert.Len(t, kmb.Source.SHA256, 64)
+
+	gm5, err := d.ModuleFiles("GM5")
+	require.NoError(t, err)
+	require.Len(t, gm5, 1)
+	assert.Equal(t, "E39", gm5[0].Chassis)
+	assert.False(t, gm5[0].Parsed)
+	assert.NotEmpty(t, gm5[0].Error)
+	assert.Zero(t, gm5[0].Confidence)
+
+	_, err = d.ModuleFiles("ZKE")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	served, err := d.PRGFiles("LSZ.prg")
+	require.NoError(t, err)
+	require.Len(t, served, 1)
+	assert.Equal(t, "LSZ.C28", served[0].Name)
+
+	jobs, err := d.Jobs("LSZ.prg")
+	require.NoError(t, err)
+	require.NotEmpty(t, jobs)
+	assert.Equal(t, "LSZ.prg", jobs[0].PRG)
+	assert.Equal(t, "prg", jobs[0].Source.Kind)
+	assert.Equal(t, "ecu/LSZ.prg", jobs[0].Source.Path)
+	assert.GreaterOrEqual(t, jobs[0].Confidence, 1)
+}
+
+func TestParametersCarryOverlayAndConfidence(t *testing.T) {
+	d := build(t)
+	files, err := d.CodingFiles("E46")
+	require.NoError(t, err)
+
+	params, err := d.Parameters(files[0].ID)
+	require.NoError(t, err)
+	require.Len(t, params, 2)
+	for _, p := range params {
+		assert.Equal(t, "Gong volume", p.Name)
+		assert.Equal(t, "safe", p.Safety)
+		assert.Equal(t, "daten/E46/KMB.C06", p.Source.Path)
+	}
+	// Understood, verified and safe; neither label is in the sample
+	// dictionary.
+	assert.Equal(t, 3, params[0].Confidence)
+
+	params, err = d.Parameters(files[1].ID)
+	require.NoError(t, err)
+	require.Len(t, params, 1)
+	assert.Empty(t, params[0].Name)
+	assert.Equal(t, "unverified", params[0].Safety)
+	assert.Equal(t, 1, params[0].Confidence)
+}
+
+func TestSearch(t *testing.T) {
+	d := build(t)
+
+	hits, err := d.Search("standlicht", 0)
+	require.NoError(t, err)
+	require.NotEmpty(t, hits)
+	assert.Equal(t, "parameter", hits[0].Kind)
+	assert.Equal(t, "TFL_STANDLICHT", hits[0].Name)
+
+	hits, err = d.Search("gong", 0)
+	require.NoError(t, err)
+	kinds := map[string]bool{}
+	for _, h := range hits {
+		kinds[h.Kind] = true
+	}
+	assert.True(t, kinds["overlay"])
+	assert.True(t, kinds["parameter"], "overlay text is indexed with the parameters it describes")
+
+	hits, err = d.Search("kilometers", 3)
+	require.NoError(t, err)
+	assert.Len(t, hits, 3)
+	for _, h := range hits {
+		assert.Equal(t, "translation", h.Kind)
+		assert.Contains(t, h.Translation, "kilometers")
+	}
+
+	_, err = d.Search(`"unterminated`, 0)
+	assert.Error(t, err)
+}
+
+func TestTranslate(t *testing.T) {
+	d := build(t)
+	english, err := d.Translate("0_KM")
+	require.NoError(t, err)
+	assert.Equal(t, "0 kilometers", english)
+
+	_, err = d.Translate("nicht_vorhanden")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestBuildSkipsMissingSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.db")
+	require.NoError(t, Build(path, Sources{}))
+	d, err := Open(path)
+	require.NoError(t, err)
+	defer d.Close()
+	chassis, err := d.Chassis()
+	require.NoError(t, err)
+	assert.Empty(t, chassis)
+}
+
+func TestOpenRefusesOtherSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kb.db")
+	require.NoError(t, Build(path, Sources{}))
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`PRAGMA user_version = 99`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = Open(path)
+	assert.ErrorIs(t, err, ErrSchemaVersion)
+}
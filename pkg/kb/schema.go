@@ -0,0 +1,131 @@
+package kb
+
+// SchemaVersion is stored in PRAGMA user_version. Bump it whenever schema
+// changes; Open refuses databases built with another version, since the
+// database is rebuilt from data/ rather than migrated.
+const SchemaVersion = 1
+
+// Every record carries source_id, the file it came from, and confidence,
+// how much is known about it: one point each for a format bavarix
+// understands, an English name, community verification and a known safe
+// setting, so 0-4.
+const schema = `
+CREATE TABLE sources (
+	id INTEGER PRIMARY KEY,
+	kind TEXT NOT NULL,
+	path TEXT NOT NULL UNIQUE,
+	sha256 TEXT NOT NULL
+);
+
+CREATE TABLE chassis (
+	name TEXT PRIMARY KEY
+) WITHOUT ROWID;
+
+CREATE TABLE modules (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE translations (
+	id INTEGER PRIMARY KEY,
+	key TEXT NOT NULL UNIQUE,
+	english TEXT NOT NULL,
+	source_id INTEGER NOT NULL REFERENCES sources (id),
+	confidence INTEGER NOT NULL
+);
+
+CREATE TABLE prg_files (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	error TEXT NOT NULL,
+	source_id INTEGER NOT NULL REFERENCES sources (id),
+	confidence INTEGER NOT NULL
+);
+
+CREATE TABLE jobs (
+	id INTEGER PRIMARY KEY,
+	prg_id INTEGER NOT NULL REFERENCES prg_files (id),
+	name TEXT NOT NULL,
+	address INTEGER NOT NULL,
+	translation TEXT NOT NULL,
+	source_id INTEGER NOT NULL REFERENCES sources (id),
+	confidence INTEGER NOT NULL
+);
+CREATE INDEX jobs_prg ON jobs (prg_id);
+
+CREATE TABLE overlay_parameters (
+	id INTEGER PRIMARY KEY,
+	chassis TEXT NOT NULL REFERENCES chassis (name),
+	module_id INTEGER NOT NULL REFERENCES modules (id),
+	key TEXT NOT NULL,
+	byte INTEGER NOT NULL,
+	bit INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	description TEXT NOT NULL,
+	safety TEXT NOT NULL,
+	reversible INTEGER NOT NULL,
+	hardware TEXT NOT NULL,
+	requires TEXT NOT NULL,
+	conflicts TEXT NOT NULL,
+	source_id INTEGER NOT NULL REFERENCES sources (id),
+	confidence INTEGER NOT NULL
+);
+CREATE INDEX overlay_parameters_module ON overlay_parameters (chassis, module_id);
+
+CREATE TABLE coding_files (
+	id INTEGER PRIMARY KEY,
+	chassis TEXT NOT NULL REFERENCES chassis (name),
+	module_id INTEGER NOT NULL REFERENCES modules (id),
+	name TEXT NOT NULL,
+	prg_id INTEGER REFERENCES prg_files (id),
+	parsed INTEGER NOT NULL,
+	error TEXT NOT NULL,
+	source_id INTEGER NOT NULL REFERENCES sources (id),
+	confidence INTEGER NOT NULL,
+	UNIQUE (chassis, name)
+);
+CREATE INDEX coding_files_module ON coding_files (module_id);
+CREATE INDEX coding_files_prg ON coding_files (prg_id);
+
+CREATE TABLE parameters (
+	id INTEGER PRIMARY KEY,
+	coding_file_id INTEGER NOT NULL REFERENCES coding_files (id),
+	block INTEGER NOT NULL,
+	byte INTEGER NOT NULL,
+	bit INTEGER NOT NULL,
+	mask INTEGER NOT NULL,
+	label TEXT NOT NULL,
+	translation TEXT NOT NULL,
+	overlay_id INTEGER REFERENCES overlay_parameters (id),
+	safety TEXT NOT NULL,
+	source_id INTEGER NOT NULL REFERENCES sources (id),
+	confidence INTEGER NOT NULL
+);
+CREATE INDEX parameters_coding_file ON parameters (coding_file_id);
+
+-- search indexes names, translations and descriptions of every kind of
+-- record; ref is the record's id in its own table.
+CREATE VIRTUAL TABLE search USING fts5 (
+	kind UNINDEXED,
+	ref UNINDEXED,
+	name,
+	translation,
+	description
+);
+`
+
+// searchIndex fills search from the other tables, in id order so rebuilds
+// are identical.
+const searchIndex = `
+INSERT INTO search (kind, ref, name, translation, description)
+	SELECT 'module', id, name, '', '' FROM modules ORDER BY id;
+INSERT INTO search (kind, ref, name, translation, description)
+	SELECT 'job', id, name, translation, '' FROM jobs ORDER BY id;
+INSERT INTO search (kind, ref, name, translation, description)
+	SELECT 'parameter', p.id, p.label, p.translation, COALESCE(o.name || ' ' || o.description, '')
+	FROM parameters p LEFT JOIN overlay_parameters o ON o.id = p.overlay_id ORDER BY p.id;
+INSERT INTO search (kind, ref, name, translation, description)
+	SELECT 'overlay', id, name, '', description FROM overlay_parameters ORDER BY id;
+INSERT INTO search (kind, ref, name, translation, description)
+	SELECT 'translation', id, key, english, '' FROM translations ORDER BY id;
+`
@@ -0,0 +1,59 @@
+package overlay
+
+import (
+	"strings"
+
+	"github.com/alexcatdad/bavarix/pkg/parser/spdaten"
+)
+
+// Field is an SP-Daten coding field with its overlay, if any.
+type Field struct {
+	spdaten.Field
+	Block int
+	// Name is the overlay name, or the raw SP-Daten label for unverified
+	// fields.
+	Name        string
+	Description string
+	Safety      Safety
+	// Parameter is nil for fields no overlay describes.
+	Parameter *Parameter
+}
+
+// Verified reports whether an overlay describes the field.
+func (f Field) Verified() bool {
+	return f.Parameter != nil
+}
+
+// ModuleName returns the module an SP-Daten file belongs to: "LSZ" for
+// "LSZ.C28".
+func ModuleName(spdatenName string) string {
+	name, _, _ := strings.Cut(spdatenName, ".")
+	return strings.ToUpper(name)
+}
+
+// Merge lays the overlay for chassis over every coding field of m, matching
+// by byte and bit and honouring each parameter's hardware list. Fields
+// without an overlay keep their raw label and are SafetyUnverified. A nil
+// *Overlays merges nothing.
+func (o *Overlays) Merge(chassis string, m spdaten.Module) []Field {
+	var params []Parameter
+	if o != nil {
+		params = o.Parameters(chassis, ModuleName(m.Name))
+	}
+
+	var fields []Field
+	for _, block := range m.CodingBlocks {
+		for _, f := range block.Fields {
+			field := Field{Field: f, Block: block.BlockNr, Name: f.Label, Safety: SafetyUnverified}
+			for i := range params {
+				p := &params[i]
+				if p.Byte == f.ByteAddr && p.Bit == f.BitIndex && p.AppliesTo(m.Name) {
+					field.Name, field.Description, field.Safety, field.Parameter = p.Name, p.Description, p.Safety, p
+					break
+				}
+			}
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,399 @@
+// Package overlay loads the community overlay: per-parameter names,
+// descriptions and safety ratings layered over raw SP-Daten coding fields.
+// Overlays live in one file per chassis and module,
+//
+//	overlays/E46/LSZ.json
+//
+// each holding a JSON array of parameters as described by Schema. A file
+// that cannot be read or fails validation is skipped with a warning, and
+// its module falls back to the raw SP-Daten labels.
+package overlay
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Schema is the JSON Schema for overlay files, for CI and editors. Load
+// enforces the same rules.
+//
+//go:embed schema.json
+var Schema []byte
+
+var ErrInvalidOverlay = errors.New("overlay: invalid overlay")
+
+// Safety is how risky changing a parameter is.
+type Safety int
+
+const (
+	// SafetyUnverified marks raw fields no overlay describes. It is not
+	// valid in an overlay file.
+	SafetyUnverified Safety = iota
+	SafetySafe
+	SafetyCaution
+	SafetyWarning
+	SafetyDangerous
+)
+
+var safetyNames = [...]string{"unverified", "safe", "caution", "warning", "dangerous"}
+
+func (s Safety) String() string {
+	if int(s) < len(safetyNames) {
+		return safetyNames[s]
+	}
+	return fmt.Sprintf("Safety(%d)", int(s))
+}
+
+func (s Safety) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Safety) UnmarshalText(text []byte) error {
+	i := slices.Index(safetyNames[:], string(text))
+	if i <= int(SafetyUnverified) {
+		return fmt.Errorf("unknown safety rating %q", text)
+	}
+	*s = Safety(i)
+	return nil
+}
+
+// Parameter is one overlay entry: a coding bit with its human context.
+type Parameter struct {
+	// ID is an optional stable name, e.g. "angel_eyes_drl", for other
+	// parameters to refer to in Requires and Conflicts.
+	ID           string   `json:"id,omitempty"`
+	Module       string   `json:"module"`
+	Byte         int      `json:"byte"`
+	Bit          int      `json:"bit"`
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	Safety       Safety   `json:"safety"`
+	Reversible   *bool    `json:"reversible"`
+	Chassis      []string `json:"chassis"`
+	Hardware     []string `json:"hardware,omitempty"`
+	Requires     []string `json:"requires,omitempty"`
+	Conflicts    []string `json:"conflicts,omitempty"`
+	VerifiedBy   []string `json:"verified_by,omitempty"`
+	LastVerified string   `json:"last_verified,omitempty"`
+}
+
+// AppliesTo reports whether the parameter covers the given SP-Daten file
+// (e.g. "LSZ.C28"). No hardware list means every variant.
+func (p Parameter) AppliesTo(hardware string) bool {
+	return len(p.Hardware) == 0 || slices.ContainsFunc(p.Hardware, func(h string) bool {
+		return strings.EqualFold(h, hardware)
+	})
+}
+
+var (
+	idPattern      = regexp.MustCompile(`^[a-z0-9_]+$`)
+	modulePattern  = regexp.MustCompile(`^[A-Z0-9_]+$`)
+	chassisPattern = regexp.MustCompile(`^[A-Z][0-9]{2}$`)
+)
+
+// Problem is one schema violation in an overlay file.
+type Problem struct {
+	// Index is the parameter's position in the file, from 0; -1 for
+	// problems with the file as a whole.
+	Index   int
+	Field   string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Index < 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("parameter %d: %s: %s", p.Index, p.Field, p.Message)
+}
+
+// ValidationError lists everything wrong with one overlay file.
+type ValidationError struct {
+	Path     string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.String()
+	}
+	return fmt.Sprintf("%v %s: %s", ErrInvalidOverlay, e.Path, strings.Join(msgs, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidOverlay
+}
+
+// ParseFile decodes and validates one overlay file for the given chassis
+// and module, which come from its location in the overlay tree.
+func ParseFile(path, chassis, module string, data []byte) ([]Parameter, error) {
+	invalid := func(msg string) error {
+		return &ValidationError{Path: path, Problems: []Problem{{Index: -1, Message: msg}}}
+	}
+
+	// Decode generically first so type and required-field problems can be
+	// reported per field rather than as a single decoder error.
+	var raw []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, invalid("not a JSON array of parameters: " + err.Error())
+	}
+	var problems []Problem
+	params := make([]Parameter, 0, len(raw))
+	for i, obj := range raw {
+		p, probs := decodeParameter(i, obj)
+		problems = append(problems, probs...)
+		// Check the fields that did decode; the others are reported once.
+		for _, vp := range p.validate(i, chassis, module) {
+			if !slices.ContainsFunc(probs, func(dp Problem) bool { return dp.Field == vp.Field }) {
+				problems = append(problems, vp)
+			}
+		}
+		params = append(params, p)
+	}
+
+	// A bit may be described once per hardware variant, so every earlier
+	// parameter on the same bit is checked, not just the last.
+	seen := make(map[[2]int][]int)
+	for i, p := range params {
+		k := [2]int{p.Byte, p.Bit}
+		for _, j := range seen[k] {
+			if overlaps(params[j].Hardware, p.Hardware) {
+				problems = append(problems, Problem{Index: i, Field: "bit",
+					Message: fmt.Sprintf("byte %d bit %d is already described by parameter %d", p.Byte, p.Bit, j)})
+				break
+			}
+		}
+		seen[k] = append(seen[k], i)
+	}
+	ids := make(map[string]int)
+	for i, p := range params {
+		if j, dup := ids[p.ID]; dup && p.ID != "" {
+			problems = append(problems, Problem{Index: i, Field: "id",
+				Message: fmt.Sprintf("%q is already used by parameter %d", p.ID, j)})
+		}
+		ids[p.ID] = i
+	}
+
+	if len(problems) > 0 {
+		return nil, &ValidationError{Path: path, Problems: problems}
+	}
+	return params, nil
+}
+
+var required = []string{"module", "byte", "bit", "name", "description", "safety", "reversible", "chassis"}
+
+func decodeParameter(i int, obj map[string]json.RawMessage) (Parameter, []Problem) {
+	var problems []Problem
+	for _, field := range required {
+		// null never reaches UnmarshalText and leaves the zero value, so
+		// it counts as missing.
+		if v, ok := obj[field]; !ok || string(v) == "null" {
+			problems = append(problems, Problem{Index: i, Field: field, Message: "is required"})
+		}
+	}
+	known := map[string]bool{"id": true, "hardware": true, "requires": true, "conflicts": true, "verified_by": true, "last_verified": true}
+	for field := range obj {
+		if !known[field] && !slices.Contains(required, field) {
+			problems = append(problems, Problem{Index: i, Field: field, Message: "is not a known field"})
+		}
+	}
+	slices.SortFunc(problems, func(a, b Problem) int { return strings.Compare(a.Field, b.Field) })
+
+	var p Parameter
+	targets := map[string]any{
+		"id": &p.ID, "module": &p.Module, "byte": &p.Byte, "bit": &p.Bit, "name": &p.Name,
+		"description": &p.Description, "safety": &p.Safety, "reversible": &p.Reversible,
+		"chassis": &p.Chassis, "hardware": &p.Hardware, "requires": &p.Requires,
+		"conflicts": &p.Conflicts, "verified_by": &p.VerifiedBy, "last_verified": &p.LastVerified,
+	}
+	fields := make([]string, 0, len(obj))
+	for field := range obj {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	for _, field := range fields {
+		target, ok := targets[field]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(obj[field], target); err != nil {
+			problems = append(problems, Problem{Index: i, Field: field, Message: typeMessage(err)})
+		}
+	}
+	return p, problems
+}
+
+func typeMessage(err error) string {
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return fmt.Sprintf("must be %s, not %s", te.Type, te.Value)
+	}
+	return err.Error()
+}
+
+func (p Parameter) validate(i int, chassis, module string) []Problem {
+	var problems []Problem
+	bad := func(field, format string, args ...any) {
+		problems = append(problems, Problem{Index: i, Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if p.ID != "" && !idPattern.MatchString(p.ID) {
+		bad("id", "%q must be lower-case letters, digits and underscores", p.ID)
+	}
+	switch {
+	case !modulePattern.MatchString(p.Module):
+		bad("module", "%q is not an upper-case module name", p.Module)
+	case module != "" && p.Module != module:
+		bad("module", "%q does not match the file's module %s", p.Module, module)
+	}
+	if p.Byte < 0 || p.Byte > 0xFFFF {
+		bad("byte", "%d is out of range", p.Byte)
+	}
+	if p.Bit < 0 || p.Bit > 7 {
+		bad("bit", "%d is not 0-7", p.Bit)
+	}
+	if strings.TrimSpace(p.Name) == "" {
+		bad("name", "must not be empty")
+	}
+	if strings.TrimSpace(p.Description) == "" {
+		bad("description", "must not be empty")
+	}
+	if p.Safety == SafetyUnverified {
+		bad("safety", "must be one of safe, caution, warning or dangerous")
+	}
+	if p.Reversible == nil {
+		bad("reversible", "must be true or false")
+	}
+	if len(p.Chassis) == 0 {
+		bad("chassis", "must list at least one chassis")
+	}
+	for _, c := range p.Chassis {
+		if !chassisPattern.MatchString(c) {
+			bad("chassis", "%q is not a chassis code like E46", c)
+		}
+	}
+	if chassis != "" && len(p.Chassis) > 0 && !slices.Contains(p.Chassis, chassis) {
+		bad("chassis", "does not include %s, the directory it is in", chassis)
+	}
+	for _, list := range []struct {
+		field  string
+		values []string
+	}{{"hardware", p.Hardware}, {"requires", p.Requires}, {"conflicts", p.Conflicts}} {
+		if slices.Contains(list.values, "") {
+			bad(list.field, "must not contain empty entries")
+		}
+	}
+	for _, v := range p.VerifiedBy {
+		if !strings.HasPrefix(v, "@") || len(v) < 2 {
+			bad("verified_by", "%q is not an @handle", v)
+		}
+	}
+	if p.LastVerified != "" {
+		if _, err := time.Parse(time.DateOnly, p.LastVerified); err != nil {
+			bad("last_verified", "%q is not a YYYY-MM-DD date", p.LastVerified)
+		}
+	}
+	return problems
+}
+
+// overlaps reports whether two hardware lists can apply to the same
+// module; an empty list applies to all. Names compare case-insensitively,
+// as in AppliesTo.
+func overlaps(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(a, func(h string) bool { return Parameter{Hardware: b}.AppliesTo(h) })
+}
+
+// Warning reports an overlay file that was skipped.
+type Warning struct {
+	Path    string
+	Chassis string
+	Module  string
+	Err     error
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("overlay %s skipped, showing raw data for %s %s: %v", w.Path, w.Chassis, w.Module, w.Err)
+}
+
+type key struct {
+	chassis, module string
+}
+
+// Overlays is a loaded overlay tree.
+type Overlays struct {
+	params   map[key][]Parameter
+	Warnings []Warning
+}
+
+// Load reads every <chassis>/<module>.json under root. Files that fail to
+// load are recorded in Warnings and skipped; only a missing or unreadable
+// root is an error.
+func Load(root string) (*Overlays, error) {
+	o := &Overlays{params: make(map[key][]Parameter)}
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("overlay: reading %s: %w", root, err)
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		chassis := strings.ToUpper(dir.Name())
+		files, err := os.ReadDir(filepath.Join(root, dir.Name()))
+		if err != nil {
+			o.Warnings = append(o.Warnings, Warning{Path: filepath.Join(root, dir.Name()), Chassis: chassis, Err: err})
+			continue
+		}
+		for _, f := range files {
+			if f.IsDir() || !strings.EqualFold(filepath.Ext(f.Name()), ".json") {
+				continue
+			}
+			module := strings.ToUpper(strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())))
+			path := filepath.Join(root, dir.Name(), f.Name())
+			params, err := loadFile(path, chassis, module)
+			if err != nil {
+				o.Warnings = append(o.Warnings, Warning{Path: path, Chassis: chassis, Module: module, Err: err})
+				continue
+			}
+			o.params[key{chassis, module}] = params
+		}
+	}
+	return o, nil
+}
+
+func loadFile(path, chassis, module string) ([]Parameter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("overlay: reading %s: %w", path, err)
+	}
+	return ParseFile(path, chassis, module, data)
+}
+
+// Parameters returns the overlay for one module, nil if there is none or
+// its file was skipped.
+func (o *Overlays) Parameters(chassis, module string) []Parameter {
+	return o.params[key{strings.ToUpper(chassis), strings.ToUpper(module)}]
+}
+
+// WarningsFor returns the warnings about one module's overlay.
+func (o *Overlays) WarningsFor(chassis, module string) []Warning {
+	var out []Warning
+	for _, w := range o.Warnings {
+		if strings.EqualFold(w.Chassis, chassis) && (w.Module == "" || strings.EqualFold(w.Module, module)) {
+			out = append(out, w)
+		}
+	}
+	return out
+}
@@ -0,0 +1,161 @@
+package overlay
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/parser/spdaten"
+)
+
+func testdataPath(name string) string {
+	_, filename, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(filename), "..", "..", "testdata", "overlays", name)
+}
+
+func TestLoad(t *testing.T) {
+	o, err := Load(testdataPath(""))
+	require.NoError(t, err)
+
+	params := o.Parameters("e46", "lsz")
+	require.Len(t, params, 2)
+	drl := params[0]
+	assert.Equal(t, "Angel eyes as DRL", drl.Name)
+	assert.Equal(t, SafetySafe, drl.Safety)
+	assert.True(t, *drl.Reversible)
+	assert.Equal(t, []string{"@user1", "@user2"}, drl.VerifiedBy)
+	assert.Equal(t, SafetyCaution, params[1].Safety)
+
+	// The corrupt and the invalid file are skipped with warnings.
+	assert.Nil(t, o.Parameters("E46", "GM5"))
+	assert.Nil(t, o.Parameters("E39", "GM3"))
+	require.Len(t, o.Warnings, 2)
+	gm5 := o.WarningsFor("E46", "GM5")
+	require.Len(t, gm5, 1)
+	assert.ErrorIs(t, gm5[0].Err, ErrInvalidOverlay)
+	assert.Contains(t, gm5[0].String(), "showing raw data for E46 GM5")
+}
+
+func TestValidationReportsEveryProblem(t *testing.T) {
+	o, err := Load(testdataPath(""))
+	require.NoError(t, err)
+	w := o.WarningsFor("E39", "GM3")
+	require.Len(t, w, 1)
+
+	var ve *ValidationError
+	require.ErrorAs(t, w[0].Err, &ve)
+	var fields []string
+	for _, p := range ve.Problems {
+		fields = append(fields, p.Field)
+	}
+	assert.ElementsMatch(t, []string{"reversible", "safety", "bit", "name", "chassis", "verified_by"}, fields)
+}
+
+func TestParseFileRules(t *testing.T) {
+	valid := `{"module":"LSZ","byte":7,"bit":3,"name":"n","description":"d","safety":"safe","reversible":false,"chassis":["E46"]}`
+	_, err := ParseFile("LSZ.json", "E46", "LSZ", []byte("["+valid+"]"))
+	require.NoError(t, err)
+
+	reversible := false
+	unrated := Parameter{Module: "LSZ", Byte: 7, Bit: 3, Name: "n", Description: "d", Reversible: &reversible, Chassis: []string{"E46"}}
+	assert.Equal(t, []Problem{{Index: 0, Field: "safety", Message: "must be one of safe, caution, warning or dangerous"}},
+		unrated.validate(0, "E46", "LSZ"))
+
+	hw := func(h string) string {
+		return valid[:len(valid)-1] + `,"hardware":["` + h + `"]}`
+	}
+	for name, tc := range map[string]struct {
+		data    string
+		problem string
+	}{
+		"not an array":  {`{}`, "not a JSON array"},
+		"missing field": {`[{"module":"LSZ"}]`, "byte: is required"},
+		"unknown field": {`[` + valid[:len(valid)-1] + `,"colour":"red"}]`, "colour: is not a known field"},
+		"wrong module":  {`[` + valid + `]`, "does not match the file's module KMB"},
+		"duplicate bit": {`[` + valid + `,` + valid + `]`, "already described by parameter 0"},
+		// C28 and C31 may share the bit, but a third entry for c28 clashes
+		// with the first one.
+		"duplicate behind another variant": {`[` + hw("LSZ.C28") + `,` + hw("LSZ.C31") + `,` + hw("lsz.c28") + `]`, "parameter 2: bit: byte 7 bit 3 is already described by parameter 0"},
+		"wrong type":                       {`[{"module":"LSZ","byte":"7","bit":3,"name":"n","description":"d","safety":"safe","reversible":false,"chassis":["E46"]}]`, "byte: must be int, not string"},
+		"unverified label":                 {`[{"module":"LSZ","byte":7,"bit":3,"name":"n","description":"d","safety":"unverified","reversible":false,"chassis":["E46"]}]`, "unknown safety rating"},
+		"null safety":                      {`[{"module":"LSZ","byte":7,"bit":3,"name":"n","description":"d","safety":null,"reversible":false,"chassis":["E46"]}]`, "safety: is required"},
+		"null bit":                         {`[{"module":"LSZ","byte":7,"bit":null,"name":"n","description":"d","safety":"safe","reversible":false,"chassis":["E46"]}]`, "bit: is required"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			module := "LSZ"
+			if name == "wrong module" {
+				module = "KMB"
+			}
+			_, err := ParseFile("f.json", "E46", module, []byte(tc.data))
+			assert.ErrorIs(t, err, ErrInvalidOverlay)
+			assert.ErrorContains(t, err, tc.problem)
+		})
+	}
+}
+
+func lszModule(name string) spdaten.Module {
+	return spdaten.Module{
+		Name: name,
+		CodingBlocks: []spdaten.CodingBlock{{
+			BlockNr: 1,
+			Fields: []spdaten.Field{
+				{ByteAddr: 7, BitIndex: 3, Mask: 0x08, Label: "TFL_STANDLICHT"},
+				{ByteAddr: 2, BitIndex: 0, Mask: 0x01, Label: "KALTUEBERWACHUNG"},
+				{ByteAddr: 9, BitIndex: 1, Mask: 0x02, Label: "NEBEL_BLINKER"},
+			},
+		}},
+	}
+}
+
+func TestMerge(t *testing.T) {
+	o, err := Load(testdataPath(""))
+	require.NoError(t, err)
+
+	fields := o.Merge("E46", lszModule("LSZ.C28"))
+	require.Len(t, fields, 3)
+	assert.Equal(t, "Angel eyes as DRL", fields[0].Name)
+	assert.Equal(t, SafetySafe, fields[0].Safety)
+	assert.Equal(t, 1, fields[0].Block)
+	assert.Equal(t, byte(0x08), fields[0].Mask)
+	assert.Equal(t, "Bulb cold monitoring", fields[1].Name)
+	assert.False(t, fields[2].Verified())
+	assert.Equal(t, "NEBEL_BLINKER", fields[2].Name)
+	assert.Equal(t, SafetyUnverified, fields[2].Safety)
+
+	// LSZ.C20 is not in the DRL parameter's hardware list.
+	fields = o.Merge("E46", lszModule("LSZ.C20"))
+	assert.False(t, fields[0].Verified())
+	assert.True(t, fields[1].Verified(), "no hardware list applies to every variant")
+}
+
+func TestMergeFallsBackToRawData(t *testing.T) {
+	o, err := Load(testdataPath(""))
+	require.NoError(t, err)
+	gm5 := lszModule("GM5.C05")
+
+	for _, overlays := range []*Overlays{o, nil} {
+		for _, f := range overlays.Merge("E46", gm5) {
+			assert.False(t, f.Verified())
+			assert.Equal(t, f.Label, f.Name)
+		}
+	}
+}
+
+func TestSchemaMatchesSafetyRatings(t *testing.T) {
+	var schema struct {
+		Items struct {
+			Required   []string `json:"required"`
+			Properties map[string]struct {
+				Enum []string `json:"enum"`
+			} `json:"properties"`
+		} `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(Schema, &schema))
+	assert.Equal(t, safetyNames[SafetySafe:], schema.Items.Properties["safety"].Enum)
+	assert.Equal(t, required, schema.Items.Required)
+	assert.Len(t, schema.Items.Properties, 14)
+}
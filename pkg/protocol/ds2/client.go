@@ -0,0 +1,106 @@
+package ds2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+// DefaultBusyRetries is how many times Do repeats a request that a module
+// answered with the busy status.
+const DefaultBusyRetries = 3
+
+// DefaultBusyDelay is how long Do waits before the first busy retry. Each
+// further retry waits one delay longer.
+const DefaultBusyDelay = 50 * time.Millisecond
+
+// Client sends typed commands to one DS2 module over a transport.
+type Client struct {
+	Transport   transport.Transport
+	Address     byte
+	BusyRetries int
+	BusyDelay   time.Duration
+
+	sleep func(time.Duration)
+}
+
+func NewClient(t transport.Transport, address byte) *Client {
+	return &Client{
+		Transport:   t,
+		Address:     address,
+		BusyRetries: DefaultBusyRetries,
+		BusyDelay:   DefaultBusyDelay,
+		sleep:       time.Sleep,
+	}
+}
+
+// Do sends req and returns the raw response data, starting with the status
+// byte, so it can be handed to the Parse functions. The K-line echo of the
+// request, frames from other modules and frames that do not parse (line
+// noise) are skipped; if no answer follows, the error names the last frame
+// discarded. Busy replies are retried after a growing BusyDelay; any other
+// non-acknowledge status is returned as an error.
+func (c *Client) Do(req Request) ([]byte, error) {
+	frame := BuildFrame(c.Address, req.Bytes())
+
+	for attempt := 0; ; attempt++ {
+		data, err := c.exchange(frame)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = DecodeResponse(data)
+		if errors.Is(err, ErrBusy) && attempt < c.BusyRetries {
+			c.backoff(attempt)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+}
+
+func (c *Client) exchange(frame []byte) ([]byte, error) {
+	if err := c.Transport.SendFrame(frame); err != nil {
+		return nil, fmt.Errorf("ds2: sending command 0x%02X: %w", frame[2], err)
+	}
+
+	var discarded error
+	for {
+		raw, err := c.Transport.ReceiveFrame()
+		if err != nil {
+			if discarded != nil {
+				return nil, fmt.Errorf("ds2: awaiting response to 0x%02X: %w (discarded a bad frame: %w)",
+					frame[2], err, discarded)
+			}
+			return nil, fmt.Errorf("ds2: awaiting response to 0x%02X: %w", frame[2], err)
+		}
+		if bytes.Equal(raw, frame) {
+			continue
+		}
+
+		parsed, err := ParseFrame(raw)
+		if err != nil {
+			discarded = err
+			continue
+		}
+		if parsed.Address != c.Address {
+			continue
+		}
+		return parsed.Data, nil
+	}
+}
+
+// backoff waits before busy retry attempt+1, one BusyDelay longer each
+// time, to give the module time to finish what it is doing.
+func (c *Client) backoff(attempt int) {
+	sleep := c.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	sleep(time.Duration(attempt+1) * c.BusyDelay)
+}
@@ -0,0 +1,160 @@
+package ds2
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeAll(t *testing.T, d *Decoder) []TimedFrame {
+	t.Helper()
+	var frames []TimedFrame
+	for {
+		f, err := d.Next()
+		if err == io.EOF {
+			return frames
+		}
+		require.NoError(t, err)
+		frames = append(frames, f)
+	}
+}
+
+func TestDecoderSplitsConcatenatedFrames(t *testing.T) {
+	stream := append(BuildFrame(0x80, []byte{0x00}), BuildFrame(0x80, []byte{0xA0, 0x01, 0x02})...)
+	frames := decodeAll(t, NewDecoder(bytes.NewReader(stream)))
+
+	require.Len(t, frames, 2)
+	assert.Equal(t, []byte{0x00}, frames[0].Data)
+	assert.Equal(t, []byte{0xA0, 0x01, 0x02}, frames[1].Data)
+	assert.Equal(t, BuildFrame(0x80, []byte{0x00}), frames[0].Raw)
+}
+
+func TestDecoderPartialReads(t *testing.T) {
+	stream := append(BuildFrame(0xD0, []byte{0x04}), BuildFrame(0xD0, []byte{0xA0, 0x00})...)
+	frames := decodeAll(t, NewDecoder(iotest.OneByteReader(bytes.NewReader(stream))))
+
+	require.Len(t, frames, 2)
+	assert.Equal(t, byte(0xD0), frames[1].Address)
+	assert.Equal(t, []byte{0xA0, 0x00}, frames[1].Data)
+}
+
+func TestDecoderResynchronizesAfterGarbage(t *testing.T) {
+	var stream []byte
+	stream = append(stream, 0xFF, 0x00, 0x55, 0x13)
+	stream = append(stream, BuildFrame(0x00, []byte{0x00})...)
+	stream = append(stream, 0x80, 0x0A, 0x08) // truncated frame
+	stream = append(stream, BuildFrame(0x00, []byte{0xA0, 0x38, 0x33})...)
+	stream = append(stream, 0x00, 0x00)
+
+	d := NewDecoder(bytes.NewReader(stream))
+	frames := decodeAll(t, d)
+
+	require.Len(t, frames, 2)
+	assert.Equal(t, []byte{0x00}, frames[0].Data)
+	assert.Equal(t, []byte{0xA0, 0x38, 0x33}, frames[1].Data)
+	assert.Equal(t, 9, d.Skipped())
+}
+
+func TestDecoderTimestamps(t *testing.T) {
+	first := BuildFrame(0x00, []byte{0x00})
+	second := BuildFrame(0x00, []byte{0xA0})
+	d := NewDecoder(iotest.OneByteReader(bytes.NewReader(append(first, second...))))
+
+	clock := time.Unix(1000, 0)
+	d.now = func() time.Time {
+		clock = clock.Add(time.Millisecond)
+		return clock
+	}
+
+	frames := decodeAll(t, d)
+	require.Len(t, frames, 2)
+	assert.True(t, frames[1].Time.After(frames[0].Time))
+}
+
+func TestDecoderReadError(t *testing.T) {
+	d := NewDecoder(iotest.ErrReader(io.ErrUnexpectedEOF))
+	_, err := d.Next()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestDecoderDeliversFrameAfterNoiseOnLiveStream(t *testing.T) {
+	// 0x55 announces a 0x80-byte frame; the real frame follows at once and
+	// the stream stays open, as on a live serial port.
+	r, w := io.Pipe()
+	defer w.Close()
+	frame := BuildFrame(0x80, []byte{0x00})
+	go w.Write(append([]byte{0x55}, frame...))
+
+	got := make(chan TimedFrame, 1)
+	d := NewDecoder(r)
+	go func() {
+		if f, err := d.Next(); err == nil {
+			got <- f
+		}
+	}()
+
+	select {
+	case f := <-got:
+		assert.Equal(t, frame, f.Raw)
+		assert.Equal(t, 1, d.Skipped())
+	case <-time.After(time.Second):
+		t.Fatal("frame after noise byte was not delivered")
+	}
+}
+
+func TestDecoderStampsFrameAtLastByte(t *testing.T) {
+	// The first frame completes in the second read; the third read only
+	// starts the next frame, so it must not move the first frame's stamp.
+	frame := BuildFrame(0x80, []byte{0x00})
+	stream := append(append([]byte{}, frame...), frame...)
+	r := &chunkReader{chunks: [][]byte{frame[:2], frame[2:], stream[len(frame):]}}
+	d := NewDecoder(r)
+
+	clock := time.Unix(1000, 0)
+	d.now = func() time.Time {
+		clock = clock.Add(time.Millisecond)
+		return clock
+	}
+
+	frames := decodeAll(t, d)
+	require.Len(t, frames, 2)
+	assert.Equal(t, time.Unix(1000, 0).Add(2*time.Millisecond), frames[0].Time)
+	assert.Equal(t, time.Unix(1000, 0).Add(3*time.Millisecond), frames[1].Time)
+}
+
+func TestDecoderDropsStaleBytesAfterInterByteTimeout(t *testing.T) {
+	frame := BuildFrame(0x80, []byte{0x00})
+	r := &chunkReader{chunks: [][]byte{{0x55}, frame}}
+	d := NewDecoder(r)
+
+	clock := time.Unix(1000, 0)
+	d.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	frames := decodeAll(t, d)
+	require.Len(t, frames, 1)
+	assert.Equal(t, frame, frames[0].Raw)
+	assert.Equal(t, 1, d.Skipped())
+}
+
+// chunkReader returns one chunk per Read, like a serial port delivering
+// bytes as they arrive.
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
@@ -0,0 +1,274 @@
+package ds2
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Command bytes for the DS2 services used by E36/E38/E39/E46 modules.
+const (
+	CmdIdent            byte = 0x00
+	CmdReadFaultMemory  byte = 0x04
+	CmdClearFaultMemory byte = 0x05
+	CmdReadMemory       byte = 0x06
+	CmdReadCoding       byte = 0x08
+	CmdWriteCoding      byte = 0x09
+	CmdReadStatus       byte = 0x0B
+	CmdControl          byte = 0x0C
+)
+
+// Status is the first data byte of every DS2 response.
+type Status byte
+
+const (
+	StatusAck            Status = 0xA0
+	StatusBusy           Status = 0xA1
+	StatusRejected       Status = 0xA2
+	StatusParameterError Status = 0xB0
+	StatusFunctionError  Status = 0xB1
+	StatusNumberError    Status = 0xB2
+	StatusNack           Status = 0xFF
+)
+
+var (
+	ErrBusy           = errors.New("ds2: module busy")
+	ErrRejected       = errors.New("ds2: command rejected")
+	ErrParameterError = errors.New("ds2: parameter error")
+	ErrFunctionError  = errors.New("ds2: function error")
+	ErrNumberError    = errors.New("ds2: number error")
+	ErrNack           = errors.New("ds2: command not acknowledged")
+	ErrUnknownStatus  = errors.New("ds2: unknown response status")
+	ErrEmptyResponse  = errors.New("ds2: response carries no status byte")
+)
+
+var statusErrors = map[Status]error{
+	StatusBusy:           ErrBusy,
+	StatusRejected:       ErrRejected,
+	StatusParameterError: ErrParameterError,
+	StatusFunctionError:  ErrFunctionError,
+	StatusNumberError:    ErrNumberError,
+	StatusNack:           ErrNack,
+}
+
+// Response is a decoded DS2 reply: the status byte and the payload after it.
+type Response struct {
+	Status Status
+	Data   []byte
+}
+
+// DecodeResponse splits a response frame's data into status and payload.
+// Any status other than acknowledge is returned as an error that unwraps
+// to the matching sentinel, alongside the decoded response.
+func DecodeResponse(data []byte) (Response, error) {
+	if len(data) == 0 {
+		return Response{}, ErrEmptyResponse
+	}
+	resp := Response{Status: Status(data[0]), Data: clone(data[1:])}
+	if resp.Status == StatusAck {
+		return resp, nil
+	}
+	if err, ok := statusErrors[resp.Status]; ok {
+		return resp, err
+	}
+	return resp, fmt.Errorf("%w: 0x%02X", ErrUnknownStatus, byte(resp.Status))
+}
+
+// Request is a typed DS2 command. Bytes returns the frame data, starting
+// with the command byte.
+type Request interface {
+	Bytes() []byte
+}
+
+type Ident struct{}
+
+func (Ident) Bytes() []byte { return []byte{CmdIdent} }
+
+type ReadFaultMemory struct{}
+
+func (ReadFaultMemory) Bytes() []byte { return []byte{CmdReadFaultMemory} }
+
+type ClearFaultMemory struct{}
+
+func (ClearFaultMemory) Bytes() []byte { return []byte{CmdClearFaultMemory} }
+
+// ReadMemory reads Length bytes from a 24-bit Address in a memory Segment.
+type ReadMemory struct {
+	Segment byte
+	Address uint32
+	Length  byte
+}
+
+func (r ReadMemory) Bytes() []byte {
+	return []byte{CmdReadMemory, r.Segment, byte(r.Address >> 16), byte(r.Address >> 8), byte(r.Address), r.Length}
+}
+
+// ReadCoding reads Length bytes of coding data starting at Address.
+type ReadCoding struct {
+	Address uint16
+	Length  byte
+}
+
+func (r ReadCoding) Bytes() []byte {
+	return []byte{CmdReadCoding, 0x00, byte(r.Address >> 8), byte(r.Address), r.Length}
+}
+
+// WriteCoding writes Data to the coding memory starting at Address.
+type WriteCoding struct {
+	Address uint16
+	Data    []byte
+}
+
+func (r WriteCoding) Bytes() []byte {
+	out := make([]byte, 0, 5+len(r.Data))
+	out = append(out, CmdWriteCoding, 0x00, byte(r.Address>>8), byte(r.Address), byte(len(r.Data)))
+	return append(out, r.Data...)
+}
+
+// ReadStatus requests a status block. Selector picks the block on modules
+// that expose more than one; it is omitted when empty.
+type ReadStatus struct {
+	Selector []byte
+}
+
+func (r ReadStatus) Bytes() []byte {
+	return append([]byte{CmdReadStatus}, r.Selector...)
+}
+
+// Control drives an actuator. Output selects the actuator and Args carries
+// the module-specific on/off or duty-cycle parameters.
+type Control struct {
+	Output byte
+	Args   []byte
+}
+
+func (r Control) Bytes() []byte {
+	out := make([]byte, 0, 2+len(r.Args))
+	out = append(out, CmdControl, r.Output)
+	return append(out, r.Args...)
+}
+
+// Identification is the decoded answer to the ident command.
+type Identification struct {
+	PartNumber     string
+	HardwareNumber string
+	CodingIndex    string
+	DiagIndex      string
+	BusIndex       string
+	BuildWeek      string
+	BuildYear      string
+	Supplier       string
+	SoftwareNumber string
+	Raw            []byte
+}
+
+// identFieldWidths lists the byte widths of the identification fields in
+// the order they appear after the status byte.
+var identFieldWidths = []int{7, 2, 2, 2, 2, 2, 2, 2, 2}
+
+// ParseIdent decodes an ident response. The first fields every DS2 module
+// sends are the BMW part number and hardware number; modules that stop
+// early leave the remaining fields empty. Fields that are not printable
+// ASCII are rendered as upper-case hex.
+func ParseIdent(data []byte) (Identification, error) {
+	resp, err := DecodeResponse(data)
+	if err != nil {
+		return Identification{}, err
+	}
+	if len(resp.Data) < identFieldWidths[0]+identFieldWidths[1] {
+		return Identification{}, fmt.Errorf("ds2: ident response too short (%d bytes)", len(resp.Data))
+	}
+
+	fields := make([]string, len(identFieldWidths))
+	off := 0
+	for i, w := range identFieldWidths {
+		if off+w > len(resp.Data) {
+			break
+		}
+		fields[i] = identField(resp.Data[off : off+w])
+		off += w
+	}
+
+	return Identification{
+		PartNumber:     fields[0],
+		HardwareNumber: fields[1],
+		CodingIndex:    fields[2],
+		DiagIndex:      fields[3],
+		BusIndex:       fields[4],
+		BuildWeek:      fields[5],
+		BuildYear:      fields[6],
+		Supplier:       fields[7],
+		SoftwareNumber: fields[8],
+		Raw:            resp.Data,
+	}, nil
+}
+
+func identField(b []byte) string {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7E {
+			return strings.ToUpper(fmt.Sprintf("%X", b))
+		}
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// FaultMemory holds the stored fault records. Record layout is
+// module-specific; the first byte of each record is the fault code.
+type FaultMemory struct {
+	Records [][]byte
+}
+
+// Codes returns the fault code of each stored record.
+func (f FaultMemory) Codes() []byte {
+	codes := make([]byte, 0, len(f.Records))
+	for _, r := range f.Records {
+		if len(r) > 0 {
+			codes = append(codes, r[0])
+		}
+	}
+	return codes
+}
+
+// ParseFaultMemory decodes a fault memory response: a count byte followed
+// by count records of equal length.
+func ParseFaultMemory(data []byte) (FaultMemory, error) {
+	resp, err := DecodeResponse(data)
+	if err != nil {
+		return FaultMemory{}, err
+	}
+	if len(resp.Data) == 0 {
+		return FaultMemory{}, fmt.Errorf("ds2: fault memory response missing count byte")
+	}
+
+	count := int(resp.Data[0])
+	body := resp.Data[1:]
+	if count == 0 {
+		return FaultMemory{}, nil
+	}
+	if len(body) < count || len(body)%count != 0 {
+		return FaultMemory{}, fmt.Errorf("ds2: %d fault records do not divide %d bytes", count, len(body))
+	}
+
+	size := len(body) / count
+	records := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		records = append(records, body[i*size:(i+1)*size])
+	}
+	return FaultMemory{Records: records}, nil
+}
+
+// ParseData decodes an acknowledged response and returns its payload. It
+// serves coding reads, memory reads and status blocks alike.
+func ParseData(data []byte) ([]byte, error) {
+	resp, err := DecodeResponse(data)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func clone(b []byte) []byte {
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
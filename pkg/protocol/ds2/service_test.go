@@ -0,0 +1,230 @@
+package ds2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+func TestRequestFrames(t *testing.T) {
+	tests := []struct {
+		name    string
+		address byte
+		req     Request
+		want    []byte
+	}{
+		{"GM5 ident", 0x00, Ident{}, []byte{0x00, 0x04, 0x00, 0x04}},
+		{"LSZ read fault memory", 0xD0, ReadFaultMemory{}, []byte{0xD0, 0x04, 0x04, 0xD0}},
+		{"LSZ clear fault memory", 0xD0, ClearFaultMemory{}, []byte{0xD0, 0x04, 0x05, 0xD1}},
+		{"KMB46 read memory", 0x80, ReadMemory{Segment: 0x00, Address: 0x000100, Length: 0x02},
+			[]byte{0x80, 0x09, 0x06, 0x00, 0x00, 0x01, 0x00, 0x02, 0x8C}},
+		{"KMB46 read coding", 0x80, ReadCoding{Address: 0x0010, Length: 0x04},
+			[]byte{0x80, 0x08, 0x08, 0x00, 0x00, 0x10, 0x04, 0x94}},
+		{"KMB46 write coding", 0x80, WriteCoding{Address: 0x0010, Data: []byte{0x55, 0x66}},
+			[]byte{0x80, 0x0A, 0x09, 0x00, 0x00, 0x10, 0x02, 0x55, 0x66, 0xA2}},
+		{"GM5 read status", 0x00, ReadStatus{Selector: []byte{0x01}}, []byte{0x00, 0x05, 0x0B, 0x01, 0x0F}},
+		{"LSZ control", 0xD0, Control{Output: 0x07, Args: []byte{0x01}}, []byte{0xD0, 0x06, 0x0C, 0x07, 0x01, 0xDC}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, BuildFrame(tt.address, tt.req.Bytes()))
+		})
+	}
+}
+
+func TestDecodeResponseStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want error
+	}{
+		{"ack", []byte{0xD0, 0x04, 0xA0, 0x74}, nil},
+		{"busy", []byte{0x80, 0x04, 0xA1, 0x25}, ErrBusy},
+		{"rejected", []byte{0x80, 0x04, 0xA2, 0x26}, ErrRejected},
+		{"parameter error", []byte{0x80, 0x04, 0xB0, 0x34}, ErrParameterError},
+		{"nack", []byte{0x80, 0x04, 0xFF, 0x7B}, ErrNack},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := ParseFrame(tt.raw)
+			require.NoError(t, err)
+
+			resp, err := DecodeResponse(frame.Data)
+			assert.Equal(t, Status(tt.raw[2]), resp.Status)
+			if tt.want == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeResponseUnknownStatus(t *testing.T) {
+	_, err := DecodeResponse([]byte{0xC3})
+	assert.ErrorIs(t, err, ErrUnknownStatus)
+}
+
+func TestParseIdentGM5(t *testing.T) {
+	raw := []byte{
+		0x00, 0x1B, 0xA0,
+		0x38, 0x33, 0x37, 0x36, 0x35, 0x30, 0x38, // 8376508
+		0x30, 0x37, 0x30, 0x35, 0x30, 0x33, 0x30, 0x31,
+		0x32, 0x34, 0x39, 0x39, 0x31, 0x32, 0x30, 0x34,
+		0x8D,
+	}
+	frame, err := ParseFrame(raw)
+	require.NoError(t, err)
+
+	ident, err := ParseIdent(frame.Data)
+	require.NoError(t, err)
+	assert.Equal(t, "8376508", ident.PartNumber)
+	assert.Equal(t, "07", ident.HardwareNumber)
+	assert.Equal(t, "05", ident.CodingIndex)
+	assert.Equal(t, "03", ident.DiagIndex)
+	assert.Equal(t, "01", ident.BusIndex)
+	assert.Equal(t, "24", ident.BuildWeek)
+	assert.Equal(t, "99", ident.BuildYear)
+	assert.Equal(t, "12", ident.Supplier)
+	assert.Equal(t, "04", ident.SoftwareNumber)
+}
+
+func TestParseIdentBinaryFields(t *testing.T) {
+	data := []byte{0xA0, 0x01, 0x38, 0x37, 0x36, 0x35, 0x30, 0x38, 0x0A, 0x1B}
+	ident, err := ParseIdent(data)
+	require.NoError(t, err)
+	assert.Equal(t, "01383736353038", ident.PartNumber)
+	assert.Equal(t, "0A1B", ident.HardwareNumber)
+	assert.Empty(t, ident.CodingIndex)
+}
+
+func TestParseFaultMemory(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   []byte
+		codes []byte
+	}{
+		{"LSZ two faults", []byte{0xD0, 0x0B, 0xA0, 0x02, 0x12, 0x01, 0x05, 0x31, 0x20, 0x01, 0x7F}, []byte{0x12, 0x31}},
+		{"LSZ empty", []byte{0xD0, 0x05, 0xA0, 0x00, 0x75}, []byte{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := ParseFrame(tt.raw)
+			require.NoError(t, err)
+
+			fm, err := ParseFaultMemory(frame.Data)
+			require.NoError(t, err)
+			assert.Equal(t, tt.codes, fm.Codes())
+		})
+	}
+}
+
+func TestParseFaultMemoryUnevenRecords(t *testing.T) {
+	_, err := ParseFaultMemory([]byte{0xA0, 0x02, 0x12, 0x01, 0x05})
+	assert.Error(t, err)
+}
+
+func TestParseData(t *testing.T) {
+	frame, err := ParseFrame([]byte{0x80, 0x08, 0xA0, 0x11, 0x22, 0x33, 0x44, 0x6C})
+	require.NoError(t, err)
+
+	data, err := ParseData(frame.Data)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x11, 0x22, 0x33, 0x44}, data)
+}
+
+type scriptedTransport struct {
+	sent      [][]byte
+	responses [][]byte
+}
+
+func (s *scriptedTransport) Connect() error    { return nil }
+func (s *scriptedTransport) Disconnect() error { return nil }
+func (s *scriptedTransport) SendFrame(frame []byte) error {
+	s.sent = append(s.sent, frame)
+	return nil
+}
+func (s *scriptedTransport) ReceiveFrame() ([]byte, error) {
+	if len(s.responses) == 0 {
+		return nil, transport.ErrTimeout
+	}
+	r := s.responses[0]
+	s.responses = s.responses[1:]
+	return r, nil
+}
+func (s *scriptedTransport) SupportsWrite() bool           { return true }
+func (s *scriptedTransport) ReadVoltage() (float64, error) { return 12.6, nil }
+
+func TestClientReadCodingSkipsEcho(t *testing.T) {
+	request := []byte{0x80, 0x08, 0x08, 0x00, 0x00, 0x10, 0x04, 0x94}
+	tr := &scriptedTransport{responses: [][]byte{
+		request,
+		{0x80, 0x08, 0xA0, 0x11, 0x22, 0x33, 0x44, 0x6C},
+	}}
+	c := NewClient(tr, 0x80)
+
+	resp, err := c.Do(ReadCoding{Address: 0x0010, Length: 0x04})
+	require.NoError(t, err)
+
+	data, err := ParseData(resp)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x11, 0x22, 0x33, 0x44}, data)
+	assert.Equal(t, [][]byte{request}, tr.sent)
+}
+
+func TestClientRetriesBusy(t *testing.T) {
+	tr := &scriptedTransport{responses: [][]byte{
+		{0xD0, 0x04, 0xA1, 0x75},
+		{0xD0, 0x04, 0xA0, 0x74},
+	}}
+	c := NewClient(tr, 0xD0)
+	var waits []time.Duration
+	c.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+	_, err := c.Do(ClearFaultMemory{})
+	require.NoError(t, err)
+	assert.Len(t, tr.sent, 2)
+	assert.Equal(t, []time.Duration{DefaultBusyDelay}, waits)
+}
+
+func TestClientBusyExhausted(t *testing.T) {
+	busy := []byte{0xD0, 0x04, 0xA1, 0x75}
+	tr := &scriptedTransport{responses: [][]byte{busy, busy}}
+	c := NewClient(tr, 0xD0)
+	c.BusyRetries = 1
+	c.sleep = func(time.Duration) {}
+
+	_, err := c.Do(ClearFaultMemory{})
+	assert.ErrorIs(t, err, ErrBusy)
+}
+
+func TestClientSkipsNoise(t *testing.T) {
+	tr := &scriptedTransport{responses: [][]byte{
+		{0x80, 0x04, 0xA0, 0x00},
+		{0x80, 0x08, 0xA0, 0x11, 0x22, 0x33, 0x44, 0x6C},
+	}}
+	resp, err := NewClient(tr, 0x80).Do(ReadCoding{Address: 0x0010, Length: 0x04})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xA0, 0x11, 0x22, 0x33, 0x44}, resp)
+
+	// Noise and then silence: the timeout names the discarded frame.
+	tr = &scriptedTransport{responses: [][]byte{{0x80, 0x04, 0xA0, 0x00}}}
+	_, err = NewClient(tr, 0x80).Do(ReadCoding{Address: 0x0010, Length: 0x04})
+	assert.ErrorIs(t, err, transport.ErrTimeout)
+	assert.ErrorIs(t, err, ErrBadChecksum)
+}
+
+func TestClientRejected(t *testing.T) {
+	tr := &scriptedTransport{responses: [][]byte{{0x80, 0x04, 0xA2, 0x26}}}
+	c := NewClient(tr, 0x80)
+
+	_, err := c.Do(WriteCoding{Address: 0x0010, Data: []byte{0x55, 0x66}})
+	assert.ErrorIs(t, err, ErrRejected)
+}
@@ -0,0 +1,166 @@
+// Package framing recovers frames from an unframed byte stream such as a
+// serial port. It holds the resynchronization shared by the DS2 and
+// KWP2000 decoders; each protocol only says where a frame starts and ends.
+package framing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// Scan is what a FrameFunc found at the start of a buffer.
+type Scan int
+
+const (
+	// Incomplete means the buffer may begin a frame that has not fully
+	// arrived yet.
+	Incomplete Scan = iota
+	// Invalid means no frame can begin at the first byte.
+	Invalid
+	// Valid means a whole frame begins the buffer.
+	Valid
+)
+
+// FrameFunc checks for a frame at the start of buf and returns it with its
+// length in bytes when the result is Valid.
+type FrameFunc[F any] func(buf []byte) (F, int, Scan)
+
+// Timed is a frame recovered from the stream, together with its raw bytes
+// and the time its last byte was read.
+type Timed[F any] struct {
+	Frame F
+	Raw   []byte
+	Time  time.Time
+}
+
+// Decoder extracts frames from a byte stream. Bytes that cannot start a
+// valid frame (line noise, partial frames) are discarded until the frame
+// boundary lines up again. A noise byte may announce a length the stream
+// never delivers, so while the head of the buffer is incomplete the
+// decoder also looks further in for a complete frame, and drops the head
+// outright when the line has been quiet for InterByteTimeout.
+type Decoder[F any] struct {
+	// InterByteTimeout drops incomplete buffered bytes when the next read
+	// arrives after a longer gap; zero disables it.
+	InterByteTimeout time.Duration
+
+	frameAt FrameFunc[F]
+	r       io.Reader
+	buf     []byte
+	reads   []arrival
+	chunk   []byte
+	eof     bool
+	last    time.Time
+	skipped int
+
+	now func() time.Time
+}
+
+// arrival records that the buffer up to end was complete at time at.
+type arrival struct {
+	end int
+	at  time.Time
+}
+
+// NewDecoder returns a decoder that reads from r, splits frames with
+// frameAt and stamps reads with now.
+func NewDecoder[F any](r io.Reader, frameAt FrameFunc[F], now func() time.Time) *Decoder[F] {
+	return &Decoder[F]{frameAt: frameAt, r: r, chunk: make([]byte, 256), now: now}
+}
+
+// Skipped returns the number of bytes discarded while resynchronizing.
+func (d *Decoder[F]) Skipped() int {
+	return d.skipped
+}
+
+// Next returns the next valid frame in the stream. It returns io.EOF once
+// the reader is exhausted and no further frame can be recovered.
+func (d *Decoder[F]) Next() (Timed[F], error) {
+	for {
+		if frame, ok := d.extract(); ok {
+			return frame, nil
+		}
+
+		if d.eof {
+			if len(d.buf) == 0 {
+				return Timed[F]{}, io.EOF
+			}
+			// The remaining bytes can never complete; drop one and rescan.
+			d.discard(1)
+			continue
+		}
+
+		n, err := d.r.Read(d.chunk)
+		if n > 0 {
+			now := d.now()
+			if d.InterByteTimeout > 0 && len(d.buf) > 0 && now.Sub(d.last) > d.InterByteTimeout {
+				d.discard(len(d.buf))
+			}
+			d.buf = append(d.buf, d.chunk[:n]...)
+			d.reads = append(d.reads, arrival{end: len(d.buf), at: now})
+			d.last = now
+		}
+		if errors.Is(err, io.EOF) {
+			d.eof = true
+		} else if err != nil {
+			return Timed[F]{}, err
+		}
+	}
+}
+
+// extract scans the buffer for a frame at its start, discarding bytes that
+// cannot begin one. While the head is incomplete, a complete frame later
+// in the buffer shows the head was noise. It reports false when more
+// input is needed.
+func (d *Decoder[F]) extract() (Timed[F], bool) {
+	for len(d.buf) > 0 {
+		frame, n, s := d.frameAt(d.buf)
+		switch s {
+		case Valid:
+			return d.take(frame, n), true
+		case Invalid:
+			d.discard(1)
+			continue
+		}
+		for i := 1; i < len(d.buf); i++ {
+			if frame, n, s := d.frameAt(d.buf[i:]); s == Valid {
+				d.discard(i)
+				return d.take(frame, n), true
+			}
+		}
+		return Timed[F]{}, false
+	}
+	return Timed[F]{}, false
+}
+
+// take removes the n-byte frame at the head of the buffer, stamped with the
+// time of the read that delivered its last byte.
+func (d *Decoder[F]) take(frame F, n int) Timed[F] {
+	tf := Timed[F]{Frame: frame, Raw: bytes.Clone(d.buf[:n])}
+	for _, a := range d.reads {
+		if a.end >= n {
+			tf.Time = a.at
+			break
+		}
+	}
+	d.consume(n)
+	return tf
+}
+
+func (d *Decoder[F]) discard(n int) {
+	d.consume(n)
+	d.skipped += n
+}
+
+func (d *Decoder[F]) consume(n int) {
+	d.buf = d.buf[n:]
+	reads := d.reads[:0]
+	for _, a := range d.reads {
+		if a.end -= n; a.end > 0 {
+			reads = append(reads, a)
+		}
+	}
+	d.reads = reads
+}
@@ -0,0 +1,125 @@
+package kwp2000
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+// DefaultPendingTimeout bounds how long Do keeps waiting while an ECU
+// answers with 0x78 response pending. Flash erase routines on DMEs can
+// legitimately hold a request for tens of seconds.
+const DefaultPendingTimeout = 30 * time.Second
+
+var ErrPendingTimeout = errors.New("kwp2000: response pending for too long")
+
+// Client sends typed requests to one ECU over a transport. Format selects
+// the request header; responses are accepted in any format.
+type Client struct {
+	Transport      transport.Transport
+	Format         Format
+	Target         byte
+	Source         byte
+	PendingTimeout time.Duration
+
+	now func() time.Time
+}
+
+func NewClient(t transport.Transport, target, source byte) *Client {
+	return &Client{
+		Transport:      t,
+		Format:         FormatPhysical,
+		Target:         target,
+		Source:         source,
+		PendingTimeout: DefaultPendingTimeout,
+		now:            time.Now,
+	}
+}
+
+// silentRequest is implemented by requests that may ask the ECU not to
+// reply, such as TesterPresent{NoResponse: true}.
+type silentRequest interface {
+	ExpectsResponse() bool
+}
+
+// Do sends req and returns the positive response data, starting with the
+// response SID; for a request that asks for no response it returns nil, nil
+// once the frame is sent. Echoed request frames, frames from other modules
+// and frames that do not parse (line noise) are skipped; if no answer
+// follows, the error names the last frame discarded. A 0x78 response pending reply keeps Do waiting for the final
+// answer until PendingTimeout expires; any other negative response is
+// returned as a *NegativeResponseError.
+func (c *Client) Do(req Request) ([]byte, error) {
+	sent := BuildFrameFormat(c.Format, c.Target, c.Source, req.Bytes())
+	if err := c.Transport.SendFrame(sent); err != nil {
+		return nil, fmt.Errorf("kwp2000: sending request 0x%02X: %w", req.SID(), err)
+	}
+	if r, ok := req.(silentRequest); ok && !r.ExpectsResponse() {
+		return nil, nil
+	}
+
+	var pendingSince time.Time
+	var discarded error
+	for {
+		raw, err := c.Transport.ReceiveFrame()
+		if err != nil {
+			if discarded != nil {
+				return nil, fmt.Errorf("kwp2000: awaiting response to 0x%02X: %w (discarded a bad frame: %w)",
+					req.SID(), err, discarded)
+			}
+			return nil, fmt.Errorf("kwp2000: awaiting response to 0x%02X: %w", req.SID(), err)
+		}
+
+		if bytes.Equal(raw, sent) {
+			continue
+		}
+
+		frame, err := ParseFrame(raw)
+		if err != nil {
+			discarded = err
+			continue
+		}
+		if !c.fromTarget(frame) {
+			continue
+		}
+
+		resp := frame.Data
+		if isPending(resp, req.SID()) {
+			if pendingSince.IsZero() {
+				pendingSince = c.now()
+			}
+			if c.now().Sub(pendingSince) > c.PendingTimeout {
+				return nil, fmt.Errorf("%w: service 0x%02X", ErrPendingTimeout, req.SID())
+			}
+			continue
+		}
+
+		if err := CheckResponse(resp, req.SID(), 0); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// fromTarget reports whether frame is a response addressed to this client.
+// Functional requests are answered by whichever module owns the function,
+// so only the destination is checked; address-less frames always match.
+func (c *Client) fromTarget(frame Frame) bool {
+	if !frame.Format.HasAddress() {
+		return true
+	}
+	if c.Format == FormatFunctional {
+		return frame.Target == c.Source
+	}
+	return frame.Target == c.Source && frame.Source == c.Target
+}
+
+func isPending(resp []byte, sid byte) bool {
+	return len(resp) >= 3 &&
+		resp[0] == SIDNegativeResponse &&
+		resp[1] == sid &&
+		NRC(resp[2]) == NRCResponsePending
+}
@@ -0,0 +1,157 @@
+package kwp2000
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+type scriptedTransport struct {
+	sent      [][]byte
+	responses [][]byte
+}
+
+func (s *scriptedTransport) Connect() error    { return nil }
+func (s *scriptedTransport) Disconnect() error { return nil }
+func (s *scriptedTransport) SendFrame(frame []byte) error {
+	s.sent = append(s.sent, frame)
+	return nil
+}
+func (s *scriptedTransport) ReceiveFrame() ([]byte, error) {
+	if len(s.responses) == 0 {
+		return nil, transport.ErrTimeout
+	}
+	r := s.responses[0]
+	s.responses = s.responses[1:]
+	return r, nil
+}
+func (s *scriptedTransport) SupportsWrite() bool           { return true }
+func (s *scriptedTransport) ReadVoltage() (float64, error) { return 12.6, nil }
+
+func TestClientDo(t *testing.T) {
+	tr := &scriptedTransport{responses: [][]byte{
+		BuildFrame(0xF1, 0x12, []byte{0x50, 0x89}),
+	}}
+	c := NewClient(tr, 0x12, 0xF1)
+
+	resp, err := c.Do(StartDiagnosticSession{Session: SessionExtended})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x50, 0x89}, resp)
+	assert.Equal(t, [][]byte{BuildFrame(0x12, 0xF1, []byte{0x10, 0x89})}, tr.sent)
+}
+
+func TestClientSkipsEchoAndOtherModules(t *testing.T) {
+	tr := &scriptedTransport{responses: [][]byte{
+		BuildFrame(0x12, 0xF1, []byte{0x3E, 0x01}),
+		BuildFrame(0xF1, 0x40, []byte{0x7E}),
+		BuildFrame(0xF1, 0x12, []byte{0x7E}),
+	}}
+	c := NewClient(tr, 0x12, 0xF1)
+
+	resp, err := c.Do(TesterPresent{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x7E}, resp)
+	assert.Empty(t, tr.responses)
+}
+
+func TestClientResponsePending(t *testing.T) {
+	tr := &scriptedTransport{responses: [][]byte{
+		BuildFrame(0xF1, 0x12, []byte{0x7F, 0x31, 0x78}),
+		BuildFrame(0xF1, 0x12, []byte{0x7F, 0x31, 0x78}),
+		BuildFrame(0xF1, 0x12, []byte{0x71, 0x02}),
+	}}
+	c := NewClient(tr, 0x12, 0xF1)
+
+	resp, err := c.Do(rawRequest{0x31, 0x02})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x71, 0x02}, resp)
+}
+
+func TestClientResponsePendingTimeout(t *testing.T) {
+	pending := BuildFrame(0xF1, 0x12, []byte{0x7F, 0x36, 0x78})
+	tr := &scriptedTransport{responses: [][]byte{pending, pending, pending}}
+	c := NewClient(tr, 0x12, 0xF1)
+	c.PendingTimeout = 5 * time.Second
+
+	clock := time.Unix(0, 0)
+	c.now = func() time.Time {
+		clock = clock.Add(3 * time.Second)
+		return clock
+	}
+
+	_, err := c.Do(TransferData{Data: []byte{0x00}})
+	assert.ErrorIs(t, err, ErrPendingTimeout)
+}
+
+func TestClientNegativeResponse(t *testing.T) {
+	tr := &scriptedTransport{responses: [][]byte{
+		BuildFrame(0xF1, 0x12, []byte{0x7F, 0x27, 0x35}),
+	}}
+	c := NewClient(tr, 0x12, 0xF1)
+
+	_, err := c.Do(SecurityAccess{Level: 0x02, Key: []byte{0x00, 0x00}})
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestClientTimeout(t *testing.T) {
+	c := NewClient(&scriptedTransport{}, 0x12, 0xF1)
+
+	_, err := c.Do(TesterPresent{})
+	assert.ErrorIs(t, err, transport.ErrTimeout)
+}
+
+func TestClientFunctionalAddressing(t *testing.T) {
+	tr := &scriptedTransport{responses: [][]byte{
+		BuildFrame(0xF1, 0x12, []byte{0x7E}),
+	}}
+	c := NewClient(tr, 0x33, 0xF1)
+	c.Format = FormatFunctional
+
+	resp, err := c.Do(TesterPresent{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x7E}, resp)
+	assert.Equal(t, byte(0xC2), tr.sent[0][0])
+}
+
+type rawRequest []byte
+
+func (r rawRequest) SID() byte     { return r[0] }
+func (r rawRequest) Bytes() []byte { return r }
+
+func TestClientTesterPresentNoResponse(t *testing.T) {
+	tr := &scriptedTransport{responses: [][]byte{BuildFrame(0xF1, 0x12, []byte{0x7E})}}
+	c := NewClient(tr, 0x12, 0xF1)
+
+	resp, err := c.Do(TesterPresent{NoResponse: true})
+	require.NoError(t, err)
+	assert.Nil(t, resp)
+	assert.Equal(t, [][]byte{BuildFrame(0x12, 0xF1, []byte{0x3E, 0x02})}, tr.sent)
+	assert.Len(t, tr.responses, 1, "no frame is read")
+}
+
+func TestClientSkipsUnparsableFrames(t *testing.T) {
+	good := BuildFrame(0xF1, 0x12, []byte{0x7E})
+	bad := append([]byte(nil), good...)
+	bad[len(bad)-1] ^= 0xFF
+	tr := &scriptedTransport{responses: [][]byte{{0x55}, bad, good}}
+	c := NewClient(tr, 0x12, 0xF1)
+
+	resp, err := c.Do(TesterPresent{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x7E}, resp)
+}
+
+func TestClientReportsDiscardedFrameOnTimeout(t *testing.T) {
+	bad := BuildFrame(0xF1, 0x12, []byte{0x7E})
+	bad[len(bad)-1] ^= 0xFF
+	tr := &scriptedTransport{responses: [][]byte{bad}}
+	c := NewClient(tr, 0x12, 0xF1)
+
+	_, err := c.Do(TesterPresent{})
+	assert.ErrorIs(t, err, transport.ErrTimeout)
+	assert.ErrorIs(t, err, ErrBadChecksum)
+}
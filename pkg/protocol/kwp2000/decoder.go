@@ -0,0 +1,64 @@
+package kwp2000
+
+import (
+	"io"
+	"time"
+
+	"github.com/alexcatdad/bavarix/pkg/protocol/internal/framing"
+)
+
+// DefaultInterByteTimeout is how long the line may stay quiet in the middle
+// of a frame. ISO 14230 allows at most 20 ms between a frame's bytes (P1
+// and P4); the margin covers USB serial adapters, which deliver bytes in
+// bursts.
+const DefaultInterByteTimeout = 100 * time.Millisecond
+
+// TimedFrame is a frame recovered from a byte stream, together with its
+// raw bytes and the time its last byte was read.
+type TimedFrame struct {
+	Frame
+	Raw  []byte
+	Time time.Time
+}
+
+// Decoder extracts KWP2000 frames in any header format from an unframed
+// byte stream such as a serial port, resynchronizing on the header length
+// and checksum after line noise or partial frames. K-line echo is returned
+// like any other frame. InterByteTimeout and Skipped come from the shared
+// framing decoder.
+type Decoder struct {
+	*decoder
+
+	now func() time.Time
+}
+
+type decoder = framing.Decoder[Frame]
+
+func NewDecoder(r io.Reader) *Decoder {
+	d := &Decoder{now: time.Now}
+	d.decoder = framing.NewDecoder(r, frameAt, func() time.Time { return d.now() })
+	d.InterByteTimeout = DefaultInterByteTimeout
+	return d
+}
+
+// Next returns the next valid frame in the stream. It returns io.EOF once
+// the reader is exhausted and no further frame can be recovered.
+func (d *Decoder) Next() (TimedFrame, error) {
+	f, err := d.decoder.Next()
+	return TimedFrame{Frame: f.Frame, Raw: f.Raw, Time: f.Time}, err
+}
+
+// frameAt checks for a frame at the start of buf.
+func frameAt(buf []byte) (Frame, int, framing.Scan) {
+	length := FrameLength(buf)
+	if length == 0 || len(buf) < length {
+		return Frame{}, 0, framing.Incomplete
+	}
+	// Every request and response carries at least a service or status
+	// byte, so empty frames are treated as noise.
+	frame, err := ParseFrame(buf[:length])
+	if err != nil || len(frame.Data) == 0 {
+		return Frame{}, 0, framing.Invalid
+	}
+	return frame, length, framing.Valid
+}
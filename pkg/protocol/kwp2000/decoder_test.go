@@ -0,0 +1,173 @@
+package kwp2000
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeAll(t *testing.T, d *Decoder) []TimedFrame {
+	t.Helper()
+	var frames []TimedFrame
+	for {
+		f, err := d.Next()
+		if err == io.EOF {
+			return frames
+		}
+		require.NoError(t, err)
+		frames = append(frames, f)
+	}
+}
+
+func TestDecoderSplitsConcatenatedFrames(t *testing.T) {
+	stream := append(BuildFrame(0x12, 0xF1, []byte{0x1A, 0x80}), BuildFrame(0xF1, 0x12, []byte{0x5A, 0x80, 0x37})...)
+	frames := decodeAll(t, NewDecoder(bytes.NewReader(stream)))
+
+	require.Len(t, frames, 2)
+	assert.Equal(t, []byte{0x1A, 0x80}, frames[0].Data)
+	assert.Equal(t, []byte{0x5A, 0x80, 0x37}, frames[1].Data)
+	assert.Equal(t, BuildFrame(0x12, 0xF1, []byte{0x1A, 0x80}), frames[0].Raw)
+}
+
+func TestDecoderMixedFormats(t *testing.T) {
+	var stream []byte
+	stream = append(stream, BuildFrameFormat(FormatFunctional, 0x33, 0xF1, []byte{0x3E, 0x01})...)
+	stream = append(stream, BuildFrameFormat(FormatNoAddress, 0, 0, []byte{0x7E})...)
+	stream = append(stream, BuildFrameFormat(FormatBMW, 0xF1, 0x12, make([]byte, 100))...)
+
+	frames := decodeAll(t, NewDecoder(iotest.OneByteReader(bytes.NewReader(stream))))
+	require.Len(t, frames, 3)
+	assert.Equal(t, FormatFunctional, frames[0].Format)
+	assert.Equal(t, FormatNoAddress, frames[1].Format)
+	assert.Len(t, frames[2].Data, 100)
+}
+
+func TestDecoderPartialReads(t *testing.T) {
+	stream := append(BuildFrame(0x12, 0xF1, []byte{0x21, 0x01}), BuildFrame(0xF1, 0x12, []byte{0x61, 0x01, 0xAA})...)
+	frames := decodeAll(t, NewDecoder(iotest.OneByteReader(bytes.NewReader(stream))))
+
+	require.Len(t, frames, 2)
+	assert.Equal(t, byte(0x12), frames[1].Source)
+	assert.Equal(t, []byte{0x61, 0x01, 0xAA}, frames[1].Data)
+}
+
+func TestDecoderResynchronizesAfterGarbage(t *testing.T) {
+	var stream []byte
+	stream = append(stream, 0x00, 0x00, 0x55)
+	stream = append(stream, BuildFrame(0x12, 0xF1, []byte{0x3E, 0x01})...)
+	stream = append(stream, 0x83, 0xF1, 0x12) // truncated frame
+	stream = append(stream, BuildFrame(0xF1, 0x12, []byte{0x7E})...)
+	stream = append(stream, 0x00)
+
+	d := NewDecoder(bytes.NewReader(stream))
+	frames := decodeAll(t, d)
+
+	require.Len(t, frames, 2)
+	assert.Equal(t, []byte{0x3E, 0x01}, frames[0].Data)
+	assert.Equal(t, []byte{0x7E}, frames[1].Data)
+	assert.Equal(t, 7, d.Skipped())
+}
+
+func TestDecoderTimestamps(t *testing.T) {
+	first := BuildFrame(0x12, 0xF1, []byte{0x3E, 0x01})
+	second := BuildFrame(0xF1, 0x12, []byte{0x7E})
+	d := NewDecoder(iotest.OneByteReader(bytes.NewReader(append(first, second...))))
+
+	clock := time.Unix(1000, 0)
+	d.now = func() time.Time {
+		clock = clock.Add(time.Millisecond)
+		return clock
+	}
+
+	frames := decodeAll(t, d)
+	require.Len(t, frames, 2)
+	assert.True(t, frames[1].Time.After(frames[0].Time))
+}
+
+func TestDecoderReadError(t *testing.T) {
+	d := NewDecoder(iotest.ErrReader(io.ErrUnexpectedEOF))
+	_, err := d.Next()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestDecoderDeliversFrameAfterNoiseOnLiveStream(t *testing.T) {
+	// 0x55 reads as a CARB header announcing 21 data bytes; the real frame
+	// follows at once and the stream stays open, as on a live serial port.
+	r, w := io.Pipe()
+	defer w.Close()
+	frame := BuildFrame(0x12, 0xF1, []byte{0x1A, 0x80})
+	go w.Write(append([]byte{0x55}, frame...))
+
+	got := make(chan TimedFrame, 1)
+	d := NewDecoder(r)
+	go func() {
+		if f, err := d.Next(); err == nil {
+			got <- f
+		}
+	}()
+
+	select {
+	case f := <-got:
+		assert.Equal(t, frame, f.Raw)
+		assert.Equal(t, 1, d.Skipped())
+	case <-time.After(time.Second):
+		t.Fatal("frame after noise byte was not delivered")
+	}
+}
+
+func TestDecoderStampsFrameAtLastByte(t *testing.T) {
+	// The first frame completes in the second read; the third read only
+	// starts the next frame, so it must not move the first frame's stamp.
+	frame := BuildFrame(0x12, 0xF1, []byte{0x1A, 0x80})
+	stream := append(append([]byte{}, frame...), frame...)
+	r := &chunkReader{chunks: [][]byte{frame[:2], frame[2:], stream[len(frame):]}}
+	d := NewDecoder(r)
+
+	clock := time.Unix(1000, 0)
+	d.now = func() time.Time {
+		clock = clock.Add(time.Millisecond)
+		return clock
+	}
+
+	frames := decodeAll(t, d)
+	require.Len(t, frames, 2)
+	assert.Equal(t, time.Unix(1000, 0).Add(2*time.Millisecond), frames[0].Time)
+	assert.Equal(t, time.Unix(1000, 0).Add(3*time.Millisecond), frames[1].Time)
+}
+
+func TestDecoderDropsStaleBytesAfterInterByteTimeout(t *testing.T) {
+	frame := BuildFrame(0x12, 0xF1, []byte{0x1A, 0x80})
+	r := &chunkReader{chunks: [][]byte{{0x55}, frame}}
+	d := NewDecoder(r)
+
+	clock := time.Unix(1000, 0)
+	d.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	frames := decodeAll(t, d)
+	require.Len(t, frames, 1)
+	assert.Equal(t, frame, frames[0].Raw)
+	assert.Equal(t, 1, d.Skipped())
+}
+
+// chunkReader returns one chunk per Read, like a serial port delivering
+// bytes as they arrive.
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
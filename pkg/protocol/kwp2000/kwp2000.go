@@ -9,9 +9,70 @@ var (
 	ErrBadChecksum    = errors.New("kwp2000: checksum mismatch")
 	ErrFrameTooShort  = errors.New("kwp2000: frame too short")
 	ErrLengthMismatch = errors.New("kwp2000: frame length mismatch")
+	ErrFormatMismatch = errors.New("kwp2000: header does not match expected format")
 )
 
+// Format identifies an ISO 14230 header variant. The addressing mode is
+// carried in the top two bits of the format byte; the low six bits hold
+// the data length, or zero when a separate length byte follows.
+type Format int
+
+const (
+	// FormatAuto detects the format from the header byte when parsing.
+	FormatAuto Format = iota
+	// FormatPhysical is the 0x80 header with target and source bytes.
+	FormatPhysical
+	// FormatFunctional is the 0xC0 header; the target is a functional
+	// (broadcast group) address rather than a single module.
+	FormatFunctional
+	// FormatNoAddress is the 0x00 header without target and source bytes,
+	// used on point-to-point links.
+	FormatNoAddress
+	// FormatCARB is the 0x40 exception-mode (CARB) header. ISO 14230-2
+	// gives it target and source bytes like the 0x80 and 0xC0 headers.
+	FormatCARB
+	// FormatBMW is BMW's KWP2000* framing: a 0x80 header with target and
+	// source, and the data length always in a separate length byte.
+	FormatBMW
+)
+
+var formatNames = map[Format]string{
+	FormatAuto:       "auto",
+	FormatPhysical:   "physical",
+	FormatFunctional: "functional",
+	FormatNoAddress:  "no-address",
+	FormatCARB:       "carb",
+	FormatBMW:        "kwp2000*",
+}
+
+func (f Format) String() string {
+	if name, ok := formatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+func (f Format) modeBits() byte {
+	switch f {
+	case FormatFunctional:
+		return 0xC0
+	case FormatNoAddress:
+		return 0x00
+	case FormatCARB:
+		return 0x40
+	default:
+		return 0x80
+	}
+}
+
+// HasAddress reports whether frames in this format carry target and
+// source bytes.
+func (f Format) HasAddress() bool {
+	return f != FormatNoAddress
+}
+
 type Frame struct {
+	Format Format
 	Target byte
 	Source byte
 	Data   []byte
@@ -25,16 +86,30 @@ func Checksum(data []byte) byte {
 	return sum
 }
 
+// BuildFrame builds a physically addressed frame with a 0x80 header.
 func BuildFrame(target, source byte, data []byte) []byte {
-	var frame []byte
+	return BuildFrameFormat(FormatPhysical, target, source, data)
+}
+
+// BuildFrameFormat builds a frame in the given header format. Target and
+// source are ignored for formats without address bytes. Data longer than
+// 63 bytes, or any data in FormatBMW, is announced with a length byte.
+// FormatAuto builds a physical frame.
+func BuildFrameFormat(format Format, target, source byte, data []byte) []byte {
+	longLength := len(data) > 63 || format == FormatBMW
 
-	if len(data) <= 63 {
-		header := byte(0x80) | byte(len(data))
-		frame = make([]byte, 0, 3+len(data)+1)
-		frame = append(frame, header, target, source)
-	} else {
-		frame = make([]byte, 0, 4+len(data)+1)
-		frame = append(frame, 0x80, target, source, byte(len(data)))
+	header := format.modeBits()
+	if !longLength {
+		header |= byte(len(data))
+	}
+
+	frame := make([]byte, 0, 5+len(data))
+	frame = append(frame, header)
+	if format.HasAddress() || format == FormatAuto {
+		frame = append(frame, target, source)
+	}
+	if longLength {
+		frame = append(frame, byte(len(data)))
 	}
 
 	frame = append(frame, data...)
@@ -42,30 +117,45 @@ func BuildFrame(target, source byte, data []byte) []byte {
 	return frame
 }
 
+// ParseFrame parses a frame in any ISO 14230 header format, detecting the
+// format from the header byte.
 func ParseFrame(raw []byte) (Frame, error) {
-	if len(raw) < 4 {
+	return ParseFrameFormat(raw, FormatAuto)
+}
+
+// ParseFrameFormat parses a frame and, unless format is FormatAuto,
+// rejects frames whose header does not match format.
+func ParseFrameFormat(raw []byte, format Format) (Frame, error) {
+	if len(raw) < 2 {
 		return Frame{}, ErrFrameTooShort
 	}
 
-	payload := raw[:len(raw)-1]
-	if Checksum(payload) != raw[len(raw)-1] {
-		return Frame{}, fmt.Errorf("%w: expected 0x%02X, got 0x%02X",
-			ErrBadChecksum, Checksum(payload), raw[len(raw)-1])
+	detected := detectFormat(raw)
+	if format != FormatAuto && !compatible(format, detected) {
+		return Frame{}, fmt.Errorf("%w: expected %s, got %s", ErrFormatMismatch, format, detected)
 	}
 
-	header := raw[0]
-	target := raw[1]
-	source := raw[2]
-
-	dataLen := int(header & 0x3F)
-	dataStart := 3
+	dataStart := 1
+	if detected.HasAddress() {
+		dataStart = 3
+	}
+	if len(raw) < dataStart+1 {
+		return Frame{}, ErrFrameTooShort
+	}
 
+	dataLen := int(raw[0] & 0x3F)
 	if dataLen == 0 {
-		if len(raw) < 5 {
+		if len(raw) < dataStart+2 {
 			return Frame{}, ErrFrameTooShort
 		}
-		dataLen = int(raw[3])
-		dataStart = 4
+		dataLen = int(raw[dataStart])
+		dataStart++
+	}
+
+	payload := raw[:len(raw)-1]
+	if Checksum(payload) != raw[len(raw)-1] {
+		return Frame{}, fmt.Errorf("%w: expected 0x%02X, got 0x%02X",
+			ErrBadChecksum, Checksum(payload), raw[len(raw)-1])
 	}
 
 	expectedTotal := dataStart + dataLen + 1
@@ -74,12 +164,57 @@ func ParseFrame(raw []byte) (Frame, error) {
 			ErrLengthMismatch, expectedTotal, len(raw))
 	}
 
-	data := make([]byte, dataLen)
-	copy(data, raw[dataStart:dataStart+dataLen])
+	frame := Frame{Format: detected, Data: make([]byte, dataLen)}
+	copy(frame.Data, raw[dataStart:dataStart+dataLen])
+	if detected.HasAddress() {
+		frame.Target = raw[1]
+		frame.Source = raw[2]
+	}
+	return frame, nil
+}
 
-	return Frame{
-		Target: target,
-		Source: source,
-		Data:   data,
-	}, nil
+// FrameLength returns the total length of the frame starting at raw[0] as
+// announced by its header, or 0 when too few bytes are present to tell.
+func FrameLength(raw []byte) int {
+	if len(raw) == 0 {
+		return 0
+	}
+	headerLen := 1
+	if detectFormat(raw).HasAddress() {
+		headerLen = 3
+	}
+	if n := int(raw[0] & 0x3F); n != 0 {
+		return headerLen + n + 1
+	}
+	if len(raw) <= headerLen {
+		return 0
+	}
+	return headerLen + 1 + int(raw[headerLen]) + 1
+}
+
+// detectFormat derives the format from the header's addressing bits. A
+// 0x80 header with a length byte under 64 can only come from a KWP2000*
+// encoder, since standard encoders put short lengths in the header.
+func detectFormat(raw []byte) Format {
+	switch raw[0] & 0xC0 {
+	case 0xC0:
+		return FormatFunctional
+	case 0x40:
+		return FormatCARB
+	case 0x00:
+		return FormatNoAddress
+	}
+	if raw[0]&0x3F == 0 && len(raw) > 3 && raw[3] <= 63 {
+		return FormatBMW
+	}
+	return FormatPhysical
+}
+
+func compatible(want, got Format) bool {
+	if want == got {
+		return true
+	}
+	// Long physical frames and KWP2000* frames share a header; a long
+	// physical frame is valid KWP2000* and vice versa for parsing.
+	return (want == FormatPhysical && got == FormatBMW) || (want == FormatBMW && got == FormatPhysical)
 }
@@ -63,3 +63,94 @@ func TestRoundTrip(t *testing.T) {
 	assert.Equal(t, byte(0xF1), parsed.Source)
 	assert.Equal(t, original, parsed.Data)
 }
+
+func TestBuildFrameFormats(t *testing.T) {
+	data := []byte{0x1A, 0x80}
+	tests := []struct {
+		format Format
+		want   []byte
+	}{
+		{FormatPhysical, []byte{0x82, 0x12, 0xF1, 0x1A, 0x80, 0x1F}},
+		{FormatFunctional, []byte{0xC2, 0x33, 0xF1, 0x1A, 0x80, 0x80}},
+		{FormatNoAddress, []byte{0x02, 0x1A, 0x80, 0x9C}},
+		{FormatCARB, []byte{0x42, 0x12, 0xF1, 0x1A, 0x80, 0xDF}},
+		{FormatBMW, []byte{0x80, 0x12, 0xF1, 0x02, 0x1A, 0x80, 0x1F}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format.String(), func(t *testing.T) {
+			target := byte(0x12)
+			if tt.format == FormatFunctional {
+				target = 0x33
+			}
+			assert.Equal(t, tt.want, BuildFrameFormat(tt.format, target, 0xF1, data))
+		})
+	}
+}
+
+func TestParseFrameAutodetectMixedCapture(t *testing.T) {
+	capture := []struct {
+		raw    []byte
+		format Format
+		target byte
+		source byte
+		data   []byte
+	}{
+		{[]byte{0x82, 0x12, 0xF1, 0x1A, 0x80, 0x1F}, FormatPhysical, 0x12, 0xF1, []byte{0x1A, 0x80}},
+		{[]byte{0xC2, 0x33, 0xF1, 0x1A, 0x80, 0x80}, FormatFunctional, 0x33, 0xF1, []byte{0x1A, 0x80}},
+		{[]byte{0x02, 0x1A, 0x80, 0x9C}, FormatNoAddress, 0x00, 0x00, []byte{0x1A, 0x80}},
+		{[]byte{0x42, 0x12, 0xF1, 0x1A, 0x80, 0xDF}, FormatCARB, 0x12, 0xF1, []byte{0x1A, 0x80}},
+		{[]byte{0x80, 0x12, 0xF1, 0x02, 0x1A, 0x80, 0x1F}, FormatBMW, 0x12, 0xF1, []byte{0x1A, 0x80}},
+		{BuildFrameFormat(FormatNoAddress, 0, 0, make([]byte, 70)), FormatNoAddress, 0x00, 0x00, make([]byte, 70)},
+	}
+
+	for _, c := range capture {
+		frame, err := ParseFrame(c.raw)
+		require.NoError(t, err, "% X", c.raw)
+		assert.Equal(t, c.format, frame.Format)
+		assert.Equal(t, c.target, frame.Target)
+		assert.Equal(t, c.source, frame.Source)
+		assert.Equal(t, c.data, frame.Data)
+	}
+}
+
+func TestParseCARBFrameWithAddresses(t *testing.T) {
+	// OBD mode 01 PID 00 from a scan tool (F1) to the CARB functional
+	// address 6A in exception-mode framing.
+	raw := []byte{0x42, 0x6A, 0xF1, 0x01, 0x00, 0x9E}
+	frame, err := ParseFrameFormat(raw, FormatCARB)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x6A), frame.Target)
+	assert.Equal(t, byte(0xF1), frame.Source)
+	assert.Equal(t, []byte{0x01, 0x00}, frame.Data)
+	assert.Equal(t, len(raw), FrameLength(raw))
+	assert.Equal(t, raw, BuildFrameFormat(FormatCARB, 0x6A, 0xF1, []byte{0x01, 0x00}))
+}
+
+func TestParseFrameFormatMismatch(t *testing.T) {
+	_, err := ParseFrameFormat([]byte{0x02, 0x1A, 0x80, 0x9C}, FormatPhysical)
+	assert.ErrorIs(t, err, ErrFormatMismatch)
+}
+
+func TestParseFrameFormatLongPhysical(t *testing.T) {
+	raw := BuildFrame(0x12, 0xF1, make([]byte, 64))
+	frame, err := ParseFrameFormat(raw, FormatPhysical)
+	require.NoError(t, err)
+	assert.Equal(t, FormatPhysical, frame.Format)
+	assert.Len(t, frame.Data, 64)
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	formats := []Format{FormatPhysical, FormatFunctional, FormatNoAddress, FormatCARB, FormatBMW}
+	for _, f := range formats {
+		for _, size := range []int{1, 63, 64, 255} {
+			data := make([]byte, size)
+			for i := range data {
+				data[i] = byte(i * 7)
+			}
+			frame, err := ParseFrameFormat(BuildFrameFormat(f, 0x12, 0xF1, data), f)
+			require.NoError(t, err, "%s/%d", f, size)
+			assert.Equal(t, data, frame.Data)
+		}
+	}
+}
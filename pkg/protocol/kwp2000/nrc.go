@@ -0,0 +1,125 @@
+package kwp2000
+
+import (
+	"errors"
+	"fmt"
+)
+
+// NRC is a KWP2000 negative response code, the third byte of a 0x7F reply.
+type NRC byte
+
+const (
+	NRCGeneralReject                         NRC = 0x10
+	NRCServiceNotSupported                   NRC = 0x11
+	NRCSubFunctionNotSupported               NRC = 0x12
+	NRCBusyRepeatRequest                     NRC = 0x21
+	NRCConditionsNotCorrect                  NRC = 0x22
+	NRCRoutineNotComplete                    NRC = 0x23
+	NRCRequestOutOfRange                     NRC = 0x31
+	NRCSecurityAccessDenied                  NRC = 0x33
+	NRCInvalidKey                            NRC = 0x35
+	NRCExceedNumberOfAttempts                NRC = 0x36
+	NRCRequiredTimeDelayNotExpired           NRC = 0x37
+	NRCDownloadNotAccepted                   NRC = 0x40
+	NRCImproperDownloadType                  NRC = 0x41
+	NRCCannotDownloadToSpecifiedAddress      NRC = 0x42
+	NRCCannotDownloadNumberOfBytesRequested  NRC = 0x43
+	NRCUploadNotAccepted                     NRC = 0x50
+	NRCImproperUploadType                    NRC = 0x51
+	NRCCannotUploadFromSpecifiedAddress      NRC = 0x52
+	NRCCannotUploadNumberOfBytesRequested    NRC = 0x53
+	NRCTransferSuspended                     NRC = 0x71
+	NRCTransferAborted                       NRC = 0x72
+	NRCIllegalAddressInBlockTransfer         NRC = 0x74
+	NRCIllegalByteCountInBlockTransfer       NRC = 0x75
+	NRCIllegalBlockTransferType              NRC = 0x76
+	NRCBlockTransferDataChecksumError        NRC = 0x77
+	NRCResponsePending                       NRC = 0x78
+	NRCIncorrectByteCountDuringBlockTransfer NRC = 0x79
+	NRCServiceNotSupportedInActiveSession    NRC = 0x80
+	NRCNoProgram                             NRC = 0x90
+)
+
+var (
+	ErrGeneralReject                         = errors.New("kwp2000: general reject")
+	ErrServiceNotSupported                   = errors.New("kwp2000: service not supported")
+	ErrSubFunctionNotSupported               = errors.New("kwp2000: sub-function not supported or invalid format")
+	ErrBusyRepeatRequest                     = errors.New("kwp2000: busy, repeat request")
+	ErrConditionsNotCorrect                  = errors.New("kwp2000: conditions not correct or request sequence error")
+	ErrRoutineNotComplete                    = errors.New("kwp2000: routine not complete")
+	ErrRequestOutOfRange                     = errors.New("kwp2000: request out of range")
+	ErrSecurityAccessDenied                  = errors.New("kwp2000: security access denied")
+	ErrInvalidKey                            = errors.New("kwp2000: invalid key")
+	ErrExceedNumberOfAttempts                = errors.New("kwp2000: exceeded number of security access attempts")
+	ErrRequiredTimeDelayNotExpired           = errors.New("kwp2000: required time delay not expired")
+	ErrDownloadNotAccepted                   = errors.New("kwp2000: download not accepted")
+	ErrImproperDownloadType                  = errors.New("kwp2000: improper download type")
+	ErrCannotDownloadToSpecifiedAddress      = errors.New("kwp2000: cannot download to specified address")
+	ErrCannotDownloadNumberOfBytesRequested  = errors.New("kwp2000: cannot download number of bytes requested")
+	ErrUploadNotAccepted                     = errors.New("kwp2000: upload not accepted")
+	ErrImproperUploadType                    = errors.New("kwp2000: improper upload type")
+	ErrCannotUploadFromSpecifiedAddress      = errors.New("kwp2000: cannot upload from specified address")
+	ErrCannotUploadNumberOfBytesRequested    = errors.New("kwp2000: cannot upload number of bytes requested")
+	ErrTransferSuspended                     = errors.New("kwp2000: transfer suspended")
+	ErrTransferAborted                       = errors.New("kwp2000: transfer aborted")
+	ErrIllegalAddressInBlockTransfer         = errors.New("kwp2000: illegal address in block transfer")
+	ErrIllegalByteCountInBlockTransfer       = errors.New("kwp2000: illegal byte count in block transfer")
+	ErrIllegalBlockTransferType              = errors.New("kwp2000: illegal block transfer type")
+	ErrBlockTransferDataChecksumError        = errors.New("kwp2000: block transfer data checksum error")
+	ErrResponsePending                       = errors.New("kwp2000: request correctly received, response pending")
+	ErrIncorrectByteCountDuringBlockTransfer = errors.New("kwp2000: incorrect byte count during block transfer")
+	ErrServiceNotSupportedInActiveSession    = errors.New("kwp2000: service not supported in active diagnostic session")
+	ErrNoProgram                             = errors.New("kwp2000: no program")
+	ErrUnknownNRC                            = errors.New("kwp2000: unknown negative response code")
+)
+
+var nrcErrors = map[NRC]error{
+	NRCGeneralReject:                         ErrGeneralReject,
+	NRCServiceNotSupported:                   ErrServiceNotSupported,
+	NRCSubFunctionNotSupported:               ErrSubFunctionNotSupported,
+	NRCBusyRepeatRequest:                     ErrBusyRepeatRequest,
+	NRCConditionsNotCorrect:                  ErrConditionsNotCorrect,
+	NRCRoutineNotComplete:                    ErrRoutineNotComplete,
+	NRCRequestOutOfRange:                     ErrRequestOutOfRange,
+	NRCSecurityAccessDenied:                  ErrSecurityAccessDenied,
+	NRCInvalidKey:                            ErrInvalidKey,
+	NRCExceedNumberOfAttempts:                ErrExceedNumberOfAttempts,
+	NRCRequiredTimeDelayNotExpired:           ErrRequiredTimeDelayNotExpired,
+	NRCDownloadNotAccepted:                   ErrDownloadNotAccepted,
+	NRCImproperDownloadType:                  ErrImproperDownloadType,
+	NRCCannotDownloadToSpecifiedAddress:      ErrCannotDownloadToSpecifiedAddress,
+	NRCCannotDownloadNumberOfBytesRequested:  ErrCannotDownloadNumberOfBytesRequested,
+	NRCUploadNotAccepted:                     ErrUploadNotAccepted,
+	NRCImproperUploadType:                    ErrImproperUploadType,
+	NRCCannotUploadFromSpecifiedAddress:      ErrCannotUploadFromSpecifiedAddress,
+	NRCCannotUploadNumberOfBytesRequested:    ErrCannotUploadNumberOfBytesRequested,
+	NRCTransferSuspended:                     ErrTransferSuspended,
+	NRCTransferAborted:                       ErrTransferAborted,
+	NRCIllegalAddressInBlockTransfer:         ErrIllegalAddressInBlockTransfer,
+	NRCIllegalByteCountInBlockTransfer:       ErrIllegalByteCountInBlockTransfer,
+	NRCIllegalBlockTransferType:              ErrIllegalBlockTransferType,
+	NRCBlockTransferDataChecksumError:        ErrBlockTransferDataChecksumError,
+	NRCResponsePending:                       ErrResponsePending,
+	NRCIncorrectByteCountDuringBlockTransfer: ErrIncorrectByteCountDuringBlockTransfer,
+	NRCServiceNotSupportedInActiveSession:    ErrServiceNotSupportedInActiveSession,
+	NRCNoProgram:                             ErrNoProgram,
+}
+
+// NegativeResponseError is returned when an ECU answers a request with a
+// 0x7F negative response. It unwraps to the sentinel error for its code,
+// so callers can test for specific conditions with errors.Is.
+type NegativeResponseError struct {
+	SID  byte
+	Code NRC
+}
+
+func (e *NegativeResponseError) Error() string {
+	return fmt.Sprintf("%v (service 0x%02X, NRC 0x%02X)", e.Unwrap(), e.SID, byte(e.Code))
+}
+
+func (e *NegativeResponseError) Unwrap() error {
+	if err, ok := nrcErrors[e.Code]; ok {
+		return err
+	}
+	return ErrUnknownNRC
+}
@@ -0,0 +1,355 @@
+package kwp2000
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Service identifiers for the KWP2000 services used by BMW modules.
+const (
+	SIDStartDiagnosticSession     byte = 0x10
+	SIDECUReset                   byte = 0x11
+	SIDClearDiagnosticInformation byte = 0x14
+	SIDReadDTCByStatus            byte = 0x18
+	SIDReadECUIdentification      byte = 0x1A
+	SIDReadDataByLocalIdentifier  byte = 0x21
+	SIDReadMemoryByAddress        byte = 0x23
+	SIDSecurityAccess             byte = 0x27
+	SIDRequestDownload            byte = 0x34
+	SIDTransferData               byte = 0x36
+	SIDRequestTransferExit        byte = 0x37
+	SIDWriteDataByLocalIdentifier byte = 0x3B
+	SIDTesterPresent              byte = 0x3E
+	SIDNegativeResponse           byte = 0x7F
+	positiveResponseOffset        byte = 0x40
+)
+
+// Diagnostic session types for StartDiagnosticSession.
+const (
+	SessionDefault     byte = 0x81
+	SessionProgramming byte = 0x85
+	SessionDevelopment byte = 0x86
+	SessionExtended    byte = 0x89
+)
+
+// Reset modes for ECUReset.
+const (
+	ResetPowerOn           byte = 0x01
+	ResetNonVolatileMemory byte = 0x82
+)
+
+// GroupAllDTCs selects every DTC group in ReadDTCByStatus and
+// ClearDiagnosticInformation.
+const GroupAllDTCs uint16 = 0xFF00
+
+var (
+	ErrUnexpectedResponse = errors.New("kwp2000: unexpected response service")
+	ErrResponseTooShort   = errors.New("kwp2000: response too short")
+)
+
+// Request is a typed KWP2000 service request. Bytes returns the service
+// data that goes into a frame, starting with the service identifier.
+type Request interface {
+	SID() byte
+	Bytes() []byte
+}
+
+type StartDiagnosticSession struct {
+	Session byte
+}
+
+func (r StartDiagnosticSession) SID() byte     { return SIDStartDiagnosticSession }
+func (r StartDiagnosticSession) Bytes() []byte { return []byte{SIDStartDiagnosticSession, r.Session} }
+
+type ECUReset struct {
+	Mode byte
+}
+
+func (r ECUReset) SID() byte     { return SIDECUReset }
+func (r ECUReset) Bytes() []byte { return []byte{SIDECUReset, r.Mode} }
+
+type ClearDiagnosticInformation struct {
+	Group uint16
+}
+
+func (r ClearDiagnosticInformation) SID() byte { return SIDClearDiagnosticInformation }
+func (r ClearDiagnosticInformation) Bytes() []byte {
+	return []byte{SIDClearDiagnosticInformation, byte(r.Group >> 8), byte(r.Group)}
+}
+
+type ReadDTCByStatus struct {
+	Status byte
+	Group  uint16
+}
+
+func (r ReadDTCByStatus) SID() byte { return SIDReadDTCByStatus }
+func (r ReadDTCByStatus) Bytes() []byte {
+	return []byte{SIDReadDTCByStatus, r.Status, byte(r.Group >> 8), byte(r.Group)}
+}
+
+type ReadECUIdentification struct {
+	Option byte
+}
+
+func (r ReadECUIdentification) SID() byte     { return SIDReadECUIdentification }
+func (r ReadECUIdentification) Bytes() []byte { return []byte{SIDReadECUIdentification, r.Option} }
+
+type ReadDataByLocalIdentifier struct {
+	ID byte
+}
+
+func (r ReadDataByLocalIdentifier) SID() byte { return SIDReadDataByLocalIdentifier }
+func (r ReadDataByLocalIdentifier) Bytes() []byte {
+	return []byte{SIDReadDataByLocalIdentifier, r.ID}
+}
+
+type WriteDataByLocalIdentifier struct {
+	ID   byte
+	Data []byte
+}
+
+func (r WriteDataByLocalIdentifier) SID() byte { return SIDWriteDataByLocalIdentifier }
+func (r WriteDataByLocalIdentifier) Bytes() []byte {
+	out := make([]byte, 0, 2+len(r.Data))
+	out = append(out, SIDWriteDataByLocalIdentifier, r.ID)
+	return append(out, r.Data...)
+}
+
+// ReadMemoryByAddress reads Size bytes starting at a 24-bit Address.
+type ReadMemoryByAddress struct {
+	Address uint32
+	Size    byte
+}
+
+func (r ReadMemoryByAddress) SID() byte { return SIDReadMemoryByAddress }
+func (r ReadMemoryByAddress) Bytes() []byte {
+	return []byte{SIDReadMemoryByAddress, byte(r.Address >> 16), byte(r.Address >> 8), byte(r.Address), r.Size}
+}
+
+// SecurityAccess requests a seed when Level is odd and sends a key when
+// Level is even (the seed level plus one).
+type SecurityAccess struct {
+	Level byte
+	Key   []byte
+}
+
+func (r SecurityAccess) SID() byte { return SIDSecurityAccess }
+func (r SecurityAccess) Bytes() []byte {
+	out := make([]byte, 0, 2+len(r.Key))
+	out = append(out, SIDSecurityAccess, r.Level)
+	return append(out, r.Key...)
+}
+
+// TesterPresent keeps a diagnostic session alive. With NoResponse the
+// ECU is asked not to answer, and Client.Do returns as soon as it is sent.
+type TesterPresent struct {
+	NoResponse bool
+}
+
+func (r TesterPresent) ExpectsResponse() bool { return !r.NoResponse }
+
+func (r TesterPresent) SID() byte { return SIDTesterPresent }
+func (r TesterPresent) Bytes() []byte {
+	if r.NoResponse {
+		return []byte{SIDTesterPresent, 0x02}
+	}
+	return []byte{SIDTesterPresent, 0x01}
+}
+
+// RequestDownload announces a download of Size bytes to a 24-bit Address.
+// Format is the data format identifier (compression/encryption nibbles).
+type RequestDownload struct {
+	Address uint32
+	Format  byte
+	Size    uint32
+}
+
+func (r RequestDownload) SID() byte { return SIDRequestDownload }
+func (r RequestDownload) Bytes() []byte {
+	return []byte{
+		SIDRequestDownload,
+		byte(r.Address >> 16), byte(r.Address >> 8), byte(r.Address),
+		r.Format,
+		byte(r.Size >> 16), byte(r.Size >> 8), byte(r.Size),
+	}
+}
+
+type TransferData struct {
+	Data []byte
+}
+
+func (r TransferData) SID() byte { return SIDTransferData }
+func (r TransferData) Bytes() []byte {
+	out := make([]byte, 0, 1+len(r.Data))
+	out = append(out, SIDTransferData)
+	return append(out, r.Data...)
+}
+
+type RequestTransferExit struct{}
+
+func (r RequestTransferExit) SID() byte     { return SIDRequestTransferExit }
+func (r RequestTransferExit) Bytes() []byte { return []byte{SIDRequestTransferExit} }
+
+// CheckResponse validates that resp is a positive response to the service
+// sid carrying at least minLen bytes after the response SID. A 0x7F reply
+// is returned as a *NegativeResponseError.
+func CheckResponse(resp []byte, sid byte, minLen int) error {
+	if len(resp) == 0 {
+		return ErrResponseTooShort
+	}
+	if resp[0] == SIDNegativeResponse {
+		if len(resp) < 3 {
+			return fmt.Errorf("%w: negative response has %d bytes", ErrResponseTooShort, len(resp))
+		}
+		return &NegativeResponseError{SID: resp[1], Code: NRC(resp[2])}
+	}
+	if resp[0] != sid+positiveResponseOffset {
+		return fmt.Errorf("%w: expected 0x%02X, got 0x%02X", ErrUnexpectedResponse, sid+positiveResponseOffset, resp[0])
+	}
+	if len(resp)-1 < minLen {
+		return fmt.Errorf("%w: service 0x%02X needs %d bytes, got %d", ErrResponseTooShort, sid, minLen, len(resp)-1)
+	}
+	return nil
+}
+
+// ParseStartDiagnosticSessionResponse returns the session the ECU entered.
+func ParseStartDiagnosticSessionResponse(resp []byte) (byte, error) {
+	if err := CheckResponse(resp, SIDStartDiagnosticSession, 1); err != nil {
+		return 0, err
+	}
+	return resp[1], nil
+}
+
+// ParseECUResetResponse returns the reset mode echoed by the ECU.
+func ParseECUResetResponse(resp []byte) (byte, error) {
+	if err := CheckResponse(resp, SIDECUReset, 0); err != nil {
+		return 0, err
+	}
+	if len(resp) > 1 {
+		return resp[1], nil
+	}
+	return 0, nil
+}
+
+// ParseClearDiagnosticInformationResponse returns the cleared DTC group.
+func ParseClearDiagnosticInformationResponse(resp []byte) (uint16, error) {
+	if err := CheckResponse(resp, SIDClearDiagnosticInformation, 2); err != nil {
+		return 0, err
+	}
+	return uint16(resp[1])<<8 | uint16(resp[2]), nil
+}
+
+// DTC is a stored diagnostic trouble code with its status byte.
+type DTC struct {
+	Code   uint16
+	Status byte
+}
+
+// ParseReadDTCByStatusResponse decodes the DTC count and the three-byte
+// code/status records that follow it.
+func ParseReadDTCByStatusResponse(resp []byte) ([]DTC, error) {
+	if err := CheckResponse(resp, SIDReadDTCByStatus, 1); err != nil {
+		return nil, err
+	}
+	count := int(resp[1])
+	records := resp[2:]
+	if len(records) < count*3 {
+		return nil, fmt.Errorf("%w: %d DTCs announced, %d bytes present", ErrResponseTooShort, count, len(records))
+	}
+	dtcs := make([]DTC, 0, count)
+	for i := 0; i < count; i++ {
+		rec := records[i*3 : i*3+3]
+		dtcs = append(dtcs, DTC{Code: uint16(rec[0])<<8 | uint16(rec[1]), Status: rec[2]})
+	}
+	return dtcs, nil
+}
+
+// ECUIdentification is the raw identification record for one option.
+type ECUIdentification struct {
+	Option byte
+	Data   []byte
+}
+
+func ParseReadECUIdentificationResponse(resp []byte) (ECUIdentification, error) {
+	if err := CheckResponse(resp, SIDReadECUIdentification, 1); err != nil {
+		return ECUIdentification{}, err
+	}
+	return ECUIdentification{Option: resp[1], Data: clone(resp[2:])}, nil
+}
+
+// LocalData is a record returned for a local identifier.
+type LocalData struct {
+	ID   byte
+	Data []byte
+}
+
+func ParseReadDataByLocalIdentifierResponse(resp []byte) (LocalData, error) {
+	if err := CheckResponse(resp, SIDReadDataByLocalIdentifier, 1); err != nil {
+		return LocalData{}, err
+	}
+	return LocalData{ID: resp[1], Data: clone(resp[2:])}, nil
+}
+
+// ParseWriteDataByLocalIdentifierResponse returns the identifier the ECU
+// acknowledged.
+func ParseWriteDataByLocalIdentifierResponse(resp []byte) (byte, error) {
+	if err := CheckResponse(resp, SIDWriteDataByLocalIdentifier, 1); err != nil {
+		return 0, err
+	}
+	return resp[1], nil
+}
+
+func ParseReadMemoryByAddressResponse(resp []byte) ([]byte, error) {
+	if err := CheckResponse(resp, SIDReadMemoryByAddress, 0); err != nil {
+		return nil, err
+	}
+	return clone(resp[1:]), nil
+}
+
+// SecurityAccessResponse carries the seed for a seed request, or the
+// access mode status for an accepted key.
+type SecurityAccessResponse struct {
+	Level byte
+	Data  []byte
+}
+
+func ParseSecurityAccessResponse(resp []byte) (SecurityAccessResponse, error) {
+	if err := CheckResponse(resp, SIDSecurityAccess, 1); err != nil {
+		return SecurityAccessResponse{}, err
+	}
+	return SecurityAccessResponse{Level: resp[1], Data: clone(resp[2:])}, nil
+}
+
+func ParseTesterPresentResponse(resp []byte) error {
+	return CheckResponse(resp, SIDTesterPresent, 0)
+}
+
+// ParseRequestDownloadResponse returns the maximum number of bytes the ECU
+// accepts per TransferData request. ISO 14230 sends a single length byte;
+// BMW flash loaders send two, big-endian.
+func ParseRequestDownloadResponse(resp []byte) (int, error) {
+	if err := CheckResponse(resp, SIDRequestDownload, 1); err != nil {
+		return 0, err
+	}
+	if len(resp) >= 3 {
+		return int(resp[1])<<8 | int(resp[2]), nil
+	}
+	return int(resp[1]), nil
+}
+
+func ParseTransferDataResponse(resp []byte) ([]byte, error) {
+	if err := CheckResponse(resp, SIDTransferData, 0); err != nil {
+		return nil, err
+	}
+	return clone(resp[1:]), nil
+}
+
+func ParseRequestTransferExitResponse(resp []byte) error {
+	return CheckResponse(resp, SIDRequestTransferExit, 0)
+}
+
+func clone(b []byte) []byte {
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
@@ -0,0 +1,130 @@
+package kwp2000
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		req  Request
+		want []byte
+	}{
+		{"StartDiagnosticSession", StartDiagnosticSession{Session: SessionProgramming}, []byte{0x10, 0x85}},
+		{"ECUReset", ECUReset{Mode: ResetPowerOn}, []byte{0x11, 0x01}},
+		{"ClearDiagnosticInformation", ClearDiagnosticInformation{Group: GroupAllDTCs}, []byte{0x14, 0xFF, 0x00}},
+		{"ReadDTCByStatus", ReadDTCByStatus{Status: 0x02, Group: GroupAllDTCs}, []byte{0x18, 0x02, 0xFF, 0x00}},
+		{"ReadECUIdentification", ReadECUIdentification{Option: 0x80}, []byte{0x1A, 0x80}},
+		{"ReadDataByLocalIdentifier", ReadDataByLocalIdentifier{ID: 0x01}, []byte{0x21, 0x01}},
+		{"WriteDataByLocalIdentifier", WriteDataByLocalIdentifier{ID: 0x01, Data: []byte{0xAA, 0xBB}}, []byte{0x3B, 0x01, 0xAA, 0xBB}},
+		{"ReadMemoryByAddress", ReadMemoryByAddress{Address: 0x123456, Size: 0x10}, []byte{0x23, 0x12, 0x34, 0x56, 0x10}},
+		{"SecurityAccessSeed", SecurityAccess{Level: 0x01}, []byte{0x27, 0x01}},
+		{"SecurityAccessKey", SecurityAccess{Level: 0x02, Key: []byte{0x12, 0x34}}, []byte{0x27, 0x02, 0x12, 0x34}},
+		{"TesterPresent", TesterPresent{}, []byte{0x3E, 0x01}},
+		{"TesterPresentNoResponse", TesterPresent{NoResponse: true}, []byte{0x3E, 0x02}},
+		{"RequestDownload", RequestDownload{Address: 0x010000, Format: 0x00, Size: 0x008000}, []byte{0x34, 0x01, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00}},
+		{"TransferData", TransferData{Data: []byte{0x01, 0x02}}, []byte{0x36, 0x01, 0x02}},
+		{"RequestTransferExit", RequestTransferExit{}, []byte{0x37}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.req.Bytes())
+			assert.Equal(t, tt.want[0], tt.req.SID())
+		})
+	}
+}
+
+func TestParseStartDiagnosticSessionResponse(t *testing.T) {
+	session, err := ParseStartDiagnosticSessionResponse([]byte{0x50, 0x89})
+	require.NoError(t, err)
+	assert.Equal(t, SessionExtended, session)
+}
+
+func TestParseReadDTCByStatusResponse(t *testing.T) {
+	resp := []byte{0x58, 0x02, 0x29, 0x4C, 0x24, 0x2A, 0xAF, 0x60}
+	dtcs, err := ParseReadDTCByStatusResponse(resp)
+	require.NoError(t, err)
+	assert.Equal(t, []DTC{{Code: 0x294C, Status: 0x24}, {Code: 0x2AAF, Status: 0x60}}, dtcs)
+}
+
+func TestParseReadDTCByStatusResponseTruncated(t *testing.T) {
+	_, err := ParseReadDTCByStatusResponse([]byte{0x58, 0x02, 0x29, 0x4C, 0x24})
+	assert.ErrorIs(t, err, ErrResponseTooShort)
+}
+
+func TestParseResponses(t *testing.T) {
+	ident, err := ParseReadECUIdentificationResponse([]byte{0x5A, 0x80, 0x37, 0x35, 0x30})
+	require.NoError(t, err)
+	assert.Equal(t, ECUIdentification{Option: 0x80, Data: []byte("750")}, ident)
+
+	local, err := ParseReadDataByLocalIdentifierResponse([]byte{0x61, 0x01, 0xDE, 0xAD})
+	require.NoError(t, err)
+	assert.Equal(t, LocalData{ID: 0x01, Data: []byte{0xDE, 0xAD}}, local)
+
+	id, err := ParseWriteDataByLocalIdentifierResponse([]byte{0x7B, 0x01})
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x01), id)
+
+	mem, err := ParseReadMemoryByAddressResponse([]byte{0x63, 0x01, 0x02, 0x03})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x01, 0x02, 0x03}, mem)
+
+	seed, err := ParseSecurityAccessResponse([]byte{0x67, 0x01, 0x4F, 0x11})
+	require.NoError(t, err)
+	assert.Equal(t, SecurityAccessResponse{Level: 0x01, Data: []byte{0x4F, 0x11}}, seed)
+
+	group, err := ParseClearDiagnosticInformationResponse([]byte{0x54, 0xFF, 0x00})
+	require.NoError(t, err)
+	assert.Equal(t, GroupAllDTCs, group)
+
+	block, err := ParseRequestDownloadResponse([]byte{0x74, 0x82})
+	require.NoError(t, err)
+	assert.Equal(t, 0x82, block)
+
+	block, err = ParseRequestDownloadResponse([]byte{0x74, 0x01, 0x02})
+	require.NoError(t, err)
+	assert.Equal(t, 0x0102, block)
+
+	assert.NoError(t, ParseTesterPresentResponse([]byte{0x7E}))
+	assert.NoError(t, ParseRequestTransferExitResponse([]byte{0x77}))
+}
+
+func TestCheckResponseUnexpectedService(t *testing.T) {
+	_, err := ParseStartDiagnosticSessionResponse([]byte{0x51, 0x01})
+	assert.ErrorIs(t, err, ErrUnexpectedResponse)
+}
+
+func TestNegativeResponseMapping(t *testing.T) {
+	tests := []struct {
+		code NRC
+		want error
+	}{
+		{NRCGeneralReject, ErrGeneralReject},
+		{NRCServiceNotSupported, ErrServiceNotSupported},
+		{NRCConditionsNotCorrect, ErrConditionsNotCorrect},
+		{NRCRequestOutOfRange, ErrRequestOutOfRange},
+		{NRCSecurityAccessDenied, ErrSecurityAccessDenied},
+		{NRCInvalidKey, ErrInvalidKey},
+		{NRCExceedNumberOfAttempts, ErrExceedNumberOfAttempts},
+		{NRCRequiredTimeDelayNotExpired, ErrRequiredTimeDelayNotExpired},
+		{NRCBlockTransferDataChecksumError, ErrBlockTransferDataChecksumError},
+		{NRCResponsePending, ErrResponsePending},
+		{NRCServiceNotSupportedInActiveSession, ErrServiceNotSupportedInActiveSession},
+		{NRC(0xFE), ErrUnknownNRC},
+	}
+
+	for _, tt := range tests {
+		err := CheckResponse([]byte{0x7F, 0x27, byte(tt.code)}, SIDSecurityAccess, 0)
+		assert.ErrorIs(t, err, tt.want, "NRC 0x%02X", byte(tt.code))
+
+		var nrErr *NegativeResponseError
+		require.True(t, errors.As(err, &nrErr))
+		assert.Equal(t, byte(0x27), nrErr.SID)
+		assert.Equal(t, tt.code, nrErr.Code)
+	}
+}
@@ -0,0 +1,223 @@
+package safety
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrVoltageOutOfRange  = errors.New("safety: battery voltage left the safe range")
+	ErrVoltageUnavailable = errors.New("safety: battery voltage could not be read")
+)
+
+// VoltageSource is anything that can report battery voltage, normally the
+// transport.
+type VoltageSource interface {
+	ReadVoltage() (float64, error)
+}
+
+type MonitorConfig struct {
+	// Interval between samples.
+	Interval time.Duration
+	// Hysteresis is how far above the warning level voltage must climb
+	// before a warning clears, so a battery hovering at the threshold does
+	// not flap.
+	Hysteresis float64
+	// Debounce is how many consecutive samples must agree before the status
+	// changes. It also bounds consecutive read failures: that many in a row
+	// cancel the operation, since voltage can no longer be vouched for.
+	Debounce int
+	// Policy supplies the thresholds for Target; nil means
+	// DefaultVoltagePolicy.
+	Policy *VoltagePolicy
+	Target Target
+	// OnChange, if set, is called from the sampling goroutine whenever the
+	// debounced status changes.
+	OnChange func(VoltageResult)
+}
+
+var DefaultMonitorConfig = MonitorConfig{
+	Interval:   250 * time.Millisecond,
+	Hysteresis: 0.2,
+	Debounce:   3,
+}
+
+// VoltageMonitor samples battery voltage for the duration of an operation
+// and cancels the operation's context once voltage stays below the block
+// level or above the over-voltage limit. Writers check the context between
+// frames, so a write or flash stops at a block boundary rather than halfway
+// through a frame.
+type VoltageMonitor struct {
+	src VoltageSource
+	op  OperationType
+	cfg MonitorConfig
+
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+	stop   chan struct{}
+	once   sync.Once
+
+	mu        sync.Mutex
+	status    VoltageStatus
+	last      VoltageResult
+	min       float64
+	samples   int
+	candidate VoltageStatus
+	streak    int
+	failures  int
+}
+
+// MonitorVoltage starts sampling src and returns a context derived from ctx
+// that is cancelled when voltage leaves the allowed range for op.
+// context.Cause on the returned context then reports ErrVoltageOutOfRange or
+// ErrVoltageUnavailable. Stop must be called when the operation ends.
+func MonitorVoltage(ctx context.Context, src VoltageSource, op OperationType, cfg MonitorConfig) (context.Context, *VoltageMonitor) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultMonitorConfig.Interval
+	}
+	if cfg.Debounce <= 0 {
+		cfg.Debounce = 1
+	}
+	if cfg.Policy == nil {
+		cfg.Policy = DefaultVoltagePolicy()
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	m := &VoltageMonitor{
+		src:    src,
+		op:     op,
+		cfg:    cfg,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		status: VoltageOK,
+	}
+	go m.run(ctx)
+	return ctx, m
+}
+
+// Stop ends sampling and cancels the monitored context, releasing its
+// resources; a voltage cause recorded earlier is kept. It does not cancel
+// the context's parent.
+func (m *VoltageMonitor) Stop() {
+	m.once.Do(func() { close(m.stop) })
+	<-m.done
+	m.cancel(context.Canceled)
+}
+
+// Status returns the debounced status and the most recent sample.
+func (m *VoltageMonitor) Status() VoltageResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.last
+	r.Status = m.status
+	return r
+}
+
+// Min returns the lowest voltage sampled so far.
+func (m *VoltageMonitor) Min() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.min
+}
+
+func (m *VoltageMonitor) run(ctx context.Context) {
+	defer close(m.done)
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		v, err := m.src.ReadVoltage()
+		if cause := m.observe(v, err); cause != nil {
+			m.cancel(cause)
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// observe feeds one sample into the debouncer and returns the cancellation
+// cause once the operation has to stop.
+func (m *VoltageMonitor) observe(v float64, err error) error {
+	m.mu.Lock()
+	var changed *VoltageResult
+	defer func() {
+		m.mu.Unlock()
+		if changed != nil && m.cfg.OnChange != nil {
+			m.cfg.OnChange(*changed)
+		}
+	}()
+
+	if err != nil {
+		m.failures++
+		if m.failures >= m.cfg.Debounce {
+			return fmt.Errorf("%w: %d reads failed in a row: %w", ErrVoltageUnavailable, m.failures, err)
+		}
+		return nil
+	}
+	m.failures = 0
+	if m.samples == 0 || v < m.min {
+		m.min = v
+	}
+	m.samples++
+
+	t, _ := m.cfg.Policy.Limits(m.op, m.cfg.Target)
+	next := m.classify(v, t)
+	m.last = VoltageResult{Status: next, Voltage: v, Message: monitorMessage(next, v, t)}
+
+	if next == m.status {
+		m.streak = 0
+		return nil
+	}
+	if next != m.candidate {
+		m.candidate, m.streak = next, 0
+	}
+	m.streak++
+	if m.streak < m.cfg.Debounce {
+		return nil
+	}
+
+	m.status, m.streak = next, 0
+	r := m.last
+	changed = &r
+	if next == VoltageBlocked {
+		return fmt.Errorf("%w: %s", ErrVoltageOutOfRange, r.Message)
+	}
+	return nil
+}
+
+func (m *VoltageMonitor) classify(v float64, t Thresholds) VoltageStatus {
+	switch {
+	case v < t.Block, t.Max > 0 && v > t.Max:
+		return VoltageBlocked
+	case v < t.Warning:
+		return VoltageWarning
+	case m.status != VoltageOK && v < t.Warning+m.cfg.Hysteresis:
+		return VoltageWarning
+	default:
+		return VoltageOK
+	}
+}
+
+func monitorMessage(s VoltageStatus, v float64, t Thresholds) string {
+	switch {
+	case s == VoltageBlocked && v >= t.Block:
+		return fmt.Sprintf("Battery voltage %.1fV rose above maximum %.1fV — operation stopped", v, t.Max)
+	case s == VoltageBlocked:
+		return fmt.Sprintf("Battery voltage %.1fV fell below minimum %.1fV — operation stopped", v, t.Block)
+	case s == VoltageWarning:
+		return fmt.Sprintf("Battery voltage %.1fV is low (recommended: %.1fV+)", v, t.Warning)
+	default:
+		return fmt.Sprintf("Battery voltage %.1fV OK", v)
+	}
+}
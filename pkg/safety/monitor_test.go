@@ -0,0 +1,137 @@
+package safety
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sequenceSource replays voltages in order and then repeats the last one.
+type sequenceSource struct {
+	mu      sync.Mutex
+	volts   []float64
+	err     error
+	samples int
+}
+
+func (s *sequenceSource) ReadVoltage() (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples++
+	if s.err != nil {
+		return 0, s.err
+	}
+	v := s.volts[0]
+	if len(s.volts) > 1 {
+		s.volts = s.volts[1:]
+	}
+	return v, nil
+}
+
+func fastConfig() MonitorConfig {
+	cfg := DefaultMonitorConfig
+	cfg.Interval = time.Millisecond
+	return cfg
+}
+
+func TestMonitorCancelsOnSustainedDrop(t *testing.T) {
+	src := &sequenceSource{volts: []float64{12.8, 12.7, 11.5}}
+	ctx, m := MonitorVoltage(context.Background(), src, OpCoding, fastConfig())
+	defer m.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor did not cancel")
+	}
+	assert.ErrorIs(t, context.Cause(ctx), ErrVoltageOutOfRange)
+	assert.Contains(t, context.Cause(ctx).Error(), "11.5")
+	assert.Equal(t, VoltageBlocked, m.Status().Status)
+	assert.Equal(t, 11.5, m.Min())
+}
+
+func TestMonitorIgnoresSingleDip(t *testing.T) {
+	src := &sequenceSource{volts: []float64{12.8, 11.0, 12.8}}
+	ctx, m := MonitorVoltage(context.Background(), src, OpCoding, fastConfig())
+
+	require.Eventually(t, func() bool {
+		src.mu.Lock()
+		defer src.mu.Unlock()
+		return src.samples > 10
+	}, 5*time.Second, time.Millisecond)
+	m.Stop()
+
+	// Stop releases the context without a voltage cause.
+	assert.ErrorIs(t, context.Cause(ctx), context.Canceled)
+	assert.NotErrorIs(t, context.Cause(ctx), ErrVoltageOutOfRange)
+	assert.Equal(t, VoltageOK, m.Status().Status)
+	assert.Equal(t, 11.0, m.Min())
+}
+
+func TestMonitorCancelsWhenVoltageUnreadable(t *testing.T) {
+	src := &sequenceSource{err: errors.New("adapter unplugged")}
+	ctx, m := MonitorVoltage(context.Background(), src, OpFlash, fastConfig())
+	defer m.Stop()
+
+	<-ctx.Done()
+	m.Stop()
+	assert.ErrorIs(t, context.Cause(ctx), ErrVoltageUnavailable, "Stop keeps the earlier cause")
+}
+
+func TestMonitorStopsWithParent(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	src := &sequenceSource{volts: []float64{12.8}}
+	ctx, m := MonitorVoltage(parent, src, OpCoding, fastConfig())
+
+	cancel()
+	m.Stop()
+	assert.ErrorIs(t, context.Cause(ctx), context.Canceled)
+}
+
+func TestMonitorDebounceAndHysteresis(t *testing.T) {
+	var changes []VoltageStatus
+	cfg := DefaultMonitorConfig
+	cfg.Policy = DefaultVoltagePolicy()
+	cfg.OnChange = func(r VoltageResult) { changes = append(changes, r.Status) }
+	m := &VoltageMonitor{op: OpCoding, cfg: cfg, status: VoltageOK}
+
+	feed := func(volts ...float64) {
+		for _, v := range volts {
+			require.NoError(t, m.observe(v, nil))
+		}
+	}
+
+	feed(12.3, 12.3)
+	assert.Equal(t, VoltageOK, m.Status().Status, "two samples do not make a warning")
+	feed(12.3)
+	assert.Equal(t, VoltageWarning, m.Status().Status)
+
+	// Back above 12.5V but inside the hysteresis band: still a warning.
+	feed(12.6, 12.6, 12.6)
+	assert.Equal(t, VoltageWarning, m.Status().Status)
+
+	feed(12.8, 12.8, 12.8)
+	assert.Equal(t, VoltageOK, m.Status().Status)
+
+	// Dips interrupted by a good sample restart the count.
+	feed(11.5, 11.5, 12.8, 11.5, 11.5)
+	assert.Equal(t, VoltageOK, m.Status().Status)
+	assert.ErrorIs(t, m.observe(11.5, nil), ErrVoltageOutOfRange)
+
+	assert.Equal(t, []VoltageStatus{VoltageWarning, VoltageOK, VoltageBlocked}, changes)
+}
+
+func TestMonitorCancelsOnOverVoltage(t *testing.T) {
+	src := &sequenceSource{volts: []float64{13.8, 15.6}}
+	ctx, m := MonitorVoltage(context.Background(), src, OpFlash, fastConfig())
+	defer m.Stop()
+
+	<-ctx.Done()
+	assert.ErrorIs(t, context.Cause(ctx), ErrVoltageOutOfRange)
+	assert.Contains(t, context.Cause(ctx).Error(), "above maximum")
+}
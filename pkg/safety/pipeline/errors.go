@@ -0,0 +1,74 @@
+package pipeline
+
+import "fmt"
+
+// StageError is the failure of one pipeline stage. Guidance tells the user
+// what state the module is in and what to do next.
+type StageError struct {
+	Stage    Stage
+	Err      error
+	Guidance string
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("pipeline: %s stage failed: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyError is a read-back that differs from what was written. The module
+// must be treated as holding unknown data until it is restored.
+type VerifyError struct {
+	Expected []byte
+	Actual   []byte
+	// Offsets lists the differing byte positions; a length difference
+	// counts from the end of the shorter slice.
+	Offsets []int
+}
+
+func newVerifyError(expected, actual []byte) *VerifyError {
+	e := &VerifyError{Expected: clone(expected), Actual: clone(actual)}
+	for i := 0; i < max(len(expected), len(actual)); i++ {
+		if i >= len(expected) || i >= len(actual) || expected[i] != actual[i] {
+			e.Offsets = append(e.Offsets, i)
+		}
+	}
+	return e
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("%v: %d of %d bytes differ, first at offset %d",
+		ErrVerifyMismatch, len(e.Offsets), len(e.Expected), e.Offsets[0])
+}
+
+func (e *VerifyError) Unwrap() error {
+	return ErrVerifyMismatch
+}
+
+func guidance(s Stage, req WriteRequest) string {
+	switch s {
+	case StageVoltage:
+		return "Nothing was written. Connect a battery charger, wait for the voltage to settle and try again."
+	case StageBackup:
+		return "Nothing was written. The current data could not be backed up; fix the connection or backup storage before retrying."
+	case StageValidate:
+		return "Nothing was written. Review the flagged values before trying again."
+	case StageConfirm:
+		return "Nothing was written."
+	case StageWrite:
+		return fmt.Sprintf("The write to %s may be incomplete. Keep the ignition on and the charger connected, "+
+			"then restore the backup of %s %s saved before this write.", req.Module, req.Chassis, req.Module)
+	case StageVerify:
+		return fmt.Sprintf("%s does not hold the data that was written. Do not drive the car. "+
+			"Restore the backup of %s %s saved before this write and verify it again.", req.Module, req.Chassis, req.Module)
+	}
+	return ""
+}
+
+func clone(b []byte) []byte {
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
@@ -0,0 +1,391 @@
+// Package pipeline runs every write to a module through the six safety
+// stages of the design: voltage, backup, validate, confirm, write and
+// verify. Stages run in order, each one must pass before the next starts,
+// and there is no way to skip one.
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alexcatdad/bavarix/pkg/audit"
+	"github.com/alexcatdad/bavarix/pkg/safety"
+	"github.com/alexcatdad/bavarix/pkg/safety/vault"
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+type Stage int
+
+const (
+	StageVoltage Stage = iota
+	StageBackup
+	StageValidate
+	StageConfirm
+	StageWrite
+	StageVerify
+)
+
+var stageNames = [...]string{"voltage", "backup", "validate", "confirm", "write", "verify"}
+
+func (s Stage) String() string {
+	if int(s) < len(stageNames) {
+		return stageNames[s]
+	}
+	return fmt.Sprintf("Stage(%d)", int(s))
+}
+
+var (
+	ErrIncomplete     = errors.New("pipeline: required step not configured")
+	ErrWriteBlocked   = errors.New("pipeline: adapter does not support writes")
+	ErrVoltage        = errors.New("pipeline: battery voltage does not allow this operation")
+	ErrDeclined       = errors.New("pipeline: change was not confirmed")
+	ErrVerifyMismatch = errors.New("pipeline: read-back does not match written data")
+)
+
+// WriteRequest describes one write to one module.
+type WriteRequest struct {
+	Chassis   string
+	Module    string
+	Version   string
+	Operation safety.OperationType
+	Data      []byte
+	// Metadata is stored with the stage 1 backup. An empty Operation is
+	// filled in from the request.
+	Metadata vault.Metadata
+}
+
+func (r WriteRequest) target() safety.Target {
+	return safety.Target{Chassis: r.Chassis, Module: r.Module}
+}
+
+// Change is what validation and confirmation look at: the request, the
+// module's current data and anything earlier stages flagged.
+type Change struct {
+	Request  WriteRequest
+	Old      []byte
+	Warnings []string
+}
+
+type (
+	// ReadFunc reads the module's current data for the request.
+	ReadFunc func(ctx context.Context, req WriteRequest) ([]byte, error)
+	// ValidateFunc checks the new data; it returns warnings to show the
+	// user, or an error to block the write.
+	ValidateFunc func(ctx context.Context, c Change) ([]string, error)
+	// ConfirmFunc asks the user to approve the change.
+	ConfirmFunc func(ctx context.Context, c Change) (bool, error)
+	// WriteFunc sends the new data to the module. It should check ctx
+	// between frames so a voltage drop stops it at a safe boundary.
+	WriteFunc func(ctx context.Context, req WriteRequest) error
+	// IdentifyFunc reads the identity of the connected module.
+	IdentifyFunc func(ctx context.Context) (Identity, error)
+)
+
+type EventStatus string
+
+const (
+	EventStarted EventStatus = "started"
+	EventPassed  EventStatus = "passed"
+	EventWarning EventStatus = "warning"
+	EventFailed  EventStatus = "failed"
+)
+
+// Event reports progress through one stage.
+type Event struct {
+	Stage   Stage
+	Status  EventStatus
+	Time    time.Time
+	Message string
+	Err     error
+}
+
+// Pipeline holds the steps for writes to a connected module. Transport,
+// Vault, Read, Validate, Confirm and Write are required; Verify defaults to
+// Read.
+type Pipeline struct {
+	Transport transport.Transport
+	Vault     *vault.Vault
+	// Policy decides the voltage stage; nil uses the default policy.
+	Policy *safety.VoltagePolicy
+	// Monitor, when set, keeps sampling voltage during the write stage and
+	// cancels the write if it leaves the allowed range.
+	Monitor *safety.MonitorConfig
+
+	Read     ReadFunc
+	Validate ValidateFunc
+	Confirm  ConfirmFunc
+	Write    WriteFunc
+	Verify   ReadFunc
+	// Identify is only needed by Rollback.
+	Identify IdentifyFunc
+	// AllowUnidentified lets Rollback restore backups that did not record
+	// the module's hardware number or coding index, such as those taken
+	// with vault.Save.
+	AllowUnidentified bool
+
+	// OnEvent receives every event as it happens.
+	OnEvent func(Event)
+
+	// Audit, when set, receives one record per run, whatever its outcome,
+	// attributed to Actor (default audit.DefaultActor). It is appended in
+	// the same vault transaction as a "run" record in the vault's own audit
+	// table, and the two name each other by backup ID and sequence number.
+	// With an encrypted vault the record holds the vault's VIN index
+	// instead of the VIN.
+	Audit *audit.Log
+	Actor string
+
+	now func() time.Time
+}
+
+// Result is the record of a pipeline run, complete or not.
+type Result struct {
+	Voltage  safety.Decision
+	BackupID int64
+	Backup   []byte
+	Warnings []string
+	Events   []Event
+}
+
+type run struct {
+	p   *Pipeline
+	res *Result
+}
+
+// Run executes the pipeline for req. It returns nil only when the module
+// has been written and the read-back matches; any failure comes back as a
+// *StageError naming the stage and what to do next.
+func (p *Pipeline) Run(ctx context.Context, req WriteRequest) (*Result, error) {
+	r := &run{p: p, res: &Result{}}
+	if err := p.check(); err != nil {
+		return r.res, err
+	}
+
+	err := r.stages(ctx, req)
+	if aerr := r.audit(req, err); aerr != nil && err == nil {
+		err = fmt.Errorf("pipeline: module was written but the audit record failed: %w", aerr)
+	}
+	return r.res, err
+}
+
+func (r *run) stages(ctx context.Context, req WriteRequest) error {
+	stages := []func(context.Context, WriteRequest) (string, error){
+		r.voltage, r.backup, r.validate, r.confirm, r.write, r.verify,
+	}
+	for i, stage := range stages {
+		s := Stage(i)
+		r.emit(s, EventStarted, "", nil)
+		if err := ctx.Err(); err != nil {
+			return r.fail(s, req, err)
+		}
+		msg, err := stage(ctx, req)
+		if err != nil {
+			return r.fail(s, req, err)
+		}
+		status := EventPassed
+		if s == StageVoltage && r.res.Voltage.Status == safety.VoltageWarning ||
+			s == StageValidate && len(r.res.Warnings) > 0 {
+			status = EventWarning
+		}
+		r.emit(s, status, msg, nil)
+	}
+	return nil
+}
+
+// audit records the run's outcome. Runs that stopped before the write
+// stage are "blocked": the module was not touched.
+func (r *run) audit(req WriteRequest, err error) error {
+	if r.p.Audit == nil {
+		return nil
+	}
+	op := req.Metadata.Operation
+	if op == "" {
+		op = req.Operation.String()
+	}
+	rec := audit.Record{
+		Actor:     r.p.Actor,
+		VIN:       req.Metadata.VIN,
+		Chassis:   req.Chassis,
+		Module:    req.Module,
+		Operation: op,
+		Voltage:   r.res.Voltage.Voltage,
+		BackupID:  r.res.BackupID,
+		Outcome:   audit.OutcomeSuccess,
+	}
+	if r.res.Backup != nil {
+		rec.BeforeSHA256 = audit.HashData(r.res.Backup)
+	}
+
+	var se *StageError
+	var ve *VerifyError
+	switch {
+	case err == nil:
+		rec.AfterSHA256 = audit.HashData(req.Data)
+	case errors.As(err, &se) && se.Stage < StageWrite:
+		rec.Outcome, rec.Detail = audit.OutcomeBlocked, err.Error()
+	default:
+		rec.Outcome, rec.Detail = audit.OutcomeFailure, err.Error()
+		if errors.As(err, &ve) {
+			rec.AfterSHA256 = audit.HashData(ve.Actual)
+		}
+	}
+	if r.p.Vault.Encrypted() {
+		rec.VIN = r.p.Vault.VINIndex(rec.VIN)
+	}
+	return r.p.Vault.RecordRun(r.res.BackupID, func() (string, error) {
+		stored, err := r.p.Audit.Append(rec)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %s: %s, audit log seq %d", req.Chassis, req.Module, op, stored.Outcome, stored.Seq), nil
+	})
+}
+
+func (p *Pipeline) check() error {
+	var missing []string
+	for _, step := range []struct {
+		name string
+		ok   bool
+	}{
+		{"transport", p.Transport != nil},
+		{"vault", p.Vault != nil},
+		{"read", p.Read != nil},
+		{"validate", p.Validate != nil},
+		{"confirm", p.Confirm != nil},
+		{"write", p.Write != nil},
+	} {
+		if !step.ok {
+			missing = append(missing, step.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %v", ErrIncomplete, missing)
+	}
+	return nil
+}
+
+func (r *run) voltage(ctx context.Context, req WriteRequest) (string, error) {
+	if !r.p.Transport.SupportsWrite() {
+		return "", ErrWriteBlocked
+	}
+	v, err := r.p.Transport.ReadVoltage()
+	if err != nil {
+		return "", fmt.Errorf("pipeline: reading battery voltage: %w", err)
+	}
+
+	policy := r.p.Policy
+	if policy == nil {
+		policy = safety.DefaultVoltagePolicy()
+	}
+	d := policy.Check(v, req.Operation, req.target())
+	r.res.Voltage = d
+	if d.Status == safety.VoltageBlocked {
+		return "", fmt.Errorf("%w: %s", ErrVoltage, d.Explain())
+	}
+	return d.Explain(), nil
+}
+
+func (r *run) backup(ctx context.Context, req WriteRequest) (string, error) {
+	old, err := r.p.Read(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("pipeline: reading current data: %w", err)
+	}
+	meta := req.Metadata
+	if meta.Operation == "" {
+		meta.Operation = req.Operation.String()
+	}
+	id, err := r.p.Vault.SaveWithMetadata(req.Chassis, req.Module, req.Version, old, meta)
+	if err != nil {
+		return "", err
+	}
+	r.res.BackupID, r.res.Backup = id, old
+	return fmt.Sprintf("saved %d bytes of %s %s", len(old), req.Chassis, req.Module), nil
+}
+
+func (r *run) change(req WriteRequest) Change {
+	warnings := r.res.Warnings
+	if r.res.Voltage.Status == safety.VoltageWarning {
+		warnings = append([]string{r.res.Voltage.Message}, warnings...)
+	}
+	return Change{Request: req, Old: r.res.Backup, Warnings: warnings}
+}
+
+func (r *run) validate(ctx context.Context, req WriteRequest) (string, error) {
+	warnings, err := r.p.Validate(ctx, r.change(req))
+	if err != nil {
+		return "", err
+	}
+	r.res.Warnings = append(r.res.Warnings, warnings...)
+	return fmt.Sprintf("%d warning(s)", len(warnings)), nil
+}
+
+func (r *run) confirm(ctx context.Context, req WriteRequest) (string, error) {
+	ok, err := r.p.Confirm(ctx, r.change(req))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrDeclined
+	}
+	return "approved", nil
+}
+
+func (r *run) write(ctx context.Context, req WriteRequest) (string, error) {
+	if r.p.Monitor != nil {
+		cfg := *r.p.Monitor
+		if cfg.Policy == nil {
+			cfg.Policy = r.p.Policy
+		}
+		cfg.Target = req.target()
+		var m *safety.VoltageMonitor
+		ctx, m = safety.MonitorVoltage(ctx, r.p.Transport, req.Operation, cfg)
+		defer m.Stop()
+	}
+
+	if err := r.p.Write(ctx, req); err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return "", fmt.Errorf("%w (%w)", err, cause)
+		}
+		return "", err
+	}
+	if cause := context.Cause(ctx); cause != nil {
+		return "", cause
+	}
+	return fmt.Sprintf("wrote %d bytes", len(req.Data)), nil
+}
+
+func (r *run) verify(ctx context.Context, req WriteRequest) (string, error) {
+	read := r.p.Verify
+	if read == nil {
+		read = r.p.Read
+	}
+	got, err := read(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("pipeline: reading back: %w", err)
+	}
+	if !bytes.Equal(got, req.Data) {
+		return "", newVerifyError(req.Data, got)
+	}
+	return "read-back matches", nil
+}
+
+func (r *run) emit(s Stage, status EventStatus, msg string, err error) {
+	now := time.Now
+	if r.p.now != nil {
+		now = r.p.now
+	}
+	e := Event{Stage: s, Status: status, Time: now(), Message: msg, Err: err}
+	r.res.Events = append(r.res.Events, e)
+	if r.p.OnEvent != nil {
+		r.p.OnEvent(e)
+	}
+}
+
+func (r *run) fail(s Stage, req WriteRequest, err error) error {
+	se := &StageError{Stage: s, Err: err, Guidance: guidance(s, req)}
+	r.emit(s, EventFailed, se.Guidance, err)
+	return se
+}
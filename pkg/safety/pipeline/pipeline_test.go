@@ -0,0 +1,368 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/audit"
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+	"github.com/alexcatdad/bavarix/pkg/safety"
+	"github.com/alexcatdad/bavarix/pkg/safety/vault"
+	"github.com/alexcatdad/bavarix/pkg/sim"
+)
+
+type fixture struct {
+	bus       *sim.Bus
+	coding    *sim.CodingMemory
+	vault     *vault.Vault
+	pipeline  *Pipeline
+	events    []Event
+	confirmed []Change
+}
+
+func original() []byte {
+	return bytes.Repeat([]byte{0x11}, 16)
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	f := &fixture{coding: sim.NewCodingMemory(append(make([]byte, 16), original()...))}
+	f.bus = sim.NewBus(&sim.Module{
+		Address:  0x12,
+		Protocol: sim.ProtocolKWP2000,
+		Handlers: []sim.Handler{f.coding},
+	})
+	require.NoError(t, f.bus.Connect())
+
+	v, err := vault.Open(filepath.Join(t.TempDir(), "vault.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { v.Close() })
+	f.vault = v
+
+	client := kwp2000.NewClient(f.bus, 0x12, 0xF1)
+	f.pipeline = &Pipeline{
+		Transport: f.bus,
+		Vault:     v,
+		Read: func(ctx context.Context, req WriteRequest) ([]byte, error) {
+			resp, err := client.Do(kwp2000.ReadDataByLocalIdentifier{ID: 0x01})
+			if err != nil {
+				return nil, err
+			}
+			ld, err := kwp2000.ParseReadDataByLocalIdentifierResponse(resp)
+			return ld.Data, err
+		},
+		Validate: func(ctx context.Context, c Change) ([]string, error) {
+			return nil, nil
+		},
+		Confirm: func(ctx context.Context, c Change) (bool, error) {
+			f.confirmed = append(f.confirmed, c)
+			return true, nil
+		},
+		Write: func(ctx context.Context, req WriteRequest) error {
+			_, err := client.Do(kwp2000.WriteDataByLocalIdentifier{ID: 0x01, Data: req.Data})
+			return err
+		},
+		OnEvent: func(e Event) { f.events = append(f.events, e) },
+	}
+	return f
+}
+
+func request() WriteRequest {
+	return WriteRequest{
+		Chassis:   "E46",
+		Module:    "MS43",
+		Version:   "430037",
+		Operation: safety.OpCoding,
+		Data:      bytes.Repeat([]byte{0x22}, 16),
+		Metadata:  vault.Metadata{VIN: "WBAAV31070FZ12345"},
+	}
+}
+
+func (f *fixture) trail() []string {
+	var out []string
+	for _, e := range f.events {
+		out = append(out, e.Stage.String()+":"+string(e.Status))
+	}
+	return out
+}
+
+func (f *fixture) backups(t *testing.T) []vault.Entry {
+	t.Helper()
+	entries, err := f.vault.List("E46", "MS43")
+	require.NoError(t, err)
+	return entries
+}
+
+func TestRunSuccess(t *testing.T) {
+	f := newFixture(t)
+	res, err := f.pipeline.Run(context.Background(), request())
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"voltage:started", "voltage:passed",
+		"backup:started", "backup:passed",
+		"validate:started", "validate:passed",
+		"confirm:started", "confirm:passed",
+		"write:started", "write:passed",
+		"verify:started", "verify:passed",
+	}, f.trail())
+	assert.Equal(t, f.events, res.Events)
+	assert.Equal(t, original(), res.Backup)
+	assert.Equal(t, request().Data, f.coding.Bytes()[16:])
+
+	entries := f.backups(t)
+	require.Len(t, entries, 1)
+	assert.Equal(t, original(), entries[0].Data)
+	assert.Equal(t, "430037", entries[0].Version)
+	assert.Equal(t, "coding", entries[0].Operation)
+	assert.Equal(t, "WBAAV31070FZ12345", entries[0].VIN)
+	assert.Equal(t, entries[0].ID, res.BackupID)
+
+	require.Len(t, f.confirmed, 1)
+	assert.Equal(t, original(), f.confirmed[0].Old)
+}
+
+func TestRunIncompletePipeline(t *testing.T) {
+	f := newFixture(t)
+	f.pipeline.Validate = nil
+	f.pipeline.Confirm = nil
+
+	_, err := f.pipeline.Run(context.Background(), request())
+	assert.ErrorIs(t, err, ErrIncomplete)
+	assert.Contains(t, err.Error(), "validate confirm")
+	assert.Empty(t, f.backups(t))
+}
+
+func TestRunLowVoltageBlocksBeforeBackup(t *testing.T) {
+	f := newFixture(t)
+	f.bus.SetVoltage(11.6)
+
+	res, err := f.pipeline.Run(context.Background(), request())
+	var se *StageError
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, StageVoltage, se.Stage)
+	assert.ErrorIs(t, err, ErrVoltage)
+	assert.Contains(t, se.Guidance, "Nothing was written")
+	assert.Equal(t, safety.VoltageBlocked, res.Voltage.Status)
+
+	assert.Empty(t, f.backups(t))
+	assert.Equal(t, original(), f.coding.Bytes()[16:])
+	assert.Equal(t, []string{"voltage:started", "voltage:failed"}, f.trail())
+}
+
+func TestRunLowVoltageWarningReachesConfirm(t *testing.T) {
+	f := newFixture(t)
+	f.bus.SetVoltage(12.3)
+
+	_, err := f.pipeline.Run(context.Background(), request())
+	require.NoError(t, err)
+	assert.Equal(t, "voltage:warning", f.trail()[1])
+	require.Len(t, f.confirmed, 1)
+	assert.Contains(t, f.confirmed[0].Warnings[0], "12.3")
+}
+
+func TestRunReadOnlyAdapter(t *testing.T) {
+	f := newFixture(t)
+	f.bus.ReadOnly = true
+
+	_, err := f.pipeline.Run(context.Background(), request())
+	assert.ErrorIs(t, err, ErrWriteBlocked)
+	assert.Empty(t, f.backups(t))
+}
+
+func TestRunValidationBlocks(t *testing.T) {
+	f := newFixture(t)
+	errAirbag := errors.New("coding disables the passenger airbag")
+	f.pipeline.Validate = func(ctx context.Context, c Change) ([]string, error) {
+		return nil, errAirbag
+	}
+
+	_, err := f.pipeline.Run(context.Background(), request())
+	assert.ErrorIs(t, err, errAirbag)
+	assert.Empty(t, f.confirmed)
+	assert.Equal(t, original(), f.coding.Bytes()[16:])
+	// The backup was taken before validation and stays.
+	assert.Len(t, f.backups(t), 1)
+}
+
+func TestRunValidationWarnings(t *testing.T) {
+	f := newFixture(t)
+	f.pipeline.Validate = func(ctx context.Context, c Change) ([]string, error) {
+		return []string{"value 0x22 is not in the community overlay"}, nil
+	}
+
+	res, err := f.pipeline.Run(context.Background(), request())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"value 0x22 is not in the community overlay"}, res.Warnings)
+	assert.Equal(t, "validate:warning", f.trail()[5])
+	assert.Equal(t, res.Warnings, f.confirmed[0].Warnings)
+}
+
+func TestRunDeclined(t *testing.T) {
+	f := newFixture(t)
+	f.pipeline.Confirm = func(ctx context.Context, c Change) (bool, error) { return false, nil }
+
+	_, err := f.pipeline.Run(context.Background(), request())
+	assert.ErrorIs(t, err, ErrDeclined)
+	assert.Equal(t, original(), f.coding.Bytes()[16:])
+}
+
+func TestRunWriteFailureGuidance(t *testing.T) {
+	f := newFixture(t)
+	errDropped := errors.New("connection lost")
+	f.pipeline.Write = func(ctx context.Context, req WriteRequest) error { return errDropped }
+
+	_, err := f.pipeline.Run(context.Background(), request())
+	var se *StageError
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, StageWrite, se.Stage)
+	assert.ErrorIs(t, err, errDropped)
+	assert.Contains(t, se.Guidance, "restore the backup")
+}
+
+func TestRunVerifyMismatchIsTypedFailure(t *testing.T) {
+	f := newFixture(t)
+	f.pipeline.Verify = func(ctx context.Context, req WriteRequest) ([]byte, error) {
+		data := f.coding.Bytes()[16:]
+		data[3] ^= 0x01
+		return data, nil
+	}
+
+	res, err := f.pipeline.Run(context.Background(), request())
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrVerifyMismatch)
+
+	var se *StageError
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, StageVerify, se.Stage)
+	assert.Contains(t, se.Guidance, "Do not drive")
+
+	var ve *VerifyError
+	require.ErrorAs(t, err, &ve)
+	assert.Equal(t, []int{3}, ve.Offsets)
+	assert.Equal(t, request().Data, ve.Expected)
+
+	last := res.Events[len(res.Events)-1]
+	assert.Equal(t, StageVerify, last.Stage)
+	assert.Equal(t, EventFailed, last.Status)
+}
+
+func TestRunMonitorStopsWrite(t *testing.T) {
+	f := newFixture(t)
+	cfg := safety.DefaultMonitorConfig
+	cfg.Interval = time.Millisecond
+	cfg.Debounce = 1
+	f.pipeline.Monitor = &cfg
+
+	written := 0
+	f.pipeline.Write = func(ctx context.Context, req WriteRequest) error {
+		f.bus.SetVoltage(11.0)
+		for range 1000 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			written++
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	}
+
+	_, err := f.pipeline.Run(context.Background(), request())
+	assert.ErrorIs(t, err, safety.ErrVoltageOutOfRange)
+	assert.Less(t, written, 1000)
+}
+
+func TestRunCancelledContext(t *testing.T) {
+	f := newFixture(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := f.pipeline.Run(ctx, request())
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, f.backups(t))
+}
+
+func TestRunWritesAuditRecords(t *testing.T) {
+	f := newFixture(t)
+	path := filepath.Join(t.TempDir(), "vault.audit.jsonl")
+	log, err := audit.Open(path)
+	require.NoError(t, err)
+	defer log.Close()
+	f.pipeline.Audit = log
+	f.pipeline.Actor = "tech@shop"
+
+	res, err := f.pipeline.Run(context.Background(), request())
+	require.NoError(t, err)
+	f.bus.SetVoltage(11.6)
+	_, err = f.pipeline.Run(context.Background(), request())
+	require.Error(t, err)
+
+	records, _, err := audit.VerifyFile(path)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	ok := records[0]
+	assert.Equal(t, audit.OutcomeSuccess, ok.Outcome)
+	assert.Equal(t, "tech@shop", ok.Actor)
+	assert.Equal(t, "WBAAV31070FZ12345", ok.VIN)
+	assert.Equal(t, "MS43", ok.Module)
+	assert.Equal(t, "coding", ok.Operation)
+	assert.Equal(t, 12.6, ok.Voltage)
+	assert.Equal(t, res.BackupID, ok.BackupID)
+	assert.Equal(t, audit.HashData(original()), ok.BeforeSHA256)
+	assert.Equal(t, audit.HashData(request().Data), ok.AfterSHA256)
+
+	blocked := records[1]
+	assert.Equal(t, audit.OutcomeBlocked, blocked.Outcome)
+	assert.Equal(t, 11.6, blocked.Voltage)
+	assert.Zero(t, blocked.BackupID)
+	assert.Contains(t, blocked.Detail, "voltage")
+
+	// The vault's own audit names the same runs.
+	trail, err := f.vault.AuditLog()
+	require.NoError(t, err)
+	var runs []vault.AuditRecord
+	for _, a := range trail {
+		if a.Action == vault.ActionRun {
+			runs = append(runs, a)
+		}
+	}
+	require.Len(t, runs, 2)
+	assert.Equal(t, res.BackupID, runs[0].BackupID)
+	assert.Equal(t, "E46 MS43 coding: success, audit log seq 1", runs[0].Detail)
+	assert.Zero(t, runs[1].BackupID)
+	assert.Contains(t, runs[1].Detail, "blocked, audit log seq 2")
+}
+
+func TestRunAuditKeepsVINOutOfLogForEncryptedVault(t *testing.T) {
+	f := newFixture(t)
+	v, err := vault.OpenEncrypted(filepath.Join(t.TempDir(), "secret.db"), "correct horse battery staple")
+	require.NoError(t, err)
+	t.Cleanup(func() { v.Close() })
+	f.pipeline.Vault = v
+
+	path := filepath.Join(t.TempDir(), "secret.audit.jsonl")
+	log, err := audit.Open(path)
+	require.NoError(t, err)
+	defer log.Close()
+	f.pipeline.Audit = log
+
+	_, err = f.pipeline.Run(context.Background(), request())
+	require.NoError(t, err)
+
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "WBAAV31070FZ12345")
+	records, _, err := audit.VerifyFile(path)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, v.VINIndex("WBAAV31070FZ12345"), records[0].VIN)
+}
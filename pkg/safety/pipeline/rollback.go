@@ -0,0 +1,157 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alexcatdad/bavarix/pkg/safety"
+	"github.com/alexcatdad/bavarix/pkg/safety/vault"
+)
+
+var (
+	ErrIncompatible  = errors.New("pipeline: backup does not match the connected module")
+	ErrCorruptBackup = errors.New("pipeline: backup data does not match its checksum")
+	ErrUnidentified  = errors.New("pipeline: backup does not record the module's hardware number and coding index")
+)
+
+// Identity is what the connected module reports about itself.
+type Identity struct {
+	Chassis        string
+	Module         string
+	HardwareNumber string
+	SoftwareNumber string
+	CodingIndex    string
+}
+
+// RollbackResult is the record of a rollback. RestoreID names its journal
+// in the vault; Result.BackupID is the state the module held before the
+// rollback, which Rollback accepts to undo it.
+type RollbackResult struct {
+	RestoreID int64
+	Entry     vault.Entry
+	Identity  Identity
+	*Result
+}
+
+// Rollback writes backup id back to the connected module. The backup must
+// be intact and taken from the same chassis and module with the same
+// hardware number and coding index; backups that did not record those are
+// refused unless AllowUnidentified is set. The write then runs through
+// every pipeline stage, so the module's current data is backed up first
+// and the restore is verified. Each step is journaled in the vault whether
+// or not it succeeds.
+func (p *Pipeline) Rollback(ctx context.Context, id int64) (*RollbackResult, error) {
+	res := &RollbackResult{Result: &Result{}}
+	if p.Vault == nil || p.Identify == nil {
+		return res, fmt.Errorf("%w: rollback needs a vault and identify step", ErrIncomplete)
+	}
+
+	restoreID, err := p.Vault.StartRestore(id)
+	if err != nil {
+		return res, err
+	}
+	res.RestoreID = restoreID
+	log := func(step, status, msg string) {
+		// The journal is best effort once started: a failure to log must
+		// not leave the module half-written.
+		_ = p.Vault.LogRestoreStep(restoreID, step, status, msg)
+	}
+
+	err = p.rollback(ctx, id, res, log)
+	if ferr := p.Vault.FinishRestore(restoreID, res.BackupID, err); ferr != nil && err == nil {
+		err = ferr
+	}
+	return res, err
+}
+
+func (p *Pipeline) rollback(ctx context.Context, id int64, res *RollbackResult, log func(step, status, msg string)) error {
+	entry, err := p.Vault.Get(id)
+	if err != nil {
+		log("fetch", string(EventFailed), err.Error())
+		return err
+	}
+	res.Entry = entry
+	if !entry.Intact() {
+		err := fmt.Errorf("%w: backup %d", ErrCorruptBackup, id)
+		log("fetch", string(EventFailed), err.Error())
+		return err
+	}
+	log("fetch", string(EventPassed), fmt.Sprintf("backup %d: %d bytes of %s %s", id, len(entry.Data), entry.Chassis, entry.Module))
+
+	ident, err := p.Identify(ctx)
+	if err != nil {
+		err = fmt.Errorf("pipeline: identifying module: %w", err)
+		log("compatibility", string(EventFailed), err.Error())
+		return err
+	}
+	res.Identity = ident
+	if err := compatible(entry, ident); err != nil {
+		log("compatibility", string(EventFailed), err.Error())
+		return err
+	}
+	if entry.HardwareNumber == "" || entry.CodingIndex == "" {
+		if !p.AllowUnidentified {
+			err := fmt.Errorf("%w: backup %d", ErrUnidentified, id)
+			log("compatibility", string(EventFailed), err.Error())
+			return err
+		}
+		log("compatibility", string(EventWarning), fmt.Sprintf("backup %d does not record its hardware number and coding index; restoring by override", id))
+	}
+	log("compatibility", string(EventPassed), fmt.Sprintf("%s %s, hardware %q, coding index %q", ident.Chassis, ident.Module, ident.HardwareNumber, ident.CodingIndex))
+
+	req := WriteRequest{
+		Chassis:   entry.Chassis,
+		Module:    entry.Module,
+		Version:   entry.Version,
+		Operation: safety.OpCoding,
+		Data:      entry.Data,
+		Metadata: vault.Metadata{
+			VIN:            entry.VIN,
+			HardwareNumber: ident.HardwareNumber,
+			SoftwareNumber: ident.SoftwareNumber,
+			CodingIndex:    ident.CodingIndex,
+			Operation:      "rollback",
+			Format:         entry.Format,
+			Note:           fmt.Sprintf("state before rollback to backup %d", id),
+			Tags:           []string{"rollback", "rollback-of:" + strconv.FormatInt(id, 10)},
+		},
+	}
+	if entry.Format == vault.FormatFlash {
+		req.Operation = safety.OpFlash
+	}
+
+	onEvent := p.OnEvent
+	run := *p
+	run.OnEvent = func(e Event) {
+		msg := e.Message
+		if e.Err != nil {
+			msg = e.Err.Error()
+		}
+		log(e.Stage.String(), string(e.Status), msg)
+		if onEvent != nil {
+			onEvent(e)
+		}
+	}
+	r, err := run.Run(ctx, req)
+	res.Result = r
+	return err
+}
+
+// compatible checks a backup against the connected module. Chassis and
+// module are always compared; hardware number and coding index only when
+// the backup recorded them.
+func compatible(e vault.Entry, ident Identity) error {
+	if !strings.EqualFold(e.Chassis, ident.Chassis) || !strings.EqualFold(e.Module, ident.Module) {
+		return fmt.Errorf("%w: backup is from %s %s, module is %s %s", ErrIncompatible, e.Chassis, e.Module, ident.Chassis, ident.Module)
+	}
+	if e.HardwareNumber != "" && e.HardwareNumber != ident.HardwareNumber {
+		return fmt.Errorf("%w: backup is from hardware %s, module is %s", ErrIncompatible, e.HardwareNumber, ident.HardwareNumber)
+	}
+	if e.CodingIndex != "" && e.CodingIndex != ident.CodingIndex {
+		return fmt.Errorf("%w: backup has coding index %s, module has %s", ErrIncompatible, e.CodingIndex, ident.CodingIndex)
+	}
+	return nil
+}
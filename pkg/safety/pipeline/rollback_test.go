@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/safety/vault"
+)
+
+var ms43 = Identity{Chassis: "E46", Module: "MS43", HardwareNumber: "7519308", SoftwareNumber: "430037", CodingIndex: "0A"}
+
+var ms43Meta = vault.Metadata{HardwareNumber: "7519308", CodingIndex: "0A"}
+
+func (f *fixture) identify(ident Identity) {
+	f.pipeline.Identify = func(ctx context.Context) (Identity, error) { return ident, nil }
+}
+
+func (f *fixture) saveBackup(t *testing.T, data []byte, meta vault.Metadata) int64 {
+	t.Helper()
+	id, err := f.vault.SaveWithMetadata("E46", "MS43", "430037", data, meta)
+	require.NoError(t, err)
+	return id
+}
+
+func TestRollbackRestoresBackup(t *testing.T) {
+	f := newFixture(t)
+	f.identify(ms43)
+	old := bytes.Repeat([]byte{0x33}, 16)
+	id := f.saveBackup(t, old, vault.Metadata{HardwareNumber: "7519308", CodingIndex: "0A", VIN: "WBAAV31070FZ12345"})
+
+	res, err := f.pipeline.Rollback(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, old, f.coding.Bytes()[16:])
+	assert.Equal(t, "verify:passed", f.trail()[len(f.trail())-1])
+
+	before, err := f.vault.Get(res.BackupID)
+	require.NoError(t, err)
+	assert.Equal(t, original(), before.Data)
+	assert.Equal(t, "rollback", before.Operation)
+	assert.Equal(t, []string{"rollback", "rollback-of:1"}, before.Tags)
+	assert.Equal(t, "WBAAV31070FZ12345", before.VIN)
+
+	journal, err := f.vault.GetRestore(res.RestoreID)
+	require.NoError(t, err)
+	assert.Equal(t, vault.RestoreSucceeded, journal.Status)
+	assert.Equal(t, id, journal.SourceID)
+	assert.Equal(t, res.BackupID, journal.BackupID)
+	var steps []string
+	for _, s := range journal.Steps {
+		steps = append(steps, s.Step+":"+s.Status)
+	}
+	assert.Equal(t, []string{
+		"fetch:passed", "compatibility:passed",
+		"voltage:started", "voltage:passed",
+		"backup:started", "backup:passed",
+		"validate:started", "validate:passed",
+		"confirm:started", "confirm:passed",
+		"write:started", "write:passed",
+		"verify:started", "verify:passed",
+	}, steps)
+}
+
+func TestRollbackCanBeRolledBack(t *testing.T) {
+	f := newFixture(t)
+	f.identify(ms43)
+	id := f.saveBackup(t, bytes.Repeat([]byte{0x33}, 16), ms43Meta)
+
+	first, err := f.pipeline.Rollback(context.Background(), id)
+	require.NoError(t, err)
+	_, err = f.pipeline.Rollback(context.Background(), first.BackupID)
+	require.NoError(t, err)
+	assert.Equal(t, original(), f.coding.Bytes()[16:])
+}
+
+func TestRollbackIncompatibleModule(t *testing.T) {
+	for name, meta := range map[string]vault.Metadata{
+		"hardware":     {HardwareNumber: "7500255", CodingIndex: "0A"},
+		"coding index": {HardwareNumber: "7519308", CodingIndex: "09"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newFixture(t)
+			f.identify(ms43)
+			id := f.saveBackup(t, bytes.Repeat([]byte{0x33}, 16), meta)
+
+			res, err := f.pipeline.Rollback(context.Background(), id)
+			assert.ErrorIs(t, err, ErrIncompatible)
+			assert.Equal(t, original(), f.coding.Bytes()[16:])
+			assert.Empty(t, f.events, "pipeline must not start")
+
+			journal, err := f.vault.GetRestore(res.RestoreID)
+			require.NoError(t, err)
+			assert.Equal(t, vault.RestoreFailed, journal.Status)
+			assert.Zero(t, journal.BackupID)
+			assert.Equal(t, "compatibility", journal.Steps[len(journal.Steps)-1].Step)
+		})
+	}
+}
+
+func TestRollbackOtherChassisOrModule(t *testing.T) {
+	for name, ident := range map[string]Identity{
+		"chassis": {Chassis: "E39", Module: "MS43", HardwareNumber: "7519308", CodingIndex: "0A"},
+		"module":  {Chassis: "E46", Module: "MS45", HardwareNumber: "7519308", CodingIndex: "0A"},
+		"unknown": {HardwareNumber: "7519308", CodingIndex: "0A"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newFixture(t)
+			f.identify(ident)
+			id := f.saveBackup(t, bytes.Repeat([]byte{0x33}, 16), ms43Meta)
+
+			_, err := f.pipeline.Rollback(context.Background(), id)
+			assert.ErrorIs(t, err, ErrIncompatible)
+			assert.Equal(t, original(), f.coding.Bytes()[16:])
+		})
+	}
+}
+
+func TestRollbackUnidentifiedBackupNeedsOverride(t *testing.T) {
+	f := newFixture(t)
+	f.identify(ms43)
+	old := bytes.Repeat([]byte{0x33}, 16)
+	id := f.saveBackup(t, old, vault.Metadata{})
+
+	res, err := f.pipeline.Rollback(context.Background(), id)
+	assert.ErrorIs(t, err, ErrUnidentified)
+	assert.Equal(t, original(), f.coding.Bytes()[16:])
+	assert.Empty(t, f.events, "pipeline must not start")
+	journal, err := f.vault.GetRestore(res.RestoreID)
+	require.NoError(t, err)
+	assert.Equal(t, vault.RestoreFailed, journal.Status)
+
+	f.pipeline.AllowUnidentified = true
+	res, err = f.pipeline.Rollback(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, old, f.coding.Bytes()[16:])
+	journal, err = f.vault.GetRestore(res.RestoreID)
+	require.NoError(t, err)
+	assert.Equal(t, "compatibility:warning", journal.Steps[1].Step+":"+journal.Steps[1].Status)
+}
+
+func TestRollbackUnknownBackup(t *testing.T) {
+	f := newFixture(t)
+	f.identify(ms43)
+
+	_, err := f.pipeline.Rollback(context.Background(), 42)
+	assert.ErrorIs(t, err, vault.ErrNoBackup)
+}
+
+func TestRollbackNeedsIdentify(t *testing.T) {
+	f := newFixture(t)
+	_, err := f.pipeline.Rollback(context.Background(), 1)
+	assert.ErrorIs(t, err, ErrIncomplete)
+}
+
+func TestRollbackFailedWriteIsJournaled(t *testing.T) {
+	f := newFixture(t)
+	f.identify(ms43)
+	f.pipeline.Confirm = func(ctx context.Context, c Change) (bool, error) { return false, nil }
+	id := f.saveBackup(t, bytes.Repeat([]byte{0x33}, 16), ms43Meta)
+
+	res, err := f.pipeline.Rollback(context.Background(), id)
+	assert.ErrorIs(t, err, ErrDeclined)
+
+	journal, err := f.vault.GetRestore(res.RestoreID)
+	require.NoError(t, err)
+	assert.Equal(t, vault.RestoreFailed, journal.Status)
+	assert.Contains(t, journal.Error, "not confirmed")
+	// The pre-rollback backup was already taken and is kept.
+	assert.Equal(t, res.BackupID, journal.BackupID)
+	assert.NotZero(t, journal.BackupID)
+}
@@ -0,0 +1,329 @@
+package safety
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrInvalidPolicy = errors.New("safety: invalid voltage policy")
+
+// Thresholds are the voltage limits for one operation. Below Block the
+// operation is refused, at Block or below Warning it may proceed with a
+// warning, and
+// above Max (when set) a charger or alternator fault is assumed and the
+// operation is refused as well.
+type Thresholds struct {
+	Block   float64 `json:"block"`
+	Warning float64 `json:"warning"`
+	Max     float64 `json:"max,omitempty"`
+}
+
+// Profile holds the thresholds of every operation for one kind of battery.
+type Profile struct {
+	Description string                       `json:"description,omitempty"`
+	Limits      map[OperationType]Thresholds `json:"limits"`
+}
+
+const DefaultProfile = "lead-acid"
+
+// BuiltinProfiles returns the profiles every policy starts from. Values are
+// resting voltages with a charger connected, which every write requires.
+func BuiltinProfiles() map[string]Profile {
+	return map[string]Profile{
+		"lead-acid": {
+			Description: "12V flooded lead-acid battery",
+			Limits: map[OperationType]Thresholds{
+				OpCoding:      {Block: 12.0, Warning: 12.5, Max: 15.0},
+				OpMultiCoding: {Block: 12.5, Warning: 12.5, Max: 15.0},
+				OpFlash:       {Block: 13.0, Warning: 13.0, Max: 15.0},
+			},
+		},
+		"agm": {
+			Description: "12V AGM battery, which rests higher and tolerates less deep discharge",
+			Limits: map[OperationType]Thresholds{
+				OpCoding:      {Block: 12.2, Warning: 12.6, Max: 14.8},
+				OpMultiCoding: {Block: 12.6, Warning: 12.7, Max: 14.8},
+				OpFlash:       {Block: 13.0, Warning: 13.2, Max: 14.8},
+			},
+		},
+		"lithium": {
+			Description: "12V LiFePO4 battery, whose flat discharge curve leaves little warning",
+			Limits: map[OperationType]Thresholds{
+				OpCoding:      {Block: 12.8, Warning: 13.0, Max: 14.6},
+				OpMultiCoding: {Block: 13.0, Warning: 13.1, Max: 14.6},
+				OpFlash:       {Block: 13.2, Warning: 13.3, Max: 14.6},
+			},
+		},
+		"24v": {
+			Description: "24V commercial vehicle system",
+			Limits: map[OperationType]Thresholds{
+				OpCoding:      {Block: 24.0, Warning: 25.0, Max: 30.0},
+				OpMultiCoding: {Block: 25.0, Warning: 25.0, Max: 30.0},
+				OpFlash:       {Block: 26.0, Warning: 26.0, Max: 30.0},
+			},
+		},
+	}
+}
+
+// Override adjusts thresholds for a chassis, a module or both, optionally
+// for a single operation. It may raise the block level but never lower it
+// below the profile's, and may lower the maximum but never raise it above
+// the profile's. Zero threshold fields keep the profile value.
+type Override struct {
+	Chassis   string         `json:"chassis,omitempty"`
+	Module    string         `json:"module,omitempty"`
+	Operation *OperationType `json:"operation,omitempty"`
+	Thresholds
+	Reason string `json:"reason,omitempty"`
+}
+
+func (o Override) matches(op OperationType, target Target) bool {
+	return (o.Chassis == "" || strings.EqualFold(o.Chassis, target.Chassis)) &&
+		(o.Module == "" || strings.EqualFold(o.Module, target.Module)) &&
+		(o.Operation == nil || *o.Operation == op)
+}
+
+// specificity ranks overrides so a module rule beats a chassis rule and an
+// operation-specific rule beats a general one.
+func (o Override) specificity() int {
+	s := 0
+	if o.Module != "" {
+		s += 4
+	}
+	if o.Chassis != "" {
+		s += 2
+	}
+	if o.Operation != nil {
+		s++
+	}
+	return s
+}
+
+func (o Override) String() string {
+	var parts []string
+	if o.Chassis != "" {
+		parts = append(parts, "chassis "+o.Chassis)
+	}
+	if o.Module != "" {
+		parts = append(parts, "module "+o.Module)
+	}
+	if o.Operation != nil {
+		parts = append(parts, "operation "+o.Operation.String())
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "all modules")
+	}
+	s := "override for " + strings.Join(parts, ", ")
+	if o.Reason != "" {
+		s += " (" + o.Reason + ")"
+	}
+	return s
+}
+
+// Target identifies what an operation is about to touch.
+type Target struct {
+	Chassis string
+	Module  string
+}
+
+// VoltagePolicy decides whether battery voltage allows an operation. It is
+// normally loaded from a JSON config:
+//
+//	{
+//	  "profile": "agm",
+//	  "overrides": [
+//	    {"chassis": "E65", "module": "DME", "operation": "flash",
+//	     "block": 13.2, "warning": 13.5, "reason": "long E65 DME flash times"}
+//	  ]
+//	}
+//
+// Custom profiles may be added under "profiles"; they replace built-in
+// profiles of the same name.
+type VoltagePolicy struct {
+	Profile   string             `json:"profile"`
+	Profiles  map[string]Profile `json:"profiles,omitempty"`
+	Overrides []Override         `json:"overrides,omitempty"`
+}
+
+func DefaultVoltagePolicy() *VoltagePolicy {
+	return &VoltagePolicy{Profile: DefaultProfile, Profiles: BuiltinProfiles()}
+}
+
+func ParseVoltagePolicy(data []byte) (*VoltagePolicy, error) {
+	p := DefaultVoltagePolicy()
+	var custom VoltagePolicy
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPolicy, err)
+	}
+	if custom.Profile != "" {
+		p.Profile = custom.Profile
+	}
+	for name, prof := range custom.Profiles {
+		p.Profiles[strings.ToLower(name)] = prof
+	}
+	p.Overrides = custom.Overrides
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func LoadVoltagePolicy(path string) (*VoltagePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("safety: reading voltage policy: %w", err)
+	}
+	return ParseVoltagePolicy(data)
+}
+
+func (p *VoltagePolicy) Validate() error {
+	prof, ok := p.Profiles[strings.ToLower(p.Profile)]
+	if !ok {
+		return fmt.Errorf("%w: unknown profile %q", ErrInvalidPolicy, p.Profile)
+	}
+	for op := range operationNames {
+		t, ok := prof.Limits[op]
+		if !ok {
+			return fmt.Errorf("%w: profile %q has no limits for %s", ErrInvalidPolicy, p.Profile, op)
+		}
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("%w: profile %q %s: %w", ErrInvalidPolicy, p.Profile, op, err)
+		}
+	}
+	chassis, modules := []string{""}, []string{""}
+	for i, o := range p.Overrides {
+		if o.Block < 0 || o.Warning < 0 || o.Max < 0 {
+			return fmt.Errorf("%w: override %d: thresholds must not be negative", ErrInvalidPolicy, i+1)
+		}
+		for op, t := range prof.Limits {
+			if o.Operation != nil && *o.Operation != op {
+				continue
+			}
+			if o.Block > 0 && o.Block < t.Block {
+				return fmt.Errorf("%w: override %d: %s block %.1fV is below the %q floor of %.1fV",
+					ErrInvalidPolicy, i+1, op, o.Block, p.Profile, t.Block)
+			}
+			if o.Max > 0 && t.Max > 0 && o.Max > t.Max {
+				return fmt.Errorf("%w: override %d: %s max %.1fV is above the %q ceiling of %.1fV",
+					ErrInvalidPolicy, i+1, op, o.Max, p.Profile, t.Max)
+			}
+		}
+		chassis = append(chassis, o.Chassis)
+		modules = append(modules, o.Module)
+	}
+
+	// Overrides combine, so check what every chassis and module named in
+	// them resolves to rather than each override on its own.
+	for op := range operationNames {
+		for _, c := range chassis {
+			for _, m := range modules {
+				t, source := p.Limits(op, Target{Chassis: c, Module: m})
+				if err := t.validate(); err != nil {
+					return fmt.Errorf("%w: %s %s: %w", ErrInvalidPolicy, source, op, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (t Thresholds) validate() error {
+	switch {
+	case t.Block <= 0:
+		return errors.New("block must be positive")
+	case t.Warning < t.Block:
+		return errors.New("warning must not be below block")
+	case t.Max != 0 && t.Max <= t.Warning:
+		return errors.New("max must be above warning")
+	}
+	return nil
+}
+
+// Decision is the outcome of a policy check together with the rule that
+// produced it.
+type Decision struct {
+	VoltageResult
+	Limits Thresholds
+	// Source names where Limits came from: the profile, or the override
+	// that applied last.
+	Source string
+	// Rule is the comparison that decided the status.
+	Rule string
+}
+
+// Explain renders the decision for logs and the UI.
+func (d Decision) Explain() string {
+	return fmt.Sprintf("%s: %s (%s)", d.Status, d.Rule, d.Source)
+}
+
+// Limits resolves the thresholds for an operation on a target, applying
+// matching overrides from least to most specific. Among equally specific
+// overrides the later one wins.
+func (p *VoltagePolicy) Limits(op OperationType, target Target) (Thresholds, string) {
+	t := p.Profiles[strings.ToLower(p.Profile)].Limits[op]
+	source := "profile " + p.Profile
+
+	for rank := 0; rank <= 7; rank++ {
+		for _, o := range p.Overrides {
+			if o.specificity() != rank || !o.matches(op, target) {
+				continue
+			}
+			if o.Block > 0 {
+				t.Block = o.Block
+			}
+			if o.Warning > 0 {
+				t.Warning = o.Warning
+			}
+			if o.Max > 0 {
+				t.Max = o.Max
+			}
+			source = o.String()
+		}
+	}
+	if t.Warning < t.Block {
+		t.Warning = t.Block
+	}
+	return t, source
+}
+
+func (p *VoltagePolicy) Check(voltage float64, op OperationType, target Target) Decision {
+	t, source := p.Limits(op, target)
+	d := Decision{Limits: t, Source: source}
+	d.Voltage = voltage
+
+	switch {
+	case voltage < t.Block:
+		d.Status = VoltageBlocked
+		d.Rule = fmt.Sprintf("%.2fV is below the %s block level of %.1fV", voltage, op, t.Block)
+		d.Message = fmt.Sprintf("Battery voltage %.1fV is below minimum %.1fV — operation blocked", voltage, t.Block)
+	case t.Max > 0 && voltage > t.Max:
+		d.Status = VoltageBlocked
+		d.Rule = fmt.Sprintf("%.2fV is above the maximum of %.1fV", voltage, t.Max)
+		d.Message = fmt.Sprintf("Battery voltage %.1fV is above maximum %.1fV — check the charger; operation blocked", voltage, t.Max)
+	case voltage == t.Block:
+		// Profiles without a warning band still warn at the very limit.
+		d.Status = VoltageWarning
+		d.Rule = fmt.Sprintf("%.2fV is at the %s block level of %.1fV", voltage, op, t.Block)
+		d.Message = fmt.Sprintf("Battery voltage %.1fV is at the minimum %.1fV — proceed with caution", voltage, t.Block)
+	case voltage < t.Warning:
+		d.Status = VoltageWarning
+		d.Rule = fmt.Sprintf("%.2fV is below the %s recommended level of %.1fV", voltage, op, t.Warning)
+		d.Message = fmt.Sprintf("Battery voltage %.1fV is low (recommended: %.1fV+) — proceed with caution", voltage, t.Warning)
+	default:
+		d.Status = VoltageOK
+		d.Rule = fmt.Sprintf("%.2fV is within %.1fV–%s for %s", voltage, t.Block, maxLabel(t.Max), op)
+		d.Message = fmt.Sprintf("Battery voltage %.1fV OK", voltage)
+	}
+	return d
+}
+
+func maxLabel(max float64) string {
+	if max == 0 {
+		return "∞"
+	}
+	return fmt.Sprintf("%.1fV", max)
+}
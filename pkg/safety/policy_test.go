@@ -0,0 +1,127 @@
+package safety
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const e65Policy = `{
+	"profile": "agm",
+	"overrides": [
+		{"chassis": "E65", "operation": "flash", "block": 13.1, "reason": "E65 flash"},
+		{"chassis": "E65", "module": "DME", "operation": "flash", "block": 13.3, "warning": 13.5, "reason": "long DME flash times"},
+		{"module": "DME", "warning": 12.9}
+	]
+}`
+
+func TestPolicyProfiles(t *testing.T) {
+	p := DefaultVoltagePolicy()
+	for name := range BuiltinProfiles() {
+		p.Profile = name
+		assert.NoError(t, p.Validate(), name)
+	}
+
+	p.Profile = "lithium"
+	assert.Equal(t, VoltageBlocked, p.Check(12.7, OpCoding, Target{}).Status)
+
+	p.Profile = "24v"
+	assert.Equal(t, VoltageOK, p.Check(27.4, OpFlash, Target{}).Status)
+	assert.Equal(t, VoltageBlocked, p.Check(12.6, OpCoding, Target{}).Status)
+}
+
+func TestPolicyOverVoltage(t *testing.T) {
+	d := DefaultVoltagePolicy().Check(15.4, OpCoding, Target{})
+	assert.Equal(t, VoltageBlocked, d.Status)
+	assert.Contains(t, d.Rule, "above the maximum")
+	assert.Contains(t, d.Message, "charger")
+}
+
+func TestPolicyOverridesBySpecificity(t *testing.T) {
+	p, err := ParseVoltagePolicy([]byte(e65Policy))
+	require.NoError(t, err)
+
+	limits, source := p.Limits(OpFlash, Target{Chassis: "e65", Module: "dme"})
+	assert.Equal(t, Thresholds{Block: 13.3, Warning: 13.5, Max: 14.8}, limits)
+	assert.Contains(t, source, "long DME flash times")
+
+	limits, source = p.Limits(OpFlash, Target{Chassis: "E65", Module: "EGS"})
+	assert.Equal(t, 13.1, limits.Block)
+	assert.Equal(t, 13.2, limits.Warning)
+	assert.Contains(t, source, "chassis E65")
+
+	limits, _ = p.Limits(OpCoding, Target{Chassis: "E46", Module: "DME"})
+	assert.Equal(t, Thresholds{Block: 12.2, Warning: 12.9, Max: 14.8}, limits)
+
+	_, source = p.Limits(OpCoding, Target{Chassis: "E46", Module: "KMB"})
+	assert.Equal(t, "profile agm", source)
+}
+
+func TestPolicyDecisionExplains(t *testing.T) {
+	p, err := ParseVoltagePolicy([]byte(e65Policy))
+	require.NoError(t, err)
+
+	d := p.Check(13.2, OpFlash, Target{Chassis: "E65", Module: "DME"})
+	assert.Equal(t, VoltageBlocked, d.Status)
+	assert.Equal(t, "blocked: 13.20V is below the flash block level of 13.3V (override for chassis E65, module DME, operation flash (long DME flash times))", d.Explain())
+
+	d = p.Check(13.4, OpFlash, Target{Chassis: "E65", Module: "DME"})
+	assert.Equal(t, VoltageWarning, d.Status)
+}
+
+func TestPolicyAtBlockWarns(t *testing.T) {
+	d := DefaultVoltagePolicy().Check(12.0, OpCoding, Target{})
+	assert.Equal(t, VoltageWarning, d.Status)
+
+	// Without a warning band the block level still warns.
+	d = DefaultVoltagePolicy().Check(13.0, OpFlash, Target{})
+	assert.Equal(t, VoltageWarning, d.Status)
+	assert.Contains(t, d.Rule, "at the flash block level")
+	d = DefaultVoltagePolicy().Check(13.01, OpFlash, Target{})
+	assert.Equal(t, VoltageOK, d.Status)
+}
+
+func TestPolicyCustomProfileFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "voltage.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"profile": "bench",
+		"profiles": {"bench": {"limits": {
+			"coding": {"block": 13.0, "warning": 13.2},
+			"multi_coding": {"block": 13.0, "warning": 13.2},
+			"flash": {"block": 13.2, "warning": 13.4}
+		}}}
+	}`), 0o644))
+
+	p, err := LoadVoltagePolicy(path)
+	require.NoError(t, err)
+	assert.Equal(t, VoltageBlocked, p.Check(12.9, OpCoding, Target{}).Status)
+	// No maximum configured: no over-voltage rule.
+	assert.Equal(t, VoltageOK, p.Check(20.0, OpCoding, Target{}).Status)
+}
+
+func TestPolicyValidation(t *testing.T) {
+	for _, js := range []string{
+		`{"profile": "nickel-iron"}`,
+		`{"profile": "x", "profiles": {"x": {"limits": {"coding": {"block": 12, "warning": 12.5}}}}}`,
+		`{"profile": "x", "profiles": {"x": {"limits": {
+			"coding": {"block": 12, "warning": 11},
+			"multi_coding": {"block": 12, "warning": 12},
+			"flash": {"block": 13, "warning": 13}}}}}`,
+		`{"overrides": [{"module": "DME", "block": -1}]}`,
+		`{"overrides": [{"operation": "welding"}]}`,
+		// Relaxes the lead-acid coding floor of 12.0V.
+		`{"overrides": [{"module": "DME", "operation": "coding", "block": 11.5}]}`,
+		// Valid alone, but the module warning ends up above the chassis max.
+		`{"overrides": [{"chassis": "E65", "max": 13.5}, {"module": "DME", "warning": 13.8}]}`,
+		`{"overrides": [{"module": "DME", "max": 12.2}]}`,
+		// Raises the lead-acid ceiling of 15.0V.
+		`{"overrides": [{"module": "DME", "max": 16.0}]}`,
+		`{`,
+	} {
+		_, err := ParseVoltagePolicy([]byte(js))
+		assert.ErrorIs(t, err, ErrInvalidPolicy, js)
+	}
+}
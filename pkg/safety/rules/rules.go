@@ -0,0 +1,299 @@
+// Package rules is the validate stage's rules engine. It compares old and
+// new coding data bit by bit, looks every changed bit up in the community
+// overlay and gives each one a verdict:
+//
+//   - safety rating gates: safe passes, caution and warning pass with a
+//     warning, dangerous is blocked unless expert mode is on;
+//   - bits no overlay describes pass with an "unverified" warning;
+//   - a parameter whose hardware list excludes the module is blocked;
+//   - enabling a parameter whose requires are not met, or that conflicts
+//     with an active parameter in either direction, is blocked, as is
+//     disabling a parameter another enabled parameter requires.
+//
+// Requires and conflicts name either equipment the car has (Context.Features)
+// or the ID of another overlay parameter of the same module, which is
+// active when its bit is set in the new coding.
+package rules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/alexcatdad/bavarix/pkg/overlay"
+	"github.com/alexcatdad/bavarix/pkg/parser/spdaten"
+	"github.com/alexcatdad/bavarix/pkg/safety/pipeline"
+)
+
+var ErrBlocked = errors.New("rules: change is blocked")
+
+type Level int
+
+const (
+	Allow Level = iota
+	Warn
+	Block
+)
+
+var levelNames = [...]string{"allow", "warn", "block"}
+
+func (l Level) String() string {
+	if int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// Context is what the engine knows about the module being coded.
+type Context struct {
+	Chassis string
+	// Hardware is the module's SP-Daten file, e.g. "LSZ.C28"; it names the
+	// module and selects hardware-specific parameters.
+	Hardware string
+	// Features lists equipment the car has, e.g. "xenon_headlights".
+	Features []string
+	// Fields are the module's raw SP-Daten fields, used to name bits no
+	// overlay describes.
+	Fields []spdaten.Field
+	// ExpertMode turns blocks from dangerous ratings and hardware
+	// restrictions into warnings. Dependency blocks stay: they describe
+	// codings that cannot work.
+	ExpertMode bool
+}
+
+// Verdict is the outcome for one changed bit.
+type Verdict struct {
+	Byte, Bit int
+	Name      string
+	Old, New  bool
+	Safety    overlay.Safety
+	Level     Level
+	Reasons   []string
+	// Parameter is nil for bits no applicable overlay describes.
+	Parameter *overlay.Parameter
+}
+
+func (v *Verdict) raise(l Level, format string, args ...any) {
+	v.Level = max(v.Level, l)
+	v.Reasons = append(v.Reasons, fmt.Sprintf(format, args...))
+}
+
+func (v Verdict) String() string {
+	state := "off"
+	if v.New {
+		state = "on"
+	}
+	return fmt.Sprintf("%s: %s (byte %d bit %d → %s): %s",
+		v.Level, v.Name, v.Byte, v.Bit, state, strings.Join(v.Reasons, "; "))
+}
+
+type Result struct {
+	Verdicts []Verdict
+}
+
+// Level is the highest level of any verdict.
+func (r Result) Level() Level {
+	l := Allow
+	for _, v := range r.Verdicts {
+		l = max(l, v.Level)
+	}
+	return l
+}
+
+// Warnings returns a line per verdict that warns.
+func (r Result) Warnings() []string {
+	var out []string
+	for _, v := range r.Verdicts {
+		if v.Level == Warn {
+			out = append(out, v.String())
+		}
+	}
+	return out
+}
+
+// Err returns a *BlockedError if any verdict blocks, nil otherwise.
+func (r Result) Err() error {
+	var blocked []Verdict
+	for _, v := range r.Verdicts {
+		if v.Level == Block {
+			blocked = append(blocked, v)
+		}
+	}
+	if len(blocked) == 0 {
+		return nil
+	}
+	return &BlockedError{Verdicts: blocked}
+}
+
+// BlockedError lists the verdicts that block a change.
+type BlockedError struct {
+	Verdicts []Verdict
+}
+
+func (e *BlockedError) Error() string {
+	lines := make([]string, len(e.Verdicts))
+	for i, v := range e.Verdicts {
+		lines[i] = v.String()
+	}
+	return fmt.Sprintf("%v: %s", ErrBlocked, strings.Join(lines, "; "))
+}
+
+func (e *BlockedError) Unwrap() error {
+	return ErrBlocked
+}
+
+// Engine evaluates coding changes against an overlay tree. A nil Overlays
+// treats every bit as unverified.
+type Engine struct {
+	Overlays *overlay.Overlays
+}
+
+// Evaluate returns a verdict for every bit that differs between old and new.
+func (e *Engine) Evaluate(c Context, old, new []byte) Result {
+	if len(old) != len(new) {
+		return Result{Verdicts: []Verdict{{
+			Name: "coding length", Level: Block,
+			Reasons: []string{fmt.Sprintf("new data is %d bytes, module holds %d", len(new), len(old))},
+		}}}
+	}
+
+	var params []overlay.Parameter
+	if e.Overlays != nil {
+		params = e.Overlays.Parameters(c.Chassis, overlay.ModuleName(c.Hardware))
+	}
+	active := e.activeFeatures(c, params, new)
+
+	var res Result
+	for i := range old {
+		for bit := range 8 {
+			mask := byte(1) << bit
+			if old[i]&mask == new[i]&mask {
+				continue
+			}
+			v := Verdict{Byte: i, Bit: bit, Old: old[i]&mask != 0, New: new[i]&mask != 0}
+			e.judge(&v, c, params, active)
+			res.Verdicts = append(res.Verdicts, v)
+		}
+	}
+	return res
+}
+
+// activeFeatures is the set of features present after the change: the
+// car's equipment plus the IDs of parameters enabled in new.
+func (e *Engine) activeFeatures(c Context, params []overlay.Parameter, new []byte) map[string]bool {
+	active := make(map[string]bool)
+	for _, f := range c.Features {
+		active[f] = true
+	}
+	for _, p := range params {
+		if p.ID != "" && p.AppliesTo(c.Hardware) && bitSet(new, p.Byte, p.Bit) {
+			active[p.ID] = true
+		}
+	}
+	return active
+}
+
+func bitSet(data []byte, byteAddr, bit int) bool {
+	return byteAddr < len(data) && data[byteAddr]&(1<<bit) != 0
+}
+
+func (e *Engine) judge(v *Verdict, c Context, params []overlay.Parameter, active map[string]bool) {
+	var p *overlay.Parameter
+	var other []string
+	for i := range params {
+		if params[i].Byte != v.Byte || params[i].Bit != v.Bit {
+			continue
+		}
+		if params[i].AppliesTo(c.Hardware) {
+			p = &params[i]
+			break
+		}
+		other = append(other, params[i].Hardware...)
+	}
+
+	if p == nil {
+		v.Name, v.Safety = e.label(c, v.Byte, v.Bit), overlay.SafetyUnverified
+		if len(other) > 0 {
+			e.gate(v, c, "only valid for %s, not %s", strings.Join(other, ", "), c.Hardware)
+			return
+		}
+		v.raise(Warn, "unverified — use at your own risk")
+		return
+	}
+
+	v.Name, v.Safety, v.Parameter = p.Name, p.Safety, p
+	switch p.Safety {
+	case overlay.SafetySafe:
+		v.raise(Allow, "rated safe")
+	case overlay.SafetyCaution:
+		v.raise(Warn, "rated caution: check the function after coding")
+	case overlay.SafetyWarning:
+		v.raise(Warn, "rated warning: %s", p.Description)
+	case overlay.SafetyDangerous:
+		e.gate(v, c, "rated dangerous: %s", p.Description)
+	default:
+		e.gate(v, c, "no safety rating")
+	}
+	if p.Reversible != nil && !*p.Reversible {
+		v.raise(Warn, "cannot be undone by restoring the coding")
+	}
+
+	if v.New {
+		for _, req := range p.Requires {
+			if !active[req] {
+				v.raise(Block, "requires %s, which is not present", req)
+			}
+		}
+		for _, con := range p.Conflicts {
+			if active[con] {
+				v.raise(Block, "conflicts with %s", con)
+			}
+		}
+		// A conflict listed only on the other side counts too.
+		for _, q := range params {
+			if p.ID != "" && q.ID != "" && active[q.ID] && q.AppliesTo(c.Hardware) &&
+				slices.Contains(q.Conflicts, p.ID) && !slices.Contains(p.Conflicts, q.ID) {
+				v.raise(Block, "conflicts with %s", q.ID)
+			}
+		}
+	} else if p.ID != "" && !active[p.ID] {
+		for _, q := range params {
+			if q.ID != "" && active[q.ID] && q.AppliesTo(c.Hardware) && slices.Contains(q.Requires, p.ID) {
+				v.raise(Block, "%s stays enabled and requires it", q.Name)
+			}
+		}
+	}
+}
+
+// gate blocks, or only warns in expert mode.
+func (e *Engine) gate(v *Verdict, c Context, format string, args ...any) {
+	if c.ExpertMode {
+		v.raise(Warn, "expert mode: "+format, args...)
+		return
+	}
+	v.raise(Block, format, args...)
+}
+
+func (e *Engine) label(c Context, byteAddr, bit int) string {
+	for _, f := range c.Fields {
+		if f.ByteAddr == byteAddr && f.BitIndex == bit && f.Label != "" {
+			return f.Label
+		}
+	}
+	return fmt.Sprintf("byte %d bit %d", byteAddr, bit)
+}
+
+// ValidateFunc adapts the engine to the pipeline's validate stage. The
+// change's old data is the module's current coding and the request's data
+// the new coding.
+func (e *Engine) ValidateFunc(c Context) pipeline.ValidateFunc {
+	return func(ctx context.Context, ch pipeline.Change) ([]string, error) {
+		res := e.Evaluate(c, ch.Old, ch.Request.Data)
+		if err := res.Err(); err != nil {
+			return nil, err
+		}
+		return res.Warnings(), nil
+	}
+}
@@ -0,0 +1,213 @@
+package rules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/overlay"
+	"github.com/alexcatdad/bavarix/pkg/parser/spdaten"
+	"github.com/alexcatdad/bavarix/pkg/safety/pipeline"
+)
+
+const lsz = `[
+  {"module": "LSZ", "byte": 0, "bit": 0, "id": "drl", "name": "Angel eyes as DRL",
+   "description": "Enables angel eye rings as daytime running lights",
+   "safety": "safe", "reversible": true, "chassis": ["E46"],
+   "requires": ["xenon_headlights"]},
+  {"module": "LSZ", "byte": 0, "bit": 1, "id": "drl_dimmed", "name": "DRL dimmed",
+   "description": "Runs the DRL at reduced brightness",
+   "safety": "caution", "reversible": true, "chassis": ["E46"], "requires": ["drl"]},
+  {"module": "LSZ", "byte": 0, "bit": 2, "id": "fog_drl", "name": "Fog lights as DRL",
+   "description": "Uses the front fog lights as daytime running lights",
+   "safety": "warning", "reversible": true, "chassis": ["E46"], "conflicts": ["drl"]},
+  {"module": "LSZ", "byte": 1, "bit": 0, "name": "Bulb cold monitoring off",
+   "description": "Unlit bulb failures are no longer reported",
+   "safety": "dangerous", "reversible": false, "chassis": ["E46"]},
+  {"module": "LSZ", "byte": 1, "bit": 1, "name": "Xenon levelling",
+   "description": "Only the xenon variants have the levelling output",
+   "safety": "safe", "reversible": true, "chassis": ["E46"], "hardware": ["LSZ.C31"]}
+]`
+
+func engine(t *testing.T) *Engine {
+	t.Helper()
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "E46"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "E46", "LSZ.json"), []byte(lsz), 0o644))
+	o, err := overlay.Load(root)
+	require.NoError(t, err)
+	require.Empty(t, o.Warnings)
+	return &Engine{Overlays: o}
+}
+
+func lszContext() Context {
+	return Context{Chassis: "E46", Hardware: "LSZ.C28", Features: []string{"xenon_headlights"}}
+}
+
+func only(t *testing.T, res Result) Verdict {
+	t.Helper()
+	require.Len(t, res.Verdicts, 1)
+	return res.Verdicts[0]
+}
+
+func TestSafeChangeAllowed(t *testing.T) {
+	v := only(t, engine(t).Evaluate(lszContext(), []byte{0x00, 0x00}, []byte{0x01, 0x00}))
+	assert.Equal(t, Allow, v.Level)
+	assert.Equal(t, "Angel eyes as DRL", v.Name)
+	assert.Equal(t, overlay.SafetySafe, v.Safety)
+	assert.True(t, v.New)
+	assert.False(t, v.Old)
+	require.NotNil(t, v.Parameter)
+	assert.Equal(t, "drl", v.Parameter.ID)
+}
+
+func TestSafetyGates(t *testing.T) {
+	e := engine(t)
+
+	res := e.Evaluate(lszContext(), []byte{0x01, 0x00}, []byte{0x03, 0x00})
+	v := only(t, res)
+	assert.Equal(t, Warn, v.Level)
+	assert.Equal(t, overlay.SafetyCaution, v.Safety)
+	assert.Len(t, res.Warnings(), 1)
+	assert.NoError(t, res.Err())
+
+	res = e.Evaluate(lszContext(), []byte{0x00, 0x00}, []byte{0x04, 0x00})
+	v = only(t, res)
+	assert.Equal(t, Warn, v.Level)
+	assert.Contains(t, v.Reasons[0], "fog lights")
+
+	res = e.Evaluate(lszContext(), []byte{0x00, 0x00}, []byte{0x00, 0x01})
+	v = only(t, res)
+	assert.Equal(t, Block, v.Level)
+	assert.Contains(t, v.Reasons, "cannot be undone by restoring the coding")
+	assert.ErrorIs(t, res.Err(), ErrBlocked)
+
+	// Overlay files cannot hold an unrated parameter, but the engine does
+	// not rely on that.
+	v = Verdict{Byte: 0, Bit: 0, New: true}
+	e.judge(&v, lszContext(), []overlay.Parameter{{Name: "Unrated"}}, nil)
+	assert.Equal(t, Block, v.Level)
+	assert.Equal(t, []string{"no safety rating"}, v.Reasons)
+}
+
+func TestExpertMode(t *testing.T) {
+	c := lszContext()
+	c.ExpertMode = true
+	v := only(t, engine(t).Evaluate(c, []byte{0x00, 0x00}, []byte{0x00, 0x01}))
+	assert.Equal(t, Warn, v.Level)
+	assert.Contains(t, v.Reasons[0], "expert mode")
+}
+
+func TestRequires(t *testing.T) {
+	e := engine(t)
+
+	c := lszContext()
+	c.Features = nil
+	v := only(t, e.Evaluate(c, []byte{0x00, 0x00}, []byte{0x01, 0x00}))
+	assert.Equal(t, Block, v.Level)
+	assert.Contains(t, v.Reasons, "requires xenon_headlights, which is not present")
+
+	// A parameter enabled in the same change satisfies a requirement.
+	res := e.Evaluate(lszContext(), []byte{0x00, 0x00}, []byte{0x03, 0x00})
+	require.Len(t, res.Verdicts, 2)
+	assert.NoError(t, res.Err())
+
+	v = only(t, e.Evaluate(lszContext(), []byte{0x00, 0x00}, []byte{0x02, 0x00}))
+	assert.Equal(t, Block, v.Level)
+	assert.Contains(t, v.Reasons, "requires drl, which is not present")
+
+	// Expert mode does not lift dependency blocks.
+	c = lszContext()
+	c.ExpertMode = true
+	v = only(t, e.Evaluate(c, []byte{0x00, 0x00}, []byte{0x02, 0x00}))
+	assert.Equal(t, Block, v.Level)
+}
+
+func TestDisablingRequiredParameter(t *testing.T) {
+	v := only(t, engine(t).Evaluate(lszContext(), []byte{0x03, 0x00}, []byte{0x02, 0x00}))
+	assert.Equal(t, Block, v.Level)
+	assert.Contains(t, v.Reasons, "DRL dimmed stays enabled and requires it")
+
+	res := engine(t).Evaluate(lszContext(), []byte{0x03, 0x00}, []byte{0x00, 0x00})
+	assert.NoError(t, res.Err())
+}
+
+func TestConflicts(t *testing.T) {
+	res := engine(t).Evaluate(lszContext(), []byte{0x01, 0x00}, []byte{0x05, 0x00})
+	v := only(t, res)
+	assert.Equal(t, Block, v.Level)
+	assert.Contains(t, v.Reasons, "conflicts with drl")
+
+	var be *BlockedError
+	require.ErrorAs(t, res.Err(), &be)
+	assert.Equal(t, []Verdict{v}, be.Verdicts)
+	assert.Contains(t, be.Error(), "Fog lights as DRL")
+
+	// Only fog_drl lists the conflict; enabling drl while it is on is
+	// blocked all the same.
+	v = only(t, engine(t).Evaluate(lszContext(), []byte{0x04, 0x00}, []byte{0x05, 0x00}))
+	assert.Equal(t, Block, v.Level)
+	assert.Equal(t, "Angel eyes as DRL", v.Name)
+	assert.Contains(t, v.Reasons, "conflicts with fog_drl")
+}
+
+func TestHardwareRestriction(t *testing.T) {
+	e := engine(t)
+	v := only(t, e.Evaluate(lszContext(), []byte{0x00, 0x00}, []byte{0x00, 0x02}))
+	assert.Equal(t, Block, v.Level)
+	assert.Nil(t, v.Parameter)
+	assert.Contains(t, v.Reasons[0], "only valid for LSZ.C31")
+
+	c := lszContext()
+	c.Hardware = "LSZ.C31"
+	v = only(t, e.Evaluate(c, []byte{0x00, 0x00}, []byte{0x00, 0x02}))
+	assert.Equal(t, Allow, v.Level)
+	assert.Equal(t, "Xenon levelling", v.Name)
+}
+
+func TestUnverifiedBits(t *testing.T) {
+	c := lszContext()
+	c.Fields = []spdaten.Field{{ByteAddr: 1, BitIndex: 7, Mask: 0x80, Label: "NSW_ALS_TFL"}}
+	res := engine(t).Evaluate(c, []byte{0x00, 0x00}, []byte{0x00, 0x90})
+	require.Len(t, res.Verdicts, 2)
+
+	for _, v := range res.Verdicts {
+		assert.Equal(t, Warn, v.Level)
+		assert.Equal(t, overlay.SafetyUnverified, v.Safety)
+		assert.Equal(t, []string{"unverified — use at your own risk"}, v.Reasons)
+	}
+	assert.Equal(t, "byte 1 bit 4", res.Verdicts[0].Name)
+	assert.Equal(t, "NSW_ALS_TFL", res.Verdicts[1].Name)
+
+	// Without overlays every bit is unverified.
+	v := only(t, (&Engine{}).Evaluate(c, []byte{0x00}, []byte{0x01}))
+	assert.Equal(t, Warn, v.Level)
+}
+
+func TestLengthMismatch(t *testing.T) {
+	res := engine(t).Evaluate(lszContext(), []byte{0x00, 0x00}, []byte{0x00})
+	assert.Equal(t, Block, res.Level())
+	assert.ErrorIs(t, res.Err(), ErrBlocked)
+}
+
+func TestValidateFunc(t *testing.T) {
+	validate := engine(t).ValidateFunc(lszContext())
+
+	warnings, err := validate(context.Background(), pipeline.Change{
+		Old:     []byte{0x01, 0x00},
+		Request: pipeline.WriteRequest{Data: []byte{0x03, 0x00}},
+	})
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "DRL dimmed")
+
+	_, err = validate(context.Background(), pipeline.Change{
+		Old:     []byte{0x00, 0x00},
+		Request: pipeline.WriteRequest{Data: []byte{0x00, 0x01}},
+	})
+	assert.ErrorIs(t, err, ErrBlocked)
+}
@@ -0,0 +1,87 @@
+package vault
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type AuditAction string
+
+const (
+	ActionSave   AuditAction = "save"
+	ActionImport AuditAction = "import"
+	ActionPrune  AuditAction = "prune"
+	// ActionRun is a safety pipeline run, written together with its
+	// record in the hash-chained audit log.
+	ActionRun AuditAction = "run"
+)
+
+// AuditRecord is one change to the vault. Records are written in the same
+// transaction as the change they describe, so there is never a backup
+// without its record or a record without its backup.
+type AuditRecord struct {
+	ID       int64
+	Time     time.Time
+	Action   AuditAction
+	BackupID int64
+	Detail   string
+}
+
+func logAudit(tx *sql.Tx, action AuditAction, backupID int64, detail string) error {
+	var backup sql.NullInt64
+	if backupID != 0 {
+		backup = sql.NullInt64{Int64: backupID, Valid: true}
+	}
+	if _, err := tx.Exec(`INSERT INTO audit (at, action, backup_id, detail) VALUES (?, ?, ?, ?)`,
+		time.Now().UTC(), string(action), backup, detail); err != nil {
+		return fmt.Errorf("vault: writing audit record: %w", err)
+	}
+	return nil
+}
+
+// RecordRun writes the record of a pipeline run that took backup backupID,
+// zero if it stopped before the backup. record is called inside the same
+// transaction to append the run to the hash-chained audit log; it returns
+// the detail to store, which names that record, so each log points at the
+// other. If record fails, nothing is written to the vault.
+func (v *Vault) RecordRun(backupID int64, record func() (string, error)) error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return fmt.Errorf("vault: recording run: %w", err)
+	}
+	defer tx.Rollback()
+	detail, err := record()
+	if err != nil {
+		return err
+	}
+	if err := logAudit(tx, ActionRun, backupID, detail); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("vault: recording run: %w", err)
+	}
+	return nil
+}
+
+// AuditLog returns every audit record, oldest first.
+func (v *Vault) AuditLog() ([]AuditRecord, error) {
+	rows, err := v.db.Query(`SELECT id, at, action, backup_id, detail FROM audit ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("vault: reading audit log: %w", err)
+	}
+	defer rows.Close()
+
+	var records []AuditRecord
+	for rows.Next() {
+		var r AuditRecord
+		var action string
+		var backup sql.NullInt64
+		if err := rows.Scan(&r.ID, &r.Time, &action, &backup, &r.Detail); err != nil {
+			return nil, fmt.Errorf("vault: scanning audit record: %w", err)
+		}
+		r.Action, r.BackupID = AuditAction(action), backup.Int64
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
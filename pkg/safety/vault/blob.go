@@ -0,0 +1,196 @@
+package vault
+
+import (
+	"bytes"
+	"compress/flate"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrCorruptBlob = errors.New("vault: stored data is corrupt")
+
+// Backup data lives in the blobs table keyed by its SHA-256, so identical
+// backups share one row. refs counts the backups pointing at a blob.
+const (
+	compressionNone  = "none"
+	compressionFlate = "flate"
+)
+
+// execer is the part of *sql.DB and *sql.Tx that blob writes need.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// putBlob stores data, or takes another reference to an identical blob,
+// and returns its digest. Data is encrypted when keys is not nil.
+func putBlob(tx execer, keys *keyring, data []byte) (string, error) {
+	sum := hashData(data)
+	res, err := tx.Exec(`UPDATE blobs SET refs = refs + 1 WHERE sha256 = ?`, sum)
+	if err != nil {
+		return "", fmt.Errorf("vault: storing blob: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", fmt.Errorf("vault: storing blob: %w", err)
+	} else if n > 0 {
+		return sum, nil
+	}
+
+	compression, stored, err := compress(data)
+	if err != nil {
+		return "", err
+	}
+	encrypted := keys != nil
+	if encrypted {
+		stored = keys.sealBlob(sum, stored)
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO blobs (sha256, size, compression, data, refs, encrypted) VALUES (?, ?, ?, ?, 1, ?)`,
+		sum, len(data), compression, stored, encrypted,
+	); err != nil {
+		return "", fmt.Errorf("vault: storing blob: %w", err)
+	}
+	return sum, nil
+}
+
+// compress deflates data, keeping it as is when that does not make it
+// smaller.
+func compress(data []byte) (string, []byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", nil, fmt.Errorf("vault: compressing blob: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return "", nil, fmt.Errorf("vault: compressing blob: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", nil, fmt.Errorf("vault: compressing blob: %w", err)
+	}
+	if buf.Len() >= len(data) {
+		return compressionNone, data, nil
+	}
+	return compressionFlate, buf.Bytes(), nil
+}
+
+// readBlob turns stored blob bytes back into the data they hold.
+func (k *keyring) readBlob(sum, compression string, encrypted bool, stored []byte, size int) ([]byte, error) {
+	if encrypted {
+		var err error
+		if stored, err = k.openBlob(sum, stored); err != nil {
+			return nil, err
+		}
+	}
+	return decompress(compression, stored, size)
+}
+
+func decompress(compression string, stored []byte, size int) ([]byte, error) {
+	var data []byte
+	switch compression {
+	case compressionNone:
+		data = stored
+	case compressionFlate:
+		r := flate.NewReader(bytes.NewReader(stored))
+		defer r.Close()
+		var err error
+		if data, err = io.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptBlob, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown compression %q", ErrCorruptBlob, compression)
+	}
+	if len(data) != size {
+		return nil, fmt.Errorf("%w: %d bytes, expected %d", ErrCorruptBlob, len(data), size)
+	}
+	return data, nil
+}
+
+// BlobProblem is one blob that failed verification.
+type BlobProblem struct {
+	SHA256 string
+	// Backups lists the IDs of the backups stored in the blob.
+	Backups []int64
+	Err     error
+}
+
+// VerifyReport is the outcome of Verify.
+type VerifyReport struct {
+	Blobs    int
+	Bytes    int64
+	Problems []BlobProblem
+}
+
+func (r VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Verify re-reads every blob, decompresses it and checks it against its
+// digest, and checks each blob's reference count against the backups that
+// use it. The returned error is for failures to read the database; corrupt
+// blobs are listed in the report.
+func (v *Vault) Verify() (VerifyReport, error) {
+	var report VerifyReport
+	rows, err := v.db.Query(`
+		SELECT b.sha256, b.size, b.compression, b.data, b.encrypted, b.refs,
+			(SELECT COUNT(*) FROM backups WHERE backups.sha256 = b.sha256)
+		FROM blobs b ORDER BY b.sha256`)
+	if err != nil {
+		return report, fmt.Errorf("vault: verifying: %w", err)
+	}
+	for rows.Next() {
+		var sum, compression string
+		var size, refs, used int
+		var stored []byte
+		var encrypted bool
+		if err := rows.Scan(&sum, &size, &compression, &stored, &encrypted, &refs, &used); err != nil {
+			rows.Close()
+			return report, fmt.Errorf("vault: verifying: %w", err)
+		}
+		report.Blobs++
+		report.Bytes += int64(size)
+
+		data, err := v.keys.readBlob(sum, compression, encrypted, stored, size)
+		switch {
+		case err != nil:
+		case hashData(data) != sum:
+			err = fmt.Errorf("%w: digest is %s", ErrCorruptBlob, hashData(data))
+		case refs != used:
+			err = fmt.Errorf("vault: blob has %d references but %d backups use it", refs, used)
+		}
+		if err != nil {
+			report.Problems = append(report.Problems, BlobProblem{SHA256: sum, Err: err})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, fmt.Errorf("vault: verifying: %w", err)
+	}
+
+	for i := range report.Problems {
+		p := &report.Problems[i]
+		ids, err := v.backupIDs(p.SHA256)
+		if err != nil {
+			return report, err
+		}
+		p.Backups = ids
+	}
+	return report, nil
+}
+
+func (v *Vault) backupIDs(sum string) ([]int64, error) {
+	rows, err := v.db.Query(`SELECT id FROM backups WHERE sha256 = ? ORDER BY id`, sum)
+	if err != nil {
+		return nil, fmt.Errorf("vault: verifying: %w", err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("vault: verifying: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
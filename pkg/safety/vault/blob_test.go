@@ -0,0 +1,94 @@
+package vault
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func blobStats(t *testing.T, v *Vault) (count, refs, stored int) {
+	t.Helper()
+	require.NoError(t, v.db.QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM(refs), 0), COALESCE(SUM(LENGTH(data)), 0) FROM blobs`,
+	).Scan(&count, &refs, &stored))
+	return count, refs, stored
+}
+
+func TestIdenticalBackupsShareBlob(t *testing.T) {
+	v := tempVault(t)
+	flash := bytes.Repeat([]byte{0xFF, 0x00, 0x12, 0x34}, 64*1024)
+
+	for range 3 {
+		_, err := v.SaveWithMetadata("E46", "DME", "MS43", flash, Metadata{Format: FormatFlash})
+		require.NoError(t, err)
+	}
+	require.NoError(t, v.Save("E46", "DME", "MS43", []byte{0x01}))
+
+	count, refs, stored := blobStats(t, v)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 4, refs)
+	assert.Less(t, stored, len(flash)/10, "repetitive flash data compresses")
+
+	entries, err := v.List("E46", "DME")
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	assert.Equal(t, []byte{0x01}, entries[0].Data)
+	assert.Equal(t, flash, entries[3].Data)
+	assert.True(t, entries[3].Intact())
+}
+
+func TestIncompressibleBlobStoredRaw(t *testing.T) {
+	v := tempVault(t)
+	require.NoError(t, v.Save("E46", "GM5", "C05", []byte{0x9C}))
+
+	var compression string
+	require.NoError(t, v.db.QueryRow(`SELECT compression FROM blobs`).Scan(&compression))
+	assert.Equal(t, compressionNone, compression)
+
+	e, err := v.Latest("E46", "GM5")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x9C}, e.Data)
+}
+
+func TestVerify(t *testing.T) {
+	v := tempVault(t)
+	good := bytes.Repeat([]byte{0x11}, 256)
+	bad := bytes.Repeat([]byte{0x22}, 256)
+	require.NoError(t, v.Save("E46", "GM5", "C05", good))
+	badID, err := v.SaveWithMetadata("E46", "LCM", "A1", bad, Metadata{})
+	require.NoError(t, err)
+
+	report, err := v.Verify()
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 2, report.Blobs)
+	assert.EqualValues(t, 512, report.Bytes)
+
+	// Flip a byte of the stored (compressed) data behind the vault's back.
+	var stored []byte
+	require.NoError(t, v.db.QueryRow(`SELECT data FROM blobs WHERE sha256 = ?`, hashData(bad)).Scan(&stored))
+	stored[len(stored)/2] ^= 0x01
+	_, err = v.db.Exec(`UPDATE blobs SET data = ? WHERE sha256 = ?`, stored, hashData(bad))
+	require.NoError(t, err)
+
+	report, err = v.Verify()
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	assert.Equal(t, hashData(bad), report.Problems[0].SHA256)
+	assert.Equal(t, []int64{badID}, report.Problems[0].Backups)
+	assert.ErrorIs(t, report.Problems[0].Err, ErrCorruptBlob)
+}
+
+func TestVerifyReferenceCount(t *testing.T) {
+	v := tempVault(t)
+	require.NoError(t, v.Save("E46", "GM5", "C05", []byte{0x01}))
+	_, err := v.db.Exec(`UPDATE blobs SET refs = 5`)
+	require.NoError(t, err)
+
+	report, err := v.Verify()
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	assert.Contains(t, report.Problems[0].Err.Error(), "5 references but 1")
+}
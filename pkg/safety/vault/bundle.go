@@ -0,0 +1,312 @@
+package vault
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// A bundle is a tar archive that carries backups between vaults:
+//
+//	manifest.json        the Manifest, describing every entry
+//	manifest.sig         optional ed25519 signature of manifest.json
+//	blobs/<sha256>       the data of each entry, uncompressed
+//
+// The manifest holds each entry's SHA-256 and the signer's public key, so
+// one signature covers the manifest and, through the digests, every blob.
+const (
+	BundleVersion = 1
+
+	manifestName  = "manifest.json"
+	signatureName = "manifest.sig"
+	blobDir       = "blobs/"
+)
+
+var (
+	ErrInvalidBundle   = errors.New("vault: invalid bundle")
+	ErrBadSignature    = errors.New("vault: bundle signature does not verify")
+	ErrUnsigned        = errors.New("vault: bundle is not signed")
+	ErrUntrustedSigner = errors.New("vault: bundle is signed by an untrusted key")
+)
+
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Signer is the hex public key that signed the bundle, if any.
+	Signer  string          `json:"signer,omitempty"`
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry describes one backup. ID is its ID in the exporting vault
+// and is informational only.
+type ManifestEntry struct {
+	ID             int64     `json:"id"`
+	Chassis        string    `json:"chassis"`
+	Module         string    `json:"module"`
+	Version        string    `json:"version"`
+	CreatedAt      time.Time `json:"created_at"`
+	Size           int       `json:"size"`
+	SHA256         string    `json:"sha256"`
+	VIN            string    `json:"vin,omitempty"`
+	HardwareNumber string    `json:"hardware_number,omitempty"`
+	SoftwareNumber string    `json:"software_number,omitempty"`
+	CodingIndex    string    `json:"coding_index,omitempty"`
+	Operation      string    `json:"operation,omitempty"`
+	ToolVersion    string    `json:"tool_version,omitempty"`
+	Format         string    `json:"format"`
+	Note           string    `json:"note,omitempty"`
+	Tags           []string  `json:"tags,omitempty"`
+}
+
+func manifestEntry(e Entry) ManifestEntry {
+	return ManifestEntry{
+		ID: e.ID, Chassis: e.Chassis, Module: e.Module, Version: e.Version,
+		CreatedAt: e.CreatedAt.UTC(), Size: len(e.Data), SHA256: e.SHA256,
+		VIN: e.VIN, HardwareNumber: e.HardwareNumber, SoftwareNumber: e.SoftwareNumber,
+		CodingIndex: e.CodingIndex, Operation: e.Operation, ToolVersion: e.ToolVersion,
+		Format: string(e.Format), Note: e.Note, Tags: e.Tags,
+	}
+}
+
+func (m ManifestEntry) entry(data []byte) Entry {
+	return Entry{
+		Chassis: m.Chassis, Module: m.Module, Version: m.Version, Data: data, CreatedAt: m.CreatedAt,
+		Metadata: Metadata{
+			VIN: m.VIN, HardwareNumber: m.HardwareNumber, SoftwareNumber: m.SoftwareNumber,
+			CodingIndex: m.CodingIndex, Operation: m.Operation, ToolVersion: m.ToolVersion,
+			Format: DataFormat(m.Format), Note: m.Note, Tags: m.Tags,
+		},
+		SHA256: m.SHA256,
+	}
+}
+
+type ExportOptions struct {
+	// SigningKey, when set, signs the manifest.
+	SigningKey ed25519.PrivateKey
+}
+
+// Export writes the backups with the given IDs to w as a bundle. Entries
+// that fail their own checksum are refused rather than exported.
+func (v *Vault) Export(w io.Writer, ids []int64, opts ExportOptions) (Manifest, error) {
+	m := Manifest{Version: BundleVersion, Created: time.Now().UTC(), Entries: []ManifestEntry{}}
+	blobs := make(map[string][]byte)
+	for _, id := range ids {
+		e, err := v.Get(id)
+		if err != nil {
+			return Manifest{}, err
+		}
+		if !e.Intact() {
+			return Manifest{}, fmt.Errorf("%w: backup %d", ErrCorruptBlob, id)
+		}
+		m.Entries = append(m.Entries, manifestEntry(e))
+		blobs[e.SHA256] = e.Data
+	}
+	if opts.SigningKey != nil {
+		m.Signer = hex.EncodeToString(opts.SigningKey.Public().(ed25519.PublicKey))
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return Manifest{}, fmt.Errorf("vault: encoding manifest: %w", err)
+	}
+	tw := tar.NewWriter(w)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: m.Created, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("vault: writing bundle: %w", err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("vault: writing bundle: %w", err)
+		}
+		return nil
+	}
+
+	if err := add(manifestName, manifest); err != nil {
+		return Manifest{}, err
+	}
+	if opts.SigningKey != nil {
+		if err := add(signatureName, ed25519.Sign(opts.SigningKey, manifest)); err != nil {
+			return Manifest{}, err
+		}
+	}
+	sums := make([]string, 0, len(blobs))
+	for sum := range blobs {
+		sums = append(sums, sum)
+	}
+	slices.Sort(sums)
+	for _, sum := range sums {
+		if err := add(blobDir+sum, blobs[sum]); err != nil {
+			return Manifest{}, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return Manifest{}, fmt.Errorf("vault: writing bundle: %w", err)
+	}
+	return m, nil
+}
+
+type ImportOptions struct {
+	// TrustedKeys, when not empty, makes a signature mandatory: unsigned
+	// bundles and bundles signed by any other key are refused. Without
+	// trusted keys a signature proves nothing, since the manifest names its
+	// own signer, and every bundle is treated as unsigned.
+	TrustedKeys []ed25519.PublicKey
+}
+
+type ImportResult struct {
+	Manifest Manifest
+	// Signer is the trusted key that signed the bundle, nil if it was
+	// unsigned or no trusted keys were given.
+	Signer ed25519.PublicKey
+	// Imported holds the new IDs of the entries added, in manifest order.
+	Imported []int64
+	// Duplicates counts entries the vault already held.
+	Duplicates int
+}
+
+// Import reads a bundle and adds its entries to the vault. The whole bundle
+// is checked first — signature, then every entry's size and SHA-256 — and
+// nothing is stored unless all of it passes. Entries matching an existing
+// backup's chassis, module, version, creation time and data are skipped.
+func (v *Vault) Import(r io.Reader, opts ImportOptions) (ImportResult, error) {
+	files, err := readBundle(r)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	raw, ok := files[manifestName]
+	if !ok {
+		return ImportResult{}, fmt.Errorf("%w: no %s", ErrInvalidBundle, manifestName)
+	}
+	var res ImportResult
+	if err := json.Unmarshal(raw, &res.Manifest); err != nil {
+		return ImportResult{}, fmt.Errorf("%w: %w", ErrInvalidBundle, err)
+	}
+	m := res.Manifest
+	if m.Version != BundleVersion {
+		return ImportResult{}, fmt.Errorf("%w: version %d, expected %d", ErrInvalidBundle, m.Version, BundleVersion)
+	}
+
+	if res.Signer, err = checkSignature(m, raw, files[signatureName], opts); err != nil {
+		return ImportResult{}, err
+	}
+
+	entries := make([]Entry, len(m.Entries))
+	for i, me := range m.Entries {
+		data, ok := files[blobDir+me.SHA256]
+		switch {
+		case !ok:
+			return ImportResult{}, fmt.Errorf("%w: entry %d: missing blob %s", ErrInvalidBundle, i+1, me.SHA256)
+		case len(data) != me.Size || hashData(data) != me.SHA256:
+			return ImportResult{}, fmt.Errorf("%w: entry %d (%s %s): data does not match its SHA-256",
+				ErrInvalidBundle, i+1, me.Chassis, me.Module)
+		}
+		entries[i] = me.entry(data)
+	}
+
+	tx, err := v.db.Begin()
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("vault: importing: %w", err)
+	}
+	defer tx.Rollback()
+	if err := v.checkKey(tx); err != nil {
+		return ImportResult{}, err
+	}
+	for i, e := range entries {
+		dup, err := hasEntry(tx, v.keys, e)
+		if err != nil {
+			return ImportResult{}, err
+		}
+		if dup {
+			res.Duplicates++
+			continue
+		}
+		id, err := insertEntry(tx, v.keys, e)
+		if err != nil {
+			return ImportResult{}, err
+		}
+		detail := fmt.Sprintf("%s %s %s from bundle entry %d", e.Chassis, e.Module, e.Version, m.Entries[i].ID)
+		if res.Signer != nil {
+			detail += ", signed by " + m.Signer
+		}
+		if err := logAudit(tx, ActionImport, id, detail); err != nil {
+			return ImportResult{}, err
+		}
+		res.Imported = append(res.Imported, id)
+	}
+	if err := tx.Commit(); err != nil {
+		return ImportResult{}, fmt.Errorf("vault: importing: %w", err)
+	}
+	return res, nil
+}
+
+func readBundle(r io.Reader) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidBundle, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidBundle, hdr.Name, err)
+		}
+		files[hdr.Name] = buf.Bytes()
+	}
+}
+
+func checkSignature(m Manifest, manifest, sig []byte, opts ImportOptions) (ed25519.PublicKey, error) {
+	if sig == nil {
+		if len(opts.TrustedKeys) > 0 {
+			return nil, ErrUnsigned
+		}
+		return nil, nil
+	}
+	key, err := hex.DecodeString(m.Signer)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: manifest has no valid signer key", ErrBadSignature)
+	}
+	signer := ed25519.PublicKey(key)
+	if !ed25519.Verify(signer, manifest, sig) {
+		return nil, ErrBadSignature
+	}
+	if len(opts.TrustedKeys) == 0 {
+		return nil, nil
+	}
+	trusted := slices.ContainsFunc(opts.TrustedKeys, func(k ed25519.PublicKey) bool {
+		return k.Equal(signer)
+	})
+	if !trusted {
+		return nil, fmt.Errorf("%w: %s", ErrUntrustedSigner, m.Signer)
+	}
+	return signer, nil
+}
+
+func hasEntry(tx *sql.Tx, keys *keyring, e Entry) (bool, error) {
+	existing, err := queryEntries(tx, keys, "checking for duplicates",
+		`SELECT `+entryColumns+entryJoin+` WHERE backups.sha256 = ? AND chassis = ? AND module = ? AND version = ?`,
+		e.SHA256, e.Chassis, e.Module, e.Version)
+	if err != nil {
+		return false, err
+	}
+	for _, x := range existing {
+		if x.CreatedAt.Equal(e.CreatedAt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
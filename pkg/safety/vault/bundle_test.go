@@ -0,0 +1,193 @@
+package vault
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func seedBundleVault(t *testing.T) (*Vault, []int64) {
+	t.Helper()
+	v := tempVault(t)
+	var ids []int64
+	for _, e := range []struct {
+		module string
+		data   []byte
+		meta   Metadata
+	}{
+		{"GM5", []byte{0x01, 0x02}, Metadata{VIN: "WBAAV31070FZ12345", Tags: []string{"before-retrofit"}}},
+		{"DME", bytes.Repeat([]byte{0xAA}, 4096), Metadata{Format: FormatFlash, HardwareNumber: "7519308"}},
+		{"LCM", []byte{0x01, 0x02}, Metadata{Note: "same data as GM5"}},
+	} {
+		id, err := v.SaveWithMetadata("E46", e.module, "v1", e.data, e.meta)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	return v, ids
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	src, ids := seedBundleVault(t)
+	var buf bytes.Buffer
+	m, err := src.Export(&buf, ids, ExportOptions{})
+	require.NoError(t, err)
+	assert.Len(t, m.Entries, 3)
+	assert.Empty(t, m.Signer)
+
+	dst := tempVault(t)
+	res, err := dst.Import(bytes.NewReader(buf.Bytes()), ImportOptions{})
+	require.NoError(t, err)
+	assert.Len(t, res.Imported, 3)
+	assert.Nil(t, res.Signer)
+
+	for i, id := range ids {
+		want, err := src.Get(id)
+		require.NoError(t, err)
+		got, err := dst.Get(res.Imported[i])
+		require.NoError(t, err)
+		assert.Equal(t, want.Data, got.Data)
+		assert.Equal(t, want.Metadata, got.Metadata)
+		assert.Equal(t, want.SHA256, got.SHA256)
+		assert.True(t, want.CreatedAt.Equal(got.CreatedAt))
+	}
+
+	count, refs, _ := blobStats(t, dst)
+	assert.Equal(t, 2, count, "GM5 and LCM share a blob")
+	assert.Equal(t, 3, refs)
+}
+
+func TestImportDeduplicates(t *testing.T) {
+	v, ids := seedBundleVault(t)
+	var buf bytes.Buffer
+	_, err := v.Export(&buf, ids, ExportOptions{})
+	require.NoError(t, err)
+
+	res, err := v.Import(bytes.NewReader(buf.Bytes()), ImportOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, res.Imported)
+	assert.Equal(t, 3, res.Duplicates)
+
+	other := tempVault(t)
+	_, err = other.Import(bytes.NewReader(buf.Bytes()), ImportOptions{})
+	require.NoError(t, err)
+	res, err = other.Import(bytes.NewReader(buf.Bytes()), ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Duplicates)
+}
+
+func TestSignedBundle(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	src, ids := seedBundleVault(t)
+	var buf bytes.Buffer
+	_, err = src.Export(&buf, ids, ExportOptions{SigningKey: priv})
+	require.NoError(t, err)
+
+	res, err := tempVault(t).Import(bytes.NewReader(buf.Bytes()), ImportOptions{TrustedKeys: []ed25519.PublicKey{pub}})
+	require.NoError(t, err)
+	assert.Equal(t, pub, res.Signer)
+	assert.Len(t, res.Imported, 3)
+
+	_, err = tempVault(t).Import(bytes.NewReader(buf.Bytes()), ImportOptions{TrustedKeys: []ed25519.PublicKey{otherPub}})
+	assert.ErrorIs(t, err, ErrUntrustedSigner)
+}
+
+func TestSignedBundleWithoutTrustedKeysIsUnsigned(t *testing.T) {
+	// Anyone can sign a bundle with a fresh key and name it in the
+	// manifest, so without a trust anchor the signature means nothing.
+	_, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	src, ids := seedBundleVault(t)
+	var buf bytes.Buffer
+	_, err = src.Export(&buf, ids, ExportOptions{SigningKey: priv})
+	require.NoError(t, err)
+
+	dst := tempVault(t)
+	res, err := dst.Import(bytes.NewReader(buf.Bytes()), ImportOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, res.Signer)
+	trail, err := dst.AuditLog()
+	require.NoError(t, err)
+	for _, a := range trail {
+		assert.NotContains(t, a.Detail, "signed by")
+	}
+}
+
+func TestImportRequiresSignature(t *testing.T) {
+	src, ids := seedBundleVault(t)
+	var buf bytes.Buffer
+	_, err := src.Export(&buf, ids, ExportOptions{})
+	require.NoError(t, err)
+
+	dst := tempVault(t)
+	pub, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, err = dst.Import(bytes.NewReader(buf.Bytes()), ImportOptions{TrustedKeys: []ed25519.PublicKey{pub}})
+	assert.ErrorIs(t, err, ErrUnsigned)
+	entries, err := dst.List("E46", "GM5")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// rewriteBundle copies a bundle, passing each file through edit.
+func rewriteBundle(t *testing.T, bundle []byte, edit func(name string, data []byte) []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(bundle))
+	tw := tar.NewWriter(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		data = edit(hdr.Name, data)
+		hdr.Size = int64(len(data))
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return out.Bytes()
+}
+
+func TestImportRejectsTampering(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	src, ids := seedBundleVault(t)
+	var buf bytes.Buffer
+	_, err = src.Export(&buf, ids, ExportOptions{SigningKey: priv})
+	require.NoError(t, err)
+
+	tamperedBlob := rewriteBundle(t, buf.Bytes(), func(name string, data []byte) []byte {
+		if name == blobDir+hashData([]byte{0x01, 0x02}) {
+			return []byte{0x01, 0x03}
+		}
+		return data
+	})
+	dst := tempVault(t)
+	_, err = dst.Import(bytes.NewReader(tamperedBlob), ImportOptions{})
+	assert.ErrorIs(t, err, ErrInvalidBundle)
+	entries, err := dst.List("E46", "DME")
+	require.NoError(t, err)
+	assert.Empty(t, entries, "nothing is imported from a bad bundle")
+
+	tamperedManifest := rewriteBundle(t, buf.Bytes(), func(name string, data []byte) []byte {
+		if name == manifestName {
+			return bytes.Replace(data, []byte(`"GM5"`), []byte(`"GM3"`), 1)
+		}
+		return data
+	})
+	_, err = tempVault(t).Import(bytes.NewReader(tamperedManifest), ImportOptions{})
+	assert.ErrorIs(t, err, ErrBadSignature)
+}
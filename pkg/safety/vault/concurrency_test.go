@@ -0,0 +1,158 @@
+package vault
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const savesPerWorker = 25
+
+// workerData is distinct per worker and save, except that every worker's
+// first save is identical so workers also race on a shared blob.
+func workerData(worker, i int) []byte {
+	if i == 0 {
+		return []byte("shared")
+	}
+	return []byte(fmt.Sprintf("worker %d save %d", worker, i))
+}
+
+func saveAll(v *Vault, worker int) error {
+	for i := range savesPerWorker {
+		if _, err := v.SaveWithMetadata("E46", "GM5", strconv.Itoa(worker), workerData(worker, i), Metadata{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWorkers asserts every save of every worker is present, intact and
+// audited, and that blob reference counts add up.
+func checkWorkers(t *testing.T, v *Vault, workers int) {
+	t.Helper()
+	entries, err := v.List("E46", "GM5")
+	require.NoError(t, err)
+	assert.Len(t, entries, workers*savesPerWorker)
+
+	got := make(map[string]bool)
+	for _, e := range entries {
+		assert.True(t, e.Intact(), "backup %d", e.ID)
+		got[e.Version+"/"+string(e.Data)] = true
+	}
+	for w := range workers {
+		for i := range savesPerWorker {
+			assert.True(t, got[strconv.Itoa(w)+"/"+string(workerData(w, i))], "worker %d save %d", w, i)
+		}
+	}
+
+	report, err := v.Verify()
+	require.NoError(t, err)
+	assert.True(t, report.OK(), "%+v", report.Problems)
+
+	log, err := v.AuditLog()
+	require.NoError(t, err)
+	assert.Len(t, log, workers*savesPerWorker)
+}
+
+func TestConcurrentSaves(t *testing.T) {
+	v := tempVault(t)
+	const workers = 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- saveAll(v, w)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	checkWorkers(t, v, workers)
+}
+
+// TestSaveHelperProcess is run by TestMultiProcessSaves in child processes.
+func TestSaveHelperProcess(t *testing.T) {
+	path := os.Getenv("VAULT_HELPER_PATH")
+	if path == "" {
+		t.Skip("only runs as a helper process")
+	}
+	worker, err := strconv.Atoi(os.Getenv("VAULT_HELPER_WORKER"))
+	require.NoError(t, err)
+
+	v, err := Open(path)
+	require.NoError(t, err)
+	defer v.Close()
+	require.NoError(t, saveAll(v, worker))
+}
+
+func TestMultiProcessSaves(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns processes")
+	}
+	path := filepath.Join(t.TempDir(), "vault.db")
+	const workers = 4
+
+	// The children race to create and migrate the vault as well.
+	cmds := make([]*exec.Cmd, workers)
+	for w := range cmds {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSaveHelperProcess$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "VAULT_HELPER_PATH="+path, "VAULT_HELPER_WORKER="+strconv.Itoa(w))
+		require.NoError(t, cmd.Start())
+		cmds[w] = cmd
+	}
+	for w, cmd := range cmds {
+		require.NoError(t, cmd.Wait(), "worker %d", w)
+	}
+
+	v, err := Open(path)
+	require.NoError(t, err)
+	defer v.Close()
+	checkWorkers(t, v, workers)
+}
+
+func TestWALMode(t *testing.T) {
+	v := tempVault(t)
+	var mode string
+	require.NoError(t, v.db.QueryRow(`PRAGMA journal_mode`).Scan(&mode))
+	assert.Equal(t, "wal", mode)
+}
+
+func TestSaveAndAuditAreAtomic(t *testing.T) {
+	v := tempVault(t)
+	_, err := v.db.Exec(`DROP TABLE audit`)
+	require.NoError(t, err)
+
+	_, err = v.SaveWithMetadata("E46", "GM5", "C05", []byte{0x01}, Metadata{})
+	require.Error(t, err)
+
+	var backups, blobs int
+	require.NoError(t, v.db.QueryRow(`SELECT COUNT(*) FROM backups`).Scan(&backups))
+	require.NoError(t, v.db.QueryRow(`SELECT COUNT(*) FROM blobs`).Scan(&blobs))
+	assert.Zero(t, backups)
+	assert.Zero(t, blobs)
+}
+
+func TestAuditLog(t *testing.T) {
+	v := tempVault(t)
+	id, err := v.SaveWithMetadata("E46", "GM5", "C05", []byte{0x01, 0x02}, Metadata{})
+	require.NoError(t, err)
+
+	log, err := v.AuditLog()
+	require.NoError(t, err)
+	require.Len(t, log, 1)
+	assert.Equal(t, ActionSave, log[0].Action)
+	assert.Equal(t, id, log[0].BackupID)
+	assert.Equal(t, "E46 GM5 C05, 2 bytes", log[0].Detail)
+}
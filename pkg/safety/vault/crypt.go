@@ -0,0 +1,387 @@
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// An encrypted vault keeps a random data key in the vault_key table,
+// sealed with a key derived from the passphrase by argon2id. The data key
+// seals blob contents and the VIN and note columns with AES-256-GCM. VINs
+// are also stored as a keyed hash so FindByVIN still works. Blobs remain
+// addressed by the SHA-256 of their plaintext, which reveals only whether
+// the vault holds an image the reader already has.
+var (
+	ErrEncrypted       = errors.New("vault: vault is encrypted; open it with its passphrase")
+	ErrWrongPassphrase = errors.New("vault: wrong passphrase")
+	ErrNotEncrypted    = errors.New("vault: vault is not encrypted")
+	ErrKeyChanged      = errors.New("vault: vault was encrypted or rekeyed by another handle; reopen it")
+
+	errKeyExists = errors.New("vault: vault was encrypted concurrently")
+)
+
+type kdfParams struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+}
+
+// defaultKDF follows the argon2id recommendation in RFC 9106 for
+// memory-constrained machines.
+var defaultKDF = kdfParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+const (
+	sealedPrefix = "enc1:"
+	keyAAD       = "bavarix vault key"
+)
+
+// keyring holds the subkeys derived from an unsealed data key. A nil
+// *keyring means the vault is not encrypted and every method is a no-op.
+type keyring struct {
+	aead  cipher.AEAD
+	index []byte
+}
+
+func newKeyring(dataKey []byte) (*keyring, error) {
+	enc, err := hkdf.Key(sha256.New, dataKey, nil, "bavarix vault encryption", 32)
+	if err != nil {
+		return nil, err
+	}
+	index, err := hkdf.Key(sha256.New, dataKey, nil, "bavarix vault index", 32)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(enc)
+	if err != nil {
+		return nil, err
+	}
+	return &keyring{aead: aead, index: index}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plain, aad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plain, aad)
+}
+
+func unseal(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], aad)
+}
+
+// sealBlob encrypts stored blob bytes, bound to the blob's digest so blobs
+// cannot be swapped.
+func (k *keyring) sealBlob(sum string, stored []byte) []byte {
+	return seal(k.aead, stored, []byte(sum))
+}
+
+func (k *keyring) openBlob(sum string, sealed []byte) ([]byte, error) {
+	if k == nil {
+		return nil, ErrEncrypted
+	}
+	data, err := unseal(k.aead, sealed, []byte(sum))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptBlob, err)
+	}
+	return data, nil
+}
+
+// sealText encrypts a column value, bound to the column name.
+func (k *keyring) sealText(column, s string) string {
+	if k == nil || s == "" {
+		return s
+	}
+	return sealedPrefix + base64.StdEncoding.EncodeToString(seal(k.aead, []byte(s), []byte(column)))
+}
+
+func (k *keyring) openText(column, s string) (string, error) {
+	enc, ok := strings.CutPrefix(s, sealedPrefix)
+	if !ok {
+		return s, nil
+	}
+	if k == nil {
+		return "", ErrEncrypted
+	}
+	sealed, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return "", fmt.Errorf("vault: decoding %s: %w", column, err)
+	}
+	plain, err := unseal(k.aead, sealed, []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("vault: decrypting %s: %w", column, err)
+	}
+	return string(plain), nil
+}
+
+// vinIndex is the searchable form of a VIN: the VIN itself in a plain vault,
+// a keyed hash in an encrypted one.
+func (k *keyring) vinIndex(vin string) string {
+	if k == nil || vin == "" {
+		return vin
+	}
+	mac := hmac.New(sha256.New, k.index)
+	mac.Write([]byte(vin))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func deriveKey(passphrase string, salt []byte, p kdfParams) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, p.Time, p.Memory, p.Threads, 32)
+}
+
+// OpenEncrypted opens an encrypted vault. A vault that is not encrypted
+// yet, including a new one, is encrypted with passphrase first.
+func OpenEncrypted(path, passphrase string) (*Vault, error) {
+	if passphrase == "" {
+		return nil, errors.New("vault: empty passphrase")
+	}
+	return open(path, passphrase)
+}
+
+// Encrypted reports whether the vault encrypts its data.
+func (v *Vault) Encrypted() bool {
+	return v.keys != nil
+}
+
+// VINIndex returns the form of vin the vault searches by: the upper-case
+// VIN in a plain vault, a keyed hash in an encrypted one. Records kept
+// outside an encrypted vault store this rather than the VIN. Rekey changes
+// the key, so indexes taken before a rekey no longer match.
+func (v *Vault) VINIndex(vin string) string {
+	return v.keys.vinIndex(strings.ToUpper(vin))
+}
+
+// unlock loads the vault's data key, if it has one.
+func (v *Vault) unlock(passphrase string) error {
+	var kdf string
+	var salt, wrapped []byte
+	var p kdfParams
+	var gen int64
+	err := v.db.QueryRow(`SELECT kdf, salt, time, memory, threads, wrapped, generation FROM vault_key`).
+		Scan(&kdf, &salt, &p.Time, &p.Memory, &p.Threads, &wrapped, &gen)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if passphrase == "" || v.readOnly {
+			return nil
+		}
+		// Another process may encrypt the vault between the read above and
+		// rekey's write transaction; if so, unlock with its key instead.
+		if err := v.rekey(passphrase); !errors.Is(err, errKeyExists) {
+			return err
+		}
+		return v.unlock(passphrase)
+	case err != nil:
+		return fmt.Errorf("vault: reading key: %w", err)
+	case passphrase == "":
+		return ErrEncrypted
+	case kdf != "argon2id":
+		return fmt.Errorf("vault: unsupported key derivation %q", kdf)
+	}
+
+	aead, err := newAEAD(deriveKey(passphrase, salt, p))
+	if err != nil {
+		return fmt.Errorf("vault: unsealing key: %w", err)
+	}
+	dataKey, err := unseal(aead, wrapped, []byte(keyAAD))
+	if err != nil {
+		return ErrWrongPassphrase
+	}
+	keys, err := newKeyring(dataKey)
+	if err != nil {
+		return fmt.Errorf("vault: unsealing key: %w", err)
+	}
+	v.keys, v.gen = keys, gen
+	return nil
+}
+
+// checkKey fails when the vault's data key is no longer the one this handle
+// unlocked, so a stale handle never stores data the others cannot read or
+// plaintext in an encrypted vault. Write transactions start IMMEDIATE and
+// hold the write lock, so the key cannot change again before they commit.
+func (v *Vault) checkKey(tx *sql.Tx) error {
+	var gen int64
+	err := tx.QueryRow(`SELECT generation FROM vault_key`).Scan(&gen)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("vault: reading key: %w", err)
+	}
+	if gen != v.gen {
+		return ErrKeyChanged
+	}
+	return nil
+}
+
+// Rekey replaces the data key and passphrase of an encrypted vault and
+// re-encrypts everything under the new key, in one transaction. Use it
+// when the passphrase or a copy of the vault may have leaked. Other handles
+// open on the vault refuse further writes with ErrKeyChanged.
+func (v *Vault) Rekey(newPassphrase string) error {
+	if v.keys == nil {
+		return ErrNotEncrypted
+	}
+	if newPassphrase == "" {
+		return errors.New("vault: empty passphrase")
+	}
+	return v.rekey(newPassphrase)
+}
+
+// rekey seals the vault under a new data key and passphrase. It also turns
+// a plain vault into an encrypted one.
+func (v *Vault) rekey(passphrase string) error {
+	dataKey := make([]byte, 32)
+	rand.Read(dataKey)
+	keys, err := newKeyring(dataKey)
+	if err != nil {
+		return fmt.Errorf("vault: creating key: %w", err)
+	}
+
+	tx, err := v.db.Begin()
+	if err != nil {
+		return fmt.Errorf("vault: rekeying: %w", err)
+	}
+	defer tx.Rollback()
+	if v.keys == nil {
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM vault_key`).Scan(&n); err != nil {
+			return fmt.Errorf("vault: rekeying: %w", err)
+		}
+		if n > 0 {
+			return errKeyExists
+		}
+	}
+	if err := v.checkKey(tx); err != nil {
+		return err
+	}
+	if err := reencrypt(tx, v.keys, keys); err != nil {
+		return fmt.Errorf("vault: rekeying: %w", err)
+	}
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	p := defaultKDF
+	aead, err := newAEAD(deriveKey(passphrase, salt, p))
+	if err != nil {
+		return fmt.Errorf("vault: sealing key: %w", err)
+	}
+	gen := v.gen + 1
+	if _, err := tx.Exec(`
+		INSERT OR REPLACE INTO vault_key (id, kdf, salt, time, memory, threads, wrapped, created_at, generation)
+		VALUES (1, 'argon2id', ?, ?, ?, ?, ?, ?, ?)`,
+		salt, p.Time, p.Memory, p.Threads, seal(aead, dataKey, []byte(keyAAD)), time.Now().UTC(), gen,
+	); err != nil {
+		return fmt.Errorf("vault: storing key: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("vault: rekeying: %w", err)
+	}
+	v.keys, v.gen = keys, gen
+
+	// Rewrite the file so freed pages no longer hold the old plaintext or
+	// ciphertext, then fold the WAL back in and truncate it, since it holds
+	// copies of those pages too.
+	if _, err := v.db.Exec(`VACUUM`); err != nil {
+		return fmt.Errorf("vault: compacting after rekey: %w", err)
+	}
+	if _, err := v.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return fmt.Errorf("vault: checkpointing after rekey: %w", err)
+	}
+	return nil
+}
+
+// reencrypt moves every blob and sealed column from old to keys. old is
+// nil when the vault was not encrypted before.
+func reencrypt(tx *sql.Tx, old, keys *keyring) error {
+	type blob struct {
+		sum       string
+		stored    []byte
+		encrypted bool
+	}
+	var blobs []blob
+	rows, err := tx.Query(`SELECT sha256, data, encrypted FROM blobs`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var b blob
+		if err := rows.Scan(&b.sum, &b.stored, &b.encrypted); err != nil {
+			rows.Close()
+			return err
+		}
+		blobs = append(blobs, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		plain := b.stored
+		if b.encrypted {
+			if plain, err = old.openBlob(b.sum, b.stored); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`UPDATE blobs SET data = ?, encrypted = 1 WHERE sha256 = ?`,
+			keys.sealBlob(b.sum, plain), b.sum); err != nil {
+			return err
+		}
+	}
+
+	type row struct {
+		id        int64
+		vin, note string
+	}
+	var backups []row
+	rows, err = tx.Query(`SELECT id, vin, note FROM backups`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.vin, &r.note); err != nil {
+			rows.Close()
+			return err
+		}
+		backups = append(backups, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, r := range backups {
+		vin, err := old.openText("vin", r.vin)
+		if err != nil {
+			return err
+		}
+		note, err := old.openText("note", r.note)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE backups SET vin = ?, vin_index = ?, note = ? WHERE id = ?`,
+			keys.sealText("vin", vin), keys.vinIndex(vin), keys.sealText("note", note), r.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
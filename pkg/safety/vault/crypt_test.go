@@ -0,0 +1,177 @@
+package vault
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testVIN  = "WBAAV31070FZ12345"
+	testPass = "correct horse battery staple"
+)
+
+// fastKDF keeps argon2 cheap for the duration of a test.
+func fastKDF(t *testing.T) {
+	t.Helper()
+	saved := defaultKDF
+	defaultKDF = kdfParams{Time: 1, Memory: 64, Threads: 1}
+	t.Cleanup(func() { defaultKDF = saved })
+}
+
+// immo is recognisable and incompressible enough to survive into the file.
+var immo = []byte("ISN=0123456789ABCDEF;EWS-SECRET-KEY-MATERIAL")
+
+func assertNotInFile(t *testing.T, path string, secrets ...[]byte) {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	for _, s := range secrets {
+		assert.False(t, bytes.Contains(raw, s), "%q found in database file", s)
+	}
+}
+
+func TestEncryptedVault(t *testing.T) {
+	fastKDF(t)
+	path := filepath.Join(t.TempDir(), "vault.db")
+	v, err := OpenEncrypted(path, testPass)
+	require.NoError(t, err)
+	assert.True(t, v.Encrypted())
+	id, err := v.SaveWithMetadata("E46", "EWS", "3", immo, Metadata{VIN: testVIN, Note: "customer Jane Doe", Format: FormatEEPROM})
+	require.NoError(t, err)
+	require.NoError(t, v.Close())
+
+	assertNotInFile(t, path, immo, []byte(testVIN), []byte("Jane Doe"))
+
+	_, err = Open(path)
+	assert.ErrorIs(t, err, ErrEncrypted)
+	_, err = OpenEncrypted(path, "wrong")
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+	_, err = OpenReadOnly(path, "")
+	assert.ErrorIs(t, err, ErrEncrypted)
+
+	ro, err := OpenReadOnly(path, testPass)
+	require.NoError(t, err)
+	assert.True(t, ro.Encrypted())
+	index := ro.VINIndex(testVIN)
+	require.NoError(t, ro.Close())
+
+	v, err = OpenEncrypted(path, testPass)
+	require.NoError(t, err)
+	defer v.Close()
+	e, err := v.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, immo, e.Data)
+	assert.Equal(t, testVIN, e.VIN)
+	assert.Equal(t, "customer Jane Doe", e.Note)
+	assert.True(t, e.Intact())
+
+	found, err := v.FindByVIN(testVIN)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, id, found[0].ID)
+	assert.Equal(t, v.VINIndex(testVIN), index)
+
+	report, err := v.Verify()
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+}
+
+func TestEncryptExistingVault(t *testing.T) {
+	fastKDF(t)
+	path := filepath.Join(t.TempDir(), "vault.db")
+	v, err := Open(path)
+	require.NoError(t, err)
+	assert.False(t, v.Encrypted())
+	_, err = v.SaveWithMetadata("E46", "EWS", "3", immo, Metadata{VIN: testVIN})
+	require.NoError(t, err)
+	require.NoError(t, v.Close())
+
+	v, err = OpenEncrypted(path, testPass)
+	require.NoError(t, err)
+	e, err := v.Latest("E46", "EWS")
+	require.NoError(t, err)
+	assert.Equal(t, immo, e.Data)
+	assert.Equal(t, testVIN, e.VIN)
+	require.NoError(t, v.Close())
+	assertNotInFile(t, path, immo, []byte(testVIN))
+}
+
+func TestRekey(t *testing.T) {
+	fastKDF(t)
+	path := filepath.Join(t.TempDir(), "vault.db")
+	v, err := OpenEncrypted(path, testPass)
+	require.NoError(t, err)
+	_, err = v.SaveWithMetadata("E46", "EWS", "3", immo, Metadata{VIN: testVIN})
+	require.NoError(t, err)
+	var before []byte
+	require.NoError(t, v.db.QueryRow(`SELECT data FROM blobs`).Scan(&before))
+
+	require.NoError(t, v.Rekey("new passphrase"))
+	var after []byte
+	require.NoError(t, v.db.QueryRow(`SELECT data FROM blobs`).Scan(&after))
+	assert.NotEqual(t, before, after, "blobs are re-encrypted")
+	require.NoError(t, v.Close())
+
+	_, err = OpenEncrypted(path, testPass)
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+
+	v, err = OpenEncrypted(path, "new passphrase")
+	require.NoError(t, err)
+	defer v.Close()
+	found, err := v.FindByVIN(testVIN)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, immo, found[0].Data)
+}
+
+func TestRekeyPlainVault(t *testing.T) {
+	v := tempVault(t)
+	assert.ErrorIs(t, v.Rekey(testPass), ErrNotEncrypted)
+}
+
+func TestRekeyStopsStaleHandles(t *testing.T) {
+	fastKDF(t)
+	path := filepath.Join(t.TempDir(), "vault.db")
+	a, err := OpenEncrypted(path, testPass)
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := OpenEncrypted(path, testPass)
+	require.NoError(t, err)
+	defer b.Close()
+
+	require.NoError(t, a.Rekey("new passphrase"))
+	_, err = b.SaveWithMetadata("E46", "EWS", "3", immo, Metadata{VIN: testVIN})
+	assert.ErrorIs(t, err, ErrKeyChanged)
+	assert.ErrorIs(t, b.Rekey("third passphrase"), ErrKeyChanged)
+
+	id, err := a.SaveWithMetadata("E46", "EWS", "3", immo, Metadata{VIN: testVIN})
+	require.NoError(t, err)
+	c, err := OpenEncrypted(path, "new passphrase")
+	require.NoError(t, err)
+	defer c.Close()
+	e, err := c.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, immo, e.Data)
+}
+
+func TestEncryptStopsPlainHandles(t *testing.T) {
+	fastKDF(t)
+	path := filepath.Join(t.TempDir(), "vault.db")
+	plain, err := Open(path)
+	require.NoError(t, err)
+	defer plain.Close()
+
+	enc, err := OpenEncrypted(path, testPass)
+	require.NoError(t, err)
+	defer enc.Close()
+
+	_, err = plain.SaveWithMetadata("E46", "EWS", "3", immo, Metadata{VIN: testVIN})
+	assert.ErrorIs(t, err, ErrKeyChanged)
+	require.NoError(t, enc.Close())
+	assertNotInFile(t, path, immo, []byte(testVIN))
+}
@@ -0,0 +1,270 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+// migration upgrades the schema by one version inside a transaction.
+type migration func(tx *sql.Tx) error
+
+// migrations are applied in order; the database's PRAGMA user_version
+// records how many have run. Append only: never edit or reorder a
+// migration that has shipped.
+var migrations = []migration{
+	// 1: the original backups table. IF NOT EXISTS adopts databases created
+	// before migrations existed.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS backups (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				chassis TEXT NOT NULL,
+				module TEXT NOT NULL,
+				version TEXT NOT NULL,
+				data BLOB NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)
+		`)
+		return err
+	},
+
+	// 2: module identity and provenance metadata.
+	func(tx *sql.Tx) error {
+		for _, col := range []string{
+			`vin TEXT NOT NULL DEFAULT ''`,
+			`hardware_number TEXT NOT NULL DEFAULT ''`,
+			`software_number TEXT NOT NULL DEFAULT ''`,
+			`coding_index TEXT NOT NULL DEFAULT ''`,
+			`operation TEXT NOT NULL DEFAULT ''`,
+			`tool_version TEXT NOT NULL DEFAULT ''`,
+			`format TEXT NOT NULL DEFAULT 'coding'`,
+			`sha256 TEXT NOT NULL DEFAULT ''`,
+			`note TEXT NOT NULL DEFAULT ''`,
+			`tags TEXT NOT NULL DEFAULT '[]'`,
+		} {
+			if _, err := tx.Exec(`ALTER TABLE backups ADD COLUMN ` + col); err != nil {
+				return err
+			}
+		}
+		for _, idx := range []string{
+			`CREATE INDEX backups_chassis_module ON backups (chassis, module)`,
+			`CREATE INDEX backups_vin ON backups (vin)`,
+			`CREATE INDEX backups_hardware_number ON backups (hardware_number)`,
+		} {
+			if _, err := tx.Exec(idx); err != nil {
+				return err
+			}
+		}
+		return backfillHashes(tx)
+	},
+
+	// 3: restore journal.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE restores (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				source_id INTEGER NOT NULL REFERENCES backups (id),
+				backup_id INTEGER REFERENCES backups (id),
+				status TEXT NOT NULL,
+				error TEXT NOT NULL DEFAULT '',
+				started_at DATETIME NOT NULL,
+				finished_at DATETIME
+			);
+			CREATE TABLE restore_steps (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				restore_id INTEGER NOT NULL REFERENCES restores (id),
+				step TEXT NOT NULL,
+				status TEXT NOT NULL,
+				message TEXT NOT NULL DEFAULT '',
+				at DATETIME NOT NULL
+			);
+			CREATE INDEX restore_steps_restore ON restore_steps (restore_id);
+		`)
+		return err
+	},
+
+	// 4: move backup data into compressed, content-addressed blobs.
+	func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			CREATE TABLE blobs (
+				sha256 TEXT PRIMARY KEY,
+				size INTEGER NOT NULL,
+				compression TEXT NOT NULL,
+				data BLOB NOT NULL,
+				refs INTEGER NOT NULL
+			)
+		`); err != nil {
+			return err
+		}
+		rows, err := tx.Query(`SELECT id, data FROM backups`)
+		if err != nil {
+			return err
+		}
+		blobs := make(map[int64][]byte)
+		for rows.Next() {
+			var id int64
+			var data []byte
+			if err := rows.Scan(&id, &data); err != nil {
+				rows.Close()
+				return err
+			}
+			blobs[id] = data
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Written out rather than using putBlob, which follows the current
+		// schema.
+		for id, data := range blobs {
+			sum := hashData(data)
+			compression, stored, err := compress(data)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`
+				INSERT INTO blobs (sha256, size, compression, data, refs) VALUES (?, ?, ?, ?, 1)
+				ON CONFLICT (sha256) DO UPDATE SET refs = refs + 1`,
+				sum, len(data), compression, stored); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE backups SET sha256 = ? WHERE id = ?`, sum, id); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(`ALTER TABLE backups DROP COLUMN data`)
+		return err
+	},
+
+	// 5: encryption at rest.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE vault_key (
+				id INTEGER PRIMARY KEY CHECK (id = 1),
+				kdf TEXT NOT NULL,
+				salt BLOB NOT NULL,
+				time INTEGER NOT NULL,
+				memory INTEGER NOT NULL,
+				threads INTEGER NOT NULL,
+				wrapped BLOB NOT NULL,
+				created_at DATETIME NOT NULL
+			);
+			ALTER TABLE blobs ADD COLUMN encrypted INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE backups ADD COLUMN vin_index TEXT NOT NULL DEFAULT '';
+			UPDATE backups SET vin_index = vin;
+			DROP INDEX backups_vin;
+			CREATE INDEX backups_vin_index ON backups (vin_index);
+		`)
+		return err
+	},
+
+	// 6: audit records written in the same transaction as the change.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE audit (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				at DATETIME NOT NULL,
+				action TEXT NOT NULL,
+				backup_id INTEGER,
+				detail TEXT NOT NULL DEFAULT ''
+			);
+			CREATE INDEX audit_backup ON audit (backup_id);
+		`)
+		return err
+	},
+
+	// 7: key generation, bumped by every rekey so open handles notice.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`ALTER TABLE vault_key ADD COLUMN generation INTEGER NOT NULL DEFAULT 1`)
+		return err
+	},
+}
+
+func backfillHashes(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, data FROM backups WHERE sha256 = ''`)
+	if err != nil {
+		return err
+	}
+	hashes := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes[id] = hashData(data)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, sum := range hashes {
+		if _, err := tx.Exec(`UPDATE backups SET sha256 = ? WHERE id = ?`, sum, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaVersion returns the number of migrations applied to the database.
+func (v *Vault) SchemaVersion() (int, error) {
+	var n int
+	if err := v.db.QueryRow(`PRAGMA user_version`).Scan(&n); err != nil {
+		return 0, fmt.Errorf("vault: reading schema version: %w", err)
+	}
+	return n, nil
+}
+
+// migrate applies pending migrations one transaction at a time. The
+// version is re-read inside each write transaction, so processes opening
+// the same vault at once never apply a migration twice.
+func (v *Vault) migrate() error {
+	for {
+		done, err := v.migrateOne()
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+func (v *Vault) migrateOne() (bool, error) {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("vault: migrating: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current int
+	if err := tx.QueryRow(`PRAGMA user_version`).Scan(&current); err != nil {
+		return false, fmt.Errorf("vault: reading schema version: %w", err)
+	}
+	if current > len(migrations) {
+		return false, fmt.Errorf("%w: database is at version %d, this build knows %d",
+			ErrSchemaTooNew, current, len(migrations))
+	}
+	if current == len(migrations) {
+		return true, nil
+	}
+
+	if err := migrations[current](tx); err != nil {
+		return false, fmt.Errorf("vault: migration %d: %w", current+1, err)
+	}
+	// PRAGMA does not take bound parameters.
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, current+1)); err != nil {
+		return false, fmt.Errorf("vault: migration %d: %w", current+1, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("vault: migration %d: %w", current+1, err)
+	}
+	return false, nil
+}
+
+func hashData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
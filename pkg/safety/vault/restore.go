@@ -0,0 +1,121 @@
+package vault
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type RestoreStatus string
+
+const (
+	RestoreStarted   RestoreStatus = "started"
+	RestoreSucceeded RestoreStatus = "succeeded"
+	RestoreFailed    RestoreStatus = "failed"
+)
+
+// Restore is the journal of one attempt to write a backup back to a module.
+type Restore struct {
+	ID int64
+	// SourceID is the backup being restored.
+	SourceID int64
+	// BackupID is the backup of the module's state taken just before the
+	// restore wrote anything; restoring it undoes the restore. Zero if the
+	// restore stopped before that point.
+	BackupID   int64
+	Status     RestoreStatus
+	Error      string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Steps      []RestoreStep
+}
+
+type RestoreStep struct {
+	Step    string
+	Status  string
+	Message string
+	At      time.Time
+}
+
+// StartRestore opens a journal entry for restoring backup sourceID.
+func (v *Vault) StartRestore(sourceID int64) (int64, error) {
+	res, err := v.db.Exec(
+		`INSERT INTO restores (source_id, status, started_at) VALUES (?, ?, ?)`,
+		sourceID, string(RestoreStarted), time.Now().UTC(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("vault: starting restore: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("vault: starting restore: %w", err)
+	}
+	return id, nil
+}
+
+// LogRestoreStep appends one step to a restore's journal.
+func (v *Vault) LogRestoreStep(restoreID int64, step, status, message string) error {
+	_, err := v.db.Exec(
+		`INSERT INTO restore_steps (restore_id, step, status, message, at) VALUES (?, ?, ?, ?, ?)`,
+		restoreID, step, status, message, time.Now().UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("vault: logging restore step: %w", err)
+	}
+	return nil
+}
+
+// FinishRestore closes a restore's journal. backupID is the pre-restore
+// backup, or zero if none was taken; a nil failure marks success.
+func (v *Vault) FinishRestore(restoreID, backupID int64, failure error) error {
+	status, msg := RestoreSucceeded, ""
+	if failure != nil {
+		status, msg = RestoreFailed, failure.Error()
+	}
+	var backup sql.NullInt64
+	if backupID != 0 {
+		backup = sql.NullInt64{Int64: backupID, Valid: true}
+	}
+
+	_, err := v.db.Exec(
+		`UPDATE restores SET backup_id = ?, status = ?, error = ?, finished_at = ? WHERE id = ?`,
+		backup, string(status), msg, time.Now().UTC(), restoreID,
+	)
+	if err != nil {
+		return fmt.Errorf("vault: finishing restore: %w", err)
+	}
+	return nil
+}
+
+// GetRestore returns a restore journal with its steps in order.
+func (v *Vault) GetRestore(id int64) (Restore, error) {
+	var r Restore
+	var backup sql.NullInt64
+	var finished sql.NullTime
+	var status string
+	err := v.db.QueryRow(
+		`SELECT id, source_id, backup_id, status, error, started_at, finished_at FROM restores WHERE id = ?`, id,
+	).Scan(&r.ID, &r.SourceID, &backup, &status, &r.Error, &r.StartedAt, &finished)
+	if err == sql.ErrNoRows {
+		return Restore{}, fmt.Errorf("vault: no restore with id %d", id)
+	}
+	if err != nil {
+		return Restore{}, fmt.Errorf("vault: reading restore: %w", err)
+	}
+	r.BackupID, r.Status, r.FinishedAt = backup.Int64, RestoreStatus(status), finished.Time
+
+	rows, err := v.db.Query(
+		`SELECT step, status, message, at FROM restore_steps WHERE restore_id = ? ORDER BY id`, id)
+	if err != nil {
+		return Restore{}, fmt.Errorf("vault: reading restore steps: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s RestoreStep
+		if err := rows.Scan(&s.Step, &s.Status, &s.Message, &s.At); err != nil {
+			return Restore{}, fmt.Errorf("vault: scanning restore step: %w", err)
+		}
+		r.Steps = append(r.Steps, s)
+	}
+	return r, rows.Err()
+}
@@ -0,0 +1,321 @@
+package vault
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+var ErrInvalidRetention = errors.New("vault: invalid retention policy")
+
+// RetentionPolicy says which backups Prune keeps. Backups are grouped by
+// chassis, module and VIN; every rule applies per group and a backup is
+// kept if any rule keeps it. Whatever the policy, Prune never deletes the
+// last backup of a group whose data still verifies, nor a backup a restore
+// journal refers to, nor a backup without a VIN, since nothing shows which
+// car it came from or whether a newer one replaces it.
+type RetentionPolicy struct {
+	// KeepFirst keeps the oldest backup of each group: the module as it
+	// left the factory or arrived at the shop.
+	KeepFirst bool `json:"keep_first"`
+	// KeepPreWrite keeps every backup the safety pipeline took before a
+	// write, i.e. every backup with an Operation.
+	KeepPreWrite bool `json:"keep_pre_write"`
+	// KeepPreWriteLast keeps the N newest backups taken before a write. It
+	// bounds the history when KeepPreWrite is off.
+	KeepPreWriteLast int `json:"keep_pre_write_last"`
+	// KeepDaily keeps the newest backup of each of the N most recent days
+	// (UTC) that have backups.
+	KeepDaily int `json:"keep_daily"`
+	// KeepLast keeps the N newest backups.
+	KeepLast int `json:"keep_last"`
+}
+
+func DefaultRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{KeepFirst: true, KeepPreWrite: true, KeepDaily: 7, KeepLast: 3}
+}
+
+func ParseRetentionPolicy(data []byte) (RetentionPolicy, error) {
+	p := DefaultRetentionPolicy()
+	if err := json.Unmarshal(data, &p); err != nil {
+		return RetentionPolicy{}, fmt.Errorf("%w: %w", ErrInvalidRetention, err)
+	}
+	return p, p.Validate()
+}
+
+func LoadRetentionPolicy(path string) (RetentionPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RetentionPolicy{}, fmt.Errorf("vault: reading retention policy: %w", err)
+	}
+	return ParseRetentionPolicy(data)
+}
+
+func (p RetentionPolicy) Validate() error {
+	if p.KeepDaily < 0 || p.KeepLast < 0 || p.KeepPreWriteLast < 0 {
+		return fmt.Errorf("%w: counts must not be negative", ErrInvalidRetention)
+	}
+	return nil
+}
+
+// PruneItem is one backup as Prune saw it. Reasons says why it is kept and
+// is empty for deleted backups.
+type PruneItem struct {
+	ID        int64
+	Chassis   string
+	Module    string
+	VIN       string
+	Operation string
+	CreatedAt time.Time
+	Size      int
+	Reasons   []string
+	sha256    string
+}
+
+type PruneReport struct {
+	DryRun  bool
+	Kept    []PruneItem
+	Deleted []PruneItem
+	// FreedBytes is the uncompressed size of the blobs no backup uses any
+	// more.
+	FreedBytes int64
+}
+
+// Prune deletes the backups policy does not keep, in one transaction with
+// an audit record per deleted backup. With dryRun nothing is changed and
+// the report says what would have been deleted.
+func (v *Vault) Prune(policy RetentionPolicy, dryRun bool) (PruneReport, error) {
+	if err := policy.Validate(); err != nil {
+		return PruneReport{}, err
+	}
+	tx, err := v.db.Begin()
+	if err != nil {
+		return PruneReport{}, fmt.Errorf("vault: pruning: %w", err)
+	}
+	defer tx.Rollback()
+
+	items, err := v.pruneItems(tx)
+	if err != nil {
+		return PruneReport{}, err
+	}
+	journaled, err := journaledBackups(tx)
+	if err != nil {
+		return PruneReport{}, err
+	}
+
+	report := PruneReport{DryRun: dryRun}
+	for _, group := range groupItems(items) {
+		policy.mark(group, journaled)
+		if err := v.keepKnownGood(tx, group); err != nil {
+			return PruneReport{}, err
+		}
+		for _, it := range group {
+			if len(it.Reasons) > 0 {
+				report.Kept = append(report.Kept, *it)
+			} else {
+				report.Deleted = append(report.Deleted, *it)
+			}
+		}
+	}
+	byID := func(a, b PruneItem) int { return cmp.Compare(a.ID, b.ID) }
+	slices.SortFunc(report.Kept, byID)
+	slices.SortFunc(report.Deleted, byID)
+
+	for _, it := range report.Deleted {
+		freed, err := deleteBackup(tx, it)
+		if err != nil {
+			return PruneReport{}, err
+		}
+		report.FreedBytes += freed
+	}
+	if dryRun {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return PruneReport{}, fmt.Errorf("vault: pruning: %w", err)
+	}
+	return report, nil
+}
+
+// pruneItems lists every backup without loading its data.
+func (v *Vault) pruneItems(tx *sql.Tx) ([]*PruneItem, error) {
+	rows, err := tx.Query(`
+		SELECT backups.id, chassis, module, vin, operation, created_at, blobs.size, backups.sha256
+		FROM backups JOIN blobs ON blobs.sha256 = backups.sha256
+		ORDER BY backups.id`)
+	if err != nil {
+		return nil, fmt.Errorf("vault: pruning: %w", err)
+	}
+	defer rows.Close()
+	var items []*PruneItem
+	for rows.Next() {
+		it := &PruneItem{}
+		if err := rows.Scan(&it.ID, &it.Chassis, &it.Module, &it.VIN, &it.Operation,
+			&it.CreatedAt, &it.Size, &it.sha256); err != nil {
+			return nil, fmt.Errorf("vault: pruning: %w", err)
+		}
+		if it.VIN, err = v.keys.openText("vin", it.VIN); err != nil {
+			return nil, fmt.Errorf("vault: backup %d: %w", it.ID, err)
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+func journaledBackups(tx *sql.Tx) (map[int64]bool, error) {
+	rows, err := tx.Query(`
+		SELECT source_id FROM restores
+		UNION SELECT backup_id FROM restores WHERE backup_id IS NOT NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("vault: pruning: %w", err)
+	}
+	defer rows.Close()
+	ids := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("vault: pruning: %w", err)
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// groupItems splits items, which are in ID order, by chassis, module and
+// VIN. A backup without a VIN forms a group of its own. Each group is
+// newest first.
+func groupItems(items []*PruneItem) [][]*PruneItem {
+	type key struct {
+		chassis, module, vin string
+		id                   int64
+	}
+	index := make(map[key]int)
+	var groups [][]*PruneItem
+	for _, it := range items {
+		k := key{it.Chassis, it.Module, it.VIN, 0}
+		if it.VIN == "" {
+			k.id = it.ID
+		}
+		i, ok := index[k]
+		if !ok {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], it)
+	}
+	for _, g := range groups {
+		slices.Reverse(g)
+	}
+	return groups
+}
+
+func (p RetentionPolicy) mark(group []*PruneItem, journaled map[int64]bool) {
+	keep := func(it *PruneItem, reason string) {
+		it.Reasons = append(it.Reasons, reason)
+	}
+	days := make(map[string]bool)
+	writes := 0
+	for i, it := range group {
+		if it.VIN == "" {
+			keep(it, "no VIN to tell its car apart")
+		}
+		if i < p.KeepLast {
+			keep(it, fmt.Sprintf("one of the %d newest", p.KeepLast))
+		}
+		if day := it.CreatedAt.UTC().Format(time.DateOnly); !days[day] && len(days) < p.KeepDaily {
+			days[day] = true
+			keep(it, "daily snapshot for "+day)
+		}
+		if it.Operation != "" {
+			writes++
+			if p.KeepPreWrite {
+				keep(it, "taken before a "+it.Operation+" write")
+			} else if writes <= p.KeepPreWriteLast {
+				keep(it, fmt.Sprintf("one of the %d newest taken before a write", p.KeepPreWriteLast))
+			}
+		}
+		if journaled[it.ID] {
+			keep(it, "referenced by a restore")
+		}
+	}
+	if p.KeepFirst && len(group) > 0 {
+		keep(group[len(group)-1], "first backup")
+	}
+}
+
+// keepKnownGood makes sure the group keeps a backup whose data verifies:
+// the newest kept one if any does, otherwise the newest one that does.
+func (v *Vault) keepKnownGood(tx *sql.Tx, group []*PruneItem) error {
+	verified := make(map[string]bool)
+	good := func(it *PruneItem) (bool, error) {
+		ok, seen := verified[it.sha256]
+		if !seen {
+			var err error
+			if ok, err = v.blobVerifies(tx, it.sha256); err != nil {
+				return false, err
+			}
+			verified[it.sha256] = ok
+		}
+		return ok, nil
+	}
+
+	for _, kept := range []bool{true, false} {
+		for _, it := range group {
+			if (len(it.Reasons) > 0) != kept {
+				continue
+			}
+			ok, err := good(it)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if !kept {
+					it.Reasons = append(it.Reasons, "only known-good state")
+				}
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (v *Vault) blobVerifies(tx *sql.Tx, sum string) (bool, error) {
+	var compression string
+	var stored []byte
+	var size int
+	var encrypted bool
+	err := tx.QueryRow(`SELECT compression, data, size, encrypted FROM blobs WHERE sha256 = ?`, sum).
+		Scan(&compression, &stored, &size, &encrypted)
+	if err != nil {
+		return false, fmt.Errorf("vault: pruning: %w", err)
+	}
+	data, err := v.keys.readBlob(sum, compression, encrypted, stored, size)
+	return err == nil && hashData(data) == sum, nil
+}
+
+// deleteBackup removes a backup, drops its blob when no other backup uses
+// it, and returns the bytes freed.
+func deleteBackup(tx *sql.Tx, it PruneItem) (int64, error) {
+	if _, err := tx.Exec(`DELETE FROM backups WHERE id = ?`, it.ID); err != nil {
+		return 0, fmt.Errorf("vault: deleting backup %d: %w", it.ID, err)
+	}
+	if _, err := tx.Exec(`UPDATE blobs SET refs = refs - 1 WHERE sha256 = ?`, it.sha256); err != nil {
+		return 0, fmt.Errorf("vault: deleting backup %d: %w", it.ID, err)
+	}
+	res, err := tx.Exec(`DELETE FROM blobs WHERE sha256 = ? AND refs <= 0`, it.sha256)
+	if err != nil {
+		return 0, fmt.Errorf("vault: deleting backup %d: %w", it.ID, err)
+	}
+	var freed int64
+	if n, _ := res.RowsAffected(); n > 0 {
+		freed = int64(it.Size)
+	}
+	detail := fmt.Sprintf("%s %s, %d bytes, taken %s", it.Chassis, it.Module, it.Size, it.CreatedAt.UTC().Format(time.RFC3339))
+	return freed, logAudit(tx, ActionPrune, it.ID, detail)
+}
@@ -0,0 +1,190 @@
+package vault
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var day0 = time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+
+func saveAt(t *testing.T, v *Vault, at time.Time, data []byte, meta Metadata) int64 {
+	t.Helper()
+	tx, err := v.db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+	id, err := insertEntry(tx, v.keys, Entry{Chassis: "E46", Module: "GM5", Version: "C05", Data: data, CreatedAt: at, Metadata: meta})
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+	return id
+}
+
+// seedDays saves two backups a day for five days and returns their IDs,
+// oldest first.
+func seedDays(t *testing.T, v *Vault) []int64 {
+	t.Helper()
+	var ids []int64
+	for d := range 5 {
+		for h := range 2 {
+			at := day0.AddDate(0, 0, d).Add(time.Duration(h) * time.Hour)
+			ids = append(ids, saveAt(t, v, at, []byte{byte(d), byte(h)}, Metadata{VIN: testVIN}))
+		}
+	}
+	return ids
+}
+
+func itemIDs(items []PruneItem) []int64 {
+	var ids []int64
+	for _, it := range items {
+		ids = append(ids, it.ID)
+	}
+	return ids
+}
+
+func TestPruneDryRun(t *testing.T) {
+	v := tempVault(t)
+	ids := seedDays(t, v)
+	policy := RetentionPolicy{KeepFirst: true, KeepDaily: 2, KeepLast: 1}
+
+	report, err := v.Prune(policy, true)
+	require.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, []int64{ids[0], ids[7], ids[9]}, itemIDs(report.Kept))
+	assert.Len(t, report.Deleted, 7)
+	assert.EqualValues(t, 14, report.FreedBytes)
+
+	entries, err := v.List("E46", "GM5")
+	require.NoError(t, err)
+	assert.Len(t, entries, 10, "dry run deletes nothing")
+	log, err := v.AuditLog()
+	require.NoError(t, err)
+	assert.Len(t, log, 0)
+}
+
+func TestPrune(t *testing.T) {
+	v := tempVault(t)
+	ids := seedDays(t, v)
+	policy := RetentionPolicy{KeepFirst: true, KeepDaily: 2, KeepLast: 1}
+
+	report, err := v.Prune(policy, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"one of the 1 newest", "daily snapshot for 2024-03-05"}, report.Kept[2].Reasons)
+	assert.Equal(t, []string{"first backup"}, report.Kept[0].Reasons)
+
+	entries, err := v.List("E46", "GM5")
+	require.NoError(t, err)
+	var left []int64
+	for _, e := range entries {
+		left = append(left, e.ID)
+	}
+	assert.Equal(t, []int64{ids[9], ids[7], ids[0]}, left)
+
+	count, refs, _ := blobStats(t, v)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, 3, refs)
+	verify, err := v.Verify()
+	require.NoError(t, err)
+	assert.True(t, verify.OK())
+
+	log, err := v.AuditLog()
+	require.NoError(t, err)
+	assert.Len(t, log, 7)
+	assert.Equal(t, ActionPrune, log[0].Action)
+
+	// Pruning again with the same policy changes nothing.
+	report, err = v.Prune(policy, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Deleted)
+}
+
+func TestPruneKeepsPreWriteAndJournaled(t *testing.T) {
+	v := tempVault(t)
+	oldFlash := saveAt(t, v, day0.Add(-2*time.Hour), []byte{0x05}, Metadata{VIN: testVIN, Operation: "flash"})
+	flash := saveAt(t, v, day0.Add(-time.Hour), []byte{0x06}, Metadata{VIN: testVIN, Operation: "flash"})
+	preWrite := saveAt(t, v, day0, []byte{0x01}, Metadata{VIN: testVIN, Operation: "coding"})
+	restored := saveAt(t, v, day0.Add(time.Hour), []byte{0x02}, Metadata{VIN: testVIN})
+	plain := saveAt(t, v, day0.Add(2*time.Hour), []byte{0x03}, Metadata{VIN: testVIN})
+	newest := saveAt(t, v, day0.Add(3*time.Hour), []byte{0x04}, Metadata{VIN: testVIN})
+	rid, err := v.StartRestore(restored)
+	require.NoError(t, err)
+	require.NoError(t, v.FinishRestore(rid, 0, nil))
+
+	report, err := v.Prune(RetentionPolicy{KeepPreWrite: true, KeepLast: 1}, true)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{oldFlash, flash, preWrite, restored, newest}, itemIDs(report.Kept))
+	assert.Equal(t, []int64{plain}, itemIDs(report.Deleted))
+	assert.Equal(t, []string{"taken before a flash write"}, report.Kept[0].Reasons)
+
+	// A cap keeps only the newest pre-write backups.
+	report, err = v.Prune(RetentionPolicy{KeepPreWriteLast: 2, KeepLast: 1}, false)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{flash, preWrite, restored, newest}, itemIDs(report.Kept))
+	assert.Equal(t, []int64{oldFlash, plain}, itemIDs(report.Deleted))
+}
+
+func TestPruneKeepsBackupsWithoutVIN(t *testing.T) {
+	// Two cars' backups without a VIN look like one module's history;
+	// pruning the older would delete the only backup of the first car.
+	v := tempVault(t)
+	first := saveAt(t, v, day0, []byte{0x01}, Metadata{})
+	second := saveAt(t, v, day0.Add(time.Hour), []byte{0x02}, Metadata{})
+	vin := saveAt(t, v, day0.Add(2*time.Hour), []byte{0x03}, Metadata{VIN: testVIN})
+	saveAt(t, v, day0.Add(3*time.Hour), []byte{0x04}, Metadata{VIN: testVIN})
+
+	report, err := v.Prune(RetentionPolicy{KeepLast: 1}, true)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{first, second, vin + 1}, itemIDs(report.Kept))
+	assert.Contains(t, report.Kept[0].Reasons, "no VIN to tell its car apart")
+	assert.Equal(t, []int64{vin}, itemIDs(report.Deleted))
+}
+
+func TestPruneNeverRemovesLastKnownGood(t *testing.T) {
+	v := tempVault(t)
+	good := saveAt(t, v, day0, []byte("good"), Metadata{VIN: testVIN})
+	corrupt := saveAt(t, v, day0.Add(time.Hour), []byte("soon corrupt"), Metadata{VIN: testVIN})
+	_, err := v.db.Exec(`UPDATE blobs SET data = x'00' WHERE sha256 = ?`, hashData([]byte("soon corrupt")))
+	require.NoError(t, err)
+
+	// Keep only the newest, which is corrupt: the older intact backup must
+	// survive as the module's only known-good state.
+	report, err := v.Prune(RetentionPolicy{KeepLast: 1}, true)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{good, corrupt}, itemIDs(report.Kept))
+	assert.Equal(t, []string{"only known-good state"}, report.Kept[0].Reasons)
+
+	// A policy that keeps nothing still keeps one good backup.
+	report, err = v.Prune(RetentionPolicy{}, true)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{good}, itemIDs(report.Kept))
+}
+
+func TestPruneGroupsByVIN(t *testing.T) {
+	v := tempVault(t)
+	a := saveAt(t, v, day0, []byte{0x01}, Metadata{VIN: testVIN})
+	b := saveAt(t, v, day0.Add(time.Hour), []byte{0x01}, Metadata{VIN: "WBAEV33473KL67890"})
+	saveAt(t, v, day0.Add(2*time.Hour), []byte{0x02}, Metadata{VIN: testVIN})
+
+	report, err := v.Prune(RetentionPolicy{KeepFirst: true}, false)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{a, b}, itemIDs(report.Kept))
+
+	// The blob shared by both VINs' first backups is still there.
+	count, refs, _ := blobStats(t, v)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 2, refs)
+}
+
+func TestParseRetentionPolicy(t *testing.T) {
+	p, err := ParseRetentionPolicy([]byte(`{"keep_daily": 30}`))
+	require.NoError(t, err)
+	assert.Equal(t, 30, p.KeepDaily)
+	assert.True(t, p.KeepFirst, "unset fields keep their defaults")
+
+	_, err = ParseRetentionPolicy([]byte(`{"keep_pre_write_last": -1}`))
+	assert.ErrorIs(t, err, ErrInvalidRetention)
+
+	_, err = ParseRetentionPolicy([]byte(`{"keep_last": -1}`))
+	assert.ErrorIs(t, err, ErrInvalidRetention)
+}
@@ -2,14 +2,43 @@ package vault
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
 )
 
-var ErrNoBackup = errors.New("vault: no backup found")
+var (
+	ErrNoBackup     = errors.New("vault: no backup found")
+	ErrSchemaTooNew = errors.New("vault: database was created by a newer version")
+	ErrSchemaTooOld = errors.New("vault: database needs migrating")
+)
+
+// DataFormat says what kind of image a backup holds.
+type DataFormat string
+
+const (
+	FormatCoding DataFormat = "coding"
+	FormatEEPROM DataFormat = "eeprom"
+	FormatFlash  DataFormat = "flash"
+)
+
+// Metadata identifies the module and the circumstances of a backup.
+type Metadata struct {
+	VIN            string
+	HardwareNumber string
+	SoftwareNumber string
+	CodingIndex    string
+	// Operation is the write the backup was taken before, e.g. "coding".
+	Operation   string
+	ToolVersion string
+	Format      DataFormat
+	Note        string
+	Tags        []string
+}
 
 type Entry struct {
 	ID        int64
@@ -18,34 +47,95 @@ type Entry struct {
 	Version   string
 	Data      []byte
 	CreatedAt time.Time
+	Metadata
+	// SHA256 is the hex digest of Data, computed when the backup was saved.
+	SHA256 string
+}
+
+// Intact reports whether Data still matches the digest taken when it was
+// saved.
+func (e Entry) Intact() bool {
+	return e.SHA256 == hashData(e.Data)
 }
 
 type Vault struct {
 	db *sql.DB
+	// keys is nil unless the vault is encrypted.
+	keys *keyring
+	// gen is the generation of the data key in keys, zero for a plain
+	// vault.
+	gen int64
+	// readOnly is set by OpenReadOnly.
+	readOnly bool
 }
 
+// Open opens a vault that is not encrypted; an encrypted one fails with
+// ErrEncrypted and must be opened with OpenEncrypted.
 func Open(path string) (*Vault, error) {
-	db, err := sql.Open("sqlite", path)
+	return open(path, "")
+}
+
+// BusyTimeout is how long a connection waits for another writer, in this
+// or another process, before giving up with SQLITE_BUSY.
+const BusyTimeout = 10 * time.Second
+
+// dsn opens path in WAL mode, so readers never block the writer, and starts
+// every transaction IMMEDIATE so writers queue on the busy timeout instead
+// of failing when a read transaction tries to upgrade. Synchronous FULL
+// syncs the WAL on every commit: a backup the pipeline reports as taken
+// must survive a power cut right after it.
+func dsn(path string) string {
+	return fmt.Sprintf("%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_txlock=immediate",
+		path, BusyTimeout.Milliseconds())
+}
+
+// OpenReadOnly opens an existing vault for reading without migrating,
+// encrypting or otherwise changing it. A vault whose schema is not the one
+// this build writes fails with ErrSchemaTooOld or ErrSchemaTooNew. The
+// passphrase unlocks an encrypted vault; a plain vault opens unencrypted
+// whatever the passphrase.
+func OpenReadOnly(path, passphrase string) (*Vault, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro&_pragma=busy_timeout(%d)",
+		path, BusyTimeout.Milliseconds()))
 	if err != nil {
 		return nil, fmt.Errorf("vault: opening database: %w", err)
 	}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS backups (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			chassis TEXT NOT NULL,
-			module TEXT NOT NULL,
-			version TEXT NOT NULL,
-			data BLOB NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
+	v := &Vault{db: db, readOnly: true}
+	n, err := v.SchemaVersion()
+	if err == nil {
+		switch {
+		case n < len(migrations):
+			err = fmt.Errorf("%w: database is at version %d, this build needs %d", ErrSchemaTooOld, n, len(migrations))
+		case n > len(migrations):
+			err = fmt.Errorf("%w: database is at version %d, this build knows %d", ErrSchemaTooNew, n, len(migrations))
+		default:
+			err = v.unlock(passphrase)
+		}
+	}
 	if err != nil {
 		db.Close()
-		return nil, fmt.Errorf("vault: creating table: %w", err)
+		return nil, err
 	}
+	return v, nil
+}
 
-	return &Vault{db: db}, nil
+func open(path, passphrase string) (*Vault, error) {
+	db, err := sql.Open("sqlite", dsn(path))
+	if err != nil {
+		return nil, fmt.Errorf("vault: opening database: %w", err)
+	}
+
+	v := &Vault{db: db}
+	if err := v.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := v.unlock(passphrase); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return v, nil
 }
 
 func (v *Vault) Close() error {
@@ -53,35 +143,163 @@ func (v *Vault) Close() error {
 }
 
 func (v *Vault) Save(chassis, module, version string, data []byte) error {
-	_, err := v.db.Exec(
-		`INSERT INTO backups (chassis, module, version, data) VALUES (?, ?, ?, ?)`,
-		chassis, module, version, data,
+	_, err := v.SaveWithMetadata(chassis, module, version, data, Metadata{})
+	return err
+}
+
+// SaveWithMetadata stores a backup with its metadata and returns its ID.
+// VINs are stored upper-case and an empty Format means FormatCoding. Data
+// identical to an earlier backup is stored only once.
+func (v *Vault) SaveWithMetadata(chassis, module, version string, data []byte, meta Metadata) (int64, error) {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("vault: saving backup: %w", err)
+	}
+	defer tx.Rollback()
+	if err := v.checkKey(tx); err != nil {
+		return 0, err
+	}
+
+	id, err := insertEntry(tx, v.keys, Entry{Chassis: chassis, Module: module, Version: version, Data: data, Metadata: meta})
+	if err != nil {
+		return 0, err
+	}
+	if err := logAudit(tx, ActionSave, id, fmt.Sprintf("%s %s %s, %d bytes", chassis, module, version, len(data))); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("vault: saving backup: %w", err)
+	}
+	return id, nil
+}
+
+// insertEntry stores e's blob and row, encrypted with keys if not nil. A
+// zero CreatedAt means now; ID and SHA256 are ignored.
+func insertEntry(tx *sql.Tx, keys *keyring, e Entry) (int64, error) {
+	meta := e.Metadata
+	if meta.Format == "" {
+		meta.Format = FormatCoding
+	}
+	tags, err := json.Marshal(nonNil(meta.Tags))
+	if err != nil {
+		return 0, fmt.Errorf("vault: encoding tags: %w", err)
+	}
+	var created sql.NullTime
+	if !e.CreatedAt.IsZero() {
+		created = sql.NullTime{Time: e.CreatedAt.UTC(), Valid: true}
+	}
+
+	sum, err := putBlob(tx, keys, e.Data)
+	if err != nil {
+		return 0, err
+	}
+	vin := strings.ToUpper(meta.VIN)
+	res, err := tx.Exec(
+		`INSERT INTO backups (chassis, module, version, created_at, vin, vin_index, hardware_number,
+			software_number, coding_index, operation, tool_version, format, sha256, note, tags)
+		 VALUES (?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Chassis, e.Module, e.Version, created, keys.sealText("vin", vin), keys.vinIndex(vin),
+		meta.HardwareNumber, meta.SoftwareNumber, meta.CodingIndex, meta.Operation, meta.ToolVersion,
+		string(meta.Format), sum, keys.sealText("note", meta.Note), string(tags),
 	)
 	if err != nil {
-		return fmt.Errorf("vault: saving backup: %w", err)
+		return 0, fmt.Errorf("vault: saving backup: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("vault: saving backup: %w", err)
 	}
-	return nil
+	return id, nil
 }
 
+// entryColumns and entryJoin select backups together with their blobs.
+const (
+	entryColumns = `backups.id, chassis, module, version, blobs.data, blobs.compression, blobs.size, blobs.encrypted,
+	created_at, vin, hardware_number, software_number, coding_index, operation, tool_version,
+	format, backups.sha256, note, tags`
+	entryJoin = ` FROM backups JOIN blobs ON blobs.sha256 = backups.sha256`
+)
+
 func (v *Vault) List(chassis, module string) ([]Entry, error) {
-	rows, err := v.db.Query(
-		`SELECT id, chassis, module, version, data, created_at
-		 FROM backups
-		 WHERE chassis = ? AND module = ?
-		 ORDER BY id DESC`,
-		chassis, module,
-	)
+	return v.query("listing backups",
+		`SELECT `+entryColumns+entryJoin+` WHERE chassis = ? AND module = ? ORDER BY backups.id DESC`,
+		chassis, module)
+}
+
+// FindByVIN returns every backup taken from the car with the given VIN,
+// newest first, across all of its modules.
+func (v *Vault) FindByVIN(vin string) ([]Entry, error) {
+	return v.query("finding backups by VIN",
+		`SELECT `+entryColumns+entryJoin+` WHERE vin_index = ? ORDER BY backups.id DESC`,
+		v.keys.vinIndex(strings.ToUpper(vin)))
+}
+
+// FindByHardware returns every backup of modules with the given hardware
+// number, newest first, whatever chassis they came from.
+func (v *Vault) FindByHardware(hardwareNumber string) ([]Entry, error) {
+	return v.query("finding backups by hardware number",
+		`SELECT `+entryColumns+entryJoin+` WHERE hardware_number = ? ORDER BY backups.id DESC`,
+		hardwareNumber)
+}
+
+// Get returns the backup with the given ID.
+func (v *Vault) Get(id int64) (Entry, error) {
+	entries, err := v.query("reading backup",
+		`SELECT `+entryColumns+entryJoin+` WHERE backups.id = ?`, id)
+	if err != nil {
+		return Entry{}, err
+	}
+	if len(entries) == 0 {
+		return Entry{}, fmt.Errorf("%w: id %d", ErrNoBackup, id)
+	}
+	return entries[0], nil
+}
+
+func (v *Vault) query(what, query string, args ...any) ([]Entry, error) {
+	return queryEntries(v.db, v.keys, what, query, args...)
+}
+
+// querier is the part of *sql.DB and *sql.Tx that reads need.
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func queryEntries(q querier, keys *keyring, what, query string, args ...any) ([]Entry, error) {
+	rows, err := q.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("vault: listing backups: %w", err)
+		return nil, fmt.Errorf("vault: %s: %w", what, err)
 	}
 	defer rows.Close()
 
 	var entries []Entry
 	for rows.Next() {
 		var e Entry
-		if err := rows.Scan(&e.ID, &e.Chassis, &e.Module, &e.Version, &e.Data, &e.CreatedAt); err != nil {
+		var format, tags, compression string
+		var stored []byte
+		var size int
+		var encrypted bool
+		if err := rows.Scan(&e.ID, &e.Chassis, &e.Module, &e.Version, &stored, &compression, &size, &encrypted,
+			&e.CreatedAt, &e.VIN, &e.HardwareNumber, &e.SoftwareNumber, &e.CodingIndex, &e.Operation,
+			&e.ToolVersion, &format, &e.SHA256, &e.Note, &tags); err != nil {
 			return nil, fmt.Errorf("vault: scanning row: %w", err)
 		}
+		data, err := keys.readBlob(e.SHA256, compression, encrypted, stored, size)
+		if err != nil {
+			return nil, fmt.Errorf("vault: backup %d: %w", e.ID, err)
+		}
+		e.Data = data
+		if e.VIN, err = keys.openText("vin", e.VIN); err != nil {
+			return nil, fmt.Errorf("vault: backup %d: %w", e.ID, err)
+		}
+		if e.Note, err = keys.openText("note", e.Note); err != nil {
+			return nil, fmt.Errorf("vault: backup %d: %w", e.ID, err)
+		}
+		e.Format = DataFormat(format)
+		if tags != "[]" {
+			if err := json.Unmarshal([]byte(tags), &e.Tags); err != nil {
+				return nil, fmt.Errorf("vault: decoding tags of backup %d: %w", e.ID, err)
+			}
+		}
 		entries = append(entries, e)
 	}
 	return entries, rows.Err()
@@ -97,3 +315,10 @@ func (v *Vault) Latest(chassis, module string) (Entry, error) {
 	}
 	return entries[0], nil
 }
+
+func nonNil(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
@@ -1,7 +1,13 @@
 package vault
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -93,3 +99,197 @@ func TestListDifferentModules(t *testing.T) {
 	assert.Len(t, gm5, 1)
 	assert.Len(t, kmb, 1)
 }
+
+func TestMigratesLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE backups (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chassis TEXT NOT NULL,
+			module TEXT NOT NULL,
+			version TEXT NOT NULL,
+			data BLOB NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO backups (chassis, module, version, data) VALUES ('E46', 'GM5', 'C05', x'0102')`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	v, err := Open(path)
+	require.NoError(t, err)
+	defer v.Close()
+
+	version, err := v.SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+
+	entry, err := v.Latest("E46", "GM5")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x01, 0x02}, entry.Data)
+	assert.Equal(t, FormatCoding, entry.Format)
+	sum := sha256.Sum256([]byte{0x01, 0x02})
+	assert.Equal(t, hex.EncodeToString(sum[:]), entry.SHA256)
+}
+
+func TestReopenKeepsSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.db")
+	v, err := Open(path)
+	require.NoError(t, err)
+	require.NoError(t, v.Save("E46", "GM5", "C05", []byte{0x01}))
+	require.NoError(t, v.Close())
+
+	v, err = Open(path)
+	require.NoError(t, err)
+	defer v.Close()
+	entries, err := v.List("E46", "GM5")
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "future.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, len(migrations)+1))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = Open(path)
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+}
+
+func TestOpenReadOnlyNeverMigrates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`PRAGMA user_version = 1`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = OpenReadOnly(path, "")
+	assert.ErrorIs(t, err, ErrSchemaTooOld)
+	db, err = sql.Open("sqlite", path)
+	require.NoError(t, err)
+	var version int
+	require.NoError(t, db.QueryRow(`PRAGMA user_version`).Scan(&version))
+	require.NoError(t, db.Close())
+	assert.Equal(t, 1, version)
+
+	missing := filepath.Join(t.TempDir(), "missing.db")
+	_, err = OpenReadOnly(missing, "")
+	assert.Error(t, err)
+	assert.NoFileExists(t, missing)
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.db")
+	v, err := Open(path)
+	require.NoError(t, err)
+	require.NoError(t, v.Save("E46", "GM5", "C05", []byte{0x01}))
+	require.NoError(t, v.Close())
+
+	// A passphrase does not encrypt a plain vault opened read-only.
+	v, err = OpenReadOnly(path, "passphrase")
+	require.NoError(t, err)
+	defer v.Close()
+	assert.False(t, v.Encrypted())
+	entry, err := v.Latest("E46", "GM5")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x01}, entry.Data)
+	assert.Error(t, v.Save("E46", "GM5", "C05", []byte{0x02}))
+}
+
+func TestSaveWithMetadata(t *testing.T) {
+	v := tempVault(t)
+
+	meta := Metadata{
+		VIN:            "wbaav31070fz12345",
+		HardwareNumber: "7511570",
+		SoftwareNumber: "430037",
+		CodingIndex:    "0A",
+		Operation:      "coding",
+		ToolVersion:    "0.1.0",
+		Format:         FormatEEPROM,
+		Note:           "before retrofit",
+		Tags:           []string{"retrofit", "xenon"},
+	}
+	id, err := v.SaveWithMetadata("E46", "LSZ", "L05", []byte{0xAA}, meta)
+	require.NoError(t, err)
+
+	entry, err := v.Get(id)
+	require.NoError(t, err)
+	meta.VIN = "WBAAV31070FZ12345"
+	assert.Equal(t, meta, entry.Metadata)
+	assert.Len(t, entry.SHA256, 64)
+
+	_, err = v.Get(id + 1)
+	assert.ErrorIs(t, err, ErrNoBackup)
+}
+
+func TestFindByVINAndHardware(t *testing.T) {
+	v := tempVault(t)
+
+	_, err := v.SaveWithMetadata("E46", "GM5", "C05", []byte{0x01}, Metadata{VIN: "WBAAV31070FZ12345", HardwareNumber: "6904277"})
+	require.NoError(t, err)
+	_, err = v.SaveWithMetadata("E46", "KMB", "C06", []byte{0x02}, Metadata{VIN: "WBAAV31070FZ12345", HardwareNumber: "6911230"})
+	require.NoError(t, err)
+	_, err = v.SaveWithMetadata("E39", "GM5", "C05", []byte{0x03}, Metadata{VIN: "WBADT43452G123456", HardwareNumber: "6904277"})
+	require.NoError(t, err)
+
+	byVIN, err := v.FindByVIN("wbaav31070fz12345")
+	require.NoError(t, err)
+	require.Len(t, byVIN, 2)
+	assert.Equal(t, "KMB", byVIN[0].Module)
+	assert.Equal(t, "GM5", byVIN[1].Module)
+
+	byHW, err := v.FindByHardware("6904277")
+	require.NoError(t, err)
+	require.Len(t, byHW, 2)
+	assert.Equal(t, "E39", byHW[0].Chassis)
+	assert.Equal(t, "E46", byHW[1].Chassis)
+
+	none, err := v.FindByHardware("0000000")
+	require.NoError(t, err)
+	assert.Empty(t, none)
+}
+
+func TestRestoreJournal(t *testing.T) {
+	v := tempVault(t)
+	source, err := v.SaveWithMetadata("E46", "GM5", "C05", []byte{0x01}, Metadata{})
+	require.NoError(t, err)
+	before, err := v.SaveWithMetadata("E46", "GM5", "C05", []byte{0x02}, Metadata{Operation: "rollback"})
+	require.NoError(t, err)
+
+	id, err := v.StartRestore(source)
+	require.NoError(t, err)
+	require.NoError(t, v.LogRestoreStep(id, "fetch", "passed", "1 byte"))
+	require.NoError(t, v.LogRestoreStep(id, "write", "failed", "connection lost"))
+	require.NoError(t, v.FinishRestore(id, before, errors.New("connection lost")))
+
+	r, err := v.GetRestore(id)
+	require.NoError(t, err)
+	assert.Equal(t, source, r.SourceID)
+	assert.Equal(t, before, r.BackupID)
+	assert.Equal(t, RestoreFailed, r.Status)
+	assert.Equal(t, "connection lost", r.Error)
+	assert.False(t, r.FinishedAt.IsZero())
+	require.Len(t, r.Steps, 2)
+	assert.Equal(t, "fetch", r.Steps[0].Step)
+	assert.Equal(t, "failed", r.Steps[1].Status)
+}
+
+func TestEntryIntact(t *testing.T) {
+	v := tempVault(t)
+	id, err := v.SaveWithMetadata("E46", "GM5", "C05", []byte{0x01, 0x02}, Metadata{})
+	require.NoError(t, err)
+
+	e, err := v.Get(id)
+	require.NoError(t, err)
+	assert.True(t, e.Intact())
+	e.Data[0] ^= 0xFF
+	assert.False(t, e.Intact())
+}
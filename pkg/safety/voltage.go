@@ -5,58 +5,68 @@ import "fmt"
 type VoltageStatus int
 
 const (
-	VoltageOK      VoltageStatus = iota
+	VoltageOK VoltageStatus = iota
 	VoltageWarning
 	VoltageBlocked
 )
 
+func (s VoltageStatus) String() string {
+	switch s {
+	case VoltageOK:
+		return "ok"
+	case VoltageWarning:
+		return "warning"
+	case VoltageBlocked:
+		return "blocked"
+	}
+	return fmt.Sprintf("VoltageStatus(%d)", int(s))
+}
+
 type OperationType int
 
 const (
-	OpCoding      OperationType = iota
+	OpCoding OperationType = iota
 	OpMultiCoding
 	OpFlash
 )
 
-type VoltageResult struct {
-	Status  VoltageStatus
-	Voltage float64
-	Message string
+var operationNames = map[OperationType]string{
+	OpCoding:      "coding",
+	OpMultiCoding: "multi_coding",
+	OpFlash:       "flash",
 }
 
-type thresholds struct {
-	block   float64
-	warning float64
+func (op OperationType) String() string {
+	if name, ok := operationNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("OperationType(%d)", int(op))
 }
 
-var voltageThresholds = map[OperationType]thresholds{
-	OpCoding:      {block: 12.0, warning: 12.5},
-	OpMultiCoding: {block: 12.5, warning: 12.5},
-	OpFlash:       {block: 13.0, warning: 13.0},
+func (op OperationType) MarshalText() ([]byte, error) {
+	if _, ok := operationNames[op]; !ok {
+		return nil, fmt.Errorf("safety: unknown operation type %d", int(op))
+	}
+	return []byte(op.String()), nil
 }
 
-func CheckVoltage(voltage float64, op OperationType) VoltageResult {
-	t := voltageThresholds[op]
-
-	if voltage < t.block {
-		return VoltageResult{
-			Status:  VoltageBlocked,
-			Voltage: voltage,
-			Message: fmt.Sprintf("Battery voltage %.1fV is below minimum %.1fV — operation blocked", voltage, t.block),
+func (op *OperationType) UnmarshalText(text []byte) error {
+	for o, name := range operationNames {
+		if name == string(text) {
+			*op = o
+			return nil
 		}
 	}
+	return fmt.Errorf("safety: unknown operation type %q", text)
+}
 
-	if voltage > t.block && voltage < t.warning {
-		return VoltageResult{
-			Status:  VoltageWarning,
-			Voltage: voltage,
-			Message: fmt.Sprintf("Battery voltage %.1fV is low (recommended: %.1fV+) — proceed with caution", voltage, t.warning),
-		}
-	}
+type VoltageResult struct {
+	Status  VoltageStatus
+	Voltage float64
+	Message string
+}
 
-	return VoltageResult{
-		Status:  VoltageOK,
-		Voltage: voltage,
-		Message: fmt.Sprintf("Battery voltage %.1fV OK", voltage),
-	}
+// CheckVoltage checks voltage against the default lead-acid profile.
+func CheckVoltage(voltage float64, op OperationType) VoltageResult {
+	return DefaultVoltagePolicy().Check(voltage, op, Target{}).VoltageResult
 }
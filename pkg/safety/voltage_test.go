@@ -44,12 +44,12 @@ func TestVoltageCheckFlashPass(t *testing.T) {
 
 func TestVoltageCheckFlashAtThreshold(t *testing.T) {
 	result := CheckVoltage(13.0, OpFlash)
-	assert.Equal(t, VoltageOK, result.Status)
+	assert.Equal(t, VoltageWarning, result.Status)
 }
 
 func TestVoltageCheckCodingExactlyAtBlock(t *testing.T) {
 	result := CheckVoltage(12.0, OpCoding)
-	assert.Equal(t, VoltageOK, result.Status)
+	assert.Equal(t, VoltageWarning, result.Status)
 }
 
 func TestVoltageCheckCodingJustBelowBlock(t *testing.T) {
@@ -0,0 +1,131 @@
+package seedkey
+
+import (
+	"bytes"
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+)
+
+// Guard is the ECU side of SecurityAccess, used by simulated modules. It
+// hands out seeds, checks keys with the same Algorithm interface a tester
+// uses, and enforces the attempt limit and time delay of a real module.
+type Guard struct {
+	Algorithm Algorithm
+	// SeedLength is the seed size in bytes; zero or less means
+	// DefaultSeedLength.
+	SeedLength  int
+	MaxAttempts int
+	Delay       time.Duration
+
+	mu           sync.Mutex
+	unlocked     map[byte]bool
+	seeds        map[byte][]byte
+	failures     int
+	delayedUntil time.Time
+	now          func() time.Time
+	random       func([]byte)
+}
+
+// DefaultSeedLength is the seed size of the KWP2000 modules bavarix codes.
+const DefaultSeedLength = 4
+
+func NewGuard(alg Algorithm) *Guard {
+	return &Guard{
+		Algorithm:   alg,
+		SeedLength:  DefaultSeedLength,
+		MaxAttempts: 3,
+		Delay:       DefaultDelay,
+		unlocked:    make(map[byte]bool),
+		seeds:       make(map[byte][]byte),
+		now:         time.Now,
+		random:      func(b []byte) { rand.Read(b) },
+	}
+}
+
+// Unlocked reports whether the given seed request level has been unlocked.
+func (g *Guard) Unlocked(level byte) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.unlocked[level]
+}
+
+// Reset relocks every level, as a session change or ECU reset would.
+func (g *Guard) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.unlocked = make(map[byte]bool)
+	g.seeds = make(map[byte][]byte)
+}
+
+// Handle answers a SecurityAccess request (starting with 0x27) with the
+// positive or negative response data a module would send.
+func (g *Guard) Handle(req []byte) []byte {
+	if len(req) < 2 || req[0] != kwp2000.SIDSecurityAccess {
+		return negative(kwp2000.NRCSubFunctionNotSupported)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	level := req[1]
+	if level%2 == 1 {
+		return g.seed(level)
+	}
+	return g.key(level-1, req[2:])
+}
+
+func (g *Guard) seed(level byte) []byte {
+	if g.now().Before(g.delayedUntil) {
+		if g.failures >= g.MaxAttempts {
+			return negative(kwp2000.NRCExceedNumberOfAttempts)
+		}
+		return negative(kwp2000.NRCRequiredTimeDelayNotExpired)
+	}
+	if g.failures >= g.MaxAttempts {
+		g.failures = 0
+	}
+
+	n := g.SeedLength
+	if n <= 0 {
+		n = DefaultSeedLength
+	}
+	if g.unlocked[level] {
+		return append([]byte{kwp2000.SIDSecurityAccess + 0x40, level}, make([]byte, n)...)
+	}
+
+	seed := make([]byte, n)
+	for allZero(seed) {
+		g.random(seed)
+	}
+	g.seeds[level] = seed
+	return append([]byte{kwp2000.SIDSecurityAccess + 0x40, level}, seed...)
+}
+
+func (g *Guard) key(level byte, key []byte) []byte {
+	seed, ok := g.seeds[level]
+	if !ok {
+		return negative(kwp2000.NRCConditionsNotCorrect)
+	}
+	delete(g.seeds, level)
+
+	want, err := g.Algorithm.Key(seed, level)
+	if err != nil || !bytes.Equal(want, key) {
+		g.failures++
+		g.delayedUntil = g.now().Add(g.Delay)
+		if g.failures >= g.MaxAttempts {
+			return negative(kwp2000.NRCExceedNumberOfAttempts)
+		}
+		return negative(kwp2000.NRCInvalidKey)
+	}
+
+	g.failures = 0
+	g.unlocked[level] = true
+	return []byte{kwp2000.SIDSecurityAccess + 0x40, level + 1, 0x34}
+}
+
+func negative(code kwp2000.NRC) []byte {
+	return []byte{kwp2000.SIDNegativeResponse, kwp2000.SIDSecurityAccess, byte(code)}
+}
@@ -0,0 +1,206 @@
+package seedkey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+)
+
+// DefaultDelay is the ISO 14230 time delay an ECU imposes after a failed
+// key or at power-up before it hands out another seed.
+const DefaultDelay = 10 * time.Second
+
+var (
+	ErrNoAlgorithm  = errors.New("seedkey: no algorithm registered for module variant and level")
+	ErrInvalidLevel = errors.New("seedkey: seed request level must be odd")
+	ErrLockedOut    = errors.New("seedkey: module locked out after too many invalid keys")
+	ErrKeyRejected  = errors.New("seedkey: module rejected the computed key")
+)
+
+// Algorithm computes the key for a seed at a given seed request level.
+type Algorithm interface {
+	Key(seed []byte, level byte) ([]byte, error)
+}
+
+// AlgorithmFunc adapts a plain function to Algorithm.
+type AlgorithmFunc func(seed []byte, level byte) ([]byte, error)
+
+func (f AlgorithmFunc) Key(seed []byte, level byte) ([]byte, error) {
+	return f(seed, level)
+}
+
+// Registry maps module variants (e.g. "MS43", "EWS3") and seed request
+// levels to algorithms. Variant names are case-insensitive.
+type Registry struct {
+	mu   sync.RWMutex
+	algs map[string]map[byte]Algorithm
+}
+
+func NewRegistry() *Registry {
+	return &Registry{algs: make(map[string]map[byte]Algorithm)}
+}
+
+// Register adds the algorithm for one variant and seed request level,
+// replacing any previous registration.
+func (r *Registry) Register(variant string, level byte, alg Algorithm) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := strings.ToUpper(variant)
+	if r.algs[key] == nil {
+		r.algs[key] = make(map[byte]Algorithm)
+	}
+	r.algs[key][level] = alg
+}
+
+func (r *Registry) Lookup(variant string, level byte) (Algorithm, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	alg, ok := r.algs[strings.ToUpper(variant)][level]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s level 0x%02X", ErrNoAlgorithm, variant, level)
+	}
+	return alg, nil
+}
+
+// DoFunc sends one request to the module being unlocked. A
+// *kwp2000.Client's Do method satisfies it; a session lease can be wrapped
+// in a closure that fixes the target.
+type DoFunc func(kwp2000.Request) ([]byte, error)
+
+// Unlocker runs the SecurityAccess seed/key exchange. It never retries a
+// rejected key on its own, since every invalid key counts towards the
+// module's lockout; it only waits out time delays the module asks for.
+type Unlocker struct {
+	Registry *Registry
+	// Delay is how long to wait when the module answers a seed request
+	// with NRC 0x37, and how long a module stays locked out locally after
+	// NRC 0x36.
+	Delay time.Duration
+	// DelayRetries bounds how many NRC 0x37 waits a single Unlock makes.
+	DelayRetries int
+
+	mu          sync.Mutex
+	lockedUntil map[string]time.Time
+	now         func() time.Time
+}
+
+func NewUnlocker(registry *Registry) *Unlocker {
+	return &Unlocker{
+		Registry:     registry,
+		Delay:        DefaultDelay,
+		DelayRetries: 1,
+		lockedUntil:  make(map[string]time.Time),
+		now:          time.Now,
+	}
+}
+
+// Unlock requests a seed at level, computes the key with the algorithm
+// registered for variant and sends it. A zero seed means the module is
+// already unlocked at that level.
+func (u *Unlocker) Unlock(ctx context.Context, do DoFunc, variant string, level byte) error {
+	if level%2 == 0 {
+		return fmt.Errorf("%w: 0x%02X", ErrInvalidLevel, level)
+	}
+	alg, err := u.Registry.Lookup(variant, level)
+	if err != nil {
+		return err
+	}
+	if err := u.checkLockout(variant); err != nil {
+		return err
+	}
+
+	seed, err := u.requestSeed(ctx, do, variant, level)
+	if err != nil {
+		return err
+	}
+	if allZero(seed) {
+		return nil
+	}
+
+	key, err := alg.Key(seed, level)
+	if err != nil {
+		return fmt.Errorf("seedkey: computing key for %s level 0x%02X: %w", variant, level, err)
+	}
+
+	resp, err := do(kwp2000.SecurityAccess{Level: level + 1, Key: key})
+	if err == nil {
+		_, err = kwp2000.ParseSecurityAccessResponse(resp)
+	}
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, kwp2000.ErrInvalidKey):
+		return fmt.Errorf("%w: %s level 0x%02X: %w", ErrKeyRejected, variant, level, err)
+	case errors.Is(err, kwp2000.ErrExceedNumberOfAttempts):
+		u.lockOut(variant)
+		return fmt.Errorf("%w: %s: %w", ErrLockedOut, variant, err)
+	default:
+		return err
+	}
+}
+
+func (u *Unlocker) requestSeed(ctx context.Context, do DoFunc, variant string, level byte) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := do(kwp2000.SecurityAccess{Level: level})
+		if err == nil {
+			var sa kwp2000.SecurityAccessResponse
+			sa, err = kwp2000.ParseSecurityAccessResponse(resp)
+			if err == nil {
+				return sa.Data, nil
+			}
+		}
+
+		switch {
+		case errors.Is(err, kwp2000.ErrExceedNumberOfAttempts):
+			u.lockOut(variant)
+			return nil, fmt.Errorf("%w: %s: %w", ErrLockedOut, variant, err)
+		case errors.Is(err, kwp2000.ErrRequiredTimeDelayNotExpired) && attempt < u.DelayRetries:
+			if err := sleep(ctx, u.Delay); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, err
+		}
+	}
+}
+
+func (u *Unlocker) checkLockout(variant string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	until, ok := u.lockedUntil[strings.ToUpper(variant)]
+	if ok && u.now().Before(until) {
+		return fmt.Errorf("%w: %s for another %s", ErrLockedOut, variant, until.Sub(u.now()).Round(time.Second))
+	}
+	return nil
+}
+
+func (u *Unlocker) lockOut(variant string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lockedUntil[strings.ToUpper(variant)] = u.now().Add(u.Delay)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,200 @@
+package seedkey
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+// xorAlgorithm stands in for a user-supplied algorithm: the key is the
+// seed XORed with a per-level mask.
+func xorAlgorithm(mask byte) Algorithm {
+	return AlgorithmFunc(func(seed []byte, level byte) ([]byte, error) {
+		key := make([]byte, len(seed))
+		for i, b := range seed {
+			key[i] = b ^ mask ^ level
+		}
+		return key, nil
+	})
+}
+
+// testECU is a KWP2000 module at address 0x12 that only accepts
+// SecurityAccess requests and enforces them with a Guard.
+type testECU struct {
+	mu      sync.Mutex
+	guard   *Guard
+	queue   [][]byte
+	keyReqs int
+}
+
+func (e *testECU) Connect() error    { return nil }
+func (e *testECU) Disconnect() error { return nil }
+func (e *testECU) SendFrame(raw []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	frame, err := kwp2000.ParseFrame(raw)
+	if err != nil {
+		return err
+	}
+	if len(frame.Data) > 1 && frame.Data[1]%2 == 0 {
+		e.keyReqs++
+	}
+	resp := e.guard.Handle(frame.Data)
+	e.queue = append(e.queue, kwp2000.BuildFrame(frame.Source, frame.Target, resp))
+	return nil
+}
+func (e *testECU) ReceiveFrame() ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) == 0 {
+		return nil, transport.ErrTimeout
+	}
+	r := e.queue[0]
+	e.queue = e.queue[1:]
+	return r, nil
+}
+func (e *testECU) SupportsWrite() bool           { return true }
+func (e *testECU) ReadVoltage() (float64, error) { return 12.6, nil }
+
+func setup(t *testing.T, ecuMask, testerMask byte) (*testECU, *Unlocker, DoFunc) {
+	t.Helper()
+	guard := NewGuard(xorAlgorithm(ecuMask))
+	guard.Delay = 5 * time.Millisecond
+	ecu := &testECU{guard: guard}
+
+	reg := NewRegistry()
+	reg.Register("MS43", 0x01, xorAlgorithm(testerMask))
+	reg.Register("MS43", 0x03, xorAlgorithm(testerMask))
+	reg.Register("MS43", 0x11, xorAlgorithm(testerMask))
+
+	u := NewUnlocker(reg)
+	u.Delay = 5 * time.Millisecond
+	return ecu, u, kwp2000.NewClient(ecu, 0x12, 0xF1).Do
+}
+
+func TestRegistryLookup(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register("ms43", 0x01, xorAlgorithm(0x5A))
+
+	_, err := reg.Lookup("MS43", 0x01)
+	assert.NoError(t, err)
+
+	_, err = reg.Lookup("MS43", 0x03)
+	assert.ErrorIs(t, err, ErrNoAlgorithm)
+
+	_, err = reg.Lookup("EWS3", 0x01)
+	assert.ErrorIs(t, err, ErrNoAlgorithm)
+}
+
+func TestUnlockLevels(t *testing.T) {
+	for _, level := range []byte{0x01, 0x03, 0x11} {
+		ecu, u, do := setup(t, 0x5A, 0x5A)
+
+		require.NoError(t, u.Unlock(context.Background(), do, "MS43", level))
+		assert.True(t, ecu.guard.Unlocked(level))
+		assert.False(t, ecu.guard.Unlocked(level+2))
+	}
+}
+
+func TestUnlockAlreadyUnlockedSkipsKey(t *testing.T) {
+	ecu, u, do := setup(t, 0x5A, 0x5A)
+	require.NoError(t, u.Unlock(context.Background(), do, "MS43", 0x01))
+	require.NoError(t, u.Unlock(context.Background(), do, "MS43", 0x01))
+	assert.Equal(t, 1, ecu.keyReqs)
+}
+
+func TestUnlockRejectsEvenLevel(t *testing.T) {
+	_, u, do := setup(t, 0x5A, 0x5A)
+	err := u.Unlock(context.Background(), do, "MS43", 0x02)
+	assert.ErrorIs(t, err, ErrInvalidLevel)
+}
+
+func TestUnlockUnknownVariantSendsNothing(t *testing.T) {
+	ecu, u, do := setup(t, 0x5A, 0x5A)
+	err := u.Unlock(context.Background(), do, "EWS3", 0x01)
+	assert.ErrorIs(t, err, ErrNoAlgorithm)
+	assert.Empty(t, ecu.queue)
+}
+
+func TestUnlockWrongKeyIsNotRetried(t *testing.T) {
+	ecu, u, do := setup(t, 0x5A, 0x00)
+
+	err := u.Unlock(context.Background(), do, "MS43", 0x01)
+	assert.ErrorIs(t, err, ErrKeyRejected)
+	assert.ErrorIs(t, err, kwp2000.ErrInvalidKey)
+	assert.Equal(t, 1, ecu.keyReqs)
+	assert.False(t, ecu.guard.Unlocked(0x01))
+}
+
+func TestUnlockWaitsOutTimeDelay(t *testing.T) {
+	ecu, u, do := setup(t, 0x5A, 0x00)
+	require.ErrorIs(t, u.Unlock(context.Background(), do, "MS43", 0x01), ErrKeyRejected)
+
+	// The module now answers seed requests with NRC 0x37 until its delay
+	// expires; the unlocker waits once and then gets a fresh seed.
+	u.Registry.Register("MS43", 0x01, xorAlgorithm(0x5A))
+	require.NoError(t, u.Unlock(context.Background(), do, "MS43", 0x01))
+	assert.True(t, ecu.guard.Unlocked(0x01))
+}
+
+func TestUnlockLockoutAfterExceededAttempts(t *testing.T) {
+	ecu, u, do := setup(t, 0x5A, 0x00)
+	ctx := context.Background()
+
+	require.ErrorIs(t, u.Unlock(ctx, do, "MS43", 0x01), ErrKeyRejected)
+	require.ErrorIs(t, u.Unlock(ctx, do, "MS43", 0x01), ErrKeyRejected)
+	err := u.Unlock(ctx, do, "MS43", 0x01)
+	assert.ErrorIs(t, err, ErrLockedOut)
+	assert.ErrorIs(t, err, kwp2000.ErrExceedNumberOfAttempts)
+
+	// The local lockout stops further attempts without touching the bus.
+	u.Delay = time.Hour
+	u.lockOut("MS43")
+	sent := ecu.keyReqs
+	assert.ErrorIs(t, u.Unlock(ctx, do, "MS43", 0x01), ErrLockedOut)
+	assert.Equal(t, sent, ecu.keyReqs)
+}
+
+func TestUnlockDelayHonoursContext(t *testing.T) {
+	ecu, u, do := setup(t, 0x5A, 0x00)
+	ecu.guard.Delay = time.Hour
+	require.ErrorIs(t, u.Unlock(context.Background(), do, "MS43", 0x01), ErrKeyRejected)
+
+	u.Delay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := u.Unlock(ctx, do, "MS43", 0x01)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestGuardRejectsKeyWithoutSeed(t *testing.T) {
+	g := NewGuard(xorAlgorithm(0x5A))
+	resp := g.Handle([]byte{0x27, 0x02, 0x00, 0x00, 0x00, 0x00})
+	assert.Equal(t, []byte{0x7F, 0x27, 0x22}, resp)
+}
+
+func TestGuardReset(t *testing.T) {
+	g := NewGuard(xorAlgorithm(0x5A))
+	seed := g.Handle([]byte{0x27, 0x01})[2:]
+	key, _ := xorAlgorithm(0x5A).Key(seed, 0x01)
+	assert.Equal(t, []byte{0x67, 0x02, 0x34}, g.Handle(append([]byte{0x27, 0x02}, key...)))
+	assert.True(t, g.Unlocked(0x01))
+
+	g.Reset()
+	assert.False(t, g.Unlocked(0x01))
+}
+
+func TestGuardZeroSeedLengthUsesDefault(t *testing.T) {
+	g := NewGuard(xorAlgorithm(0x5A))
+	g.SeedLength = 0
+	resp := g.Handle([]byte{0x27, 0x01})
+	require.Len(t, resp, 2+DefaultSeedLength)
+	assert.Equal(t, []byte{0x67, 0x01}, resp[:2])
+}
@@ -0,0 +1,413 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+// DefaultSource is the tester address used on BMW diagnostic buses.
+const DefaultSource byte = 0xF1
+
+// DefaultRetries is how many times a request is repeated after a timeout
+// or a busy-repeat-request reply.
+const DefaultRetries = 2
+
+// NoRetries in Config.Retries sends every request exactly once.
+const NoRetries = -1
+
+var (
+	ErrClosed     = errors.New("session: closed")
+	ErrNotOpen    = errors.New("session: no diagnostic session open with module")
+	ErrLeaseEnded = errors.New("session: bus lease already released")
+)
+
+// Timing holds the bus timing for one diagnostic session.
+type Timing struct {
+	// ResponseTimeout is applied to transports that implement
+	// transport.ResponseTimeoutSetter.
+	ResponseTimeout time.Duration
+	// RequestGap is the minimum idle time between the end of a response
+	// and the next request (P3min).
+	RequestGap time.Duration
+	// TesterPresentInterval is how long a module may sit idle before a
+	// TesterPresent is sent to keep its session alive. It must stay below
+	// the module's session timeout (P3max, 5 s by default).
+	TesterPresentInterval time.Duration
+}
+
+var (
+	DefaultTiming     = Timing{ResponseTimeout: 500 * time.Millisecond, RequestGap: 55 * time.Millisecond, TesterPresentInterval: 2 * time.Second}
+	ProgrammingTiming = Timing{ResponseTimeout: 2 * time.Second, RequestGap: 55 * time.Millisecond, TesterPresentInterval: 2 * time.Second}
+)
+
+// withDefaults fills the fields of t that are not positive from
+// DefaultTiming. The keepalive ticker needs a positive interval.
+func (t Timing) withDefaults() Timing {
+	if t.ResponseTimeout <= 0 {
+		t.ResponseTimeout = DefaultTiming.ResponseTimeout
+	}
+	if t.RequestGap <= 0 {
+		t.RequestGap = DefaultTiming.RequestGap
+	}
+	if t.TesterPresentInterval <= 0 {
+		t.TesterPresentInterval = DefaultTiming.TesterPresentInterval
+	}
+	return t
+}
+
+// TimingFor returns the timing used for a KWP2000 diagnostic session type.
+func TimingFor(diagSession byte) Timing {
+	if diagSession == kwp2000.SessionProgramming {
+		return ProgrammingTiming
+	}
+	return DefaultTiming
+}
+
+type Config struct {
+	Source byte
+	// Retries is how many times a request is repeated; zero selects
+	// DefaultRetries and NoRetries disables retrying. Requests that change
+	// module state are only repeated after a busy reply, never after a
+	// timeout, since the module may have acted on the first one.
+	Retries int
+	// Timing, when set, overrides TimingFor for every diagnostic session.
+	// Fields left zero take their DefaultTiming values.
+	Timing Timing
+	// OnKeepaliveError is called from the keepalive goroutine when a
+	// TesterPresent fails. The module stays registered; the next request
+	// will surface the error to its caller.
+	OnKeepaliveError func(target byte, err error)
+}
+
+type module struct {
+	client       *kwp2000.Client
+	diagSession  byte
+	timing       Timing
+	lastActivity time.Time
+}
+
+// Session owns a transport and the diagnostic sessions opened on it. All
+// traffic goes through a single bus lease, so requests from different
+// goroutines are queued and never interleave frames on the K-line. While a
+// module is idle, a background goroutine keeps its session alive with
+// TesterPresent.
+type Session struct {
+	transport transport.Transport
+	cfg       Config
+
+	bus chan struct{}
+
+	mu       sync.Mutex
+	modules  map[byte]*module
+	lastDone time.Time
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// New starts a session manager on t. Call Close to stop the keepalive.
+func New(t transport.Transport, cfg Config) *Session {
+	if cfg.Source == 0 {
+		cfg.Source = DefaultSource
+	}
+	switch {
+	case cfg.Retries == 0:
+		cfg.Retries = DefaultRetries
+	case cfg.Retries < 0:
+		cfg.Retries = 0
+	}
+	if cfg.Timing != (Timing{}) {
+		cfg.Timing = cfg.Timing.withDefaults()
+	}
+
+	s := &Session{
+		transport: t,
+		cfg:       cfg,
+		bus:       make(chan struct{}, 1),
+		modules:   make(map[byte]*module),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go s.keepalive()
+	return s
+}
+
+// Close stops the keepalive goroutine. It does not end the diagnostic
+// sessions; modules fall back to their default session on their own once
+// TesterPresent stops.
+func (s *Session) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+	return nil
+}
+
+// Open starts a KWP2000 diagnostic session with target and registers the
+// module for keepalive.
+func (s *Session) Open(ctx context.Context, target, diagSession byte) error {
+	lease, err := s.Lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer lease.Release()
+
+	m := &module{
+		client:      kwp2000.NewClient(s.transport, target, s.cfg.Source),
+		diagSession: diagSession,
+		timing:      s.timingFor(diagSession),
+	}
+	resp, err := lease.exchange(m, kwp2000.StartDiagnosticSession{Session: diagSession})
+	if err != nil {
+		return fmt.Errorf("session: opening 0x%02X with module 0x%02X: %w", diagSession, target, err)
+	}
+	if _, err := kwp2000.ParseStartDiagnosticSessionResponse(resp); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.modules[target] = m
+	s.mu.Unlock()
+	return nil
+}
+
+// End returns target to its default session and stops its keepalive.
+func (s *Session) End(ctx context.Context, target byte) error {
+	lease, err := s.Lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer lease.Release()
+
+	m, err := s.module(target)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.modules, target)
+	s.mu.Unlock()
+
+	_, err = lease.exchange(m, kwp2000.StartDiagnosticSession{Session: kwp2000.SessionDefault})
+	return err
+}
+
+// Do sends a single request to an open module, waiting for the bus if
+// another goroutine holds it.
+func (s *Session) Do(ctx context.Context, target byte, req kwp2000.Request) ([]byte, error) {
+	lease, err := s.Lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer lease.Release()
+	return lease.Do(target, req)
+}
+
+// Lock waits for exclusive use of the bus. Jobs that must not be split
+// (read, write, verify of a coding block) hold one lease for all their
+// requests. The keepalive pauses while a lease is held.
+func (s *Session) Lock(ctx context.Context) (*Lease, error) {
+	select {
+	case <-s.stop:
+		return nil, ErrClosed
+	default:
+	}
+
+	select {
+	case s.bus <- struct{}{}:
+		return &Lease{s: s}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.stop:
+		return nil, ErrClosed
+	}
+}
+
+func (s *Session) timingFor(diagSession byte) Timing {
+	if s.cfg.Timing != (Timing{}) {
+		return s.cfg.Timing
+	}
+	return TimingFor(diagSession)
+}
+
+func (s *Session) module(target byte) (*module, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.modules[target]
+	if !ok {
+		return nil, fmt.Errorf("%w: 0x%02X", ErrNotOpen, target)
+	}
+	return m, nil
+}
+
+// keepalive wakes at a quarter of the shortest TesterPresent interval and
+// pings every module that has been idle for a full interval.
+func (s *Session) keepalive() {
+	defer close(s.done)
+
+	tick := s.timingFor(kwp2000.SessionDefault).TesterPresentInterval / 4
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if next := s.shortestInterval() / 4; next > 0 && next != tick {
+			tick = next
+			ticker.Reset(tick)
+		}
+
+		for _, target := range s.idleModules() {
+			s.ping(target)
+		}
+	}
+}
+
+func (s *Session) shortestInterval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var shortest time.Duration
+	for _, m := range s.modules {
+		if shortest == 0 || m.timing.TesterPresentInterval < shortest {
+			shortest = m.timing.TesterPresentInterval
+		}
+	}
+	return shortest
+}
+
+func (s *Session) idleModules() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var idle []byte
+	for target, m := range s.modules {
+		if now.Sub(m.lastActivity) >= m.timing.TesterPresentInterval {
+			idle = append(idle, target)
+		}
+	}
+	return idle
+}
+
+func (s *Session) ping(target byte) {
+	select {
+	case s.bus <- struct{}{}:
+	case <-s.stop:
+		return
+	}
+	lease := &Lease{s: s}
+	defer lease.Release()
+
+	m, err := s.module(target)
+	if err != nil {
+		return
+	}
+	// Another request may have reached the module while we waited.
+	s.mu.Lock()
+	fresh := time.Since(m.lastActivity) < m.timing.TesterPresentInterval
+	s.mu.Unlock()
+	if fresh {
+		return
+	}
+
+	if _, err := lease.exchange(m, kwp2000.TesterPresent{}); err != nil && s.cfg.OnKeepaliveError != nil {
+		s.cfg.OnKeepaliveError(target, err)
+	}
+}
+
+// Lease is exclusive use of the bus obtained from Session.Lock.
+type Lease struct {
+	s        *Session
+	released bool
+}
+
+// Do sends a request to an open module within the lease.
+func (l *Lease) Do(target byte, req kwp2000.Request) ([]byte, error) {
+	if l.released {
+		return nil, ErrLeaseEnded
+	}
+	m, err := l.s.module(target)
+	if err != nil {
+		return nil, err
+	}
+	return l.exchange(m, req)
+}
+
+// Release hands the bus to the next waiter. It is safe to call twice.
+func (l *Lease) Release() {
+	if l.released {
+		return
+	}
+	l.released = true
+	<-l.s.bus
+}
+
+// exchange performs one request with P3 spacing, retrying busy replies and,
+// for requests that are safe to repeat, timeouts.
+func (l *Lease) exchange(m *module, req kwp2000.Request) ([]byte, error) {
+	s := l.s
+	if ts, ok := s.transport.(transport.ResponseTimeoutSetter); ok {
+		ts.SetResponseTimeout(m.timing.ResponseTimeout)
+	}
+
+	var resp []byte
+	var err error
+	for attempt := 0; attempt <= s.cfg.Retries; attempt++ {
+		s.waitGap(m.timing.RequestGap)
+		resp, err = m.client.Do(req)
+		s.markDone(m)
+		if !retryable(req, err) {
+			break
+		}
+	}
+	return resp, err
+}
+
+func retryable(req kwp2000.Request, err error) bool {
+	if errors.Is(err, kwp2000.ErrBusyRepeatRequest) {
+		return true
+	}
+	return errors.Is(err, transport.ErrTimeout) && repeatable(req.SID())
+}
+
+// repeatable reports whether a request can be sent again when its response
+// was lost. Writes, transfers, resets and key submissions may already have
+// taken effect, and repeating a SecurityAccess key counts as a failed
+// attempt.
+func repeatable(sid byte) bool {
+	switch sid {
+	case kwp2000.SIDStartDiagnosticSession,
+		kwp2000.SIDReadDTCByStatus,
+		kwp2000.SIDReadECUIdentification,
+		kwp2000.SIDReadDataByLocalIdentifier,
+		kwp2000.SIDReadMemoryByAddress,
+		kwp2000.SIDTesterPresent:
+		return true
+	}
+	return false
+}
+
+func (s *Session) waitGap(gap time.Duration) {
+	s.mu.Lock()
+	wait := gap - time.Since(s.lastDone)
+	s.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (s *Session) markDone(m *module) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.lastDone = now
+	m.lastActivity = now
+}
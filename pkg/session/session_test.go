@@ -0,0 +1,280 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+var fastTiming = Timing{
+	ResponseTimeout:       10 * time.Millisecond,
+	RequestGap:            time.Millisecond,
+	TesterPresentInterval: 20 * time.Millisecond,
+}
+
+// fakeECU answers every request with a positive response and records
+// whether a request was ever sent while another was still unanswered.
+type fakeECU struct {
+	mu          sync.Mutex
+	queue       [][]byte
+	outstanding bool
+	interleaved bool
+	requests    [][]byte
+	timeouts    int
+	timeout     time.Duration
+}
+
+func (f *fakeECU) Connect() error    { return nil }
+func (f *fakeECU) Disconnect() error { return nil }
+
+func (f *fakeECU) SendFrame(raw []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.outstanding {
+		f.interleaved = true
+	}
+	f.outstanding = true
+
+	frame, err := kwp2000.ParseFrame(raw)
+	if err != nil {
+		return err
+	}
+	f.requests = append(f.requests, frame.Data)
+	if f.timeouts > 0 {
+		f.timeouts--
+		return nil
+	}
+	resp := append([]byte{frame.Data[0] + 0x40}, frame.Data[1:]...)
+	f.queue = append(f.queue, kwp2000.BuildFrame(frame.Source, frame.Target, resp))
+	return nil
+}
+
+func (f *fakeECU) ReceiveFrame() ([]byte, error) {
+	time.Sleep(time.Millisecond)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.outstanding = false
+	if len(f.queue) == 0 {
+		return nil, transport.ErrTimeout
+	}
+	r := f.queue[0]
+	f.queue = f.queue[1:]
+	return r, nil
+}
+
+func (f *fakeECU) SupportsWrite() bool           { return true }
+func (f *fakeECU) ReadVoltage() (float64, error) { return 12.6, nil }
+
+func (f *fakeECU) SetResponseTimeout(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.timeout = d
+}
+
+func (f *fakeECU) countRequests(sid byte) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if r[0] == sid {
+			n++
+		}
+	}
+	return n
+}
+
+func newSession(t *testing.T, ecu *fakeECU) *Session {
+	t.Helper()
+	s := New(ecu, Config{Timing: fastTiming})
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestOpenStartsDiagnosticSession(t *testing.T) {
+	ecu := &fakeECU{}
+	s := newSession(t, ecu)
+
+	require.NoError(t, s.Open(context.Background(), 0x12, kwp2000.SessionExtended))
+
+	ecu.mu.Lock()
+	defer ecu.mu.Unlock()
+	assert.Equal(t, []byte{0x10, 0x89}, ecu.requests[0])
+	assert.Equal(t, fastTiming.ResponseTimeout, ecu.timeout)
+}
+
+func TestDoRequiresOpenModule(t *testing.T) {
+	s := newSession(t, &fakeECU{})
+
+	_, err := s.Do(context.Background(), 0x12, kwp2000.ReadECUIdentification{Option: 0x80})
+	assert.ErrorIs(t, err, ErrNotOpen)
+}
+
+func TestDoRetriesTimeouts(t *testing.T) {
+	ecu := &fakeECU{}
+	s := newSession(t, ecu)
+	require.NoError(t, s.Open(context.Background(), 0x12, kwp2000.SessionExtended))
+
+	ecu.mu.Lock()
+	ecu.timeouts = 2
+	ecu.mu.Unlock()
+
+	resp, err := s.Do(context.Background(), 0x12, kwp2000.ReadDataByLocalIdentifier{ID: 0x01})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x61, 0x01}, resp)
+	assert.Equal(t, 3, ecu.countRequests(kwp2000.SIDReadDataByLocalIdentifier))
+}
+
+func TestDoGivesUpAfterRetries(t *testing.T) {
+	ecu := &fakeECU{}
+	s := newSession(t, ecu)
+	require.NoError(t, s.Open(context.Background(), 0x12, kwp2000.SessionExtended))
+
+	ecu.mu.Lock()
+	ecu.timeouts = 10
+	ecu.mu.Unlock()
+
+	_, err := s.Do(context.Background(), 0x12, kwp2000.ReadDataByLocalIdentifier{ID: 0x01})
+	assert.ErrorIs(t, err, transport.ErrTimeout)
+}
+
+func TestDoWithRetriesDisabled(t *testing.T) {
+	ecu := &fakeECU{}
+	s := New(ecu, Config{Timing: fastTiming, Retries: NoRetries})
+	t.Cleanup(func() { s.Close() })
+	require.NoError(t, s.Open(context.Background(), 0x12, kwp2000.SessionExtended))
+
+	ecu.mu.Lock()
+	ecu.timeouts = 1
+	ecu.mu.Unlock()
+
+	_, err := s.Do(context.Background(), 0x12, kwp2000.ReadDataByLocalIdentifier{ID: 0x01})
+	assert.ErrorIs(t, err, transport.ErrTimeout)
+	assert.Equal(t, 1, ecu.countRequests(kwp2000.SIDReadDataByLocalIdentifier))
+}
+
+func TestDoNeverRepeatsWritesAfterTimeout(t *testing.T) {
+	ecu := &fakeECU{}
+	s := newSession(t, ecu)
+	require.NoError(t, s.Open(context.Background(), 0x12, kwp2000.SessionExtended))
+
+	writes := []kwp2000.Request{
+		kwp2000.WriteDataByLocalIdentifier{ID: 0x01, Data: []byte{0xAA}},
+		kwp2000.TransferData{Data: []byte{0x00}},
+	}
+	for _, req := range writes {
+		ecu.mu.Lock()
+		ecu.timeouts = 1
+		ecu.mu.Unlock()
+
+		_, err := s.Do(context.Background(), 0x12, req)
+		assert.ErrorIs(t, err, transport.ErrTimeout)
+		assert.Equal(t, 1, ecu.countRequests(req.SID()), "0x%02X", req.SID())
+	}
+}
+
+func TestPartialTimingTakesDefaults(t *testing.T) {
+	s := New(&fakeECU{}, Config{Timing: Timing{ResponseTimeout: time.Second}})
+	defer s.Close()
+
+	timing := s.timingFor(kwp2000.SessionExtended)
+	assert.Equal(t, time.Second, timing.ResponseTimeout)
+	assert.Equal(t, DefaultTiming.RequestGap, timing.RequestGap)
+	assert.Equal(t, DefaultTiming.TesterPresentInterval, timing.TesterPresentInterval)
+}
+
+func TestKeepaliveSendsTesterPresentWhileIdle(t *testing.T) {
+	ecu := &fakeECU{}
+	s := newSession(t, ecu)
+	require.NoError(t, s.Open(context.Background(), 0x12, kwp2000.SessionExtended))
+
+	assert.Eventually(t, func() bool {
+		return ecu.countRequests(kwp2000.SIDTesterPresent) >= 2
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestKeepaliveStopsAfterEnd(t *testing.T) {
+	ecu := &fakeECU{}
+	s := newSession(t, ecu)
+	require.NoError(t, s.Open(context.Background(), 0x12, kwp2000.SessionExtended))
+	require.NoError(t, s.End(context.Background(), 0x12))
+
+	before := ecu.countRequests(kwp2000.SIDTesterPresent)
+	time.Sleep(5 * fastTiming.TesterPresentInterval)
+	assert.Equal(t, before, ecu.countRequests(kwp2000.SIDTesterPresent))
+}
+
+func TestConcurrentRequestsNeverInterleave(t *testing.T) {
+	ecu := &fakeECU{}
+	s := newSession(t, ecu)
+	ctx := context.Background()
+	require.NoError(t, s.Open(ctx, 0x12, kwp2000.SessionExtended))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 2; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				_, err := s.Do(ctx, 0x12, kwp2000.ReadDataByLocalIdentifier{ID: byte(i)})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	// A coding job holds the bus for read, write and verify.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		lease, err := s.Lock(ctx)
+		require.NoError(t, err)
+		defer lease.Release()
+		for _, req := range []kwp2000.Request{
+			kwp2000.ReadDataByLocalIdentifier{ID: 0x3B},
+			kwp2000.WriteDataByLocalIdentifier{ID: 0x3B, Data: []byte{0x01}},
+			kwp2000.ReadDataByLocalIdentifier{ID: 0x3B},
+		} {
+			_, err := lease.Do(0x12, req)
+			assert.NoError(t, err)
+		}
+	}()
+
+	wg.Wait()
+	assert.False(t, ecu.interleaved, "requests interleaved on the bus")
+}
+
+func TestLockHonoursContext(t *testing.T) {
+	s := newSession(t, &fakeECU{})
+
+	lease, err := s.Lock(context.Background())
+	require.NoError(t, err)
+	defer lease.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.Lock(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestReleasedLeaseRejectsRequests(t *testing.T) {
+	s := newSession(t, &fakeECU{})
+
+	lease, err := s.Lock(context.Background())
+	require.NoError(t, err)
+	lease.Release()
+	lease.Release()
+
+	_, err = lease.Do(0x12, kwp2000.TesterPresent{})
+	assert.ErrorIs(t, err, ErrLeaseEnded)
+}
+
+func TestTimingFor(t *testing.T) {
+	assert.Equal(t, ProgrammingTiming, TimingFor(kwp2000.SessionProgramming))
+	assert.Equal(t, DefaultTiming, TimingFor(kwp2000.SessionExtended))
+}
@@ -0,0 +1,284 @@
+package sim
+
+import (
+	"sync"
+
+	"github.com/alexcatdad/bavarix/pkg/protocol/ds2"
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+	"github.com/alexcatdad/bavarix/pkg/seedkey"
+)
+
+// StaticTable answers requests with fixed responses, typically lifted from
+// a captured session with a real module.
+type StaticTable struct {
+	mu        sync.Mutex
+	responses map[string][]byte
+}
+
+func NewStaticTable() *StaticTable {
+	return &StaticTable{responses: make(map[string][]byte)}
+}
+
+// Add records the response data to send for an exact request.
+func (t *StaticTable) Add(req, resp []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.responses[string(req)] = clone(resp)
+}
+
+func (t *StaticTable) Handle(_ Protocol, req []byte) ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	resp, ok := t.responses[string(req)]
+	return clone(resp), ok
+}
+
+// KWPSession answers StartDiagnosticSession, ECUReset, TesterPresent and,
+// when Security is set, SecurityAccess. Changing session or resetting the
+// module relocks Security.
+type KWPSession struct {
+	Security *seedkey.Guard
+
+	mu      sync.Mutex
+	current byte
+}
+
+// Current returns the active diagnostic session type.
+func (s *KWPSession) Current() byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == 0 {
+		return kwp2000.SessionDefault
+	}
+	return s.current
+}
+
+func (s *KWPSession) Handle(p Protocol, req []byte) ([]byte, bool) {
+	if p != ProtocolKWP2000 {
+		return nil, false
+	}
+
+	switch req[0] {
+	case kwp2000.SIDStartDiagnosticSession:
+		if len(req) < 2 {
+			return kwpNegative(req[0], kwp2000.NRCSubFunctionNotSupported), true
+		}
+		s.mu.Lock()
+		s.current = req[1]
+		s.mu.Unlock()
+		s.relock()
+		return []byte{0x50, req[1]}, true
+	case kwp2000.SIDECUReset:
+		s.mu.Lock()
+		s.current = kwp2000.SessionDefault
+		s.mu.Unlock()
+		s.relock()
+		return []byte{0x51}, true
+	case kwp2000.SIDTesterPresent:
+		return []byte{0x7E}, true
+	case kwp2000.SIDSecurityAccess:
+		if s.Security == nil {
+			return nil, false
+		}
+		return s.Security.Handle(req), true
+	}
+	return nil, false
+}
+
+func (s *KWPSession) relock() {
+	if s.Security != nil {
+		s.Security.Reset()
+	}
+}
+
+// CodingMemory is a module's writable coding area. DS2 modules address it
+// with coding read/write and memory read commands; KWP2000 modules expose
+// it as local identifier blocks of BlockSize bytes (identifier n covers
+// bytes n*BlockSize onwards) and through ReadMemoryByAddress. Writes stay
+// in memory for the life of the module, so write→verify cycles can be
+// exercised end to end.
+type CodingMemory struct {
+	BlockSize int
+	// Security, when set, must be unlocked at level 0x01 before KWP2000
+	// writes are accepted.
+	Security *seedkey.Guard
+
+	mu   sync.Mutex
+	data []byte
+}
+
+func NewCodingMemory(initial []byte) *CodingMemory {
+	return &CodingMemory{BlockSize: 16, data: clone(initial)}
+}
+
+// Bytes returns a copy of the current coding memory.
+func (c *CodingMemory) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return clone(c.data)
+}
+
+func (c *CodingMemory) Handle(p Protocol, req []byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p == ProtocolDS2 {
+		return c.handleDS2(req)
+	}
+	return c.handleKWP(req)
+}
+
+func (c *CodingMemory) handleDS2(req []byte) ([]byte, bool) {
+	switch req[0] {
+	case ds2.CmdReadCoding:
+		if len(req) < 5 {
+			return ds2Status(ds2.StatusParameterError), true
+		}
+		addr, n := int(req[2])<<8|int(req[3]), int(req[4])
+		data, ok := c.read(addr, n)
+		if !ok {
+			return ds2Status(ds2.StatusRejected), true
+		}
+		return append(ds2Status(ds2.StatusAck), data...), true
+	case ds2.CmdWriteCoding:
+		if len(req) < 5 || len(req[5:]) != int(req[4]) {
+			return ds2Status(ds2.StatusParameterError), true
+		}
+		addr := int(req[2])<<8 | int(req[3])
+		if !c.write(addr, req[5:]) {
+			return ds2Status(ds2.StatusRejected), true
+		}
+		return ds2Status(ds2.StatusAck), true
+	case ds2.CmdReadMemory:
+		if len(req) < 6 {
+			return ds2Status(ds2.StatusParameterError), true
+		}
+		addr := int(req[2])<<16 | int(req[3])<<8 | int(req[4])
+		data, ok := c.read(addr, int(req[5]))
+		if !ok {
+			return ds2Status(ds2.StatusRejected), true
+		}
+		return append(ds2Status(ds2.StatusAck), data...), true
+	}
+	return nil, false
+}
+
+func (c *CodingMemory) handleKWP(req []byte) ([]byte, bool) {
+	sid := req[0]
+	switch sid {
+	case kwp2000.SIDReadDataByLocalIdentifier:
+		if len(req) < 2 {
+			return kwpNegative(sid, kwp2000.NRCSubFunctionNotSupported), true
+		}
+		data, ok := c.read(int(req[1])*c.BlockSize, c.BlockSize)
+		if !ok {
+			return kwpNegative(sid, kwp2000.NRCRequestOutOfRange), true
+		}
+		return append([]byte{0x61, req[1]}, data...), true
+	case kwp2000.SIDWriteDataByLocalIdentifier:
+		if len(req) < 3 {
+			return kwpNegative(sid, kwp2000.NRCSubFunctionNotSupported), true
+		}
+		if c.Security != nil && !c.Security.Unlocked(0x01) {
+			return kwpNegative(sid, kwp2000.NRCSecurityAccessDenied), true
+		}
+		if !c.write(int(req[1])*c.BlockSize, req[2:]) {
+			return kwpNegative(sid, kwp2000.NRCRequestOutOfRange), true
+		}
+		return []byte{0x7B, req[1]}, true
+	case kwp2000.SIDReadMemoryByAddress:
+		if len(req) < 5 {
+			return kwpNegative(sid, kwp2000.NRCSubFunctionNotSupported), true
+		}
+		addr := int(req[1])<<16 | int(req[2])<<8 | int(req[3])
+		data, ok := c.read(addr, int(req[4]))
+		if !ok {
+			return kwpNegative(sid, kwp2000.NRCRequestOutOfRange), true
+		}
+		return append([]byte{0x63}, data...), true
+	}
+	return nil, false
+}
+
+func (c *CodingMemory) read(addr, n int) ([]byte, bool) {
+	if addr < 0 || n < 0 || addr+n > len(c.data) {
+		return nil, false
+	}
+	return clone(c.data[addr : addr+n]), true
+}
+
+func (c *CodingMemory) write(addr int, data []byte) bool {
+	if addr < 0 || addr+len(data) > len(c.data) {
+		return false
+	}
+	copy(c.data[addr:], data)
+	return true
+}
+
+// Fault is a stored trouble code. DS2 modules report only the low byte of
+// Code.
+type Fault struct {
+	Code   uint16
+	Status byte
+}
+
+// FaultMemory answers fault memory reads and clears for either protocol.
+type FaultMemory struct {
+	mu     sync.Mutex
+	faults []Fault
+}
+
+func NewFaultMemory(faults ...Fault) *FaultMemory {
+	return &FaultMemory{faults: append([]Fault(nil), faults...)}
+}
+
+// Set replaces the stored faults.
+func (f *FaultMemory) Set(faults ...Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append([]Fault(nil), faults...)
+}
+
+func (f *FaultMemory) Faults() []Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Fault(nil), f.faults...)
+}
+
+func (f *FaultMemory) Handle(p Protocol, req []byte) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case p == ProtocolDS2 && req[0] == ds2.CmdReadFaultMemory:
+		resp := []byte{byte(ds2.StatusAck), byte(len(f.faults))}
+		for _, fault := range f.faults {
+			resp = append(resp, byte(fault.Code), fault.Status)
+		}
+		return resp, true
+	case p == ProtocolDS2 && req[0] == ds2.CmdClearFaultMemory:
+		f.faults = nil
+		return ds2Status(ds2.StatusAck), true
+	case p == ProtocolKWP2000 && req[0] == kwp2000.SIDReadDTCByStatus:
+		resp := []byte{0x58, byte(len(f.faults))}
+		for _, fault := range f.faults {
+			resp = append(resp, byte(fault.Code>>8), byte(fault.Code), fault.Status)
+		}
+		return resp, true
+	case p == ProtocolKWP2000 && req[0] == kwp2000.SIDClearDiagnosticInformation:
+		f.faults = nil
+		group := []byte{0xFF, 0x00}
+		if len(req) >= 3 {
+			group = req[1:3]
+		}
+		return append([]byte{0x54}, group...), true
+	}
+	return nil, false
+}
+
+func ds2Status(s ds2.Status) []byte {
+	return []byte{byte(s)}
+}
+
+func kwpNegative(sid byte, code kwp2000.NRC) []byte {
+	return []byte{kwp2000.SIDNegativeResponse, sid, byte(code)}
+}
@@ -0,0 +1,247 @@
+package sim
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/alexcatdad/bavarix/pkg/parser/prg"
+	"github.com/alexcatdad/bavarix/pkg/protocol/ds2"
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+// DefaultVoltage is the battery voltage a bus reports unless told otherwise.
+const DefaultVoltage = 12.6
+
+type Protocol int
+
+const (
+	ProtocolDS2 Protocol = iota
+	ProtocolKWP2000
+)
+
+func (p Protocol) String() string {
+	if p == ProtocolDS2 {
+		return "DS2"
+	}
+	return "KWP2000"
+}
+
+// Handler is one piece of a module's response model. Handle receives the
+// request data (command or service byte first) and returns the response
+// data, or false when the request is not its concern.
+type Handler interface {
+	Handle(p Protocol, req []byte) ([]byte, bool)
+}
+
+// Module is a simulated control unit. Requests are offered to Handlers in
+// order; the first one that answers wins. Requests nobody answers get the
+// protocol's "not supported" reply.
+type Module struct {
+	Name     string
+	Address  byte
+	Protocol Protocol
+	Handlers []Handler
+	// Jobs lists the EDIABAS job names of the module's PRG file, when the
+	// module was built with FromPRG.
+	Jobs []string
+}
+
+// FromPRG creates a module named after a PRG file and carrying its job
+// list. Response models still have to be attached by the caller.
+func FromPRG(path string, address byte, protocol Protocol) (*Module, error) {
+	jobs, err := prg.ExtractJobs(path)
+	if err != nil {
+		return nil, fmt.Errorf("sim: reading module metadata: %w", err)
+	}
+
+	m := &Module{
+		Name:     strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		Address:  address,
+		Protocol: protocol,
+	}
+	for _, j := range jobs {
+		m.Jobs = append(m.Jobs, j.Name)
+	}
+	return m, nil
+}
+
+func (m *Module) respond(req []byte) []byte {
+	for _, h := range m.Handlers {
+		if resp, ok := h.Handle(m.Protocol, req); ok {
+			return resp
+		}
+	}
+	if m.Protocol == ProtocolDS2 {
+		return []byte{byte(ds2.StatusNack)}
+	}
+	return []byte{kwp2000.SIDNegativeResponse, req[0], byte(kwp2000.NRCServiceNotSupported)}
+}
+
+// Bus is a virtual diagnostic bus implementing transport.Transport. It
+// carries whole frames, so it stands in for a K-line or a D-CAN cable
+// alike. Requests are routed to the attached module by address.
+type Bus struct {
+	// Echo makes the bus return every request frame before the response,
+	// as a K-line interface does.
+	Echo bool
+	// ReadOnly simulates an ELM327-class adapter that cannot write:
+	// SupportsWrite reports false and SendFrame refuses write services
+	// with transport.ErrWriteNotSupported.
+	ReadOnly bool
+
+	mu        sync.Mutex
+	modules   map[byte]*Module
+	queue     [][]byte
+	voltage   float64
+	connected bool
+}
+
+func NewBus(modules ...*Module) *Bus {
+	b := &Bus{modules: make(map[byte]*Module), voltage: DefaultVoltage}
+	for _, m := range modules {
+		b.Attach(m)
+	}
+	return b
+}
+
+// Attach adds a module to the bus, replacing any module at its address.
+func (b *Bus) Attach(m *Module) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.modules[m.Address] = m
+}
+
+// Module returns the module at address, or nil.
+func (b *Bus) Module(address byte) *Module {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.modules[address]
+}
+
+// SetVoltage sets the battery voltage reported by ReadVoltage.
+func (b *Bus) SetVoltage(v float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.voltage = v
+}
+
+func (b *Bus) Connect() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connected = true
+	return nil
+}
+
+func (b *Bus) Disconnect() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connected = false
+	b.queue = nil
+	return nil
+}
+
+func (b *Bus) SendFrame(frame []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.connected {
+		return transport.ErrNotConnected
+	}
+	if b.ReadOnly && b.writes(frame) {
+		return transport.ErrWriteNotSupported
+	}
+	if b.Echo {
+		b.queue = append(b.queue, clone(frame))
+	}
+
+	if resp, ok := b.routeDS2(frame); ok {
+		b.queue = append(b.queue, resp)
+		return nil
+	}
+	if resp, ok := b.routeKWP(frame); ok {
+		b.queue = append(b.queue, resp)
+	}
+	// Frames for absent modules, or that fail their checksum, go
+	// unanswered like on a real bus.
+	return nil
+}
+
+// kwpWrites are the KWP2000 services that change a module's memory.
+var kwpWrites = []byte{
+	kwp2000.SIDWriteDataByLocalIdentifier,
+	kwp2000.SIDRequestDownload,
+	kwp2000.SIDTransferData,
+	kwp2000.SIDRequestTransferExit,
+}
+
+// writes reports whether raw asks an attached module to change its memory.
+func (b *Bus) writes(raw []byte) bool {
+	if len(raw) > 0 {
+		if m, ok := b.modules[raw[0]]; ok && m.Protocol == ProtocolDS2 {
+			frame, err := ds2.ParseFrame(raw)
+			return err == nil && len(frame.Data) > 0 && frame.Data[0] == ds2.CmdWriteCoding
+		}
+	}
+	frame, err := kwp2000.ParseFrame(raw)
+	return err == nil && len(frame.Data) > 0 && slices.Contains(kwpWrites, frame.Data[0])
+}
+
+func (b *Bus) routeDS2(raw []byte) ([]byte, bool) {
+	if len(raw) == 0 {
+		return nil, false
+	}
+	m, ok := b.modules[raw[0]]
+	if !ok || m.Protocol != ProtocolDS2 {
+		return nil, false
+	}
+	frame, err := ds2.ParseFrame(raw)
+	if err != nil || len(frame.Data) == 0 {
+		return nil, false
+	}
+	return ds2.BuildFrame(m.Address, m.respond(frame.Data)), true
+}
+
+func (b *Bus) routeKWP(raw []byte) ([]byte, bool) {
+	frame, err := kwp2000.ParseFrame(raw)
+	if err != nil || len(frame.Data) == 0 || !frame.Format.HasAddress() {
+		return nil, false
+	}
+	m, ok := b.modules[frame.Target]
+	if !ok || m.Protocol != ProtocolKWP2000 {
+		return nil, false
+	}
+	return kwp2000.BuildFrame(frame.Source, m.Address, m.respond(frame.Data)), true
+}
+
+func (b *Bus) ReceiveFrame() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.connected {
+		return nil, transport.ErrNotConnected
+	}
+	if len(b.queue) == 0 {
+		return nil, transport.ErrTimeout
+	}
+	frame := b.queue[0]
+	b.queue = b.queue[1:]
+	return frame, nil
+}
+
+func (b *Bus) SupportsWrite() bool {
+	return !b.ReadOnly
+}
+
+func (b *Bus) ReadVoltage() (float64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.voltage, nil
+}
+
+func clone(b []byte) []byte {
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
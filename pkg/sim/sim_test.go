@@ -0,0 +1,237 @@
+package sim
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/protocol/ds2"
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+	"github.com/alexcatdad/bavarix/pkg/seedkey"
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+func testdataPath(name string) string {
+	_, filename, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(filename), "..", "..", "testdata", "prg", name)
+}
+
+func connected(t *testing.T, modules ...*Module) *Bus {
+	t.Helper()
+	bus := NewBus(modules...)
+	require.NoError(t, bus.Connect())
+	return bus
+}
+
+func TestBusImplementsTransport(t *testing.T) {
+	var _ transport.Transport = NewBus()
+}
+
+func TestBusRequiresConnect(t *testing.T) {
+	bus := NewBus()
+	assert.ErrorIs(t, bus.SendFrame([]byte{0x00}), transport.ErrNotConnected)
+	_, err := bus.ReceiveFrame()
+	assert.ErrorIs(t, err, transport.ErrNotConnected)
+}
+
+func TestDS2CodingWriteVerify(t *testing.T) {
+	coding := NewCodingMemory(make([]byte, 32))
+	bus := connected(t, &Module{Name: "GM5", Address: 0x00, Protocol: ProtocolDS2, Handlers: []Handler{coding}})
+	client := ds2.NewClient(bus, 0x00)
+
+	_, err := client.Do(ds2.WriteCoding{Address: 0x0004, Data: []byte{0xDE, 0xAD}})
+	require.NoError(t, err)
+
+	resp, err := client.Do(ds2.ReadCoding{Address: 0x0004, Length: 2})
+	require.NoError(t, err)
+	data, err := ds2.ParseData(resp)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xDE, 0xAD}, data)
+	assert.Equal(t, []byte{0xDE, 0xAD}, coding.Bytes()[4:6])
+}
+
+func TestDS2CodingOutOfRange(t *testing.T) {
+	bus := connected(t, &Module{Address: 0x00, Protocol: ProtocolDS2, Handlers: []Handler{NewCodingMemory(make([]byte, 4))}})
+	_, err := ds2.NewClient(bus, 0x00).Do(ds2.ReadCoding{Address: 0x0002, Length: 8})
+	assert.ErrorIs(t, err, ds2.ErrRejected)
+}
+
+func TestDS2FaultMemory(t *testing.T) {
+	faults := NewFaultMemory(Fault{Code: 0x12, Status: 0x01}, Fault{Code: 0x34, Status: 0x02})
+	bus := connected(t, &Module{Address: 0x00, Protocol: ProtocolDS2, Handlers: []Handler{faults}})
+	client := ds2.NewClient(bus, 0x00)
+
+	resp, err := client.Do(ds2.ReadFaultMemory{})
+	require.NoError(t, err)
+	fm, err := ds2.ParseFaultMemory(resp)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x12, 0x34}, fm.Codes())
+
+	_, err = client.Do(ds2.ClearFaultMemory{})
+	require.NoError(t, err)
+	assert.Empty(t, faults.Faults())
+}
+
+func TestDS2UnknownCommandNacked(t *testing.T) {
+	bus := connected(t, &Module{Address: 0x00, Protocol: ProtocolDS2})
+	_, err := ds2.NewClient(bus, 0x00).Do(ds2.Ident{})
+	assert.ErrorIs(t, err, ds2.ErrNack)
+}
+
+func TestKWPCodingWriteVerifyWithSecurity(t *testing.T) {
+	alg := seedkey.AlgorithmFunc(func(seed []byte, level byte) ([]byte, error) {
+		key := make([]byte, len(seed))
+		for i, b := range seed {
+			key[i] = b ^ 0x5A
+		}
+		return key, nil
+	})
+	guard := seedkey.NewGuard(alg)
+	coding := NewCodingMemory(make([]byte, 64))
+	coding.Security = guard
+	session := &KWPSession{Security: guard}
+
+	bus := connected(t, &Module{Name: "MS43", Address: 0x12, Protocol: ProtocolKWP2000, Handlers: []Handler{session, coding}})
+	client := kwp2000.NewClient(bus, 0x12, 0xF1)
+
+	block := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10}
+	_, err := client.Do(kwp2000.WriteDataByLocalIdentifier{ID: 0x01, Data: block})
+	assert.ErrorIs(t, err, kwp2000.ErrSecurityAccessDenied)
+
+	_, err = client.Do(kwp2000.StartDiagnosticSession{Session: kwp2000.SessionExtended})
+	require.NoError(t, err)
+	assert.Equal(t, byte(kwp2000.SessionExtended), session.Current())
+
+	reg := seedkey.NewRegistry()
+	reg.Register("MS43", 0x01, alg)
+	require.NoError(t, seedkey.NewUnlocker(reg).Unlock(t.Context(), client.Do, "MS43", 0x01))
+
+	_, err = client.Do(kwp2000.WriteDataByLocalIdentifier{ID: 0x01, Data: block})
+	require.NoError(t, err)
+
+	resp, err := client.Do(kwp2000.ReadDataByLocalIdentifier{ID: 0x01})
+	require.NoError(t, err)
+	ld, err := kwp2000.ParseReadDataByLocalIdentifierResponse(resp)
+	require.NoError(t, err)
+	assert.Equal(t, block, ld.Data)
+	assert.Equal(t, block, coding.Bytes()[16:32])
+
+	// A reset relocks the module but the coding survives it.
+	_, err = client.Do(kwp2000.ECUReset{Mode: kwp2000.ResetPowerOn})
+	require.NoError(t, err)
+	assert.False(t, guard.Unlocked(0x01))
+	assert.Equal(t, block, coding.Bytes()[16:32])
+}
+
+func TestKWPFaultMemory(t *testing.T) {
+	faults := NewFaultMemory(Fault{Code: 0x2A0F, Status: 0x24})
+	bus := connected(t, &Module{Address: 0x12, Protocol: ProtocolKWP2000, Handlers: []Handler{faults}})
+	client := kwp2000.NewClient(bus, 0x12, 0xF1)
+
+	resp, err := client.Do(kwp2000.ReadDTCByStatus{Status: 0x02, Group: kwp2000.GroupAllDTCs})
+	require.NoError(t, err)
+	dtcs, err := kwp2000.ParseReadDTCByStatusResponse(resp)
+	require.NoError(t, err)
+	require.Len(t, dtcs, 1)
+	assert.Equal(t, uint16(0x2A0F), dtcs[0].Code)
+
+	_, err = client.Do(kwp2000.ClearDiagnosticInformation{Group: kwp2000.GroupAllDTCs})
+	require.NoError(t, err)
+	assert.Empty(t, faults.Faults())
+}
+
+func TestKWPUnsupportedService(t *testing.T) {
+	bus := connected(t, &Module{Address: 0x12, Protocol: ProtocolKWP2000})
+	_, err := kwp2000.NewClient(bus, 0x12, 0xF1).Do(kwp2000.TesterPresent{})
+	assert.ErrorIs(t, err, kwp2000.ErrServiceNotSupported)
+}
+
+func TestStaticTable(t *testing.T) {
+	table := NewStaticTable()
+	table.Add([]byte{0x1A, 0x80}, []byte{0x5A, 0x80, 0x31, 0x32})
+	bus := connected(t, &Module{Address: 0x12, Protocol: ProtocolKWP2000, Handlers: []Handler{table}})
+
+	resp, err := kwp2000.NewClient(bus, 0x12, 0xF1).Do(kwp2000.ReadECUIdentification{Option: 0x80})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x5A, 0x80, 0x31, 0x32}, resp)
+}
+
+func TestBusEchoAndMixedProtocols(t *testing.T) {
+	ds2Coding := NewCodingMemory([]byte{0xAA, 0xBB})
+	bus := connected(t,
+		&Module{Address: 0x00, Protocol: ProtocolDS2, Handlers: []Handler{ds2Coding}},
+		&Module{Address: 0x12, Protocol: ProtocolKWP2000, Handlers: []Handler{&KWPSession{}}},
+	)
+	bus.Echo = true
+
+	frame := ds2.BuildFrame(0x00, ds2.ReadCoding{Address: 0, Length: 2}.Bytes())
+	require.NoError(t, bus.SendFrame(frame))
+	echo, err := bus.ReceiveFrame()
+	require.NoError(t, err)
+	assert.Equal(t, frame, echo)
+
+	_, err = bus.ReceiveFrame()
+	require.NoError(t, err)
+	_, err = bus.ReceiveFrame()
+	assert.ErrorIs(t, err, transport.ErrTimeout)
+
+	// The clients skip echoes on their own.
+	resp, err := kwp2000.NewClient(bus, 0x12, 0xF1).Do(kwp2000.TesterPresent{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x7E}, resp)
+}
+
+func TestBusVoltageAndReadOnly(t *testing.T) {
+	bus := NewBus()
+	v, err := bus.ReadVoltage()
+	require.NoError(t, err)
+	assert.Equal(t, DefaultVoltage, v)
+
+	bus.SetVoltage(11.2)
+	v, _ = bus.ReadVoltage()
+	assert.Equal(t, 11.2, v)
+
+	assert.True(t, bus.SupportsWrite())
+	bus.ReadOnly = true
+	assert.False(t, bus.SupportsWrite())
+}
+
+func TestReadOnlyBusRefusesWrites(t *testing.T) {
+	ds2Coding := NewCodingMemory([]byte{0xAA, 0xBB})
+	kwpCoding := NewCodingMemory([]byte{0xCC, 0xDD})
+	bus := connected(t,
+		&Module{Address: 0x00, Protocol: ProtocolDS2, Handlers: []Handler{ds2Coding}},
+		&Module{Address: 0x12, Protocol: ProtocolKWP2000, Handlers: []Handler{&KWPSession{}, kwpCoding}},
+	)
+	bus.ReadOnly = true
+
+	_, err := ds2.NewClient(bus, 0x00).Do(ds2.WriteCoding{Address: 0, Data: []byte{0x01}})
+	assert.ErrorIs(t, err, transport.ErrWriteNotSupported)
+	_, err = kwp2000.NewClient(bus, 0x12, 0xF1).Do(kwp2000.WriteDataByLocalIdentifier{ID: 0x01, Data: []byte{0x01}})
+	assert.ErrorIs(t, err, transport.ErrWriteNotSupported)
+	assert.Equal(t, []byte{0xAA, 0xBB}, ds2Coding.Bytes())
+	assert.Equal(t, []byte{0xCC, 0xDD}, kwpCoding.Bytes())
+
+	// Reads still go through.
+	resp, err := ds2.NewClient(bus, 0x00).Do(ds2.ReadCoding{Address: 0, Length: 2})
+	require.NoError(t, err)
+	data, err := ds2.ParseData(resp)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xAA, 0xBB}, data)
+}
+
+func TestFromPRG(t *testing.T) {
+	path := testdataPath("C_GM5.prg")
+	if _, err := os.Stat(path); err != nil {
+		t.Skip("testdata/prg/C_GM5.prg not available")
+	}
+
+	m, err := FromPRG(path, 0x00, ProtocolDS2)
+	require.NoError(t, err)
+	assert.Equal(t, "C_GM5", m.Name)
+	assert.NotEmpty(t, m.Jobs)
+}
@@ -0,0 +1,231 @@
+// Package capture records the traffic between the protocol engine and a
+// diagnostic cable, and replays recorded sessions as virtual ECUs.
+//
+// A capture file is JSON Lines. The first line is the header:
+//
+//	{"type":"header","version":1,"start":"2026-03-01T10:00:00.123456789Z","protocol":"KWP2000","baud":10400,"interface":"/dev/ttyUSB0"}
+//
+// Every further line is one event. T is the event time in nanoseconds since
+// the header's start; Data holds frame bytes as hex:
+//
+//	{"type":"connect","t":0}
+//	{"type":"tx","t":1520000,"data":"8212f11a80ef"}
+//	{"type":"raw","t":1690000,"data":"8212f11a80ef83"}
+//	{"type":"rx","t":1690000,"data":"8212f11a80ef"}
+//	{"type":"raw","t":48200000,"data":"f1125a8031a1"}
+//	{"type":"rx","t":48200000,"data":"83f1125a8031a1"}
+//	{"type":"timeout","t":548300000}
+//	{"type":"voltage","t":549000000,"voltage":12.48}
+//	{"type":"error","t":560000000,"op":"tx","error":"write /dev/ttyUSB0: input/output error"}
+//	{"type":"note","t":561000000,"text":"ignition off"}
+//	{"type":"disconnect","t":900000000}
+//
+// tx is a frame sent to the cable and rx a frame received from it,
+// including K-line echo; an rx event is stamped when the frame's last byte
+// arrived. raw holds the bytes of one read from a cable that delivers an
+// unframed byte stream, noise and fragments included, so lines are not
+// always in T order. Protocol, Baud and Note annotate the whole session or
+// a single event; readers ignore fields they do not know.
+package capture
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Version is the capture format version written in headers.
+const Version = 1
+
+var (
+	ErrNoHeader           = errors.New("capture: file does not start with a header")
+	ErrUnsupportedVersion = errors.New("capture: unsupported format version")
+)
+
+type EventType string
+
+const (
+	EventHeader     EventType = "header"
+	EventConnect    EventType = "connect"
+	EventDisconnect EventType = "disconnect"
+	EventTx         EventType = "tx"
+	EventRx         EventType = "rx"
+	EventRaw        EventType = "raw"
+	EventTimeout    EventType = "timeout"
+	EventVoltage    EventType = "voltage"
+	EventError      EventType = "error"
+	EventNote       EventType = "note"
+)
+
+// Header describes a whole capture.
+type Header struct {
+	Version   int       `json:"version"`
+	Start     time.Time `json:"start"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Baud      int       `json:"baud,omitempty"`
+	Interface string    `json:"interface,omitempty"`
+	Note      string    `json:"note,omitempty"`
+}
+
+// Event is one line of a capture after the header.
+type Event struct {
+	Type EventType `json:"type"`
+	// T is the offset from Header.Start.
+	T        time.Duration `json:"t"`
+	Data     Hex           `json:"data,omitempty"`
+	Voltage  float64       `json:"voltage,omitempty"`
+	Op       EventType     `json:"op,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Text     string        `json:"text,omitempty"`
+	Protocol string        `json:"protocol,omitempty"`
+	Baud     int           `json:"baud,omitempty"`
+}
+
+// Hex is a byte slice that marshals to a lowercase hex string.
+type Hex []byte
+
+func (h Hex) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+func (h *Hex) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("capture: decoding frame bytes: %w", err)
+	}
+	*h = b
+	return nil
+}
+
+// Writer appends events to a capture. Each event is written through to the
+// underlying writer immediately, so a capture survives a crash of the tool
+// up to the last complete line.
+type Writer struct {
+	w     io.Writer
+	start time.Time
+}
+
+// NewWriter writes the header and returns a Writer for the events. A zero
+// Start is set to the current time and Version is always set.
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	if h.Start.IsZero() {
+		h.Start = time.Now()
+	}
+	h.Version = Version
+
+	line, err := json.Marshal(struct {
+		Type EventType `json:"type"`
+		Header
+	}{EventHeader, h})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("capture: writing header: %w", err)
+	}
+	return &Writer{w: w, start: h.Start}, nil
+}
+
+// Start returns the header start time that event offsets are relative to.
+func (w *Writer) Start() time.Time {
+	return w.start
+}
+
+func (w *Writer) Write(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := w.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("capture: writing event: %w", err)
+	}
+	return nil
+}
+
+// Reader reads a capture written by Writer.
+type Reader struct {
+	s      *bufio.Scanner
+	header Header
+	line   int
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return nil, fmt.Errorf("capture: reading header: %w", err)
+		}
+		return nil, ErrNoHeader
+	}
+
+	var h struct {
+		Type EventType `json:"type"`
+		Header
+	}
+	if err := json.Unmarshal(s.Bytes(), &h); err != nil || h.Type != EventHeader {
+		return nil, ErrNoHeader
+	}
+	if h.Version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.Version)
+	}
+	return &Reader{s: s, header: h.Header, line: 1}, nil
+}
+
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Next returns the next event, or io.EOF at the end of the capture. Blank
+// lines are skipped.
+func (r *Reader) Next() (Event, error) {
+	for r.s.Scan() {
+		r.line++
+		if len(r.s.Bytes()) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(r.s.Bytes(), &e); err != nil {
+			return Event{}, fmt.Errorf("capture: line %d: %w", r.line, err)
+		}
+		return e, nil
+	}
+	if err := r.s.Err(); err != nil {
+		return Event{}, fmt.Errorf("capture: line %d: %w", r.line+1, err)
+	}
+	return Event{}, io.EOF
+}
+
+// ReadFile loads a whole capture.
+func ReadFile(path string) (Header, []Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	defer f.Close()
+
+	r, err := NewReader(f)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	var events []Event
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return r.Header(), events, nil
+		}
+		if err != nil {
+			return Header{}, nil, err
+		}
+		events = append(events, e)
+	}
+}
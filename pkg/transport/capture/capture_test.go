@@ -0,0 +1,229 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+	"github.com/alexcatdad/bavarix/pkg/sim"
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+func simBus() *sim.Bus {
+	bus := sim.NewBus(&sim.Module{
+		Address:  0x12,
+		Protocol: sim.ProtocolKWP2000,
+		Handlers: []sim.Handler{&sim.KWPSession{}, sim.NewCodingMemory(make([]byte, 32))},
+	})
+	bus.Echo = true
+	return bus
+}
+
+// session runs a short coding write and verify against t and returns the
+// response data of each request.
+func session(t *testing.T, tr transport.Transport) [][]byte {
+	t.Helper()
+	client := kwp2000.NewClient(tr, 0x12, 0xF1)
+	var out [][]byte
+	for _, req := range []kwp2000.Request{
+		kwp2000.StartDiagnosticSession{Session: kwp2000.SessionExtended},
+		kwp2000.WriteDataByLocalIdentifier{ID: 0x01, Data: []byte{0xCA, 0xFE}},
+		kwp2000.ReadDataByLocalIdentifier{ID: 0x01},
+	} {
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		out = append(out, resp)
+	}
+	return out
+}
+
+func record(t *testing.T) (*bytes.Buffer, [][]byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, Header{Protocol: "KWP2000", Baud: 10400, Interface: "sim"})
+	require.NoError(t, err)
+
+	rec := NewRecorder(simBus(), w)
+	require.NoError(t, rec.Connect())
+	_, err = rec.ReadVoltage()
+	require.NoError(t, err)
+	responses := session(t, rec)
+	rec.Note("done")
+	require.NoError(t, rec.Disconnect())
+	require.NoError(t, rec.Err())
+	return &buf, responses
+}
+
+func TestRecorderWritesCapture(t *testing.T) {
+	buf, _ := record(t)
+
+	r, err := NewReader(buf)
+	require.NoError(t, err)
+	h := r.Header()
+	assert.Equal(t, Version, h.Version)
+	assert.Equal(t, "KWP2000", h.Protocol)
+	assert.Equal(t, 10400, h.Baud)
+	assert.False(t, h.Start.IsZero())
+
+	var types []EventType
+	var last time.Duration
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, e.T, last)
+		last = e.T
+		types = append(types, e.Type)
+	}
+
+	// Each request is followed by its echo and the module's reply.
+	assert.Equal(t, []EventType{
+		EventConnect, EventVoltage,
+		EventTx, EventRx, EventRx,
+		EventTx, EventRx, EventRx,
+		EventTx, EventRx, EventRx,
+		EventNote, EventDisconnect,
+	}, types)
+}
+
+// streamCable delivers a reply as two reads from an unframed line, the
+// first carrying a noise byte.
+type streamCable struct {
+	tap   func(data []byte, at time.Time)
+	start time.Time
+}
+
+func (c *streamCable) Connect() error                     { return nil }
+func (c *streamCable) Disconnect() error                  { return nil }
+func (c *streamCable) SendFrame([]byte) error             { return nil }
+func (c *streamCable) SupportsWrite() bool                { return true }
+func (c *streamCable) ReadVoltage() (float64, error)      { return 0, nil }
+func (c *streamCable) TapRaw(tap func([]byte, time.Time)) { c.tap = tap }
+
+func (c *streamCable) ReceiveFrame() ([]byte, error) {
+	frame, _, err := c.ReceiveTimedFrame()
+	return frame, err
+}
+
+func (c *streamCable) ReceiveTimedFrame() ([]byte, time.Time, error) {
+	c.tap([]byte{0x55, 0x83, 0xF1}, c.start.Add(10*time.Millisecond))
+	c.tap([]byte{0x12, 0x5A, 0x80, 0x31, 0x31}, c.start.Add(12*time.Millisecond))
+	return []byte{0x83, 0xF1, 0x12, 0x5A, 0x80, 0x31, 0x31}, c.start.Add(12 * time.Millisecond), nil
+}
+
+func TestRecorderLogsRawReadsAndFrameTimes(t *testing.T) {
+	start := time.Unix(1000, 0)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, Header{Start: start})
+	require.NoError(t, err)
+
+	rec := NewRecorder(&streamCable{start: start}, w)
+	rec.now = func() time.Time { return start.Add(time.Second) }
+	_, err = rec.ReceiveFrame()
+	require.NoError(t, err)
+	require.NoError(t, rec.Err())
+
+	r, err := NewReader(&buf)
+	require.NoError(t, err)
+	var events []Event
+	for e, err := r.Next(); err == nil; e, err = r.Next() {
+		events = append(events, e)
+	}
+	assert.Equal(t, []Event{
+		{Type: EventRaw, T: 10 * time.Millisecond, Data: Hex{0x55, 0x83, 0xF1}},
+		{Type: EventRaw, T: 12 * time.Millisecond, Data: Hex{0x12, 0x5A, 0x80, 0x31, 0x31}},
+		{Type: EventRx, T: 12 * time.Millisecond, Data: Hex{0x83, 0xF1, 0x12, 0x5A, 0x80, 0x31, 0x31}},
+	}, events)
+}
+
+func TestEventJSONUsesHex(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, Header{Start: time.Unix(0, 0).UTC()})
+	require.NoError(t, err)
+	require.NoError(t, w.Write(Event{Type: EventTx, T: 1500, Data: Hex{0x82, 0x12, 0xF1}}))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"type":"header"`)
+	assert.Equal(t, `{"type":"tx","t":1500,"data":"8212f1"}`, lines[1])
+}
+
+func TestReaderRejectsMissingHeader(t *testing.T) {
+	_, err := NewReader(strings.NewReader(`{"type":"tx","t":0,"data":"00"}` + "\n"))
+	assert.ErrorIs(t, err, ErrNoHeader)
+
+	_, err = NewReader(strings.NewReader(""))
+	assert.ErrorIs(t, err, ErrNoHeader)
+
+	_, err = NewReader(strings.NewReader(`{"type":"header","version":99}` + "\n"))
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestReplayReproducesSession(t *testing.T) {
+	buf, want := record(t)
+
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+
+	for run := 0; run < 2; run++ {
+		replay, err := OpenReplay(path)
+		require.NoError(t, err)
+		require.NoError(t, replay.Connect())
+
+		v, err := replay.ReadVoltage()
+		require.NoError(t, err)
+		assert.Equal(t, sim.DefaultVoltage, v)
+
+		assert.Equal(t, want, session(t, replay))
+		assert.Zero(t, replay.Remaining())
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	buf, _ := record(t)
+	r, err := NewReader(buf)
+	require.NoError(t, err)
+	var events []Event
+	for e, err := r.Next(); err == nil; e, err = r.Next() {
+		events = append(events, e)
+	}
+
+	replay := NewReplay(events)
+	require.NoError(t, replay.Connect())
+	_, err = kwp2000.NewClient(replay, 0x12, 0xF1).Do(kwp2000.TesterPresent{})
+	assert.ErrorIs(t, err, ErrMismatch)
+}
+
+func TestReplayRecordedTimeoutAndFailure(t *testing.T) {
+	replay := NewReplay([]Event{
+		{Type: EventTx, Data: Hex{0x01}},
+		{Type: EventTimeout},
+		{Type: EventRx, Data: Hex{0x02}},
+		{Type: EventVoltage, Voltage: 11.9},
+		{Type: EventError, Op: EventTx, Data: Hex{0x03}, Error: "cable unplugged"},
+	})
+	assert.ErrorIs(t, replay.SendFrame([]byte{0x01}), transport.ErrNotConnected)
+	require.NoError(t, replay.Connect())
+
+	require.NoError(t, replay.SendFrame([]byte{0x01}))
+	_, err := replay.ReceiveFrame()
+	assert.ErrorIs(t, err, transport.ErrTimeout)
+	frame, err := replay.ReceiveFrame()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x02}, frame)
+	v, _ := replay.ReadVoltage()
+	assert.Equal(t, 11.9, v)
+
+	assert.ErrorIs(t, replay.SendFrame([]byte{0x03}), ErrRecordedFailure)
+	assert.ErrorIs(t, replay.SendFrame([]byte{0x04}), ErrEndOfCapture)
+}
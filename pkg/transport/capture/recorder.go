@@ -0,0 +1,148 @@
+package capture
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+// RawTapper is implemented by transports that recover frames from an
+// unframed byte stream. The tap is called with the bytes of every read
+// from the line and the time they arrived.
+type RawTapper interface {
+	TapRaw(tap func(data []byte, at time.Time))
+}
+
+// TimedReceiver is implemented by transports that know when the last byte
+// of a received frame arrived.
+type TimedReceiver interface {
+	ReceiveTimedFrame() ([]byte, time.Time, error)
+}
+
+// Recorder is a transport.Transport that passes every call through to an
+// inner transport and logs the frames and outcomes to a capture. When the
+// inner transport is a RawTapper, every read from the line is logged as
+// well. Logging never changes what the caller sees: the first capture
+// write error is kept and reported by Err instead.
+type Recorder struct {
+	inner transport.Transport
+
+	mu  sync.Mutex
+	w   *Writer
+	err error
+	now func() time.Time
+}
+
+func NewRecorder(inner transport.Transport, w *Writer) *Recorder {
+	r := &Recorder{inner: inner, w: w, now: time.Now}
+	if t, ok := inner.(RawTapper); ok {
+		t.TapRaw(func(data []byte, at time.Time) {
+			r.logAt(Event{Type: EventRaw, Data: clone(data)}, at)
+		})
+	}
+	return r
+}
+
+// Err returns the first error met while writing the capture.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Note adds a free-text annotation, for example what the operator was
+// doing at the time.
+func (r *Recorder) Note(text string) {
+	r.log(Event{Type: EventNote, Text: text})
+}
+
+// Annotate records a change of protocol or baud rate mid-session.
+func (r *Recorder) Annotate(protocol string, baud int) {
+	r.log(Event{Type: EventNote, Protocol: protocol, Baud: baud})
+}
+
+func (r *Recorder) Connect() error {
+	err := r.inner.Connect()
+	r.logResult(Event{Type: EventConnect}, err)
+	return err
+}
+
+func (r *Recorder) Disconnect() error {
+	err := r.inner.Disconnect()
+	r.logResult(Event{Type: EventDisconnect}, err)
+	return err
+}
+
+func (r *Recorder) SendFrame(frame []byte) error {
+	err := r.inner.SendFrame(frame)
+	r.logResult(Event{Type: EventTx, Data: clone(frame)}, err)
+	return err
+}
+
+func (r *Recorder) ReceiveFrame() ([]byte, error) {
+	var frame []byte
+	var at time.Time
+	var err error
+	if t, ok := r.inner.(TimedReceiver); ok {
+		frame, at, err = t.ReceiveTimedFrame()
+	} else {
+		frame, err = r.inner.ReceiveFrame()
+	}
+	switch {
+	case err == nil && !at.IsZero():
+		r.logAt(Event{Type: EventRx, Data: clone(frame)}, at)
+	case err == nil:
+		r.log(Event{Type: EventRx, Data: clone(frame)})
+	case errors.Is(err, transport.ErrTimeout):
+		r.log(Event{Type: EventTimeout})
+	default:
+		r.log(Event{Type: EventError, Op: EventRx, Error: err.Error()})
+	}
+	return frame, err
+}
+
+func (r *Recorder) SupportsWrite() bool {
+	return r.inner.SupportsWrite()
+}
+
+func (r *Recorder) ReadVoltage() (float64, error) {
+	v, err := r.inner.ReadVoltage()
+	r.logResult(Event{Type: EventVoltage, Voltage: v}, err)
+	return v, err
+}
+
+// SetResponseTimeout forwards to the inner transport when it supports
+// tuning its timeout.
+func (r *Recorder) SetResponseTimeout(d time.Duration) {
+	if s, ok := r.inner.(transport.ResponseTimeoutSetter); ok {
+		s.SetResponseTimeout(d)
+	}
+}
+
+func (r *Recorder) logResult(e Event, err error) {
+	if err != nil {
+		e = Event{Type: EventError, Op: e.Type, Data: e.Data, Error: err.Error()}
+	}
+	r.log(e)
+}
+
+func (r *Recorder) log(e Event) {
+	r.logAt(e, r.now())
+}
+
+func (r *Recorder) logAt(e Event, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.T = at.Sub(r.w.Start())
+	if err := r.w.Write(e); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+func clone(b []byte) []byte {
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
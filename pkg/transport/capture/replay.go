@@ -0,0 +1,156 @@
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+var (
+	ErrMismatch        = errors.New("capture: sent frame does not match the recording")
+	ErrEndOfCapture    = errors.New("capture: no more requests in the recording")
+	ErrRecordedFailure = errors.New("capture: recorded transport failure")
+)
+
+// exchange is one sent frame and everything the cable produced until the
+// next one.
+type exchange struct {
+	tx      []byte
+	txErr   string
+	replies []Event
+	// voltage is the last reading recorded before the next exchange.
+	voltage float64
+}
+
+// Replay is a transport.Transport that plays a capture back as a
+// deterministic virtual ECU. Frames must be sent in the recorded order;
+// each one releases the frames, timeouts and failures recorded after it.
+// Replies still unread when the next frame is sent are dropped, as they
+// would be lost on a real cable.
+type Replay struct {
+	// ReadOnly simulates an adapter that cannot write.
+	ReadOnly bool
+
+	mu        sync.Mutex
+	exchanges []exchange
+	next      int
+	queue     []Event
+	voltage   float64
+	connected bool
+}
+
+// DefaultVoltage is reported by ReadVoltage until the capture contains a
+// voltage reading.
+const DefaultVoltage = 12.6
+
+func NewReplay(events []Event) *Replay {
+	r := &Replay{voltage: DefaultVoltage}
+	voltage := DefaultVoltage
+	var cur *exchange
+	for _, e := range events {
+		switch {
+		case e.Type == EventTx, e.Type == EventError && e.Op == EventTx:
+			r.exchanges = append(r.exchanges, exchange{tx: e.Data, txErr: e.Error, voltage: voltage})
+			cur = &r.exchanges[len(r.exchanges)-1]
+		case e.Type == EventVoltage:
+			voltage = e.Voltage
+			if cur != nil {
+				cur.voltage = voltage
+			} else {
+				r.voltage = voltage
+			}
+		case cur != nil && (e.Type == EventRx || e.Type == EventTimeout || e.Type == EventError && e.Op == EventRx):
+			cur.replies = append(cur.replies, e)
+		}
+	}
+	return r
+}
+
+// OpenReplay loads a capture file for replay.
+func OpenReplay(path string) (*Replay, error) {
+	_, events, err := ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplay(events), nil
+}
+
+// Remaining returns the number of recorded frames not yet sent.
+func (r *Replay) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.exchanges) - r.next
+}
+
+func (r *Replay) Connect() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connected = true
+	return nil
+}
+
+func (r *Replay) Disconnect() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connected = false
+	r.queue = nil
+	return nil
+}
+
+func (r *Replay) SendFrame(frame []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.connected {
+		return transport.ErrNotConnected
+	}
+	if r.next >= len(r.exchanges) {
+		return fmt.Errorf("%w: got % X", ErrEndOfCapture, frame)
+	}
+
+	ex := r.exchanges[r.next]
+	if !bytes.Equal(ex.tx, frame) {
+		return fmt.Errorf("%w: request %d: got % X, recorded % X", ErrMismatch, r.next+1, frame, ex.tx)
+	}
+	r.next++
+	r.voltage = ex.voltage
+	r.queue = append([]Event(nil), ex.replies...)
+	if ex.txErr != "" {
+		return fmt.Errorf("%w: %s", ErrRecordedFailure, ex.txErr)
+	}
+	return nil
+}
+
+func (r *Replay) ReceiveFrame() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.connected {
+		return nil, transport.ErrNotConnected
+	}
+	if len(r.queue) == 0 {
+		return nil, transport.ErrTimeout
+	}
+
+	e := r.queue[0]
+	r.queue = r.queue[1:]
+	switch e.Type {
+	case EventRx:
+		return clone(e.Data), nil
+	case EventTimeout:
+		return nil, transport.ErrTimeout
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrRecordedFailure, e.Error)
+	}
+}
+
+func (r *Replay) SupportsWrite() bool {
+	return !r.ReadOnly
+}
+
+func (r *Replay) ReadVoltage() (float64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.voltage, nil
+}
@@ -0,0 +1,274 @@
+package chaos
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexcatdad/bavarix/pkg/protocol/ds2"
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+	"github.com/alexcatdad/bavarix/pkg/safety"
+	"github.com/alexcatdad/bavarix/pkg/safety/vault"
+	"github.com/alexcatdad/bavarix/pkg/sim"
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+func original() []byte {
+	return bytes.Repeat([]byte{0x11}, 64)
+}
+
+func kwpModule() (*sim.Bus, *sim.CodingMemory) {
+	coding := sim.NewCodingMemory(original())
+	bus := sim.NewBus(&sim.Module{
+		Address:  0x12,
+		Protocol: sim.ProtocolKWP2000,
+		Handlers: []sim.Handler{&sim.KWPSession{}, coding},
+	})
+	return bus, coding
+}
+
+func scenario(t *testing.T, js string) *Scenario {
+	t.Helper()
+	s, err := ParseScenario([]byte(js))
+	require.NoError(t, err)
+	return s
+}
+
+func chaosTransport(t *testing.T, inner transport.Transport, js string) *Transport {
+	t.Helper()
+	tr := New(inner, scenario(t, js))
+	tr.sleep = func(time.Duration) {}
+	require.NoError(t, tr.Connect())
+	return tr
+}
+
+var errVoltage = errors.New("voltage too low for coding")
+
+// codingWrite is the shape of a coding session: check voltage, back up the
+// block, check voltage again, write and verify.
+func codingWrite(tr transport.Transport, v *vault.Vault, block []byte) error {
+	client := kwp2000.NewClient(tr, 0x12, 0xF1)
+
+	checkVoltage := func() error {
+		volts, err := tr.ReadVoltage()
+		if err != nil {
+			return err
+		}
+		if r := safety.CheckVoltage(volts, safety.OpCoding); r.Status == safety.VoltageBlocked {
+			return fmt.Errorf("%w: %s", errVoltage, r.Message)
+		}
+		return nil
+	}
+
+	if err := checkVoltage(); err != nil {
+		return err
+	}
+	resp, err := client.Do(kwp2000.ReadDataByLocalIdentifier{ID: 0x01})
+	if err != nil {
+		return err
+	}
+	backup, err := kwp2000.ParseReadDataByLocalIdentifierResponse(resp)
+	if err != nil {
+		return err
+	}
+	if err := v.Save("WBAXX00000C000000", "MS43", "1", backup.Data); err != nil {
+		return err
+	}
+
+	if err := checkVoltage(); err != nil {
+		return err
+	}
+	if _, err := client.Do(kwp2000.WriteDataByLocalIdentifier{ID: 0x01, Data: block}); err != nil {
+		return err
+	}
+	resp, err = client.Do(kwp2000.ReadDataByLocalIdentifier{ID: 0x01})
+	if err != nil {
+		return err
+	}
+	readBack, err := kwp2000.ParseReadDataByLocalIdentifierResponse(resp)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(readBack.Data, block) {
+		return errors.New("read-back does not match written coding")
+	}
+	return nil
+}
+
+func tempVault(t *testing.T) *vault.Vault {
+	t.Helper()
+	v, err := vault.Open(filepath.Join(t.TempDir(), "vault.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { v.Close() })
+	return v
+}
+
+func TestCodingWriteAbortsAndBackupSurvives(t *testing.T) {
+	block := bytes.Repeat([]byte{0xEE}, 16)
+
+	tests := []struct {
+		name     string
+		scenario string
+		wantErr  error
+		// written reports whether the fault strikes after the module has
+		// accepted the new coding.
+		written bool
+	}{
+		{
+			// Read request and reply take 28 bytes; the write frame is cut.
+			name:     "connection drops mid-write",
+			scenario: `{"faults": [{"kind": "drop_connection", "after_bytes": 40}]}`,
+			wantErr:  transport.ErrNotConnected,
+		},
+		{
+			name:     "module rejects write",
+			scenario: `{"faults": [{"kind": "inject_nrc", "service": "0x3B", "code": "0x22"}]}`,
+			wantErr:  kwp2000.ErrConditionsNotCorrect,
+			written:  true,
+		},
+		{
+			name:     "voltage sags before write",
+			scenario: `{"faults": [{"kind": "voltage_sag", "after_requests": 1, "volts": 11.4}]}`,
+			wantErr:  errVoltage,
+		},
+		{
+			name:     "corrupted write reply",
+			scenario: `{"faults": [{"kind": "corrupt_checksum", "service": 59}]}`,
+			wantErr:  kwp2000.ErrBadChecksum,
+			written:  true,
+		},
+		{
+			name:     "write reply too late",
+			scenario: `{"faults": [{"kind": "delay", "after_requests": 1, "delay": "2s", "times": 1}]}`,
+			wantErr:  transport.ErrTimeout,
+			written:  true,
+		},
+		{
+			name:     "checksum mismatch on read-back",
+			scenario: `{"faults": [{"kind": "corrupt_checksum", "after_requests": 2}]}`,
+			wantErr:  kwp2000.ErrBadChecksum,
+			written:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus, coding := kwpModule()
+			tr := chaosTransport(t, bus, tt.scenario)
+			v := tempVault(t)
+
+			err := codingWrite(tr, v, block)
+			require.ErrorIs(t, err, tt.wantErr)
+			assert.NotZero(t, tr.Fired()[0])
+
+			entries, err := v.List("WBAXX00000C000000", "MS43")
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			assert.Equal(t, original()[16:32], entries[0].Data)
+
+			want := original()
+			if tt.written {
+				copy(want[16:], block)
+			}
+			assert.Equal(t, want, coding.Bytes())
+		})
+	}
+}
+
+func TestDuplicateFrameConfusesNextRequest(t *testing.T) {
+	bus, _ := kwpModule()
+	tr := chaosTransport(t, bus, `{"faults": [{"kind": "duplicate", "times": 1}]}`)
+	client := kwp2000.NewClient(tr, 0x12, 0xF1)
+
+	_, err := client.Do(kwp2000.TesterPresent{})
+	require.NoError(t, err)
+
+	// The stale copy of the TesterPresent reply is taken for the answer.
+	_, err = client.Do(kwp2000.ReadDataByLocalIdentifier{ID: 0x01})
+	assert.ErrorIs(t, err, kwp2000.ErrUnexpectedResponse)
+}
+
+func TestDelayedFrameArrivesLate(t *testing.T) {
+	bus, _ := kwpModule()
+	tr := chaosTransport(t, bus, `{"faults": [{"kind": "delay", "delay": "100ms", "times": 1}]}`)
+	var slept []time.Duration
+	tr.sleep = func(d time.Duration) { slept = append(slept, d) }
+	tr.SetResponseTimeout(50 * time.Millisecond)
+
+	require.NoError(t, tr.SendFrame(kwp2000.BuildFrame(0x12, 0xF1, []byte{0x3E})))
+	_, err := tr.ReceiveFrame()
+	assert.ErrorIs(t, err, transport.ErrTimeout)
+	frame, err := tr.ReceiveFrame()
+	require.NoError(t, err)
+	f, err := kwp2000.ParseFrame(frame)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x7E}, f.Data)
+	assert.Equal(t, []time.Duration{50 * time.Millisecond}, slept)
+}
+
+func TestDS2InjectedStatus(t *testing.T) {
+	bus := sim.NewBus(&sim.Module{Address: 0x00, Protocol: sim.ProtocolDS2, Handlers: []sim.Handler{sim.NewCodingMemory(original())}})
+	tr := chaosTransport(t, bus, `{"protocol": "ds2", "faults": [{"kind": "inject_nrc", "service": "0x09", "code": "0xA2"}]}`)
+	client := ds2.NewClient(tr, 0x00)
+
+	_, err := client.Do(ds2.ReadCoding{Address: 0, Length: 2})
+	require.NoError(t, err)
+	_, err = client.Do(ds2.WriteCoding{Address: 0, Data: []byte{0x01}})
+	assert.ErrorIs(t, err, ds2.ErrRejected)
+}
+
+func TestLoadScenario(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scenario.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"name": "sag",
+		"faults": [{"kind": "voltage_sag", "volts": 11.0}]
+	}`), 0o644))
+
+	s, err := LoadScenario(path)
+	require.NoError(t, err)
+	assert.Equal(t, "sag", s.Name)
+
+	tr := New(sim.NewBus(), s)
+	volts, err := tr.ReadVoltage()
+	require.NoError(t, err)
+	assert.Equal(t, 11.0, volts)
+}
+
+func TestVoltageSagTimes(t *testing.T) {
+	bus, _ := kwpModule()
+	tr := chaosTransport(t, bus, `{"faults": [{"kind": "voltage_sag", "volts": 11.0, "times": 2}]}`)
+	want, err := bus.ReadVoltage()
+	require.NoError(t, err)
+
+	var got []float64
+	for range 3 {
+		v, err := tr.ReadVoltage()
+		require.NoError(t, err)
+		got = append(got, v)
+	}
+	assert.Equal(t, []float64{11.0, 11.0, want}, got)
+}
+
+func TestScenarioValidation(t *testing.T) {
+	for _, js := range []string{
+		`{"faults": [{"kind": "meteor_strike"}]}`,
+		`{"faults": [{"kind": "drop_connection"}]}`,
+		`{"faults": [{"kind": "delay", "delay": "0s"}]}`,
+		`{"faults": [{"kind": "voltage_sag"}]}`,
+		`{"faults": [{"kind": "duplicate", "times": -1}]}`,
+		`{"protocol": "can", "faults": []}`,
+		`{"faults": [{"kind": "inject_nrc", "code": "0x1FF"}]}`,
+		`{"faults": [{"kind": "delay", "delay": 500}]}`,
+		`not json`,
+	} {
+		_, err := ParseScenario([]byte(js))
+		assert.ErrorIs(t, err, ErrInvalidScenario, js)
+	}
+}
@@ -0,0 +1,171 @@
+// Package chaos wraps a transport with declarative fault injection, so the
+// failure scenarios of the safety pipeline can be exercised without a car.
+package chaos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidScenario = errors.New("chaos: invalid scenario")
+
+type Kind string
+
+const (
+	// KindDrop loses the connection once AfterBytes bytes have crossed the
+	// link in either direction. The frame that crosses the limit is cut
+	// short.
+	KindDrop Kind = "drop_connection"
+	// KindCorrupt flips the checksum byte of received frames.
+	KindCorrupt Kind = "corrupt_checksum"
+	// KindDelay holds received frames back for Delay. A delay longer than
+	// the response timeout makes ReceiveFrame time out, and the frame
+	// arrives late on the next call.
+	KindDelay Kind = "delay"
+	// KindNRC replaces the module's reply with a negative response carrying
+	// Code (a DS2 status byte on DS2 links).
+	KindNRC Kind = "inject_nrc"
+	// KindDuplicate delivers received frames twice.
+	KindDuplicate Kind = "duplicate"
+	// KindVoltageSag makes ReadVoltage report Volts.
+	KindVoltageSag Kind = "voltage_sag"
+)
+
+// Fault is one injected failure. Frame faults only touch module replies,
+// never K-line echo.
+type Fault struct {
+	Kind Kind `json:"kind"`
+	// AfterRequests leaves the traffic of the first n requests alone. For
+	// voltage sag it is the number of requests after which the sag starts.
+	AfterRequests int `json:"after_requests,omitempty"`
+	// Service limits frame faults to replies to requests with this service
+	// ID (DS2 command byte).
+	Service *Byte `json:"service,omitempty"`
+	// Times is how often the fault fires; 0 means every time.
+	Times int `json:"times,omitempty"`
+
+	AfterBytes int      `json:"after_bytes,omitempty"`
+	Delay      Duration `json:"delay,omitempty"`
+	Code       Byte     `json:"code,omitempty"`
+	Volts      float64  `json:"volts,omitempty"`
+}
+
+// Scenario is a named set of faults, normally loaded from a JSON file:
+//
+//	{
+//	  "name": "connection lost during coding write",
+//	  "protocol": "kwp2000",
+//	  "faults": [
+//	    {"kind": "drop_connection", "after_bytes": 48},
+//	    {"kind": "inject_nrc", "service": "0x3B", "code": "0x22", "times": 1},
+//	    {"kind": "delay", "after_requests": 2, "delay": "750ms"},
+//	    {"kind": "voltage_sag", "after_requests": 3, "volts": 11.4}
+//	  ]
+//	}
+type Scenario struct {
+	Name string `json:"name"`
+	// Protocol is "kwp2000" (default) or "ds2"; it decides how frames are
+	// taken apart and how injected replies are built.
+	Protocol string  `json:"protocol,omitempty"`
+	Faults   []Fault `json:"faults"`
+}
+
+func ParseScenario(data []byte) (*Scenario, error) {
+	var s Scenario
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidScenario, err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("chaos: reading scenario: %w", err)
+	}
+	s, err := ParseScenario(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *Scenario) Validate() error {
+	switch strings.ToLower(s.Protocol) {
+	case "", "kwp2000", "ds2":
+	default:
+		return fmt.Errorf("%w: unknown protocol %q", ErrInvalidScenario, s.Protocol)
+	}
+
+	for i, f := range s.Faults {
+		var problem string
+		switch f.Kind {
+		case KindDrop:
+			if f.AfterBytes <= 0 {
+				problem = "after_bytes must be positive"
+			}
+		case KindDelay:
+			if f.Delay <= 0 {
+				problem = "delay must be positive"
+			}
+		case KindVoltageSag:
+			if f.Volts <= 0 {
+				problem = "volts must be positive"
+			}
+		case KindCorrupt, KindNRC, KindDuplicate:
+		default:
+			problem = fmt.Sprintf("unknown kind %q", f.Kind)
+		}
+		if problem == "" && (f.AfterRequests < 0 || f.Times < 0) {
+			problem = "after_requests and times must not be negative"
+		}
+		if problem != "" {
+			return fmt.Errorf("%w: fault %d: %s", ErrInvalidScenario, i+1, problem)
+		}
+	}
+	return nil
+}
+
+// Byte is a byte written in scenario files as a number or a "0x3B" string.
+type Byte byte
+
+func (b *Byte) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	n, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return fmt.Errorf("byte value %s: %w", data, err)
+	}
+	*b = Byte(n)
+	return nil
+}
+
+// Duration is a time.Duration written in scenario files as "750ms".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"500ms\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
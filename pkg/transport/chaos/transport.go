@@ -0,0 +1,265 @@
+package chaos
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexcatdad/bavarix/pkg/protocol/ds2"
+	"github.com/alexcatdad/bavarix/pkg/protocol/kwp2000"
+	"github.com/alexcatdad/bavarix/pkg/transport"
+)
+
+// DefaultResponseTimeout is the receive timeout assumed for delay faults
+// until SetResponseTimeout is called.
+const DefaultResponseTimeout = 500 * time.Millisecond
+
+// ErrConnectionDropped is returned once a drop fault has fired. It wraps
+// transport.ErrNotConnected.
+var ErrConnectionDropped = fmt.Errorf("%w: connection dropped by fault injection", transport.ErrNotConnected)
+
+// Transport decorates another transport with the faults of a scenario.
+type Transport struct {
+	inner    transport.Transport
+	scenario *Scenario
+	ds2      bool
+
+	mu       sync.Mutex
+	fired    []int
+	sent     int
+	bytes    int
+	dropped  bool
+	lastSent []byte
+	service  int
+	pending  [][]byte
+	timeout  time.Duration
+	sleep    func(time.Duration)
+}
+
+func New(inner transport.Transport, s *Scenario) *Transport {
+	return &Transport{
+		inner:    inner,
+		scenario: s,
+		ds2:      strings.EqualFold(s.Protocol, "ds2"),
+		fired:    make([]int, len(s.Faults)),
+		service:  -1,
+		timeout:  DefaultResponseTimeout,
+		sleep:    time.Sleep,
+	}
+}
+
+// Fired returns how many times each fault of the scenario has fired, in
+// scenario order.
+func (t *Transport) Fired() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]int(nil), t.fired...)
+}
+
+func (t *Transport) Connect() error {
+	t.mu.Lock()
+	dropped := t.dropped
+	t.mu.Unlock()
+	if dropped {
+		return ErrConnectionDropped
+	}
+	return t.inner.Connect()
+}
+
+func (t *Transport) Disconnect() error {
+	return t.inner.Disconnect()
+}
+
+func (t *Transport) SendFrame(frame []byte) error {
+	t.mu.Lock()
+	if t.dropped {
+		t.mu.Unlock()
+		return ErrConnectionDropped
+	}
+	t.sent++
+	t.lastSent = clone(frame)
+	t.service = -1
+	if data := t.payload(frame); len(data) > 0 {
+		t.service = int(data[0])
+	}
+
+	n, drop := t.transfer(len(frame))
+	t.mu.Unlock()
+
+	if drop {
+		// The start of the frame still reaches the bus.
+		if n > 0 {
+			t.inner.SendFrame(frame[:n])
+		}
+		return ErrConnectionDropped
+	}
+	return t.inner.SendFrame(frame)
+}
+
+func (t *Transport) ReceiveFrame() ([]byte, error) {
+	t.mu.Lock()
+	if t.dropped {
+		t.mu.Unlock()
+		return nil, ErrConnectionDropped
+	}
+	if len(t.pending) > 0 {
+		frame := t.pending[0]
+		t.pending = t.pending[1:]
+		t.mu.Unlock()
+		return frame, nil
+	}
+	t.mu.Unlock()
+
+	frame, err := t.inner.ReceiveFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	if _, drop := t.transfer(len(frame)); drop {
+		t.mu.Unlock()
+		return nil, ErrConnectionDropped
+	}
+	if bytes.Equal(frame, t.lastSent) {
+		t.mu.Unlock()
+		return frame, nil
+	}
+
+	var delay time.Duration
+	for i, f := range t.scenario.Faults {
+		if !t.armed(i, f) {
+			continue
+		}
+		switch f.Kind {
+		case KindCorrupt:
+			frame = clone(frame)
+			frame[len(frame)-1] ^= 0xFF
+		case KindNRC:
+			frame = t.negative(frame, byte(f.Code))
+		case KindDuplicate:
+			t.pending = append(t.pending, clone(frame))
+		case KindDelay:
+			delay += time.Duration(f.Delay)
+		default:
+			continue
+		}
+		t.fired[i]++
+	}
+	timeout := t.timeout
+	if delay >= timeout {
+		// The frame turns up after the caller has given up on it.
+		t.pending = append([][]byte{frame}, t.pending...)
+	}
+	t.mu.Unlock()
+
+	if delay >= timeout {
+		t.sleep(timeout)
+		return nil, transport.ErrTimeout
+	}
+	if delay > 0 {
+		t.sleep(delay)
+	}
+	return frame, nil
+}
+
+func (t *Transport) SupportsWrite() bool {
+	return t.inner.SupportsWrite()
+}
+
+func (t *Transport) ReadVoltage() (float64, error) {
+	v, err := t.inner.ReadVoltage()
+	if err != nil {
+		return v, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, f := range t.scenario.Faults {
+		if f.Kind != KindVoltageSag || t.sent < f.AfterRequests {
+			continue
+		}
+		if f.Times > 0 && t.fired[i] >= f.Times {
+			continue
+		}
+		v = f.Volts
+		t.fired[i]++
+	}
+	return v, nil
+}
+
+func (t *Transport) SetResponseTimeout(d time.Duration) {
+	t.mu.Lock()
+	t.timeout = d
+	t.mu.Unlock()
+	if s, ok := t.inner.(transport.ResponseTimeoutSetter); ok {
+		s.SetResponseTimeout(d)
+	}
+}
+
+// transfer counts n bytes crossing the link and reports whether a drop
+// fault fires, along with how many of the n bytes got through first.
+func (t *Transport) transfer(n int) (int, bool) {
+	before := t.bytes
+	t.bytes += n
+	for i, f := range t.scenario.Faults {
+		if f.Kind == KindDrop && t.bytes > f.AfterBytes {
+			t.fired[i]++
+			t.dropped = true
+			return max(f.AfterBytes-before, 0), true
+		}
+	}
+	return n, false
+}
+
+func (t *Transport) armed(i int, f Fault) bool {
+	if t.sent <= f.AfterRequests {
+		return false
+	}
+	if f.Times > 0 && t.fired[i] >= f.Times {
+		return false
+	}
+	return f.Service == nil || int(*f.Service) == t.service
+}
+
+// payload returns the data of a frame, or nil when it does not parse.
+func (t *Transport) payload(frame []byte) []byte {
+	if t.ds2 {
+		f, err := ds2.ParseFrame(frame)
+		if err != nil {
+			return nil
+		}
+		return f.Data
+	}
+	f, err := kwp2000.ParseFrame(frame)
+	if err != nil {
+		return nil
+	}
+	return f.Data
+}
+
+// negative rebuilds a reply frame as a negative response to the last
+// request.
+func (t *Transport) negative(frame []byte, code byte) []byte {
+	if t.ds2 {
+		f, err := ds2.ParseFrame(frame)
+		if err != nil {
+			return frame
+		}
+		return ds2.BuildFrame(f.Address, []byte{code})
+	}
+
+	f, err := kwp2000.ParseFrame(frame)
+	if err != nil || t.service < 0 {
+		return frame
+	}
+	return kwp2000.BuildFrameFormat(f.Format, f.Target, f.Source,
+		[]byte{kwp2000.SIDNegativeResponse, byte(t.service), code})
+}
+
+func clone(b []byte) []byte {
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
@@ -0,0 +1,30 @@
+package transport
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrTimeout           = errors.New("transport: receive timeout")
+	ErrNotConnected      = errors.New("transport: not connected")
+	ErrWriteNotSupported = errors.New("transport: adapter does not support write operations")
+)
+
+// Transport is the link between the protocol engine and a diagnostic cable.
+// SendFrame and ReceiveFrame exchange complete, checksummed protocol frames;
+// ReceiveFrame returns ErrTimeout when no frame arrives in time.
+type Transport interface {
+	Connect() error
+	Disconnect() error
+	SendFrame(frame []byte) error
+	ReceiveFrame() ([]byte, error)
+	SupportsWrite() bool
+	ReadVoltage() (float64, error)
+}
+
+// ResponseTimeoutSetter is implemented by transports whose receive timeout
+// can be tuned to the timing of the active diagnostic session.
+type ResponseTimeoutSetter interface {
+	SetResponseTimeout(d time.Duration)
+}